@@ -0,0 +1,107 @@
+// Package clock tells the time of the captured traffic: the capture time of the packets, so that
+// replaying a capture gives the same start, update and expiry times as the live run it recorded.
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock tells the current time.
+type Clock interface {
+	Now() time.Time
+}
+
+// Observer is a Clock driven by the timestamps of the packets it observes.
+type Observer interface {
+	Clock
+
+	// Observe advances the clock to the timestamp of a packet, the clock never goes back.
+	Observe(t time.Time)
+}
+
+// Wall is the clock of the system.
+var Wall Clock = wall{}
+
+type wall struct{}
+
+func (wall) Now() time.Time { return time.Now() }
+
+// Packet is an Observer. Between packets, it advances like the wall clock since the last packet
+// which moved it, so that expiry goes on when the traffic stops. Before the first packet, it is the wall clock.
+type Packet struct {
+	lock sync.Mutex
+	// last is the timestamp of the last packet which moved the clock, observed at the wall time at.
+	last, at time.Time
+}
+
+// NewPacket creates a Packet clock.
+func NewPacket() *Packet {
+	return &Packet{}
+}
+
+// Now implements Clock
+func (c *Packet) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.now()
+}
+
+func (c *Packet) now() time.Time {
+	if c.last.IsZero() {
+		return time.Now()
+	}
+
+	return c.last.Add(time.Since(c.at))
+}
+
+// Observe implements Observer. Timestamps behind the clock, e.g. of packets queued a while or
+// reordered between several capture inputs, leave it as it is.
+func (c *Packet) Observe(t time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.last.IsZero() || t.After(c.now()) {
+		c.last, c.at = t, time.Now()
+	}
+}
+
+// Schedule tells when a periodic task is due by the time of a Clock. It is checked whenever something happens,
+// e.g. a packet arrives, so that replaying a capture faster than it was recorded runs the task as often per
+// captured minute as the live run did. A ticker checking it too runs the task while nothing happens.
+type Schedule struct {
+	clock    Clock
+	interval time.Duration
+
+	lock sync.Mutex
+	// next is when the task is due, zero until the first check.
+	next time.Time
+}
+
+// NewSchedule creates a Schedule of a task due every interval of the time of c, first an interval
+// after its first check.
+func NewSchedule(c Clock, interval time.Duration) *Schedule {
+	return &Schedule{clock: c, interval: interval}
+}
+
+// Due tells whether the task is due, the next time an interval later, and returns the time of the clock.
+func (s *Schedule) Due() (time.Time, bool) {
+	now := s.clock.Now()
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	// a Packet clock goes back to the first packet of a replayed capture
+	if s.next.IsZero() || now.Before(s.next.Add(-s.interval)) {
+		s.next = now.Add(s.interval)
+		return now, false
+	}
+
+	if now.Before(s.next) {
+		return now, false
+	}
+
+	s.next = now.Add(s.interval)
+	return now, true
+}
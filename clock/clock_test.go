@@ -0,0 +1,42 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScheduleDueByPacketTime(t *testing.T) {
+	start := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	c := NewPacket()
+	s := NewSchedule(c, time.Minute)
+
+	// checked before the first packet, at the wall time
+	if _, ok := s.Due(); ok {
+		t.Fatal("due when checked first")
+	}
+
+	for _, step := range []struct {
+		after time.Duration
+		due   bool
+	}{
+		// the clock goes back to the replayed capture, the schedule starts over
+		{0, false},
+		{30 * time.Second, false},
+		{61 * time.Second, true},
+		{90 * time.Second, false},
+		{2 * time.Minute, false},
+		{2*time.Minute + 2*time.Second, true},
+		// several intervals without packets are due once
+		{10 * time.Minute, true},
+		{10*time.Minute + time.Second, false},
+	} {
+		c.Observe(start.Add(step.after))
+		now, ok := s.Due()
+		if ok != step.due {
+			t.Errorf("due %v at +%s, want %v", ok, step.after, step.due)
+		}
+		if now.Before(start.Add(step.after)) {
+			t.Errorf("due at %s, before the packet at +%s", now, step.after)
+		}
+	}
+}
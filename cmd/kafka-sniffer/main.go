@@ -1,141 +1,430 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"flag"
+	"fmt"
 	"github.com/bingoohuang/kafka-sniffer/stream/flowd"
+	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"runtime"
+	"strings"
 	"time"
 
-	"github.com/bingoohuang/kafka-sniffer/metrics"
+	"github.com/bingoohuang/kafka-sniffer/otlp"
+	"github.com/bingoohuang/kafka-sniffer/proxy"
+	"github.com/bingoohuang/kafka-sniffer/push"
+	"github.com/bingoohuang/kafka-sniffer/report"
+	"github.com/bingoohuang/kafka-sniffer/sniffer"
 	"github.com/bingoohuang/kafka-sniffer/stream"
+	"github.com/bingoohuang/kafka-sniffer/topology"
 
-	"github.com/google/gopacket"
 	"github.com/google/gopacket/examples/util"
-	"github.com/google/gopacket/layers"
-	"github.com/google/gopacket/pcap"
-	"github.com/google/gopacket/tcpassembly"
-	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 var (
 	pType      = flag.String("t", "", "req types filter, e.g. FetchRequest, ProduceRequest")
 	iface      = flag.String("i", "eth0", "Interface to get packets from")
-	bpf        = flag.String("bpf", "tcp and dst port 9092", "BPF expr")
+	readFile   = flag.String("r", "", "Replay a pcap file instead of capturing on -i, the times are the capture times of its packets")
+	ports      = flag.String("ports", "9092", "Kafka broker ports, e.g. 9092,9093")
+	bpf        = flag.String("bpf", "", "BPF expr, default to capture both directions of the broker ports")
+	mirrors    = flag.String("listen-mirror", "", "Receive mirrored packets instead of capturing on -i, e.g. udp://:4789,udp://:37008,gre://")
+	tlsPorts   = flag.String("tls-ports", "", "Kafka broker TLS ports, e.g. 9093, the other ports are plaintext then, otherwise learned from their first connection")
+	discover   = flag.Duration("discover", 0, "Capture all TCP for this long and probe the streams for Kafka requests, then narrow the BPF to the broker ports found, e.g. 1m")
+	tunnels    = flag.Bool("tunnels", true, "Capture the broker ports behind VLAN tags and in VXLAN, Geneve and GRE tunnels too")
+	keyLogFile = flag.String("keylog", os.Getenv("SSLKEYLOGFILE"), "NSS key log file of the clients to decrypt their TLS connections, default to $SSLKEYLOGFILE")
 	snaplen    = flag.Int("snap", 16<<10, "SnapLen for pcap packet capture")
 	verbose    = flag.Bool("v", false, "Logs every packet in great detail")
 	rwPrint    = flag.Bool("s", true, "Print the read and write clients")
 	connTrack  = flag.Bool("flow", false, "Captures TCP/IP traffic and keeps conns track")
 	listenAddr = flag.String("addr", ":9870", "Address on which sniffer listen the requests, e.g. :9870")
 	expireTime = flag.Duration("metrics.expire-time", 5*time.Minute, "Expiration time of metric.")
+	relations  = flag.Bool("metrics.relations", true, "Export the relations of clients and topics as prometheus metrics")
+	maxLabels  = flag.Int("metrics.max-cardinality", 100000, "Maximum label sets of each relation metric, the least recently seen are evicted beyond it, 0 for no limit")
+	shards     = flag.Int("shards", runtime.NumCPU(), "Number of TCP reassembly shards, flows are hashed across them")
+	queueSize  = flag.Int("queue", 1000, "Packet queue size of each reassembly shard, packets are dropped when it is full")
+
+	eventsMaxClients = flag.Int("events.max-clients", 16, "Maximum clients of the live /events stream at once")
+	eventsMaxRate    = flag.Float64("events.max-rate", 100, "Maximum events per second streamed to a client of /events, the others are dropped")
 
 	printJsonDuration = flag.Duration("p", 0, "Print the request json")
+	output            = flag.String("o", "text", "Output format, text logs or json: one JSON object per request (NDJSON), the logs go to stderr then")
+	outputFile        = flag.String("o.file", "", "File the JSON objects are appended to with -o json, default to stdout")
+
+	otlpEndpoint = flag.String("otlp.endpoint", "", "Export the metrics and a span per answered request to this OpenTelemetry collector, e.g. localhost:4317 or http://localhost:4318")
+	otlpProtocol = flag.String("otlp.protocol", otlp.ProtocolGRPC, "OTLP protocol, grpc or http")
+	otlpInterval = flag.Duration("otlp.interval", 15*time.Second, "Interval between OTLP exports")
+	otlpHeaders  = flag.String("otlp.headers", "", "Headers of the OTLP exports, e.g. authorization=Bearer xyz,x-tenant=kafka")
+	otlpResource = flag.String("otlp.resource", "", "More resource attributes of the OTLP exports, e.g. deployment.environment=prod,broker.cluster=main")
 
-	clientStat *stream.ClientStat
+	statsdAddr   = flag.String("statsd", "", "Push the metrics to this StatsD server over UDP, e.g. localhost:8125")
+	dogStatsD    = flag.Bool("statsd.dogstatsd", true, "Send the labels as DogStatsD tags, otherwise append their values to the StatsD names")
+	influxURL    = flag.String("influx", "", "Push the metrics as InfluxDB line protocol, e.g. http://localhost:8086/write?db=kafka or udp://localhost:8089")
+	influxToken  = flag.String("influx.token", "", "Token of the InfluxDB HTTP API")
+	pushInterval = flag.Duration("push.interval", 10*time.Second, "Interval between the pushes to -statsd and -influx")
 )
 
-func init() {
+func main() {
 	flag.Parse()
 	log.SetOutput(os.Stdout)
-}
 
-func main() {
+	switch flag.Arg(0) {
+	case "topology":
+		runTopology(flag.Args()[1:])
+		return
+	case "report":
+		runReport(flag.Args()[1:])
+		return
+	}
+
 	defer util.Run()()
 
-	log.Printf("starting capture on interface %q", *iface)
+	sinks, err := outputSinks()
+	if err != nil {
+		log.Fatalf("failed to open output, err: %v", err)
+	}
+
+	exporter, err := otlpExporter()
+	if err != nil {
+		log.Fatalf("failed to create OTLP exporter, err: %v", err)
+	}
+	if exporter != nil {
+		sinks = append(sinks, exporter)
+		go exporter.Run(context.Background())
+	}
+
+	pushers, err := metricPushers()
+	if err != nil {
+		log.Fatalf("failed to create metric pushers, err: %v", err)
+	}
+	for _, p := range pushers {
+		go p.Run(context.Background())
+	}
+
+	s, err := sniffer.New(sniffer.Options{
+		Interface:         *iface,
+		ReadFile:          *readFile,
+		Snaplen:           *snaplen,
+		BPF:               *bpf,
+		Mirrors:           splitMirrors(*mirrors),
+		Tunnels:           *tunnels,
+		Ports:             *ports,
+		TLSPorts:          *tlsPorts,
+		Discover:          *discover,
+		KeyLogFile:        *keyLogFile,
+		Shards:            *shards,
+		QueueSize:         *queueSize,
+		PrintClients:      *rwPrint,
+		PrintType:         *pType,
+		PrintJSONInterval: *printJsonDuration,
+		RelationMetrics:   *relations,
+		MetricsExpireTime: *expireTime,
+		MetricsMaxLabels:  *maxLabels,
+		EventsMaxClients:  *eventsMaxClients,
+		EventsMaxRate:     *eventsMaxRate,
+		Verbose:           *verbose,
+		Sinks:             sinks,
+	})
+	if err != nil {
+		log.Fatalf("failed to create sniffer, err: %v", err)
+	}
+
+	switch {
+	case flag.Arg(0) == "proxy":
+		go runProxy(s.StreamFactory(), flag.Args()[1:])
+	case *connTrack:
+		log.Printf("starting capture on interface %q", *iface)
+
+		expr := *bpf
+		if expr == "" {
+			expr = defaultBPF(s.BrokerPorts())
+		}
 
-	if *connTrack {
-		handler, err := flowd.RunNetworkAnalyzer(*iface, *bpf, int32(*snaplen))
+		handler, err := flowd.RunNetworkAnalyzer(*iface, expr, int32(*snaplen))
 		if err != nil {
 			log.Fatalf("failed to create network analyzer, err: %v", err)
 		}
-		log.Printf("start to captures TCP/IP traffic and keeps conns track, using bpf %q on device %q", *bpf, *iface)
+		log.Printf("start to captures TCP/IP traffic and keeps conns track, using bpf %q on device %q", expr, *iface)
 		http.HandleFunc("/flow", handler)
-	} else {
-		go handlerKafka()
+	default:
+		if err := s.Start(context.Background()); err != nil {
+			log.Fatalf("failed to start sniffer, err: %v", err)
+		}
 	}
 
-	runTelemetry()
+	runTelemetry(s)
 }
 
-func handlerKafka() {
-	// Set up pcap packet capture
-	handle, err := pcap.OpenLive(*iface, int32(*snaplen), true, pcap.BlockForever)
+// outputSinks writes the requests in the -o format.
+func outputSinks() ([]stream.Sink, error) {
+	switch *output {
+	case "text":
+		return nil, nil
+	case "json":
+		if *outputFile == "" {
+			// keep stdout for the JSON objects
+			log.SetOutput(os.Stderr)
+			return []stream.Sink{stream.NewJSONSink(os.Stdout)}, nil
+		}
+
+		f, err := os.OpenFile(*outputFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return nil, err
+		}
+
+		return []stream.Sink{stream.NewJSONSink(f)}, nil
+	default:
+		return nil, fmt.Errorf("unknown output format %q, text or json", *output)
+	}
+}
+
+// otlpExporter creates the exporter to -otlp.endpoint, nil without it.
+func otlpExporter() (*otlp.Exporter, error) {
+	if *otlpEndpoint == "" {
+		return nil, nil
+	}
+
+	headers, err := splitKeyValues(*otlpHeaders)
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+	resource, err := splitKeyValues(*otlpResource)
+	if err != nil {
+		return nil, err
 	}
 
-	if err := handle.SetBPFFilter(*bpf); err != nil {
-		panic(err)
+	// mirrored and replayed packets were not captured on -i
+	iface := *iface
+	if *mirrors != "" || *readFile != "" {
+		iface = ""
 	}
 
-	// init metrics storage
-	metricsStorage := metrics.NewStorage(prometheus.DefaultRegisterer, *expireTime)
-
-	// Set up assembly
-	var f tcpassembly.StreamFactory
-	if *rwPrint {
-		xf := stream.NewKafkaClientPrintStreamFactory(*printJsonDuration, *pType)
-		clientStat = xf.ClientStat
-		f = xf
-	} else {
-		f = stream.NewKafkaStreamFactory(metricsStorage, *verbose)
-	}
-
-	streamPool := tcpassembly.NewStreamPool(f)
-	assembler := tcpassembly.NewAssembler(streamPool)
-
-	// Auto-flushing connection state to get packets
-	// without waiting SYN
-	assembler.MaxBufferedPagesTotal = 1000
-	assembler.MaxBufferedPagesPerConnection = 1
-
-	if *verbose {
-		log.Println("reading in packets")
-	}
-
-	// Read in packets, pass to assembler.
-	packets := gopacket.NewPacketSource(handle, handle.LinkType()).Packets()
-	ticker := time.Tick(time.Minute)
-
-	for {
-		select {
-		case p := <-packets:
-			if *verbose {
-				log.Println(p)
-			}
-
-			n := p.NetworkLayer()
-			t := p.TransportLayer()
-			if n == nil || t == nil || t.LayerType() != layers.LayerTypeTCP {
-				if *verbose {
-					log.Println("Unusable packet")
-				}
-				continue
-			}
-
-			tcp := t.(*layers.TCP)
-			assembler.AssembleWithTimestamp(n.NetworkFlow(), tcp, p.Metadata().Timestamp)
-
-		case <-ticker:
-			// Every minute, flush connections that haven't seen activity in the past 2 minutes.
-			assembler.FlushOlderThan(time.Now().Add(time.Minute * -2))
-			if *verbose {
-				log.Println("---- FLUSHING ----")
-			}
+	log.Printf("exporting to OTLP collector %s over %s every %s", *otlpEndpoint, *otlpProtocol, *otlpInterval)
+
+	return otlp.New(otlp.Options{
+		Endpoint:  *otlpEndpoint,
+		Protocol:  *otlpProtocol,
+		Headers:   headers,
+		Interval:  *otlpInterval,
+		Interface: iface,
+		Resource:  resource,
+	})
+}
+
+// metricPushers push the metrics to -statsd and -influx.
+func metricPushers() (pushers []*push.Pusher, err error) {
+	opts := push.Options{Interval: *pushInterval}
+	if host, err := os.Hostname(); err == nil {
+		opts.Tags = map[string]string{"host": host}
+	}
+
+	if *statsdAddr != "" {
+		p, err := push.NewStatsD(*statsdAddr, *dogStatsD, opts)
+		if err != nil {
+			return nil, err
 		}
+		log.Printf("pushing metrics to StatsD %s every %s", *statsdAddr, *pushInterval)
+		pushers = append(pushers, p)
 	}
+
+	if *influxURL != "" {
+		p, err := push.NewInflux(*influxURL, *influxToken, opts)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("pushing metrics to InfluxDB %s every %s", *influxURL, *pushInterval)
+		pushers = append(pushers, p)
+	}
+
+	return pushers, nil
+}
+
+// splitKeyValues splits comma separated key=value pairs, e.g. a=1,b=2
+func splitKeyValues(s string) (map[string]string, error) {
+	m := map[string]string{}
+	for _, kv := range strings.Split(s, ",") {
+		if kv = strings.TrimSpace(kv); kv == "" {
+			continue
+		}
+
+		i := strings.Index(kv, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid key=value %q", kv)
+		}
+		m[strings.TrimSpace(kv[:i])] = strings.TrimSpace(kv[i+1:])
+	}
+
+	return m, nil
 }
 
-func runTelemetry() {
+// defaultBPF captures both directions of the broker ports, see -tunnels.
+func defaultBPF(brokerPorts *stream.BrokerPorts) string {
+	expr := brokerPorts.BPF()
+	if *tunnels {
+		return stream.TunnelBPF(expr)
+	}
+
+	return expr
+}
+
+// splitMirrors splits the comma separated -listen-mirror URLs.
+func splitMirrors(s string) []string {
+	if s == "" {
+		return nil
+	}
+
+	return strings.Split(s, ",")
+}
+
+// runProxy relays Kafka traffic instead of capturing it, e.g. kafka-sniffer proxy -listen :19092 -upstream broker:9092
+func runProxy(f stream.ConnStreamFactory, args []string) {
+	fs := flag.NewFlagSet("proxy", flag.ExitOnError)
+	listen := fs.String("listen", ":19092", "Address on which the proxy accepts Kafka clients")
+	upstream := fs.String("upstream", "", "Address of the bootstrap broker, e.g. broker:9092")
+	advertise := fs.String("advertise", "", "Host announced to the clients to reach the proxy, default to the host of -listen or the hostname")
+	_ = fs.Parse(args)
+
+	if *upstream == "" {
+		log.Fatalf("proxy requires -upstream")
+	}
+
+	if *advertise == "" {
+		if host, _, _ := net.SplitHostPort(*listen); host == "" {
+			*advertise, _ = os.Hostname()
+		}
+	}
+
+	p, err := proxy.New(*listen, *advertise, f)
+	if err != nil {
+		log.Fatalf("failed to create proxy, err: %v", err)
+	}
+
+	log.Fatal(p.ListenAndServe(*listen, *upstream))
+}
+
+// runTopology renders the clients of a running sniffer as a graph,
+// e.g. kafka-sniffer topology -from localhost:9870 -format mermaid -group subnet
+func runTopology(args []string) {
+	fs := flag.NewFlagSet("topology", flag.ExitOnError)
+	from := fs.String("from", "localhost:9870", "Address of the running sniffer whose /client is rendered")
+	format := fs.String("format", topology.FormatDOT, "Format of the graph, dot, mermaid or json")
+	group := fs.String("group", topology.GroupIP, "Group the clients by ip, subnet, client_id or principal")
+	weight := fs.String("weight", topology.WeightRate, "Weight the edges by rate (requests per second) or bytes")
+	mask := fs.Int("mask", 24, "Prefix length of the IPv4 subnets, with -group subnet")
+	mask6 := fs.Int("mask6", 64, "Prefix length of the IPv6 subnets, with -group subnet")
+	out := fs.String("out", "", "File the graph is written to, default to stdout")
+	_ = fs.Parse(args)
+
+	src := *from
+	if !strings.Contains(src, "://") {
+		src = "http://" + src
+	}
+
+	resp, err := http.Get(strings.TrimSuffix(src, "/") + "/client")
+	if err != nil {
+		log.Fatalf("failed to get the clients, err: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		log.Fatalf("failed to get the clients, status: %s", resp.Status)
+	}
+
+	var items []stream.ReqTypeStatItemSnapshot
+	if err := json.NewDecoder(resp.Body).Decode(&items); err != nil {
+		log.Fatalf("failed to decode the clients, err: %v", err)
+	}
+
+	g, err := topology.Build(items, topology.Options{GroupBy: *group, Weight: *weight, Mask: *mask, Mask6: *mask6})
+	if err != nil {
+		log.Fatalf("failed to build the topology, err: %v", err)
+	}
+
+	w := os.Stdout
+	if *out != "" {
+		if w, err = os.Create(*out); err != nil {
+			log.Fatalf("failed to create %s, err: %v", *out, err)
+		}
+		defer w.Close()
+	}
+
+	if err := topology.Render(w, g, *format); err != nil {
+		log.Fatalf("failed to render the topology, err: %v", err)
+	}
+}
+
+// runReport writes the migration readiness report of a running sniffer, diffed against a previous one in JSON,
+// e.g. kafka-sniffer report -from localhost:9870 -since 24h -previous last.json -format md
+func runReport(args []string) {
+	fs := flag.NewFlagSet("report", flag.ExitOnError)
+	from := fs.String("from", "localhost:9870", "Address of the running sniffer whose /report/migration is written")
+	since := fs.String("since", "24h", "Start of the window, a RFC 3339 time or a duration before now")
+	until := fs.String("until", "", "End of the window, a RFC 3339 time or a duration before now, default to now")
+	format := fs.String("format", report.FormatMarkdown, "Format of the report, md, csv or json")
+	previous := fs.String("previous", "", "Previous report in JSON to diff against, e.g. written by -format json")
+	out := fs.String("out", "", "File the report is written to, default to stdout")
+	_ = fs.Parse(args)
+
+	var prev *report.Report
+	if *previous != "" {
+		b, err := ioutil.ReadFile(*previous)
+		if err != nil {
+			log.Fatalf("failed to read the previous report, err: %v", err)
+		}
+		prev = &report.Report{}
+		if err := json.Unmarshal(b, prev); err != nil {
+			log.Fatalf("failed to decode the previous report %s, err: %v", *previous, err)
+		}
+	}
+
+	addr := *from
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+	q := url.Values{"format": {report.FormatJSON}, "since": {*since}, "until": {*until}}
+
+	resp, err := http.Get(strings.TrimSuffix(addr, "/") + "/report/migration?" + q.Encode())
+	if err != nil {
+		log.Fatalf("failed to get the report, err: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		log.Fatalf("failed to get the report, status: %s", resp.Status)
+	}
+
+	var r report.Report
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		log.Fatalf("failed to decode the report, err: %v", err)
+	}
+	if prev != nil {
+		report.Diff(&r, prev)
+	}
+
+	w := os.Stdout
+	if *out != "" {
+		if w, err = os.Create(*out); err != nil {
+			log.Fatalf("failed to create %s, err: %v", *out, err)
+		}
+		defer w.Close()
+	}
+
+	if err := report.Render(w, &r, *format); err != nil {
+		log.Fatalf("failed to render the report, err: %v", err)
+	}
+}
+
+func runTelemetry(s *sniffer.Sniffer) {
 	log.Printf("serving metrics and api on %s\n", *listenAddr)
 
 	http.Handle("/metrics", promhttp.Handler())
-	if clientStat != nil {
-		http.Handle("/client", stream.ServeClientStatHandler(clientStat))
-	}
+	s.RegisterHandlers(http.DefaultServeMux)
 
 	if err := http.ListenAndServe(*listenAddr, nil); err != nil {
 		panic(err)
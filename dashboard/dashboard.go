@@ -0,0 +1,24 @@
+// Package dashboard serves the web UI of the sniffer, embedded in the binary: the graph of the producers,
+// the topics and the consumers of /client/graph, the tables of the clients, the topics and the client ids,
+// and the details of a client. The graph is refreshed periodically and flashes the requests of /events.
+package dashboard
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+//go:embed static
+var static embed.FS
+
+// Handler serves the dashboard under prefix, e.g. /ui/, it requests /client/graph and /events
+// relative to the parent of prefix.
+func Handler(prefix string) http.Handler {
+	files, err := fs.Sub(static, "static")
+	if err != nil {
+		panic(err)
+	}
+
+	return http.StripPrefix(prefix, http.FileServer(http.FS(files)))
+}
@@ -0,0 +1,362 @@
+// The dashboard of kafka-sniffer: renders /client/graph as producers -> topics -> consumers,
+// refreshed every few seconds, and flashes the edges of the requests streamed by /events.
+// The client ids and the topics come from the network, they are only ever set as text.
+(function () {
+  "use strict";
+
+  var REFRESH = 5000;
+  var ROW = 24;
+  var SVG = "http://www.w3.org/2000/svg";
+
+  var graph = null;
+  var selected = null; // {kind: "client"|"topic"|"client_id", id: string}
+  var tab = "clients";
+  var sorts = {clients: {key: "ID", desc: false}, topics: {key: "Topic", desc: false}, clientIds: {key: "ClientID", desc: false}};
+  var timer = null;
+  var events = null;
+
+  var $ = function (id) { return document.getElementById(id); };
+
+  function el(tag, attrs, text) {
+    var e = document.createElement(tag);
+    for (var k in attrs || {}) e.setAttribute(k, attrs[k]);
+    if (text !== undefined && text !== null) e.textContent = String(text);
+    return e;
+  }
+
+  function svgEl(tag, attrs) {
+    var e = document.createElementNS(SVG, tag);
+    for (var k in attrs || {}) e.setAttribute(k, attrs[k]);
+    return e;
+  }
+
+  function bytes(n) {
+    var units = ["B", "KiB", "MiB", "GiB", "TiB"];
+    var i = 0;
+    while (n >= 1024 && i < units.length - 1) { n /= 1024; i++; }
+    return (i ? n.toFixed(1) : n) + " " + units[i];
+  }
+
+  function edgeKey(client, topic, role) {
+    return client + "\u0000" + topic + "\u0000" + role;
+  }
+
+  // filtered returns the clients, topics and edges matching the filter, with their neighbours.
+  function filtered() {
+    var q = $("filter").value.trim().toLowerCase();
+    if (!q) return {clients: graph.Clients || [], topics: graph.Topics || [], edges: graph.Edges || []};
+
+    var clients = {}, topics = {};
+    (graph.Clients || []).forEach(function (c) {
+      if (c.ID.toLowerCase().indexOf(q) >= 0) clients[c.ID] = true;
+    });
+    (graph.Topics || []).forEach(function (t) {
+      if (t.Topic.toLowerCase().indexOf(q) >= 0) topics[t.Topic] = true;
+    });
+
+    var edges = (graph.Edges || []).filter(function (e) {
+      return clients[e.Client] || topics[e.Topic];
+    });
+    edges.forEach(function (e) { clients[e.Client] = true; topics[e.Topic] = true; });
+
+    return {
+      clients: (graph.Clients || []).filter(function (c) { return clients[c.ID]; }),
+      topics: (graph.Topics || []).filter(function (t) { return topics[t.Topic]; }),
+      edges: edges
+    };
+  }
+
+  function renderGraph() {
+    var svg = $("svg");
+    while (svg.firstChild) svg.removeChild(svg.firstChild);
+
+    var g = filtered();
+    var producers = g.clients.filter(function (c) { return c.Produces && c.Produces.length; });
+    var consumers = g.clients.filter(function (c) { return c.Fetches && c.Fetches.length; });
+    $("empty").hidden = g.topics.length > 0;
+
+    var width = svg.clientWidth || 900;
+    var rows = Math.max(producers.length, g.topics.length, consumers.length, 1);
+    svg.setAttribute("height", rows * ROW + ROW);
+
+    var x = {producer: width * 0.2, topic: width * 0.5, consumer: width * 0.8};
+    var pos = {};
+    function place(list, column, id) {
+      var offset = (rows - list.length) * ROW / 2 + ROW;
+      list.forEach(function (n, i) { pos[column + "\u0000" + id(n)] = offset + i * ROW; });
+    }
+    place(producers, "producer", function (c) { return c.ID; });
+    place(g.topics, "topic", function (t) { return t.Topic; });
+    place(consumers, "consumer", function (c) { return c.ID; });
+
+    var edgeLayer = svgEl("g"), nodeLayer = svgEl("g");
+    svg.appendChild(edgeLayer);
+    svg.appendChild(nodeLayer);
+
+    g.edges.forEach(function (e) {
+      var cy = pos[e.Role + "\u0000" + e.Client], ty = pos["topic\u0000" + e.Topic];
+      if (cy === undefined || ty === undefined) return;
+      var x1 = e.Role === "producer" ? x.producer : x.topic;
+      var x2 = e.Role === "producer" ? x.topic : x.consumer;
+      var y1 = e.Role === "producer" ? cy : ty;
+      var y2 = e.Role === "producer" ? ty : cy;
+      var mid = (x1 + x2) / 2;
+      var path = svgEl("path", {
+        "class": "edge " + e.Role,
+        d: "M" + x1 + "," + y1 + " C" + mid + "," + y1 + " " + mid + "," + y2 + " " + x2 + "," + y2
+      });
+      path.dataset.key = edgeKey(e.Client, e.Topic, e.Role);
+      path.dataset.client = e.Client;
+      path.dataset.topic = e.Topic;
+      var title = svgEl("title");
+      title.textContent = e.Client + (e.Role === "producer" ? " produces to " : " fetches from ") + e.Topic +
+        ", " + e.Connections + " connection(s)";
+      path.appendChild(title);
+      edgeLayer.appendChild(path);
+    });
+
+    function node(kind, column, id, label, anchor) {
+      var y = pos[column + "\u0000" + id];
+      var n = svgEl("g", {"class": "node " + kind, transform: "translate(" + x[column] + "," + y + ")"});
+      n.dataset.kind = kind;
+      n.dataset.id = id;
+      n.appendChild(svgEl("circle", {r: 5}));
+      var text = svgEl("text", {x: anchor === "end" ? -9 : 9, y: 4, "text-anchor": anchor});
+      text.textContent = label;
+      n.appendChild(text);
+      if (selected && selected.kind === kind && selected.id === id) n.classList.add("selected");
+      n.addEventListener("click", function () { select(kind, id); });
+      n.addEventListener("mouseenter", function () { highlight(kind, id); });
+      n.addEventListener("mouseleave", function () { highlight(null); });
+      nodeLayer.appendChild(n);
+    }
+
+    function clientLabel(c) {
+      return c.IP + "  " + (c.ClientID || "-");
+    }
+
+    producers.forEach(function (c) { node("client", "producer", c.ID, clientLabel(c), "end"); });
+    g.topics.forEach(function (t) { node("topic", "topic", t.Topic, t.Topic, "start"); });
+    consumers.forEach(function (c) { node("client", "consumer", c.ID, clientLabel(c), "start"); });
+  }
+
+  // highlight dims what is not adjacent to the hovered node.
+  function highlight(kind, id) {
+    var edges = $("svg").querySelectorAll(".edge");
+    var nodes = $("svg").querySelectorAll(".node");
+    var adjacent = {};
+    Array.prototype.forEach.call(edges, function (e) {
+      var on = !kind || (kind === "client" ? e.dataset.client === id : e.dataset.topic === id);
+      e.classList.toggle("dim", !on);
+      if (on) { adjacent["client\u0000" + e.dataset.client] = true; adjacent["topic\u0000" + e.dataset.topic] = true; }
+    });
+    Array.prototype.forEach.call(nodes, function (n) {
+      n.classList.toggle("dim", !!kind && !adjacent[n.dataset.kind + "\u0000" + n.dataset.id]);
+    });
+  }
+
+  function flash(client, topic, role) {
+    var key = edgeKey(client, topic, role);
+    Array.prototype.forEach.call($("svg").querySelectorAll(".edge"), function (e) {
+      if (e.dataset.key !== key) return;
+      e.classList.add("flash");
+      setTimeout(function () { e.classList.remove("flash"); }, 600);
+    });
+  }
+
+  var columns = {
+    clients: [
+      ["ID", "client"], ["ClientID", "client id"], ["Produces", "produces"], ["Fetches", "fetches"],
+      ["Connections", "connections", "num"], ["Requests", "requests", "num"], ["BytesRead", "bytes", "num"]
+    ],
+    topics: [["Topic", "topic"], ["Producers", "producers", "num"], ["Consumers", "consumers", "num"]],
+    clientIds: [
+      ["ClientID", "client id"], ["Clients", "clients", "num"], ["Produces", "produces"], ["Fetches", "fetches"],
+      ["Requests", "requests", "num"]
+    ]
+  };
+
+  function cell(row, key) {
+    var v = row[key];
+    if (key === "BytesRead") return bytes(v);
+    if (Array.isArray(v)) return key === "Connections" || key === "Clients" ? v.length : v.join(", ");
+    return v === undefined || v === "" ? "-" : v;
+  }
+
+  function sortValue(row, key) {
+    var v = row[key];
+    if (Array.isArray(v)) return key === "Connections" || key === "Clients" ? v.length : v.join(",");
+    return v === undefined ? "" : v;
+  }
+
+  function renderTable(name, rows, kind, id) {
+    var table = $(name);
+    while (table.firstChild) table.removeChild(table.firstChild);
+
+    var sort = sorts[name];
+    rows = rows.slice().sort(function (a, b) {
+      var x = sortValue(a, sort.key), y = sortValue(b, sort.key);
+      var c = x < y ? -1 : x > y ? 1 : 0;
+      if (c === 0) c = id(a) < id(b) ? -1 : id(a) > id(b) ? 1 : 0;
+      return sort.desc ? -c : c;
+    });
+
+    var head = el("tr");
+    columns[name].forEach(function (col) {
+      var th = el("th", col[2] ? {"class": col[2]} : {}, col[1] + (sort.key === col[0] ? (sort.desc ? " ▼" : " ▲") : ""));
+      th.addEventListener("click", function () {
+        sorts[name] = {key: col[0], desc: sort.key === col[0] ? !sort.desc : false};
+        renderTables();
+      });
+      head.appendChild(th);
+    });
+    table.appendChild(el("thead")).appendChild(head);
+
+    var body = table.appendChild(el("tbody"));
+    rows.forEach(function (row) {
+      var tr = el("tr");
+      columns[name].forEach(function (col) {
+        tr.appendChild(el("td", col[2] ? {"class": col[2]} : {}, cell(row, col[0])));
+      });
+      tr.addEventListener("click", function () { select(kind, id(row)); });
+      body.appendChild(tr);
+    });
+  }
+
+  function renderTables() {
+    var g = filtered();
+    var q = $("filter").value.trim().toLowerCase();
+    var clientIds = (graph.ClientIDs || []).filter(function (gr) {
+      return !q || gr.ClientID.toLowerCase().indexOf(q) >= 0 ||
+        gr.Clients.some(function (c) { return c.toLowerCase().indexOf(q) >= 0; });
+    });
+
+    renderTable("clients", g.clients, "client", function (c) { return c.ID; });
+    renderTable("topics", g.topics, "topic", function (t) { return t.Topic; });
+    renderTable("clientIds", clientIds, "client_id", function (gr) { return gr.ClientID; });
+  }
+
+  function list(parent, title, values, kind) {
+    parent.appendChild(el("h3", {}, title + " (" + (values || []).length + ")"));
+    var ul = parent.appendChild(el("ul"));
+    (values || []).forEach(function (v) {
+      var li = ul.appendChild(el("li"));
+      if (!kind) {
+        li.textContent = v;
+        return;
+      }
+      var a = li.appendChild(el("a", {href: "#"}, v));
+      a.addEventListener("click", function (e) { e.preventDefault(); select(kind, v); });
+    });
+  }
+
+  function renderDetails() {
+    var body = $("details-body");
+    while (body.firstChild) body.removeChild(body.firstChild);
+    $("details").hidden = !selected;
+    if (!selected || !graph) return;
+
+    if (selected.kind === "client") {
+      var c = (graph.Clients || []).filter(function (c) { return c.ID === selected.id; })[0];
+      if (!c) return body.appendChild(el("p", {}, selected.id + " is gone"));
+
+      body.appendChild(el("h2", {}, c.ID));
+      body.appendChild(el("p", {}, c.Requests + " requests, " + bytes(c.BytesRead) + (c.TLS ? ", TLS" : "") +
+        ", since " + new Date(c.Start).toLocaleString()));
+      list(body, "produces to", c.Produces, "topic");
+      list(body, "fetches from", c.Fetches, "topic");
+      list(body, "brokers", c.Brokers);
+
+      body.appendChild(el("h3", {}, "connections (" + c.Connections.length + ")"));
+      var table = body.appendChild(el("table"));
+      var head = table.appendChild(el("thead")).appendChild(el("tr"));
+      ["source", "broker", "type", "requests", "bytes"].forEach(function (h) { head.appendChild(el("th", {}, h)); });
+      var tbody = table.appendChild(el("tbody"));
+      c.Connections.forEach(function (conn) {
+        var tr = tbody.appendChild(el("tr"));
+        [conn.Src, conn.Dst + (conn.Tunnel ? " via " + conn.Tunnel : ""), conn.ReqType.replace("*kafka.", ""),
+          conn.Requests, bytes(conn.BytesRead)].forEach(function (v) { tr.appendChild(el("td", {}, v)); });
+      });
+    } else if (selected.kind === "topic") {
+      body.appendChild(el("h2", {}, selected.id));
+      var edges = (graph.Edges || []).filter(function (e) { return e.Topic === selected.id; });
+      list(body, "producers", edges.filter(function (e) { return e.Role === "producer"; }).map(function (e) { return e.Client; }), "client");
+      list(body, "consumers", edges.filter(function (e) { return e.Role === "consumer"; }).map(function (e) { return e.Client; }), "client");
+    } else {
+      var gr = (graph.ClientIDs || []).filter(function (gr) { return gr.ClientID === selected.id; })[0];
+      if (!gr) return body.appendChild(el("p", {}, selected.id + " is gone"));
+
+      body.appendChild(el("h2", {}, "client id " + (gr.ClientID || "-")));
+      body.appendChild(el("p", {}, gr.Requests + " requests"));
+      list(body, "clients", gr.Clients, "client");
+      list(body, "produces to", gr.Produces, "topic");
+      list(body, "fetches from", gr.Fetches, "topic");
+    }
+  }
+
+  function select(kind, id) {
+    selected = kind ? {kind: kind, id: id} : null;
+    render();
+  }
+
+  function render() {
+    if (!graph) return;
+    renderGraph();
+    renderTables();
+    renderDetails();
+  }
+
+  function refresh() {
+    fetch("../client/graph").then(function (resp) {
+      if (!resp.ok) throw new Error(resp.status + " " + resp.statusText);
+      return resp.json();
+    }).then(function (g) {
+      graph = g;
+      $("status").textContent = "updated " + new Date().toLocaleTimeString();
+      render();
+    }).catch(function (err) {
+      $("status").textContent = "failed to load /client/graph: " + err.message;
+    });
+  }
+
+  // stream flashes the edges of the produce and fetch requests, a few per second at most.
+  function stream(on) {
+    if (events) {
+      events.close();
+      events = null;
+    }
+    if (!on || !window.EventSource) return;
+
+    events = new EventSource("../events?type=request&api_key=0,1&rate=20");
+    events.addEventListener("request", function (msg) {
+      var r = JSON.parse(msg.data).request;
+      var i = r.src.lastIndexOf(":");
+      var ip = r.src.substring(0, i).replace(/^\[|\]$/g, "");
+      var role = r.api_key === 0 ? "producer" : "consumer";
+      (r.topics || []).forEach(function (t) { flash(ip + "/" + r.client_id, t.topic, role); });
+    });
+  }
+
+  function live(on) {
+    clearInterval(timer);
+    timer = on ? setInterval(refresh, REFRESH) : null;
+    stream(on);
+  }
+
+  $("filter").addEventListener("input", render);
+  $("live").addEventListener("change", function () { live(this.checked); });
+  $("close").addEventListener("click", function () { select(null); });
+  Array.prototype.forEach.call(document.querySelectorAll("#tabs button"), function (b) {
+    b.addEventListener("click", function () {
+      tab = b.dataset.tab;
+      Array.prototype.forEach.call(document.querySelectorAll("#tabs button"), function (o) {
+        o.classList.toggle("active", o === b);
+      });
+      ["clients", "topics", "clientIds"].forEach(function (t) { $(t).hidden = t !== tab; });
+    });
+  });
+  window.addEventListener("resize", render);
+
+  refresh();
+  live(true);
+})();
@@ -0,0 +1,102 @@
+package kafka
+
+import (
+	"fmt"
+	"strings"
+)
+
+type apiKey struct {
+	name       string
+	maxVersion int16
+}
+
+// apiKeys lists the request types of the Kafka protocol with the highest version known to us,
+// see https://kafka.apache.org/protocol#protocol_api_keys
+var apiKeys = map[int16]apiKey{
+	0:  {"Produce", 10},
+	1:  {"Fetch", 16},
+	2:  {"ListOffsets", 8},
+	3:  {"Metadata", 12},
+	4:  {"LeaderAndIsr", 7},
+	5:  {"StopReplica", 4},
+	6:  {"UpdateMetadata", 8},
+	7:  {"ControlledShutdown", 3},
+	8:  {"OffsetCommit", 9},
+	9:  {"OffsetFetch", 9},
+	10: {"FindCoordinator", 5},
+	11: {"JoinGroup", 9},
+	12: {"Heartbeat", 4},
+	13: {"LeaveGroup", 5},
+	14: {"SyncGroup", 5},
+	15: {"DescribeGroups", 5},
+	16: {"ListGroups", 5},
+	17: {"SaslHandshake", 1},
+	18: {"ApiVersions", 3},
+	19: {"CreateTopics", 7},
+	20: {"DeleteTopics", 6},
+	21: {"DeleteRecords", 2},
+	22: {"InitProducerId", 5},
+	23: {"OffsetForLeaderEpoch", 4},
+	24: {"AddPartitionsToTxn", 5},
+	25: {"AddOffsetsToTxn", 4},
+	26: {"EndTxn", 4},
+	27: {"WriteTxnMarkers", 1},
+	28: {"TxnOffsetCommit", 4},
+	29: {"DescribeAcls", 3},
+	30: {"CreateAcls", 3},
+	31: {"DeleteAcls", 3},
+	32: {"DescribeConfigs", 4},
+	33: {"AlterConfigs", 2},
+	34: {"AlterReplicaLogDirs", 2},
+	35: {"DescribeLogDirs", 4},
+	36: {"SaslAuthenticate", 2},
+	37: {"CreatePartitions", 3},
+	38: {"CreateDelegationToken", 3},
+	39: {"RenewDelegationToken", 2},
+	40: {"ExpireDelegationToken", 2},
+	41: {"DescribeDelegationToken", 3},
+	42: {"DeleteGroups", 2},
+	43: {"ElectLeaders", 2},
+	44: {"IncrementalAlterConfigs", 1},
+	45: {"AlterPartitionReassignments", 0},
+	46: {"ListPartitionReassignments", 0},
+	47: {"OffsetDelete", 0},
+	48: {"DescribeClientQuotas", 1},
+	49: {"AlterClientQuotas", 1},
+	50: {"DescribeUserScramCredentials", 0},
+	51: {"AlterUserScramCredentials", 0},
+	55: {"DescribeQuorum", 1},
+	57: {"UpdateFeatures", 1},
+	60: {"DescribeCluster", 1},
+	61: {"DescribeProducers", 0},
+	65: {"DescribeTransactions", 0},
+	66: {"ListTransactions", 1},
+	68: {"ConsumerGroupHeartbeat", 0},
+	69: {"ConsumerGroupDescribe", 0},
+}
+
+// APIName returns the name of the api key, e.g. Produce for 0
+func APIName(key int16) string {
+	if k, ok := apiKeys[key]; ok {
+		return k.name
+	}
+
+	return fmt.Sprintf("Unknown(%d)", key)
+}
+
+// APIKey returns the api key named name, case insensitive, e.g. 0 for produce
+func APIKey(name string) (int16, bool) {
+	for key, k := range apiKeys {
+		if strings.EqualFold(k.name, name) {
+			return key, true
+		}
+	}
+
+	return 0, false
+}
+
+// IsKnownAPI tells whether key and version denote a request type of the Kafka protocol.
+func IsKnownAPI(key, version int16) bool {
+	k, ok := apiKeys[key]
+	return ok && version >= 0 && version <= k.maxVersion
+}
@@ -38,7 +38,9 @@ type PacketDecoder interface {
 	getInt32() (int32, error)
 	getInt64() (int64, error)
 	getVarint() (int64, error)
+	getUVarint() (uint64, error)
 	getArrayLength() (int, error)
+	getCompactArrayLength() (int, error)
 	getBool() (bool, error)
 
 	// Collections
@@ -47,9 +49,15 @@ type PacketDecoder interface {
 	getRawBytes(length int) ([]byte, error)
 	getString() (string, error)
 	getNullableString() (*string, error)
+	getCompactString() (string, error)
+	getCompactNullableString() (*string, error)
 	getInt32Array() ([]int32, error)
 	getInt64Array() ([]int64, error)
 	getStringArray() ([]string, error)
+	getCompactInt32Array() ([]int32, error)
+
+	// Tagged fields of the flexible versions, skipped
+	getTaggedFields() error
 
 	// Subsets
 	remaining() int
@@ -184,6 +192,20 @@ func (rd *RealDecoder) getVarint() (int64, error) {
 	return tmp, nil
 }
 
+func (rd *RealDecoder) getUVarint() (uint64, error) {
+	tmp, n := binary.Uvarint(rd.raw[rd.off:])
+	if n == 0 {
+		rd.off = len(rd.raw)
+		return 0, ErrInsufficientData
+	}
+	if n < 0 {
+		rd.off -= n
+		return 0, errVarintOverflow
+	}
+	rd.off += n
+	return tmp, nil
+}
+
 func (rd *RealDecoder) getArrayLength() (int, error) {
 	if rd.remaining() < 4 {
 		rd.off = len(rd.raw)
@@ -200,6 +222,26 @@ func (rd *RealDecoder) getArrayLength() (int, error) {
 	return tmp, nil
 }
 
+// getCompactArrayLength reads the length of a compact array, its count plus one, -1 for a null array.
+func (rd *RealDecoder) getCompactArrayLength() (int, error) {
+	n, err := rd.getUVarint()
+	if err != nil {
+		return -1, err
+	}
+	if n == 0 {
+		return -1, nil
+	}
+
+	tmp := n - 1
+	if tmp > uint64(rd.remaining()) {
+		rd.off = len(rd.raw)
+		return -1, ErrInsufficientData
+	} else if tmp > 2*math.MaxUint16 {
+		return -1, errInvalidArrayLength
+	}
+	return int(tmp), nil
+}
+
 func (rd *RealDecoder) getBool() (bool, error) {
 	b, err := rd.getInt8()
 	if err != nil || b == 0 {
@@ -278,6 +320,42 @@ func (rd *RealDecoder) getNullableString() (*string, error) {
 	return &tmpStr, err
 }
 
+// getCompactStringLength reads the length of a compact string, its length plus one, -1 for a null string.
+func (rd *RealDecoder) getCompactStringLength() (int, error) {
+	length, err := rd.getUVarint()
+	if err != nil {
+		return 0, err
+	}
+	if length > uint64(rd.remaining())+1 {
+		rd.off = len(rd.raw)
+		return 0, ErrInsufficientData
+	}
+
+	return int(length) - 1, nil
+}
+
+func (rd *RealDecoder) getCompactString() (string, error) {
+	n, err := rd.getCompactStringLength()
+	if err != nil || n == -1 {
+		return "", err
+	}
+
+	tmpStr := string(rd.raw[rd.off : rd.off+n])
+	rd.off += n
+	return tmpStr, nil
+}
+
+func (rd *RealDecoder) getCompactNullableString() (*string, error) {
+	n, err := rd.getCompactStringLength()
+	if err != nil || n == -1 {
+		return nil, err
+	}
+
+	tmpStr := string(rd.raw[rd.off : rd.off+n])
+	rd.off += n
+	return &tmpStr, nil
+}
+
 func (rd *RealDecoder) getInt32Array() ([]int32, error) {
 	if rd.remaining() < 4 {
 		rd.off = len(rd.raw)
@@ -364,6 +442,50 @@ func (rd *RealDecoder) getStringArray() ([]string, error) {
 	return ret, nil
 }
 
+func (rd *RealDecoder) getCompactInt32Array() ([]int32, error) {
+	n, err := rd.getCompactArrayLength()
+	if err != nil || n <= 0 {
+		return nil, err
+	}
+
+	if rd.remaining() < 4*n {
+		rd.off = len(rd.raw)
+		return nil, ErrInsufficientData
+	}
+
+	ret := make([]int32, n)
+	for i := range ret {
+		ret[i] = int32(binary.BigEndian.Uint32(rd.raw[rd.off:]))
+		rd.off += 4
+	}
+	return ret, nil
+}
+
+// getTaggedFields skips the tagged fields ending the structures of the flexible versions.
+func (rd *RealDecoder) getTaggedFields() error {
+	count, err := rd.getUVarint()
+	if err != nil {
+		return err
+	}
+
+	for i := uint64(0); i < count; i++ {
+		if _, err := rd.getUVarint(); err != nil { // tag
+			return err
+		}
+		size, err := rd.getUVarint()
+		if err != nil {
+			return err
+		}
+		if size > uint64(rd.remaining()) {
+			rd.off = len(rd.raw)
+			return ErrInsufficientData
+		}
+		rd.off += int(size)
+	}
+
+	return nil
+}
+
 // subsets
 
 func (rd *RealDecoder) remaining() int {
@@ -443,3 +565,30 @@ func (rd *RealDecoder) pop() error {
 func (rd *RealDecoder) discard(length int) {
 	rd.off += length
 }
+
+// getArrayLength reads the length of an array, compact in the flexible versions.
+func getArrayLength(pd PacketDecoder, flexible bool) (int, error) {
+	if flexible {
+		return pd.getCompactArrayLength()
+	}
+
+	return pd.getArrayLength()
+}
+
+// getString reads a string, compact in the flexible versions.
+func getString(pd PacketDecoder, flexible bool) (string, error) {
+	if flexible {
+		return pd.getCompactString()
+	}
+
+	return pd.getString()
+}
+
+// getTaggedFields skips the tagged fields of the flexible versions, the others have none.
+func getTaggedFields(pd PacketDecoder, flexible bool) error {
+	if !flexible {
+		return nil
+	}
+
+	return pd.getTaggedFields()
+}
@@ -1,17 +1,27 @@
 package kafka
 
-import (
-	"github.com/bingoohuang/kafka-sniffer/metrics"
-)
+import "fmt"
 
 type fetchRequestBlock struct {
 	Version            int16
 	currentLeaderEpoch int32
 	fetchOffset        int64
+	lastFetchedEpoch   int32
 	logStartOffset     int64
 	maxBytes           int32
 }
 
+const (
+	// fetchFlexibleVersion is the first version of the fetch request with the compact encoding and tagged fields,
+	// Kafka 2.7
+	fetchFlexibleVersion = 12
+	// fetchTopicIDVersion is the first version of the fetch request naming the topics by their id, Kafka 3.1
+	fetchTopicIDVersion = 13
+	// fetchReplicaStateVersion is the first version of the fetch request without the replica id, which
+	// moved to a tagged field, Kafka 3.5
+	fetchReplicaStateVersion = 15
+)
+
 func (b *fetchRequestBlock) decode(pd PacketDecoder, version int16) (err error) {
 	b.Version = version
 	if b.Version >= 9 {
@@ -22,6 +32,11 @@ func (b *fetchRequestBlock) decode(pd PacketDecoder, version int16) (err error)
 	if b.fetchOffset, err = pd.getInt64(); err != nil {
 		return err
 	}
+	if b.Version >= fetchFlexibleVersion {
+		if b.lastFetchedEpoch, err = pd.getInt32(); err != nil {
+			return err
+		}
+	}
 	if b.Version >= 5 {
 		if b.logStartOffset, err = pd.getInt64(); err != nil {
 			return err
@@ -30,7 +45,7 @@ func (b *fetchRequestBlock) decode(pd PacketDecoder, version int16) (err error)
 	if b.maxBytes, err = pd.getInt32(); err != nil {
 		return err
 	}
-	return nil
+	return getTaggedFields(pd, b.Version >= fetchFlexibleVersion)
 }
 
 // FetchRequest (API key 1) will fetch Kafka messages. Version 3 introduced the MaxBytes field. See
@@ -52,7 +67,8 @@ type FetchRequest struct {
 // IsolationLevel is a setting for reliability
 type IsolationLevel int8
 
-// ExtractTopics returns a list of all topics from request
+// ExtractTopics returns a list of all topics from request. From version 13 the request names the topics by
+// their id, e.g. 8f7e6d5c-4b3a-2918-0706-f5e4d3c2b1a0, see TopicID.
 func (r *FetchRequest) ExtractTopics() []string {
 	var topics []string
 	for k := range r.blocks {
@@ -62,6 +78,20 @@ func (r *FetchRequest) ExtractTopics() []string {
 	return topics
 }
 
+// ExtractPartitions returns the partitions of every topic, in ascending order
+func (r *FetchRequest) ExtractPartitions() map[string][]int32 {
+	out := make(map[string][]int32, len(r.blocks))
+
+	for topic, partitions := range r.blocks {
+		for partition := range partitions {
+			out[topic] = append(out[topic], partition)
+		}
+		sortPartitions(out[topic])
+	}
+
+	return out
+}
+
 // GetRequestedBlocksCount returns a total amount of blocks from fetch request
 func (r *FetchRequest) GetRequestedBlocksCount() (blocksCount int) {
 	for _, partition := range r.blocks {
@@ -73,9 +103,18 @@ func (r *FetchRequest) GetRequestedBlocksCount() (blocksCount int) {
 // Decode retrieves kafka fetch request from packet
 func (r *FetchRequest) Decode(pd PacketDecoder, version int16) (err error) {
 	r.Version = version
+	flexible := version >= fetchFlexibleVersion
 
-	if _, err = pd.getInt32(); err != nil {
-		return err
+	if flexible {
+		// the request header ends with tagged fields
+		if err = pd.getTaggedFields(); err != nil {
+			return err
+		}
+	}
+	if r.Version < fetchReplicaStateVersion {
+		if _, err = pd.getInt32(); err != nil {
+			return err
+		}
 	}
 	if r.MaxWaitTime, err = pd.getInt32(); err != nil {
 		return err
@@ -106,22 +145,21 @@ func (r *FetchRequest) Decode(pd PacketDecoder, version int16) (err error) {
 			return err
 		}
 	}
-	topicCount, err := pd.getArrayLength()
+	topicCount, err := getArrayLength(pd, flexible)
 	if err != nil {
 		return err
 	}
-	if topicCount == 0 {
-		return nil
+	if topicCount > 0 {
+		r.blocks = make(map[string]map[int32]*fetchRequestBlock)
 	}
-	r.blocks = make(map[string]map[int32]*fetchRequestBlock)
 	for i := 0; i < topicCount; i++ {
 		var topic string
-		topic, err = pd.getString()
+		topic, err = r.getTopic(pd)
 		if err != nil {
 			return err
 		}
 		var partitionCount int
-		partitionCount, err = pd.getArrayLength()
+		partitionCount, err = getArrayLength(pd, flexible)
 		if err != nil {
 			return err
 		}
@@ -138,55 +176,65 @@ func (r *FetchRequest) Decode(pd PacketDecoder, version int16) (err error) {
 			}
 			r.blocks[topic][partition] = fetchBlock
 		}
+		if err = getTaggedFields(pd, flexible); err != nil {
+			return err
+		}
 	}
 
 	if r.Version >= 7 {
 		var forgottenCount int
-		forgottenCount, err = pd.getArrayLength()
+		forgottenCount, err = getArrayLength(pd, flexible)
 		if err != nil {
 			return err
 		}
 		r.forgotten = make(map[string][]int32)
 		for i := 0; i < forgottenCount; i++ {
 			var topic string
-			topic, err = pd.getString()
+			topic, err = r.getTopic(pd)
 			if err != nil {
 				return err
 			}
-			var partitionCount int
-			partitionCount, err = pd.getArrayLength()
+			if flexible {
+				r.forgotten[topic], err = pd.getCompactInt32Array()
+			} else {
+				r.forgotten[topic], err = pd.getInt32Array()
+			}
 			if err != nil {
 				return err
 			}
-			r.forgotten[topic] = make([]int32, partitionCount)
-
-			for j := 0; j < partitionCount; j++ {
-				var partition int32
-				partition, err = pd.getInt32()
-				if err != nil {
-					return err
-				}
-				r.forgotten[topic][j] = partition
+			if err = getTaggedFields(pd, flexible); err != nil {
+				return err
 			}
 		}
 	}
 
 	if r.Version >= 11 {
-		r.RackID, err = pd.getString()
+		r.RackID, err = getString(pd, flexible)
 		if err != nil {
 			return err
 		}
 	}
 
-	return nil
+	return getTaggedFields(pd, flexible)
 }
 
-// CollectClientMetrics collects metrics associated with client
-func (r *FetchRequest) CollectClientMetrics(srcHost string) {
-	metrics.RequestsCount.WithLabelValues(srcHost, "fetch").Inc()
+// getTopic reads the name of a topic, or its id from version 13.
+func (r *FetchRequest) getTopic(pd PacketDecoder) (string, error) {
+	if r.Version < fetchTopicIDVersion {
+		return getString(pd, r.Version >= fetchFlexibleVersion)
+	}
+
+	id, err := pd.getRawBytes(16)
+	if err != nil {
+		return "", err
+	}
+
+	return TopicID(id), nil
+}
 
-	blocksCount := r.GetRequestedBlocksCount()
-	metrics.BlocksRequested.WithLabelValues(srcHost).Add(float64(blocksCount))
+// TopicID formats the 16 bytes of a topic id as a UUID.
+func TopicID(id []byte) string {
+	return fmt.Sprintf("%x-%x-%x-%x-%x", id[0:4], id[4:6], id[6:8], id[8:10], id[10:16])
 }
 
 func (r *FetchRequest) key() int16 {
@@ -5,8 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
-
-	"github.com/bingoohuang/kafka-sniffer/metrics"
+	"sort"
 )
 
 var (
@@ -17,7 +16,6 @@ var (
 // ProtocolBody represents body of kafka request
 type ProtocolBody interface {
 	versionedDecoder
-	metrics.ClientMetricsCollector
 	key() int16
 	version() int16
 	requiredVersion() Version
@@ -74,8 +72,7 @@ func (r *Request) Decode(pd PacketDecoder) (err error) {
 
 	// If  we can't (don't want) to unmarshal request structure - we need to discard the rest bytes
 	if body == nil {
-		// discard 10 bytes + clientID length
-		pd.discard(int(r.BodyLength) - 10 - len(r.ClientID))
+		pd.discard(pd.remaining())
 
 		// Skip Body decoding for now
 		return nil
@@ -104,7 +101,13 @@ func DecodeVersion(encoded []byte) int16 {
 	return int16(binary.BigEndian.Uint16(encoded[6:]))
 }
 
-// DecodeRequest decodes request from packets delivered by reader
+// DecodeCorrelationID decodes correlation id from packet
+func DecodeCorrelationID(encoded []byte) int32 {
+	return int32(binary.BigEndian.Uint32(encoded[8:12]))
+}
+
+// DecodeRequest decodes request from packets delivered by reader. The frame of a request type which is not decoded
+// is read and returned with its header only, its Body nil, along with a PacketDecodingError.
 func DecodeRequest(r io.Reader) (*Request, int, error) {
 	var (
 		needReadBytes = 8
@@ -123,11 +126,6 @@ func DecodeRequest(r io.Reader) (*Request, int, error) {
 	key := DecodeKey(readBytes)
 	version := DecodeVersion(readBytes)
 
-	// check request type
-	if protocol := allocateBody(key, version); protocol == nil {
-		return nil, int(length), PacketDecodingError{fmt.Sprintf("unsupported protocol with key: %d", key)}
-	}
-
 	// check request size
 	if length <= 4 || length > MaxRequestSize {
 		return nil, int(length), PacketDecodingError{fmt.Sprintf("message of length %d too large or too small", length)}
@@ -152,6 +150,11 @@ func DecodeRequest(r io.Reader) (*Request, int, error) {
 		return nil, bytesRead, err
 	}
 
+	// check request type, the header tells the client of the requests which are not decoded
+	if req.Body == nil {
+		return req, bytesRead, PacketDecodingError{fmt.Sprintf("unsupported protocol with key: %d", key)}
+	}
+
 	return req, bytesRead, nil
 }
 
@@ -161,6 +164,16 @@ func allocateBody(key, version int16) ProtocolBody {
 		return &ProduceRequest{}
 	case 1:
 		return &FetchRequest{Version: version}
+	case 17:
+		return &SaslHandshakeRequest{}
+	case 18:
+		return &APIVersionsRequest{}
+	case 36:
+		return &SaslAuthenticateRequest{}
 	}
 	return nil
 }
+
+func sortPartitions(partitions []int32) {
+	sort.Slice(partitions, func(i, j int) bool { return partitions[i] < partitions[j] })
+}
@@ -0,0 +1,76 @@
+package kafka
+
+import "encoding/binary"
+
+// APIVersionsRequest (API key 18) is sent by the clients first on a connection to learn the versions the broker supports.
+// From version 3 it names the software of the client, e.g. apache-kafka-java 3.6.0, earlier versions have no body.
+type APIVersionsRequest struct {
+	Version               int16
+	ClientSoftwareName    string
+	ClientSoftwareVersion string
+}
+
+// Decode decodes kafka api versions request from packet
+func (r *APIVersionsRequest) Decode(pd PacketDecoder, version int16) error {
+	r.Version = version
+	if version < 3 {
+		return nil
+	}
+
+	// version 3 is flexible: the request header ends with tagged fields, the names are compact strings
+	rest, err := pd.getRawBytes(pd.remaining())
+	if err != nil {
+		return err
+	}
+	if rest, err = skipTaggedFields(rest); err != nil {
+		return err
+	}
+	if r.ClientSoftwareName, rest, err = compactString(rest); err != nil {
+		return err
+	}
+	r.ClientSoftwareVersion, _, err = compactString(rest)
+
+	return err
+}
+
+func (r *APIVersionsRequest) key() int16 {
+	return 18
+}
+
+func (r *APIVersionsRequest) version() int16 {
+	return r.Version
+}
+
+func (r *APIVersionsRequest) requiredVersion() Version {
+	switch r.Version {
+	case 1:
+		return V0_11_0_0
+	case 2:
+		return V2_0_0_0
+	case 3:
+		return V2_4_0_0
+	default:
+		return V0_10_0_0
+	}
+}
+
+// ClientSoftware returns the software of the client as name/version, e.g. apache-kafka-java/3.6.0,
+// empty before version 3.
+func (r *APIVersionsRequest) ClientSoftware() string {
+	if r.ClientSoftwareName == "" {
+		return ""
+	}
+
+	return r.ClientSoftwareName + "/" + r.ClientSoftwareVersion
+}
+
+// compactString reads a compact string starting b, and returns the bytes after it.
+func compactString(b []byte) (string, []byte, error) {
+	n, size := binary.Uvarint(b)
+	if size <= 0 || n == 0 || n-1 > uint64(len(b)-size) {
+		return "", nil, errInvalidByteSliceLength
+	}
+
+	end := size + int(n-1)
+	return string(b[size:end]), b[end:], nil
+}
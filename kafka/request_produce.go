@@ -1,9 +1,5 @@
 package kafka
 
-import (
-	"github.com/bingoohuang/kafka-sniffer/metrics"
-)
-
 // RequiredAcks is used in Produce Requests to tell the broker how many replica acknowledgements
 // it must see before responding. Any of the constants defined here are valid. On broker versions
 // prior to 0.8.2.0 any other positive int16 is also valid (the broker will wait for that many
@@ -18,13 +14,31 @@ type ProduceRequest struct {
 	Timeout         int32
 	Version         int16 // v1 requires Kafka 0.9, v2 requires Kafka 0.10, v3 requires Kafka 0.11
 	Records         map[string]map[int32]Records
+
+	// batchSize is the size of the record batches of every topic as they were sent
+	batchSize map[string]int
 }
 
+// produceFlexibleVersion is the first version of the produce request with the compact encoding and tagged fields,
+// Kafka 2.8
+const produceFlexibleVersion = 9
+
 // Decode decodes kafka produce request from packet
 func (r *ProduceRequest) Decode(pd PacketDecoder, version int16) error {
 	r.Version = version
+	flexible := version >= produceFlexibleVersion
 
-	if version >= 3 {
+	if flexible {
+		// the request header ends with tagged fields
+		if err := pd.getTaggedFields(); err != nil {
+			return err
+		}
+		id, err := pd.getCompactNullableString()
+		if err != nil {
+			return err
+		}
+		r.TransactionalID = id
+	} else if version >= 3 {
 		id, err := pd.getNullableString()
 		if err != nil {
 			return err
@@ -39,21 +53,22 @@ func (r *ProduceRequest) Decode(pd PacketDecoder, version int16) error {
 	if r.Timeout, err = pd.getInt32(); err != nil {
 		return err
 	}
-	topicCount, err := pd.getArrayLength()
+	topicCount, err := getArrayLength(pd, flexible)
 	if err != nil {
 		return err
 	}
-	if topicCount == 0 {
-		return nil
+	if topicCount <= 0 {
+		return getTaggedFields(pd, flexible)
 	}
 
 	r.Records = make(map[string]map[int32]Records)
+	r.batchSize = make(map[string]int)
 	for i := 0; i < topicCount; i++ {
-		topic, err := pd.getString()
+		topic, err := getString(pd, flexible)
 		if err != nil {
 			return err
 		}
-		partitionCount, err := pd.getArrayLength()
+		partitionCount, err := getArrayLength(pd, flexible)
 		if err != nil {
 			return err
 		}
@@ -64,13 +79,24 @@ func (r *ProduceRequest) Decode(pd PacketDecoder, version int16) error {
 			if err != nil {
 				return err
 			}
-			size, err := pd.getInt32()
-			if err != nil {
-				return err
+			var size int
+			if flexible {
+				// compact records, their size plus one
+				n, err := pd.getUVarint()
+				if err != nil {
+					return err
+				}
+				size = int(n) - 1
+			} else {
+				n, err := pd.getInt32()
+				if err != nil {
+					return err
+				}
+				size = int(n)
 			}
 
 			// rewind decoder to size
-			recordsDecoder, err := pd.getSubset(int(size))
+			recordsDecoder, err := pd.getSubset(size)
 			if err != nil {
 				return err
 			}
@@ -79,10 +105,19 @@ func (r *ProduceRequest) Decode(pd PacketDecoder, version int16) error {
 				return err
 			}
 			r.Records[topic][partition] = records
+			r.batchSize[topic] += size
+
+			if err := getTaggedFields(pd, flexible); err != nil {
+				return err
+			}
+		}
+
+		if err := getTaggedFields(pd, flexible); err != nil {
+			return err
 		}
 	}
 
-	return nil
+	return getTaggedFields(pd, flexible)
 }
 
 func (r *ProduceRequest) key() int16 {
@@ -104,17 +139,24 @@ func (r *ProduceRequest) ExtractTopics() []string {
 	return out
 }
 
+// ExtractPartitions returns the partitions of every topic, in ascending order
+func (r *ProduceRequest) ExtractPartitions() map[string][]int32 {
+	out := make(map[string][]int32, len(r.Records))
+
+	for topic, partitions := range r.Records {
+		for partition := range partitions {
+			out[topic] = append(out[topic], partition)
+		}
+		sortPartitions(out[topic])
+	}
+
+	return out
+}
+
 // RecordsLen retrieves total size in bytes of all Records in message
 func (r *ProduceRequest) RecordsLen() (recordsLen int) {
 	for _, partition := range r.Records {
-		for _, record := range partition {
-			switch record.RecordsType {
-			case legacyRecords:
-				recordsLen += len(record.MsgSet.Messages)
-			case defaultRecords:
-				recordsLen += len(record.RecordBatch.Records)
-			}
-		}
+		recordsLen += partitionRecordsLen(partition)
 	}
 	return
 }
@@ -122,29 +164,69 @@ func (r *ProduceRequest) RecordsLen() (recordsLen int) {
 // RecordsSize retrieves total number of Records in batch
 func (r *ProduceRequest) RecordsSize() (recordsSize int) {
 	for _, partition := range r.Records {
-		for _, record := range partition {
-			switch record.RecordsType {
-			case legacyRecords:
-				for _, msg := range record.MsgSet.Messages {
-					recordsSize += msg.Msg.compressedSize
-				}
-			case defaultRecords:
-				recordsSize += record.RecordBatch.recordsLen
-			}
-		}
+		recordsSize += partitionRecordsSize(partition)
 	}
 	return
 }
 
-// CollectClientMetrics collects metrics associated with client
-func (r *ProduceRequest) CollectClientMetrics(srcHost string) {
-	metrics.RequestsCount.WithLabelValues(srcHost, "produce").Inc()
+// TopicRecordsLen returns the RecordsLen of every topic
+func (r *ProduceRequest) TopicRecordsLen() map[string]int {
+	out := make(map[string]int, len(r.Records))
+
+	for topic, partition := range r.Records {
+		out[topic] = partitionRecordsLen(partition)
+	}
+
+	return out
+}
+
+// TopicRecordsSize returns the RecordsSize of every topic
+func (r *ProduceRequest) TopicRecordsSize() map[string]int {
+	out := make(map[string]int, len(r.Records))
+
+	for topic, partition := range r.Records {
+		out[topic] = partitionRecordsSize(partition)
+	}
+
+	return out
+}
+
+// TopicBatchSize returns the size in bytes of the record batches of every topic as they were sent,
+// compressed or not
+func (r *ProduceRequest) TopicBatchSize() map[string]int {
+	out := make(map[string]int, len(r.batchSize))
+
+	for topic, size := range r.batchSize {
+		out[topic] = size
+	}
 
-	batchSize := r.RecordsSize()
-	metrics.ProducerBatchSize.WithLabelValues(srcHost).Add(float64(batchSize))
+	return out
+}
+
+func partitionRecordsLen(partition map[int32]Records) (recordsLen int) {
+	for _, record := range partition {
+		switch record.RecordsType {
+		case legacyRecords:
+			recordsLen += len(record.MsgSet.Messages)
+		case defaultRecords:
+			recordsLen += len(record.RecordBatch.Records)
+		}
+	}
+	return
+}
 
-	batchLen := r.RecordsLen()
-	metrics.ProducerBatchLen.WithLabelValues(srcHost).Add(float64(batchLen))
+func partitionRecordsSize(partition map[int32]Records) (recordsSize int) {
+	for _, record := range partition {
+		switch record.RecordsType {
+		case legacyRecords:
+			for _, msg := range record.MsgSet.Messages {
+				recordsSize += msg.Msg.compressedSize
+			}
+		case defaultRecords:
+			recordsSize += record.RecordBatch.recordsLen
+		}
+	}
+	return
 }
 
 func (r *ProduceRequest) requiredVersion() Version {
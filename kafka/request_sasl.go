@@ -0,0 +1,194 @@
+package kafka
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"strings"
+)
+
+// SaslHandshakeRequest (API key 17) names the SASL mechanism of a connection, e.g. PLAIN or SCRAM-SHA-512.
+// From version 1 the SASL tokens follow as SaslAuthenticate requests, before they followed unframed.
+type SaslHandshakeRequest struct {
+	Version   int16
+	Mechanism string
+}
+
+// Decode decodes kafka sasl handshake request from packet
+func (r *SaslHandshakeRequest) Decode(pd PacketDecoder, version int16) (err error) {
+	r.Version = version
+	r.Mechanism, err = pd.getString()
+	return err
+}
+
+func (r *SaslHandshakeRequest) key() int16 {
+	return 17
+}
+
+func (r *SaslHandshakeRequest) version() int16 {
+	return r.Version
+}
+
+func (r *SaslHandshakeRequest) requiredVersion() Version {
+	if r.Version >= 1 {
+		return V1_0_0_0
+	}
+
+	return V0_10_0_0
+}
+
+// SaslAuthenticateRequest (API key 36) carries a SASL token of the client. Only the principal authenticating
+// is kept, the credentials of the token are never.
+type SaslAuthenticateRequest struct {
+	Version int16
+	// principal is the user of a PLAIN or SCRAM client-first token, or of an OAUTHBEARER token.
+	principal string
+}
+
+// Decode decodes kafka sasl authenticate request from packet
+func (r *SaslAuthenticateRequest) Decode(pd PacketDecoder, version int16) error {
+	r.Version = version
+
+	if version < 2 {
+		token, err := pd.getBytes()
+		if err != nil {
+			return err
+		}
+		r.principal = saslPrincipal(token)
+		return nil
+	}
+
+	// version 2 is flexible: the request header ends with tagged fields, the token is compact bytes
+	rest, err := pd.getRawBytes(pd.remaining())
+	if err != nil {
+		return err
+	}
+	if rest, err = skipTaggedFields(rest); err != nil {
+		return err
+	}
+
+	n, size := binary.Uvarint(rest)
+	if size <= 0 || n == 0 || int(n-1) > len(rest)-size {
+		return errInvalidByteSliceLength
+	}
+	r.principal = saslPrincipal(rest[size : size+int(n-1)])
+
+	return nil
+}
+
+func (r *SaslAuthenticateRequest) key() int16 {
+	return 36
+}
+
+func (r *SaslAuthenticateRequest) version() int16 {
+	return r.Version
+}
+
+func (r *SaslAuthenticateRequest) requiredVersion() Version {
+	switch r.Version {
+	case 1:
+		return V2_0_0_0
+	case 2:
+		return V2_4_0_0
+	default:
+		return V1_0_0_0
+	}
+}
+
+// Principal returns the user authenticating, empty when the token does not tell it, e.g. GSSAPI
+// or the client-final token of SCRAM.
+func (r *SaslAuthenticateRequest) Principal() string {
+	return r.principal
+}
+
+// skipTaggedFields skips the tagged fields starting b.
+func skipTaggedFields(b []byte) ([]byte, error) {
+	count, n := binary.Uvarint(b)
+	if n <= 0 {
+		return nil, errVarintOverflow
+	}
+	b = b[n:]
+
+	for i := uint64(0); i < count; i++ {
+		if _, n = binary.Uvarint(b); n <= 0 {
+			return nil, errVarintOverflow
+		}
+		b = b[n:]
+
+		size, n := binary.Uvarint(b)
+		if n <= 0 || size > uint64(len(b)-n) {
+			return nil, errInvalidByteSliceLength
+		}
+		b = b[n+int(size):]
+	}
+
+	return b, nil
+}
+
+// saslPrincipal returns the user of a SASL token of the client:
+// PLAIN is authzid NUL authcid NUL password, see RFC 4616,
+// SCRAM client-first is gs2-header n=user,r=nonce, see RFC 5802,
+// OAUTHBEARER is gs2-header with a=user, or the sub claim of the JWT bearer token, see RFC 7628.
+func saslPrincipal(token []byte) string {
+	// kafka requires the authzid of PLAIN to be empty or the authcid
+	if parts := bytes.Split(token, []byte{0}); len(parts) == 3 {
+		return string(parts[1])
+	}
+
+	s := string(token)
+	if !strings.HasPrefix(s, "n,") && !strings.HasPrefix(s, "y,") && !strings.HasPrefix(s, "p=") {
+		return ""
+	}
+
+	// the gs2 header: channel binding flag, authzid
+	fields := strings.SplitN(s, ",", 3)
+	if len(fields) < 3 {
+		return ""
+	}
+	if authzid := strings.TrimPrefix(fields[1], "a="); authzid != fields[1] && authzid != "" {
+		return unescapeSaslName(authzid)
+	}
+
+	rest := fields[2]
+	if strings.HasPrefix(rest, "n=") {
+		user := strings.TrimPrefix(rest, "n=")
+		if i := strings.IndexByte(user, ','); i >= 0 {
+			user = user[:i]
+		}
+		return unescapeSaslName(user)
+	}
+
+	for _, kv := range strings.Split(rest, "\x01") {
+		if bearer := strings.TrimPrefix(kv, "auth=Bearer "); bearer != kv {
+			return jwtSubject(bearer)
+		}
+	}
+
+	return ""
+}
+
+// unescapeSaslName unescapes the commas and the equal signs of a SCRAM or gs2 user name.
+var unescapeSaslName = strings.NewReplacer("=2C", ",", "=3D", "=").Replace
+
+// jwtSubject returns the sub claim of a JWT, not verified, empty when it is no JWT.
+func jwtSubject(token string) string {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return ""
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return ""
+	}
+
+	var claims struct {
+		Sub string `json:"sub"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return ""
+	}
+
+	return claims.Sub
+}
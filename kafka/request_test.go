@@ -0,0 +1,262 @@
+package kafka
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// packet builds the frames of the tests with Kafka's encoding rules.
+type packet struct {
+	b []byte
+}
+
+func (p *packet) int8(v int8) *packet {
+	p.b = append(p.b, byte(v))
+	return p
+}
+
+func (p *packet) int16(v int16) *packet {
+	p.b = append(p.b, byte(v>>8), byte(v))
+	return p
+}
+
+func (p *packet) int32(v int32) *packet {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], uint32(v))
+	p.b = append(p.b, b[:]...)
+	return p
+}
+
+func (p *packet) int64(v int64) *packet {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(v))
+	p.b = append(p.b, b[:]...)
+	return p
+}
+
+func (p *packet) uvarint(v uint64) *packet {
+	var b [binary.MaxVarintLen64]byte
+	p.b = append(p.b, b[:binary.PutUvarint(b[:], v)]...)
+	return p
+}
+
+func (p *packet) varint(v int64) *packet {
+	var b [binary.MaxVarintLen64]byte
+	p.b = append(p.b, b[:binary.PutVarint(b[:], v)]...)
+	return p
+}
+
+func (p *packet) raw(b []byte) *packet {
+	p.b = append(p.b, b...)
+	return p
+}
+
+// string appends s, a compact string in the flexible versions.
+func (p *packet) string(s string, flexible bool) *packet {
+	if flexible {
+		p.uvarint(uint64(len(s) + 1))
+	} else {
+		p.int16(int16(len(s)))
+	}
+	return p.raw([]byte(s))
+}
+
+// array appends the length of an array of n items, compact in the flexible versions.
+func (p *packet) array(n int, flexible bool) *packet {
+	if flexible {
+		return p.uvarint(uint64(n + 1))
+	}
+	return p.int32(int32(n))
+}
+
+// tagged appends the empty tagged fields of the flexible versions.
+func (p *packet) tagged(flexible bool) *packet {
+	if flexible {
+		p.uvarint(0)
+	}
+	return p
+}
+
+// requestFrame is the frame of a request, length included, with the header of the flexible versions
+// ending with tagged fields.
+func requestFrame(key, version int16, correlationID int32, clientID string, flexible bool, body []byte) []byte {
+	p := &packet{}
+	p.int32(0).int16(key).int16(version).int32(correlationID).string(clientID, false).tagged(flexible).raw(body)
+	binary.BigEndian.PutUint32(p.b, uint32(len(p.b)-4))
+
+	return p.b
+}
+
+// recordBatch is a record batch of values, without keys.
+func recordBatch(values ...string) []byte {
+	records := &packet{}
+	for i, v := range values {
+		r := &packet{}
+		r.int8(0).varint(0).varint(int64(i)).varint(-1).varint(int64(len(v))).raw([]byte(v)).varint(0)
+		records.varint(int64(len(r.b))).raw(r.b)
+	}
+
+	// the crc covers the attributes and what follows
+	crc := &packet{}
+	crc.int16(0).int32(int32(len(values) - 1)).int64(0).int64(0).int64(-1).int16(-1).int32(-1).int32(int32(len(values))).raw(records.b)
+
+	p := &packet{}
+	p.int64(0).int32(int32(recordBatchOverhead + len(records.b))).int32(0).int8(2)
+	p.int32(int32(crc32.Checksum(crc.b, crc32.MakeTable(crc32.Castagnoli)))).raw(crc.b)
+
+	return p.b
+}
+
+// produceBody is the body of a produce request of batch to partition 0 of every topic.
+func produceBody(version int16, batch []byte, topics ...string) []byte {
+	flexible := version >= produceFlexibleVersion
+
+	p := &packet{}
+	if version >= 3 {
+		if flexible {
+			p.uvarint(0) // null transactional id
+		} else {
+			p.int16(-1)
+		}
+	}
+	p.int16(1).int32(1000).array(len(topics), flexible)
+	for _, topic := range topics {
+		p.string(topic, flexible).array(1, flexible).int32(0)
+		if flexible {
+			p.uvarint(uint64(len(batch) + 1))
+		} else {
+			p.int32(int32(len(batch)))
+		}
+		p.raw(batch).tagged(flexible).tagged(flexible)
+	}
+
+	return p.tagged(flexible).b
+}
+
+// fetchBody is the body of a fetch request of partition 0 of every topic, named by its id from version 13.
+func fetchBody(version int16, topics ...string) []byte {
+	flexible := version >= fetchFlexibleVersion
+	topic := func(p *packet, name string) {
+		if version >= fetchTopicIDVersion {
+			p.raw([]byte(name)[:16])
+		} else {
+			p.string(name, flexible)
+		}
+	}
+
+	p := &packet{}
+	if version < fetchReplicaStateVersion {
+		p.int32(-1)
+	}
+	p.int32(500).int32(1)
+	if version >= 3 {
+		p.int32(1 << 20)
+	}
+	if version >= 4 {
+		p.int8(0)
+	}
+	if version >= 7 {
+		p.int32(0).int32(-1)
+	}
+	p.array(len(topics), flexible)
+	for _, name := range topics {
+		topic(p, name)
+		p.array(1, flexible).int32(0)
+		if version >= 9 {
+			p.int32(-1)
+		}
+		p.int64(42)
+		if version >= 12 {
+			p.int32(-1)
+		}
+		if version >= 5 {
+			p.int64(0)
+		}
+		p.int32(1 << 20).tagged(flexible).tagged(flexible)
+	}
+	if version >= 7 {
+		// a forgotten partition of the first topic
+		p.array(1, flexible)
+		topic(p, topics[0])
+		p.array(1, flexible).int32(1).tagged(flexible)
+	}
+	if version >= 11 {
+		p.string("rack-a", flexible)
+	}
+
+	return p.tagged(flexible).b
+}
+
+func TestDecodeProduceRequest(t *testing.T) {
+	for _, version := range []int16{0, 3, 7, 8, 9, 10} {
+		frame := requestFrame(0, version, 7, "producer-1", version >= produceFlexibleVersion,
+			produceBody(version, recordBatch("a", "bc"), "orders", "payments"))
+
+		req, n, err := DecodeRequest(bytes.NewReader(frame))
+		if err != nil {
+			t.Errorf("v%d: %v", version, err)
+			continue
+		}
+		body, ok := req.Body.(*ProduceRequest)
+		if !ok || n != len(frame) || req.CorrelationID != 7 || req.ClientID != "producer-1" {
+			t.Errorf("v%d: decoded %d bytes of %d as %+v", version, n, len(frame), req)
+			continue
+		}
+
+		topics := body.ExtractTopics()
+		sort.Strings(topics)
+		if want := []string{"orders", "payments"}; !reflect.DeepEqual(topics, want) {
+			t.Errorf("v%d: topics %v, want %v", version, topics, want)
+		}
+		if got := body.TopicRecordsLen(); got["orders"] != 2 || got["payments"] != 2 {
+			t.Errorf("v%d: records %v, want 2 per topic", version, got)
+		}
+		if got, want := body.TopicBatchSize(), len(recordBatch("a", "bc")); got["orders"] != want || got["payments"] != want {
+			t.Errorf("v%d: batch sizes %v, want %d per topic", version, got, want)
+		}
+	}
+}
+
+func TestDecodeFetchRequest(t *testing.T) {
+	const id = "\x8f\x7e\x6d\x5c\x4b\x3a\x29\x18\x07\x06\xf5\xe4\xd3\xc2\xb1\xa0"
+
+	for _, version := range []int16{0, 4, 7, 9, 11, 12, 13, 15, 16} {
+		topic := "orders"
+		if version >= fetchTopicIDVersion {
+			topic = id
+		}
+		frame := requestFrame(1, version, 9, "consumer-1", version >= fetchFlexibleVersion, fetchBody(version, topic))
+
+		req, n, err := DecodeRequest(bytes.NewReader(frame))
+		if err != nil {
+			t.Errorf("v%d: %v", version, err)
+			continue
+		}
+		body, ok := req.Body.(*FetchRequest)
+		if !ok || n != len(frame) || req.CorrelationID != 9 || req.ClientID != "consumer-1" {
+			t.Errorf("v%d: decoded %d bytes of %d as %+v", version, n, len(frame), req)
+			continue
+		}
+
+		want := "orders"
+		if version >= fetchTopicIDVersion {
+			want = "8f7e6d5c-4b3a-2918-0706-f5e4d3c2b1a0"
+		}
+		if topics := body.ExtractTopics(); len(topics) != 1 || topics[0] != want {
+			t.Errorf("v%d: topics %v, want %s", version, topics, want)
+		}
+		if block := body.blocks[want][0]; block == nil || block.fetchOffset != 42 {
+			t.Errorf("v%d: block %+v, want offset 42", version, block)
+		}
+		if version >= 7 && !reflect.DeepEqual(body.forgotten[want], []int32{1}) {
+			t.Errorf("v%d: forgotten %v, want partition 1", version, body.forgotten)
+		}
+		if version >= 11 && body.RackID != "rack-a" {
+			t.Errorf("v%d: rack %q", version, body.RackID)
+		}
+	}
+}
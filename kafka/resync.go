@@ -0,0 +1,250 @@
+package kafka
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+)
+
+// requestHeaderSize is the size of length, api key, api version, correlation id and client id length
+const requestHeaderSize = 14
+
+// maxClientIDLength is the longest client id accepted while searching for a frame boundary
+const maxClientIDLength = 255
+
+// RequestHeaderProbeSize is the count of bytes after which ProbeRequestHeader can tell for sure
+const RequestHeaderProbeSize = requestHeaderSize + maxClientIDLength
+
+// ProbeRequestHeader tells whether b starts with a plausible request frame: a sane length,
+// a known api key and version, a non negative correlation id and a printable client id.
+// It returns false when b is too short to tell.
+func ProbeRequestHeader(b []byte) bool {
+	clientIDLen, ok := probeFixedHeader(b)
+	if !ok || len(b) < requestHeaderSize+clientIDLen {
+		return false
+	}
+
+	for _, c := range b[requestHeaderSize : requestHeaderSize+clientIDLen] {
+		if c < 0x20 || c > 0x7e {
+			return false
+		}
+	}
+
+	return true
+}
+
+// probeFixedHeader checks the fixed size part of a request header and returns the client id length.
+func probeFixedHeader(b []byte) (clientIDLen int, ok bool) {
+	if len(b) < requestHeaderSize {
+		return 0, false
+	}
+
+	if !IsKnownAPI(DecodeKey(b), DecodeVersion(b)) {
+		return 0, false
+	}
+
+	if correlationID := DecodeCorrelationID(b); correlationID < 0 {
+		return 0, false
+	}
+
+	clientIDLen = int(int16(binary.BigEndian.Uint16(b[12:14])))
+	if clientIDLen == -1 { // null client id
+		clientIDLen = 0
+	} else if clientIDLen < 0 || clientIDLen > maxClientIDLength {
+		return 0, false
+	}
+
+	length := DecodeLength(b)
+	if length < int32(requestHeaderSize-4+clientIDLen) || length > MaxRequestSize {
+		return 0, false
+	}
+
+	return clientIDLen, true
+}
+
+// RequestReader decodes the requests sent on one connection. It starts with, and falls back after
+// any undecodable frame to, searching the stream for the next plausible frame header. This lets
+// connections opened before the capture or streams with lost segments get decoded again.
+type RequestReader struct {
+	r       *bufio.Reader
+	src     io.Reader
+	aligned bool
+
+	// lastCorrelationID is the correlation id of the last decoded frame, -1 when unknown.
+	lastCorrelationID int32
+
+	// OnResync is called with the count of bytes skipped to find the next frame boundary.
+	OnResync func(skipped int)
+}
+
+// NewRequestReader creates a RequestReader reading from src.
+func NewRequestReader(src io.Reader) *RequestReader {
+	return &RequestReader{
+		r:                 bufio.NewReaderSize(src, 2<<15), // 65k
+		src:               src,
+		lastCorrelationID: -1,
+	}
+}
+
+// Reset drops the buffered bytes, e.g. after a gap in the stream. The next request is resynchronized.
+func (rr *RequestReader) Reset() {
+	rr.r.Reset(rr.src)
+	rr.aligned = false
+}
+
+// Next decodes the next request and returns it with the count of bytes read.
+// Frames of request types which are not decoded are skipped and reported as PacketDecodingError,
+// returned with their header, see DecodeRequest.
+func (rr *RequestReader) Next() (*Request, int, error) {
+	if !rr.aligned {
+		if err := rr.resync(); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	head, err := rr.peekHeader()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if !ProbeRequestHeader(head) {
+		rr.aligned = false
+		return nil, 0, PacketDecodingError{"implausible request header, resynchronizing"}
+	}
+
+	// a frame which does not decode was not a request, its correlation id cannot order the next ones
+	req, n, err := DecodeRequest(rr.r)
+	if req != nil {
+		rr.lastCorrelationID = req.CorrelationID
+	}
+
+	return req, n, err
+}
+
+// peekHeader peeks the fixed part of the request header and, when it is plausible, the client id following it.
+// Implausible headers are not extended, so that garbage lengths never wait for bytes which might not come.
+func (rr *RequestReader) peekHeader() ([]byte, error) {
+	head, err := rr.r.Peek(requestHeaderSize)
+	if err != nil {
+		return nil, err
+	}
+
+	if clientIDLen, ok := probeFixedHeader(head); ok && clientIDLen > 0 {
+		return rr.r.Peek(requestHeaderSize + clientIDLen)
+	}
+
+	return head, nil
+}
+
+// resync discards bytes until the stream is positioned on a plausible frame header.
+// Once a correlation id was seen, the next frame must carry a larger one.
+func (rr *RequestReader) resync() error {
+	skipped := 0
+	defer func() {
+		if skipped > 0 && rr.OnResync != nil {
+			rr.OnResync(skipped)
+		}
+	}()
+
+	for {
+		head, err := rr.peekHeader()
+		if err != nil {
+			return err
+		}
+
+		correlationID := DecodeCorrelationID(head)
+		if ProbeRequestHeader(head) && (rr.lastCorrelationID < 0 || correlationID > rr.lastCorrelationID) && rr.confirm(head) {
+			rr.aligned = true
+			return nil
+		}
+
+		if _, err := rr.r.Discard(1); err != nil {
+			return err
+		}
+		skipped++
+	}
+}
+
+// confirm cross-checks a candidate frame: a frame of a decoded request type must decode, the start of
+// a produce request larger than the buffer included, and when the following bytes are already buffered,
+// they must start with a plausible header too.
+func (rr *RequestReader) confirm(head []byte) bool {
+	// runs of zero bytes look like a produce request without a client id
+	correlationID := DecodeCorrelationID(head)
+	clientIDLen := int16(binary.BigEndian.Uint16(head[12:14]))
+	if correlationID == 0 && clientIDLen <= 0 {
+		return false
+	}
+
+	key, version := DecodeKey(head), DecodeVersion(head)
+	frameLen := int(DecodeLength(head)) + 4
+	peekLen := frameLen
+	if peekLen > rr.r.Size() {
+		// only produce requests carry more than a buffer
+		if key != 0 {
+			return false
+		}
+		peekLen = rr.r.Size()
+	}
+
+	frame, err := rr.r.Peek(peekLen)
+	if err == io.EOF {
+		// the stream ends before the frame, which cannot decode
+		return false
+	} else if err != nil {
+		// let Next report the error
+		return true
+	}
+
+	if allocateBody(key, version) != nil {
+		req := &Request{BodyLength: int32(frameLen - 8), Key: key, Version: version, UsePreparedKeyVersion: true}
+		// the start of a frame larger than the buffer runs out of bytes, in the records of a named topic
+		// rather than in garbage array lengths
+		if err := Decode(frame[8:], req); err != nil &&
+			(len(frame) == frameLen || err != ErrInsufficientData || !namesTopic(req.Body)) {
+			return false
+		}
+	}
+
+	if buffered := rr.r.Buffered(); len(frame) == frameLen && buffered >= frameLen+requestHeaderSize {
+		next, _ := rr.r.Peek(frameLen + requestHeaderSize)
+		_, ok := probeFixedHeader(next[frameLen:])
+		return ok
+	}
+
+	return true
+}
+
+// namesTopic tells whether the produce request body decoded a legal topic name before running out of bytes.
+func namesTopic(body ProtocolBody) bool {
+	produce, ok := body.(*ProduceRequest)
+	if !ok {
+		return false
+	}
+
+	for topic := range produce.Records {
+		if isLegalTopic(topic) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// maxTopicLength is the longest topic name Kafka accepts
+const maxTopicLength = 249
+
+// isLegalTopic tells whether topic is made of the characters Kafka accepts in topic names.
+func isLegalTopic(topic string) bool {
+	if topic == "" || len(topic) > maxTopicLength {
+		return false
+	}
+
+	for _, c := range topic {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '.' || c == '_' || c == '-') {
+			return false
+		}
+	}
+
+	return true
+}
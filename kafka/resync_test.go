@@ -0,0 +1,158 @@
+package kafka
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+)
+
+// apiVersionsFrame is an ApiVersions v0 request of correlationID, without a body.
+func apiVersionsFrame(correlationID int32) []byte {
+	return requestFrame(18, 0, correlationID, "c1", false, nil)
+}
+
+func TestProbeRequestHeader(t *testing.T) {
+	frame := apiVersionsFrame(5)
+	with := func(offset int, b ...byte) []byte {
+		return append(append(append([]byte(nil), frame[:offset]...), b...), frame[offset+len(b):]...)
+	}
+
+	for _, tc := range []struct {
+		name string
+		head []byte
+		want bool
+	}{
+		{"request", frame, true},
+		{"flexible produce", requestFrame(0, 9, 1, "producer-1", true, nil), true},
+		{"null client id", with(12, 0xff, 0xff), true},
+		{"too short to tell", frame[:requestHeaderSize+1], false},
+		{"unknown api key", with(4, 0, 99), false},
+		{"version above the known ones", with(6, 0, 4), false},
+		{"negative correlation id", with(8, 0xff, 0xff, 0xff, 0xff), false},
+		{"length shorter than the header", with(0, 0, 0, 0, 9), false},
+		{"length above MaxRequestSize", with(0, 0x7f, 0xff, 0xff, 0xff), false},
+		{"client id above the longest one", with(12, 1, 0), false},
+		{"unprintable client id", with(14, '\n'), false},
+	} {
+		if got := ProbeRequestHeader(tc.head); got != tc.want {
+			t.Errorf("%s: probed %t, want %t", tc.name, got, tc.want)
+		}
+	}
+}
+
+// chunkReader reads the chunks one after the other, returning errGap between them as a stream with lost
+// segments does.
+type chunkReader struct {
+	chunks [][]byte
+}
+
+var errGap = errors.New("gap")
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	if len(r.chunks) == 0 {
+		return 0, io.EOF
+	}
+
+	if len(r.chunks[0]) == 0 {
+		r.chunks = r.chunks[1:]
+		if len(r.chunks) == 0 {
+			return 0, io.EOF
+		}
+		return 0, errGap
+	}
+
+	n := copy(p, r.chunks[0])
+	r.chunks[0] = r.chunks[0][n:]
+	return n, nil
+}
+
+// readRequests reads the requests of rr until io.EOF, resetting it after the gaps as the stream decoder does,
+// and returns the correlation ids of the decoded ones.
+func readRequests(t *testing.T, rr *RequestReader) []int32 {
+	t.Helper()
+
+	var ids []int32
+	for i := 0; i < 100; i++ {
+		req, _, err := rr.Next()
+		switch {
+		case err == io.EOF:
+			return ids
+		case errors.Is(err, errGap):
+			rr.Reset()
+		case err == nil:
+			ids = append(ids, req.CorrelationID)
+		}
+	}
+
+	t.Fatal("the reader never reached io.EOF")
+	return nil
+}
+
+func TestRequestReaderResync(t *testing.T) {
+	batch := recordBatch("a", "bc")
+	produce := requestFrame(0, 9, 21, "producer-1", true, produceBody(9, batch, "orders"))
+	fetch := requestFrame(1, 12, 22, "consumer-1", true, fetchBody(12, "orders"))
+	// a produce request larger than the buffer of the reader
+	large := requestFrame(0, 9, 40, "producer-1", true, produceBody(9, recordBatch(string(make([]byte, 100000))), "orders"))
+	join := func(b ...[]byte) []byte { return bytes.Join(b, nil) }
+
+	for _, tc := range []struct {
+		name    string
+		chunks  [][]byte
+		ids     []int32
+		skipped int
+	}{
+		{
+			name:   "aligned",
+			chunks: [][]byte{join(apiVersionsFrame(1), apiVersionsFrame(2))},
+			ids:    []int32{1, 2},
+		},
+		{
+			name:    "joined mid-frame",
+			chunks:  [][]byte{join(produce[10:], apiVersionsFrame(30), apiVersionsFrame(31))},
+			ids:     []int32{30, 31},
+			skipped: len(produce) - 10,
+		},
+		{
+			name: "gap",
+			// the end of the second frame and the start of the third are lost
+			chunks:  [][]byte{join(apiVersionsFrame(1), apiVersionsFrame(2)[:8]), join(apiVersionsFrame(3)[12:], apiVersionsFrame(4))},
+			ids:     []int32{1, 4},
+			skipped: len(apiVersionsFrame(3)) - 12,
+		},
+		{
+			name: "zero run",
+			// zeros after a length look like a produce request of correlation id 0 without a client id
+			chunks:  [][]byte{join([]byte{0, 0, 0, 40}, make([]byte, 60), apiVersionsFrame(1))},
+			ids:     []int32{1},
+			skipped: 64,
+		},
+		{
+			name:    "flexible produce and fetch",
+			chunks:  [][]byte{join(fetch[20:], produce, fetch)},
+			ids:     []int32{21, 22},
+			skipped: len(fetch) - 20,
+		},
+		{
+			name:    "produce larger than the buffer",
+			chunks:  [][]byte{join(fetch[20:], large, apiVersionsFrame(41))},
+			ids:     []int32{40, 41},
+			skipped: len(fetch) - 20,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			skipped := 0
+			rr := NewRequestReader(&chunkReader{chunks: tc.chunks})
+			rr.OnResync = func(n int) { skipped += n }
+
+			if ids := readRequests(t, rr); !reflect.DeepEqual(ids, tc.ids) {
+				t.Errorf("decoded %v, want %v", ids, tc.ids)
+			}
+			if skipped != tc.skipped {
+				t.Errorf("skipped %d bytes, want %d", skipped, tc.skipped)
+			}
+		})
+	}
+}
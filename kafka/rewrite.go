@@ -0,0 +1,211 @@
+package kafka
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// BrokerRewriter maps the address of a broker to the address clients shall connect to instead.
+type BrokerRewriter func(host string, port int32) (string, int32)
+
+// AnnouncesBrokers tells whether the responses to requests of api key carry broker addresses.
+func AnnouncesBrokers(key int16) bool {
+	return key == 3 || key == 10
+}
+
+// RewriteResponse rewrites the broker addresses announced by Metadata and FindCoordinator responses.
+// payload is the response frame without its length prefix, key and version are the ones of the request
+// it answers. Responses of other types are returned as is.
+func RewriteResponse(key, version int16, payload []byte, rewrite BrokerRewriter) ([]byte, error) {
+	var w *responseRewriter
+	switch key {
+	case 3:
+		w = &responseRewriter{in: payload, flexible: version >= 9, rewrite: rewrite}
+		w.metadata(version)
+	case 10:
+		w = &responseRewriter{in: payload, flexible: version >= 3, rewrite: rewrite}
+		w.findCoordinator(version)
+	default:
+		return payload, nil
+	}
+
+	if w.err != nil {
+		return nil, w.err
+	}
+
+	return append(w.out, w.in[w.mark:]...), nil
+}
+
+// responseRewriter copies the input while replacing broker hosts and ports.
+// Bytes between mark and off are read but not yet copied.
+type responseRewriter struct {
+	in        []byte
+	off, mark int
+	out       []byte
+	flexible  bool
+	rewrite   BrokerRewriter
+	err       error
+}
+
+func (w *responseRewriter) metadata(version int16) {
+	w.header()
+	if version >= 3 {
+		w.int32() // throttle_time_ms
+	}
+
+	brokers := w.arrayLength()
+	for i := 0; i < brokers && w.err == nil; i++ {
+		w.int32() // node_id
+		w.broker()
+		if version >= 1 {
+			w.nullableString() // rack
+		}
+		w.taggedFields()
+	}
+}
+
+func (w *responseRewriter) findCoordinator(version int16) {
+	w.header()
+	if version >= 1 {
+		w.int32() // throttle_time_ms
+	}
+
+	if version < 4 {
+		w.int16() // error_code
+		if version >= 1 {
+			w.nullableString() // error_message
+		}
+		w.int32() // node_id
+		w.broker()
+		return
+	}
+
+	coordinators := w.arrayLength()
+	for i := 0; i < coordinators && w.err == nil; i++ {
+		w.string()         // key
+		w.int32()          // node_id
+		w.broker()         // host, port
+		w.int16()          // error_code
+		w.nullableString() // error_message
+		w.taggedFields()
+	}
+}
+
+// header skips the response header: the correlation id and, for flexible versions, the tagged fields.
+func (w *responseRewriter) header() {
+	w.int32()
+	w.taggedFields()
+}
+
+// broker replaces the host and port fields at the current offset.
+func (w *responseRewriter) broker() {
+	w.out = append(w.out, w.in[w.mark:w.off]...)
+	host := w.string()
+	port := w.int32()
+	if w.err != nil {
+		return
+	}
+	w.mark = w.off
+
+	host, port = w.rewrite(host, port)
+
+	var buf [binary.MaxVarintLen64]byte
+	if w.flexible {
+		w.out = append(w.out, buf[:binary.PutUvarint(buf[:], uint64(len(host)+1))]...)
+	} else {
+		binary.BigEndian.PutUint16(buf[:], uint16(len(host)))
+		w.out = append(w.out, buf[:2]...)
+	}
+	w.out = append(w.out, host...)
+
+	binary.BigEndian.PutUint32(buf[:], uint32(port))
+	w.out = append(w.out, buf[:4]...)
+}
+
+func (w *responseRewriter) skip(n int) []byte {
+	if w.err != nil {
+		return nil
+	}
+	if n < 0 || w.off+n > len(w.in) {
+		w.err = ErrInsufficientData
+		return nil
+	}
+
+	b := w.in[w.off : w.off+n]
+	w.off += n
+	return b
+}
+
+func (w *responseRewriter) int16() int16 {
+	if b := w.skip(2); b != nil {
+		return int16(binary.BigEndian.Uint16(b))
+	}
+	return 0
+}
+
+func (w *responseRewriter) int32() int32 {
+	if b := w.skip(4); b != nil {
+		return int32(binary.BigEndian.Uint32(b))
+	}
+	return 0
+}
+
+func (w *responseRewriter) uvarint() uint64 {
+	if w.err != nil {
+		return 0
+	}
+
+	v, n := binary.Uvarint(w.in[w.off:])
+	if n <= 0 {
+		w.err = errVarintOverflow
+		return 0
+	}
+	w.off += n
+	return v
+}
+
+func (w *responseRewriter) arrayLength() int {
+	if w.flexible {
+		return int(w.uvarint()) - 1
+	}
+	return int(w.int32())
+}
+
+func (w *responseRewriter) string() string {
+	var n int
+	if w.flexible {
+		n = int(w.uvarint()) - 1
+	} else {
+		n = int(w.int16())
+	}
+
+	if n < 0 && w.err == nil {
+		w.err = PacketDecodingError{fmt.Sprintf("invalid string length %d", n)}
+	}
+	return string(w.skip(n))
+}
+
+func (w *responseRewriter) nullableString() {
+	var n int
+	if w.flexible {
+		n = int(w.uvarint()) - 1
+	} else {
+		n = int(w.int16())
+	}
+
+	if n > 0 {
+		w.skip(n)
+	}
+}
+
+func (w *responseRewriter) taggedFields() {
+	if !w.flexible {
+		return
+	}
+
+	fields := w.uvarint()
+	for i := uint64(0); i < fields && w.err == nil; i++ {
+		w.uvarint() // tag
+		w.skip(int(w.uvarint()))
+	}
+}
@@ -0,0 +1,128 @@
+package kafka
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/twmb/franz-go/pkg/kmsg"
+)
+
+// announcedBrokers are the hosts and ports of the brokers in the responses of the tests.
+var announcedBrokers = []struct {
+	host string
+	port int32
+}{{"broker-1.kafka.internal", 9092}, {"b2", 9093}}
+
+// proxyRewriter announces a proxy listener for every broker, whose host is long enough to need
+// a compact length of two bytes.
+func proxyRewriter(host string, port int32) (string, int32) {
+	return strings.Repeat("p", 120) + "-" + host, port + 10000
+}
+
+func noRewrite(host string, port int32) (string, int32) {
+	return host, port
+}
+
+// metadataResponse is a Metadata response of version announcing the brokers as rewrite maps them.
+func metadataResponse(version int16, rewrite BrokerRewriter) kmsg.Response {
+	rack, cluster, topic := "rack-a", "cluster-1", "orders"
+
+	resp := kmsg.NewPtrMetadataResponse()
+	resp.Version = version
+	for i, b := range announcedBrokers {
+		broker := kmsg.NewMetadataResponseBroker()
+		broker.NodeID = int32(i + 1)
+		broker.Host, broker.Port = rewrite(b.host, b.port)
+		broker.Rack = &rack
+		resp.Brokers = append(resp.Brokers, broker)
+	}
+	resp.ClusterID, resp.ControllerID = &cluster, 1
+
+	// the topics follow the brokers and are relayed as is
+	t := kmsg.NewMetadataResponseTopic()
+	t.Topic = &topic
+	p := kmsg.NewMetadataResponseTopicPartition()
+	p.Leader, p.Replicas, p.ISR = 1, []int32{1, 2}, []int32{1, 2}
+	t.Partitions = append(t.Partitions, p)
+	resp.Topics = append(resp.Topics, t)
+
+	return resp
+}
+
+// findCoordinatorResponse is a FindCoordinator response of version announcing the first broker, and the second
+// one too from version 4 which looks up several coordinators at once, as rewrite maps them.
+func findCoordinatorResponse(version int16, rewrite BrokerRewriter) kmsg.Response {
+	resp := kmsg.NewPtrFindCoordinatorResponse()
+	resp.Version = version
+	if version < 4 {
+		resp.NodeID = 1
+		resp.Host, resp.Port = rewrite(announcedBrokers[0].host, announcedBrokers[0].port)
+		return resp
+	}
+
+	for i, b := range announcedBrokers {
+		coordinator := kmsg.NewFindCoordinatorResponseCoordinator()
+		coordinator.Key = "group-" + string(rune('a'+i))
+		coordinator.NodeID = int32(i + 1)
+		coordinator.Host, coordinator.Port = rewrite(b.host, b.port)
+		resp.Coordinators = append(resp.Coordinators, coordinator)
+	}
+
+	return resp
+}
+
+// responsePayload is the frame of resp without its length: the correlation id, the tagged fields
+// of the flexible versions and the body.
+func responsePayload(correlationID int32, resp kmsg.Response) []byte {
+	p := &packet{}
+	p.int32(correlationID).tagged(resp.IsFlexible())
+
+	return resp.AppendTo(p.b)
+}
+
+func TestRewriteResponse(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		version  int16
+		response func(version int16, rewrite BrokerRewriter) kmsg.Response
+	}{
+		{"metadata v0", 0, metadataResponse},
+		{"metadata v1", 1, metadataResponse},
+		{"metadata v8", 8, metadataResponse},
+		{"metadata v9 flexible", 9, metadataResponse},
+		{"metadata v12 flexible", 12, metadataResponse},
+		{"find coordinator v0", 0, findCoordinatorResponse},
+		{"find coordinator v3 flexible", 3, findCoordinatorResponse},
+		{"find coordinator v4 batched", 4, findCoordinatorResponse},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := tc.response(tc.version, noRewrite)
+			payload := responsePayload(7, resp)
+			want := responsePayload(7, tc.response(tc.version, proxyRewriter))
+
+			got, err := RewriteResponse(resp.Key(), tc.version, payload, proxyRewriter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Fatalf("rewrote\n%x\nwant\n%x", got, want)
+			}
+
+			// the rewritten response decodes
+			header := 4
+			if resp.IsFlexible() {
+				header++
+			}
+			decoded := tc.response(tc.version, noRewrite)
+			if err := decoded.ReadFrom(got[header:]); err != nil {
+				t.Fatalf("decode the rewritten response: %v", err)
+			}
+
+			// cut in the first broker
+			if _, err := RewriteResponse(resp.Key(), tc.version, payload[:12], proxyRewriter); err == nil {
+				t.Error("rewrote a truncated response")
+			}
+		})
+	}
+}
@@ -0,0 +1,88 @@
+package metrics
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// Assembly contains the metrics of the reassembly of the TCP streams.
+type Assembly struct {
+	// AssemblyQueueDepth is a prometheus metric. See info field
+	AssemblyQueueDepth *prometheus.GaugeVec
+	// AssemblyDroppedPackets is a prometheus metric. See info field
+	AssemblyDroppedPackets *prometheus.CounterVec
+	// TCPRejectedPackets is a prometheus metric. See info field
+	TCPRejectedPackets *prometheus.CounterVec
+	// TCPOverlapPackets is a prometheus metric. See info field
+	TCPOverlapPackets prometheus.Counter
+	// TCPOverlapBytes is a prometheus metric. See info field
+	TCPOverlapBytes prometheus.Counter
+	// TCPGaps is a prometheus metric. See info field
+	TCPGaps prometheus.Counter
+	// TCPMissingBytes is a prometheus metric. See info field
+	TCPMissingBytes prometheus.Counter
+	// ResyncSkippedBytes is a prometheus metric. See info field
+	ResyncSkippedBytes prometheus.Counter
+	// ProxyHeaders is a prometheus metric. See info field
+	ProxyHeaders *prometheus.CounterVec
+	// RelayDroppedRequests is a prometheus metric. See info field
+	RelayDroppedRequests prometheus.Counter
+}
+
+func newAssembly() Assembly {
+	return Assembly{
+		AssemblyQueueDepth: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "assembly_queue_depth",
+			Help:      "Number of packets waiting in the queue of a reassembly shard",
+		}, []string{"shard"}),
+		AssemblyDroppedPackets: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "assembly_dropped_packets_total",
+			Help:      "Total packets dropped because the queue of a reassembly shard was full",
+		}, []string{"shard"}),
+		TCPRejectedPackets: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "tcp_rejected_packets_total",
+			Help:      "Total TCP packets rejected by the connection state machine or the TCP option checks",
+		}, []string{"reason"}),
+		TCPOverlapPackets: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "tcp_overlap_packets_total",
+			Help:      "Total retransmitted or overlapping TCP packets",
+		}),
+		TCPOverlapBytes: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "tcp_overlap_bytes_total",
+			Help:      "Total bytes of retransmitted or overlapping TCP packets",
+		}),
+		TCPGaps: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "tcp_gaps_total",
+			Help:      "Total missing TCP segments which forced the decoder to skip data",
+		}),
+		TCPMissingBytes: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "tcp_missing_bytes_total",
+			Help:      "Total bytes of missing TCP segments",
+		}),
+		ResyncSkippedBytes: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "resync_skipped_bytes_total",
+			Help:      "Total bytes skipped to find the next request frame boundary",
+		}),
+		ProxyHeaders: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "proxy_headers_total",
+			Help:      "Total connections starting with a PROXY protocol header by version, or invalid",
+		}, []string{"version"}),
+		RelayDroppedRequests: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "relay_dropped_requests_total",
+			Help:      "Total requests relayed by the proxy but not decoded because the queue of the decoder was full",
+		}),
+	}
+}
+
+func (a Assembly) collectors() []prometheus.Collector {
+	return []prometheus.Collector{a.AssemblyQueueDepth, a.AssemblyDroppedPackets, a.TCPRejectedPackets,
+		a.TCPOverlapPackets, a.TCPOverlapBytes, a.TCPGaps, a.TCPMissingBytes, a.ResyncSkippedBytes, a.ProxyHeaders,
+		a.RelayDroppedRequests}
+}
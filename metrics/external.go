@@ -2,41 +2,50 @@ package metrics
 
 import "github.com/prometheus/client_golang/prometheus"
 
-var (
+// Clients contains the metrics of the requests of the clients.
+type Clients struct {
 	// RequestsCount is a prometheus metric. See info field
-	RequestsCount = prometheus.NewCounterVec(prometheus.CounterOpts{
-		Namespace: namespace,
-		Name:      "typed_requests_total",
-		Help:      "Total requests to kafka by type",
-	}, []string{"client_ip", "request_type"})
-
+	RequestsCount *prometheus.CounterVec
+	// RequestBytes is a prometheus metric. See info field
+	RequestBytes *prometheus.CounterVec
 	// ProducerBatchLen is a prometheus metric. See info field
-	ProducerBatchLen = prometheus.NewCounterVec(prometheus.CounterOpts{
-		Namespace: namespace,
-		Name:      "producer_batch_length",
-		Help:      "Length of producer request batch to kafka",
-	}, []string{"client_ip"})
-
+	ProducerBatchLen *prometheus.CounterVec
 	// ProducerBatchSize is a prometheus metric. See info field
-	ProducerBatchSize = prometheus.NewCounterVec(prometheus.CounterOpts{
-		Namespace: namespace,
-		Name:      "producer_batch_size",
-		Help:      "Total size of a batch in producer request to kafka",
-	}, []string{"client_ip"})
-
+	ProducerBatchSize *prometheus.CounterVec
 	// BlocksRequested is a prometheus metric. See info field
-	BlocksRequested = prometheus.NewCounterVec(prometheus.CounterOpts{
-		Namespace: namespace,
-		Name:      "blocks_requested",
-		Help:      "Total size of a batch in producer request to kafka",
-	}, []string{"client_ip"})
-)
+	BlocksRequested *prometheus.CounterVec
+}
 
-func init() {
-	prometheus.MustRegister(RequestsCount, ProducerBatchLen, ProducerBatchSize, BlocksRequested)
+func newClients() Clients {
+	return Clients{
+		RequestsCount: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "typed_requests_total",
+			Help:      "Total requests to kafka by type",
+		}, []string{"client_ip", "request_type"}),
+		RequestBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "request_bytes_total",
+			Help:      "Total bytes of the requests to kafka by type",
+		}, []string{"client_ip", "request_type"}),
+		ProducerBatchLen: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "producer_batch_length",
+			Help:      "Length of producer request batch to kafka",
+		}, []string{"client_ip"}),
+		ProducerBatchSize: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "producer_batch_size",
+			Help:      "Total size of a batch in producer request to kafka",
+		}, []string{"client_ip"}),
+		BlocksRequested: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "blocks_requested",
+			Help:      "Total size of a batch in producer request to kafka",
+		}, []string{"client_ip"}),
+	}
 }
 
-// ClientMetricsCollector is an interface, which allows to collect metrics for concrete client
-type ClientMetricsCollector interface {
-	CollectClientMetrics(srcHost string)
+func (c Clients) collectors() []prometheus.Collector {
+	return []prometheus.Collector{c.RequestsCount, c.RequestBytes, c.ProducerBatchLen, c.ProducerBatchSize, c.BlocksRequested}
 }
@@ -6,14 +6,14 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 )
 
-var buildInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-	Namespace: namespace,
-	Name:      "build_info",
-	Help:      "Kafka sniffer build info",
-}, []string{"version", "revision", "branch"})
-
-func init() {
-	prometheus.MustRegister(buildInfo)
+func newBuildInfo() *prometheus.GaugeVec {
+	buildInfo := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "build_info",
+		Help:      "Kafka sniffer build info",
+	}, []string{"version", "revision", "branch"})
 
 	buildInfo.WithLabelValues(version.Version, version.Revision, version.Branch)
+
+	return buildInfo
 }
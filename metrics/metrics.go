@@ -0,0 +1,43 @@
+package metrics
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// Metrics contains the prometheus metrics of a sniffer. Every sniffer has its own, so that
+// several of them run in one process when each registers with another registry.
+type Metrics struct {
+	Assembly
+	Security
+	Clients
+	Topics
+
+	buildInfo *prometheus.GaugeVec
+}
+
+// New creates the metrics and registers them with registerer. Without a registerer,
+// the metrics are not exported, e.g. to be gathered by tests.
+func New(registerer prometheus.Registerer) *Metrics {
+	m := &Metrics{
+		Assembly:  newAssembly(),
+		Security:  newSecurity(),
+		Clients:   newClients(),
+		Topics:    newTopics(),
+		buildInfo: newBuildInfo(),
+	}
+
+	if registerer != nil {
+		registerer.MustRegister(m.Collectors()...)
+	}
+
+	return m
+}
+
+// Collectors returns all the metrics, e.g. to register them with another registry.
+func (m *Metrics) Collectors() []prometheus.Collector {
+	var cs []prometheus.Collector
+	cs = append(cs, m.Assembly.collectors()...)
+	cs = append(cs, m.Security.collectors()...)
+	cs = append(cs, m.Clients.collectors()...)
+	cs = append(cs, m.Topics.collectors()...)
+
+	return append(cs, m.buildInfo)
+}
@@ -0,0 +1,132 @@
+package metrics
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bingoohuang/kafka-sniffer/clock"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestNewRegistersWithRegistry(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	m := New(registry)
+
+	m.RequestsCount.WithLabelValues("10.0.0.1", "fetch").Inc()
+	m.RequestBytes.WithLabelValues("10.0.0.1", "fetch").Add(120)
+	m.TopicRequestsCount.WithLabelValues("orders", "fetch").Inc()
+
+	families := gather(t, registry)
+	for _, name := range []string{
+		"kafka_sniffer_build_info",
+		"kafka_sniffer_typed_requests_total",
+		"kafka_sniffer_request_bytes_total",
+		"kafka_sniffer_topic_requests_total",
+	} {
+		if families[name] == nil {
+			t.Errorf("metric %s not gathered", name)
+		}
+	}
+
+	bytes := families["kafka_sniffer_request_bytes_total"].GetMetric()
+	if len(bytes) != 1 || bytes[0].GetCounter().GetValue() != 120 {
+		t.Errorf("request bytes gathered %v, want 120", bytes)
+	}
+	if got := labels(bytes[0]); got["client_ip"] != "10.0.0.1" || got["request_type"] != "fetch" {
+		t.Errorf("request bytes labelled %v", got)
+	}
+}
+
+func TestInstancesAreIndependent(t *testing.T) {
+	r1, r2 := prometheus.NewRegistry(), prometheus.NewRegistry()
+
+	// registering the same metrics twice with one registry panics, with two registries it must not
+	m1, m2 := New(r1), New(r2)
+	s1 := NewStorage(r1, time.Minute, 0, clock.Wall)
+	defer s1.Close()
+	s2 := NewStorage(r2, time.Minute, 0, clock.Wall)
+	defer s2.Close()
+
+	m1.RequestsCount.WithLabelValues("10.0.0.1", "produce").Add(3)
+	m2.RequestsCount.WithLabelValues("10.0.0.2", "produce").Add(5)
+	s1.AddActiveConnectionsTotal("10.0.0.1", "")
+
+	for registry, want := range map[*prometheus.Registry]float64{r1: 3, r2: 5} {
+		families := gather(t, registry)
+		requests := families["kafka_sniffer_typed_requests_total"].GetMetric()
+		if len(requests) != 1 || requests[0].GetCounter().GetValue() != want {
+			t.Errorf("requests gathered %v, want only %v", requests, want)
+		}
+	}
+
+	if gather(t, r1)["kafka_sniffer_active_connections_total"] == nil {
+		t.Error("active connections of the first storage not gathered")
+	}
+	if gather(t, r2)["kafka_sniffer_active_connections_total"] != nil {
+		t.Error("active connections of the first storage gathered by the second registry")
+	}
+}
+
+func TestNewWithoutRegisterer(t *testing.T) {
+	m := New(nil)
+	m.RequestsCount.WithLabelValues("10.0.0.1", "fetch").Inc()
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(m.Collectors()...)
+	if gather(t, registry)["kafka_sniffer_typed_requests_total"] == nil {
+		t.Error("collectors of unregistered metrics not gathered")
+	}
+}
+
+func gather(t *testing.T, g prometheus.Gatherer) map[string]*dto.MetricFamily {
+	t.Helper()
+
+	families, err := g.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	byName := make(map[string]*dto.MetricFamily, len(families))
+	for _, f := range families {
+		byName[f.GetName()] = f
+	}
+
+	return byName
+}
+
+func labels(m *dto.Metric) map[string]string {
+	ret := map[string]string{}
+	for _, l := range m.GetLabel() {
+		ret[l.GetName()] = l.GetValue()
+	}
+
+	return ret
+}
+
+func TestStorageExpiresByPacketTime(t *testing.T) {
+	start := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	c := clock.NewPacket()
+	c.Observe(start)
+
+	registry := prometheus.NewRegistry()
+	s := NewStorage(registry, time.Minute, 0, c)
+	defer s.Close()
+
+	s.AddActiveConnectionsTotal("10.0.0.1", "")
+	s.AddProducerTopicRelationInfo("10.0.0.1", "orders", "")
+
+	// the replay goes on faster than the wall clock, the sweep is due by the time of the packets
+	c.Observe(start.Add(2 * time.Minute))
+	s.AddActiveConnectionsTotal("10.0.0.2", "")
+
+	families := gather(t, registry)
+	if families["kafka_sniffer_producer_topic_relation_info"] != nil {
+		t.Error("expired producer relation still gathered")
+	}
+	connections := families["kafka_sniffer_active_connections_total"].GetMetric()
+	if len(connections) != 1 || labels(connections[0])["client_ip"] != "10.0.0.2" {
+		t.Errorf("active connections %v, want only 10.0.0.2", connections)
+	}
+}
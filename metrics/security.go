@@ -0,0 +1,37 @@
+package metrics
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// Security contains the metrics of the TLS connections.
+type Security struct {
+	// TLSConnections is a prometheus metric. See info field
+	TLSConnections *prometheus.CounterVec
+	// SecurityMismatches is a prometheus metric. See info field
+	SecurityMismatches *prometheus.CounterVec
+	// TLSDecryptions is a prometheus metric. See info field
+	TLSDecryptions *prometheus.CounterVec
+}
+
+func newSecurity() Security {
+	return Security{
+		TLSConnections: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "tls_connections_total",
+			Help:      "Total TLS connections to brokers by offered TLS version",
+		}, []string{"version"}),
+		SecurityMismatches: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "security_mismatches_total",
+			Help:      "Total connections speaking plaintext to a TLS port or TLS to a plaintext port",
+		}, []string{"port", "expected", "actual"}),
+		TLSDecryptions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "tls_decryptions_total",
+			Help:      "Total TLS connections decrypted with the key log or failed to",
+		}, []string{"result"}),
+	}
+}
+
+func (s Security) collectors() []prometheus.Collector {
+	return []prometheus.Collector{s.TLSConnections, s.SecurityMismatches, s.TLSDecryptions}
+}
@@ -1,15 +1,21 @@
 package metrics
 
 import (
+	"container/list"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/bingoohuang/kafka-sniffer/clock"
+
 	"github.com/prometheus/client_golang/prometheus"
 )
 
 const namespace = "kafka_sniffer"
 
+// maxSweepInterval bounds how late the label sets are removed after they expired.
+const maxSweepInterval = time.Minute
+
 // Storage contains prometheus metrics that have expiration time. When expiration time is exceeded,
 // metric with specific labels is removed from storage. It is needed to keep only fresh producer,
 // topic and consumer relations.
@@ -17,154 +23,210 @@ type Storage struct {
 	producerTopicRelationInfo *metric
 	consumerTopicRelationInfo *metric
 	activeConnectionsTotal    *metric
+
+	evictions *prometheus.CounterVec
+	clock     clock.Clock
+	sweep     *clock.Schedule
+	quit      chan struct{}
+	closeOnce sync.Once
 }
 
-// NewStorage creates new Storage
-func NewStorage(registerer prometheus.Registerer, expireTime time.Duration) *Storage {
+// NewStorage creates new Storage. Every metric keeps at most maxCardinality label sets, the least
+// recently seen ones are evicted beyond it. maxCardinality 0 keeps them all until they expire.
+// The label sets are seen and expire at the time of c, e.g. of the captured packets.
+func NewStorage(registerer prometheus.Registerer, expireTime time.Duration, maxCardinality int, c clock.Clock) *Storage {
+	evictions := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "metric_evictions_total",
+		Help:      "Total label sets removed from the relation metrics because they expired or the metric was full",
+	}, []string{"metric", "reason"})
+
 	var s = &Storage{
-		producerTopicRelationInfo: newMetric(prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		producerTopicRelationInfo: newMetric(prometheus.GaugeOpts{
 			Namespace: namespace,
 			Name:      "producer_topic_relation_info",
 			Help:      "Relation information between producer and topic",
-		}, []string{"client_ip", "topic"}), expireTime),
-		consumerTopicRelationInfo: newMetric(prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		}, []string{"client_ip", "topic", "tunnel"}, expireTime, maxCardinality, evictions),
+		consumerTopicRelationInfo: newMetric(prometheus.GaugeOpts{
 			Namespace: namespace,
 			Name:      "consumer_topic_relation_info",
 			Help:      "Relation information between consumer and topic",
-		}, []string{"client_ip", "topic"}), expireTime),
-		activeConnectionsTotal: newMetric(prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		}, []string{"client_ip", "topic", "tunnel"}, expireTime, maxCardinality, evictions),
+		activeConnectionsTotal: newMetric(prometheus.GaugeOpts{
 			Namespace: namespace,
 			Name:      "active_connections_total",
 			Help:      "Contains total count of active connections",
-		}, []string{"client_ip"}), expireTime),
+		}, []string{"client_ip", "tunnel"}, expireTime, maxCardinality, evictions),
+		evictions: evictions,
+		clock:     c,
+		sweep:     clock.NewSchedule(c, sweepInterval(expireTime)),
+		quit:      make(chan struct{}),
 	}
 
 	registerer.MustRegister(
 		s.producerTopicRelationInfo.promMetric,
 		s.consumerTopicRelationInfo.promMetric,
 		s.activeConnectionsTotal.promMetric,
+		s.evictions,
 	)
 
+	go s.runExpiration(sweepInterval(expireTime))
+
 	return s
 }
 
-// AddProducerTopicRelationInfo adds (producer, topic) pair to metrics
-func (s *Storage) AddProducerTopicRelationInfo(producer, topic string) {
-	s.producerTopicRelationInfo.set(producer, topic)
+// AddProducerTopicRelationInfo adds (producer, topic) pair to metrics.
+// tunnel is the encapsulation of the producer's traffic, empty when it is not encapsulated.
+func (s *Storage) AddProducerTopicRelationInfo(producer, topic, tunnel string) {
+	s.producerTopicRelationInfo.set(s.clock.Now(), producer, topic, tunnel)
+	s.expireIfDue()
 }
 
 // AddConsumerTopicRelationInfo adds (consumer, topic) pair to metrics
-func (s *Storage) AddConsumerTopicRelationInfo(consumer, topic string) {
-	s.consumerTopicRelationInfo.set(consumer, topic)
+func (s *Storage) AddConsumerTopicRelationInfo(consumer, topic, tunnel string) {
+	s.consumerTopicRelationInfo.set(s.clock.Now(), consumer, topic, tunnel)
+	s.expireIfDue()
 }
 
 // AddActiveConnectionsTotal adds incoming connection
-func (s *Storage) AddActiveConnectionsTotal(clientIP string) {
-	s.activeConnectionsTotal.inc(clientIP)
+func (s *Storage) AddActiveConnectionsTotal(clientIP, tunnel string) {
+	s.activeConnectionsTotal.inc(s.clock.Now(), clientIP, tunnel)
+	s.expireIfDue()
 }
 
-// metric contains expiration functionality
-type metric struct {
-	promMetric *prometheus.GaugeVec
-	expireTime time.Duration
-
-	expCh chan []string
-
-	mux       sync.Mutex
-	relations map[string]*relation
+// Close stops the expiration, the metrics keep their label sets.
+func (s *Storage) Close() {
+	s.closeOnce.Do(func() { close(s.quit) })
 }
 
-func newMetric(promMetric *prometheus.GaugeVec, expireTime time.Duration) *metric {
-	m := &metric{
-		promMetric: promMetric,
-		expireTime: expireTime,
+// runExpiration checks the sweep while no label sets are added, e.g. when the traffic stopped.
+func (s *Storage) runExpiration(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
 
-		relations: make(map[string]*relation),
-		expCh:     make(chan []string),
+	for {
+		select {
+		case <-s.quit:
+			return
+		case <-ticker.C:
+			s.expireIfDue()
+		}
 	}
+}
 
-	go m.runExpiration()
+// expireIfDue removes the expired label sets of all the metrics every sweep interval of the time of the clock,
+// checked whenever a label set is added.
+func (s *Storage) expireIfDue() {
+	now, ok := s.sweep.Due()
+	if !ok {
+		return
+	}
 
-	return m
+	s.producerTopicRelationInfo.expire(now)
+	s.consumerTopicRelationInfo.expire(now)
+	s.activeConnectionsTotal.expire(now)
 }
 
-func (m *metric) set(labels ...string) {
-	m.promMetric.WithLabelValues(labels...).Set(float64(1))
+// sweepInterval checks several times per expireTime, the label sets live at most an interval longer.
+func sweepInterval(expireTime time.Duration) time.Duration {
+	interval := expireTime / 4
+	if interval > maxSweepInterval {
+		return maxSweepInterval
+	}
+	if interval <= 0 {
+		return time.Millisecond
+	}
 
-	m.update(labels...)
+	return interval
 }
 
-func (m *metric) inc(labels ...string) {
-	m.promMetric.WithLabelValues(labels...).Inc()
+// metric contains expiration functionality
+type metric struct {
+	name           string
+	promMetric     *prometheus.GaugeVec
+	expireTime     time.Duration
+	maxCardinality int
+	evictions      *prometheus.CounterVec
 
-	m.update(labels...)
+	mux       sync.Mutex
+	relations map[string]*list.Element
+	// seen orders the relations from the least to the most recently seen
+	seen *list.List
 }
 
-// update updates relations or creates new one
-func (m *metric) update(labels ...string) {
-	m.mux.Lock()
-	defer m.mux.Unlock()
-	if r, ok := m.relations[genLabelKey(labels...)]; ok {
-		r.refresh()
-	} else {
-		m.relations[genLabelKey(labels...)] = newRelation(m.expireTime, labels, m.expCh)
+// relation contains metric labels and the time they were last seen
+type relation struct {
+	key      string
+	labels   []string
+	lastSeen time.Time
+}
+
+func newMetric(opts prometheus.GaugeOpts, labelNames []string, expireTime time.Duration, maxCardinality int,
+	evictions *prometheus.CounterVec) *metric {
+	return &metric{
+		name:           opts.Name,
+		promMetric:     prometheus.NewGaugeVec(opts, labelNames),
+		expireTime:     expireTime,
+		maxCardinality: maxCardinality,
+		evictions:      evictions,
+
+		relations: make(map[string]*list.Element),
+		seen:      list.New(),
 	}
 }
 
-// runExpiration removes metric by specific label values and removes relation
-func (m *metric) runExpiration() {
-	for labels := range m.expCh {
-		m.promMetric.DeleteLabelValues(labels...)
+func (m *metric) set(now time.Time, labels ...string) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
 
-		// remove relation
-		m.mux.Lock()
-		delete(m.relations, genLabelKey(labels...))
-		m.mux.Unlock()
-	}
+	m.update(now, labels...)
+	m.promMetric.WithLabelValues(labels...).Set(float64(1))
 }
 
-// relation contains metric labels and expiration time
-type relation struct {
-	expireTime time.Duration
-
-	labels []string
-	expCh  chan []string
+func (m *metric) inc(now time.Time, labels ...string) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
 
-	mux   sync.Mutex
-	timer *time.Timer
+	m.update(now, labels...)
+	m.promMetric.WithLabelValues(labels...).Inc()
 }
 
-func newRelation(expireTime time.Duration, labels []string, expCh chan []string) *relation {
-	var rel = relation{
-		expireTime: expireTime,
-		labels:     labels,
-		expCh:      expCh,
+// update refreshes the relation seen at now or creates new one, evicting the least recently seen beyond
+// maxCardinality. The caller holds m.mux.
+func (m *metric) update(now time.Time, labels ...string) {
+	key := genLabelKey(labels...)
+	if e, ok := m.relations[key]; ok {
+		e.Value.(*relation).lastSeen = now
+		m.seen.MoveToBack(e)
+		return
 	}
 
-	go rel.run()
+	if m.maxCardinality > 0 && m.seen.Len() >= m.maxCardinality {
+		m.remove(m.seen.Front(), "cardinality")
+	}
 
-	return &rel
+	m.relations[key] = m.seen.PushBack(&relation{key: key, labels: labels, lastSeen: now})
 }
 
-// run runs expiration with specific timer
-func (c *relation) run() {
-	c.refresh()
+// expire removes the relations not seen for expireTime, and their label sets from the metric.
+func (m *metric) expire(now time.Time) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
 
-	<-c.timer.C
-	c.expCh <- c.labels
+	for e := m.seen.Front(); e != nil && now.Sub(e.Value.(*relation).lastSeen) >= m.expireTime; e = m.seen.Front() {
+		m.remove(e, "expired")
+	}
 }
 
-// refresh resets timer or create new one
-func (c *relation) refresh() {
-	c.mux.Lock()
-	defer c.mux.Unlock()
-	if c.timer == nil {
-		c.timer = time.NewTimer(c.expireTime)
-	} else {
-		c.timer.Reset(c.expireTime)
-	}
+// remove removes the relation of e. The caller holds m.mux.
+func (m *metric) remove(e *list.Element, reason string) {
+	r := m.seen.Remove(e).(*relation)
+	delete(m.relations, r.key)
+	m.promMetric.DeleteLabelValues(r.labels...)
+	m.evictions.WithLabelValues(m.name, reason).Inc()
 }
 
 func genLabelKey(labels ...string) string {
-	return strings.Join(labels, "_")
+	// label values may contain any separator but NUL
+	return strings.Join(labels, "\x00")
 }
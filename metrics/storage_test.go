@@ -0,0 +1,52 @@
+package metrics
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/bingoohuang/kafka-sniffer/clock"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestStorageEvictsLeastRecentlySeen(t *testing.T) {
+	const maxCardinality = 3
+	start := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	c := clock.NewPacket()
+	c.Observe(start)
+
+	registry := prometheus.NewRegistry()
+	s := NewStorage(registry, time.Hour, maxCardinality, c)
+	defer s.Close()
+
+	for i, ip := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"} {
+		c.Observe(start.Add(time.Duration(i) * time.Second))
+		s.AddActiveConnectionsTotal(ip, "")
+	}
+	// seen again, the second one is now the least recently seen
+	c.Observe(start.Add(3 * time.Second))
+	s.AddActiveConnectionsTotal("10.0.0.1", "")
+
+	// one label set more than maxCardinality
+	c.Observe(start.Add(4 * time.Second))
+	s.AddActiveConnectionsTotal("10.0.0.4", "")
+
+	var ips []string
+	for _, m := range gather(t, registry)["kafka_sniffer_active_connections_total"].GetMetric() {
+		ips = append(ips, labels(m)["client_ip"])
+	}
+	sort.Strings(ips)
+	if want := []string{"10.0.0.1", "10.0.0.3", "10.0.0.4"}; !reflect.DeepEqual(ips, want) {
+		t.Errorf("active connections of %v, want %v", ips, want)
+	}
+
+	if got := testutil.ToFloat64(s.evictions.WithLabelValues("active_connections_total", "cardinality")); got != 1 {
+		t.Errorf("%v label sets evicted for the cardinality, want 1", got)
+	}
+	if got := testutil.ToFloat64(s.evictions.WithLabelValues("active_connections_total", "expired")); got != 0 {
+		t.Errorf("%v label sets expired, want none", got)
+	}
+}
@@ -0,0 +1,51 @@
+package metrics
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// Topics contains the metrics of the requests naming the topics.
+type Topics struct {
+	// TopicRequestsCount is a prometheus metric. See info field
+	TopicRequestsCount *prometheus.CounterVec
+	// TopicRequestBytes is a prometheus metric. See info field
+	TopicRequestBytes *prometheus.CounterVec
+	// TopicRecords is a prometheus metric. See info field
+	TopicRecords *prometheus.CounterVec
+	// TopicRecordBytes is a prometheus metric. See info field
+	TopicRecordBytes *prometheus.CounterVec
+	// TopicLastSeen is a prometheus metric. See info field
+	TopicLastSeen *prometheus.GaugeVec
+}
+
+func newTopics() Topics {
+	return Topics{
+		TopicRequestsCount: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "topic_requests_total",
+			Help:      "Total requests to kafka naming the topic by type",
+		}, []string{"topic", "request_type"}),
+		TopicRequestBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "topic_request_bytes_total",
+			Help:      "Total bytes of the requests to kafka naming the topic by type, split among the topics of a request",
+		}, []string{"topic", "request_type"}),
+		TopicRecords: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "topic_records_total",
+			Help:      "Total records produced to the topic",
+		}, []string{"topic"}),
+		TopicRecordBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "topic_record_bytes_total",
+			Help:      "Total bytes of the records produced to the topic",
+		}, []string{"topic"}),
+		TopicLastSeen: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "topic_last_seen_timestamp_seconds",
+			Help:      "Time a request naming the topic was last seen, in seconds since the epoch",
+		}, []string{"topic"}),
+	}
+}
+
+func (t Topics) collectors() []prometheus.Collector {
+	return []prometheus.Collector{t.TopicRequestsCount, t.TopicRequestBytes, t.TopicRecords, t.TopicRecordBytes, t.TopicLastSeen}
+}
@@ -0,0 +1,123 @@
+// Package mirror receives the copies of packets which switches and cloud traffic mirroring send to a collector,
+// so that one sniffer can watch brokers it is not installed on.
+package mirror
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"time"
+
+	"github.com/bingoohuang/kafka-sniffer/stream"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// maxPacketSize is the largest mirrored packet read, a jumbo frame with its encapsulation
+const maxPacketSize = 16 << 10
+
+// encapsulations maps the names of the supported encapsulations to the layer a received datagram starts with
+var encapsulations = map[string]gopacket.LayerType{
+	"vxlan":  layers.LayerTypeVXLAN,
+	"geneve": layers.LayerTypeGeneve,
+	"tzsp":   stream.LayerTypeTZSP,
+	"erspan": layers.LayerTypeGRE,
+}
+
+// defaultEncapsulations are the encapsulations of UDP inputs without an encap parameter, by port
+var defaultEncapsulations = map[string]string{
+	"4789":  "vxlan",
+	"6081":  "geneve",
+	"37008": "tzsp",
+}
+
+// Source is a mirror input.
+type Source struct {
+	conn  net.PacketConn
+	first gopacket.LayerType
+	name  string
+}
+
+// Listen opens the mirror input described by rawURL:
+//
+//	udp://:4789            VXLAN, e.g. from AWS VPC or Azure vTAP traffic mirroring
+//	udp://:6081            Geneve
+//	udp://:37008           TZSP
+//	udp://:9999?encap=tzsp any port with an explicit encapsulation
+//	gre://0.0.0.0          ERSPAN type II and III, received on a raw socket which requires CAP_NET_RAW
+func Listen(rawURL string) (*Source, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		network, address, encap string
+	)
+
+	switch u.Scheme {
+	case "udp":
+		network, address = "udp", u.Host
+		if encap = u.Query().Get("encap"); encap == "" {
+			encap = defaultEncapsulations[u.Port()]
+		}
+		if encap == "" {
+			return nil, fmt.Errorf("mirror input %s requires an encap parameter, e.g. ?encap=vxlan", rawURL)
+		}
+	case "gre":
+		network, address, encap = "ip4:gre", u.Hostname(), "erspan"
+		if address == "" {
+			address = "0.0.0.0"
+		}
+	default:
+		return nil, fmt.Errorf("unsupported mirror input %s, expecting udp:// or gre://", rawURL)
+	}
+
+	first, ok := encapsulations[encap]
+	if !ok {
+		return nil, fmt.Errorf("unsupported encapsulation %q of mirror input %s", encap, rawURL)
+	}
+
+	conn, err := net.ListenPacket(network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Source{conn: conn, first: first, name: rawURL}, nil
+}
+
+// Packets returns a channel of the received packets, which is closed when the input fails.
+func (s *Source) Packets() chan gopacket.Packet {
+	packets := make(chan gopacket.Packet, 1000)
+
+	go func() {
+		defer close(packets)
+
+		buf := make([]byte, maxPacketSize)
+		for {
+			n, _, err := s.conn.ReadFrom(buf)
+			if err != nil {
+				log.Printf("mirror input %s stopped, err: %v", s.name, err)
+				return
+			}
+
+			// the packet copies buf
+			p := gopacket.NewPacket(buf[:n], s.first, gopacket.Default)
+			m := p.Metadata()
+			m.Timestamp = time.Now()
+			m.CaptureLength = n
+			m.Length = n
+
+			packets <- p
+		}
+	}()
+
+	return packets
+}
+
+// Close stops the input.
+func (s *Source) Close() error {
+	return s.conn.Close()
+}
@@ -0,0 +1,154 @@
+package otlp
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/http2"
+)
+
+// Protocols of the OTLP exporter
+const (
+	ProtocolGRPC = "grpc"
+	ProtocolHTTP = "http"
+)
+
+// The paths of the OTLP exports
+const (
+	httpMetricsPath = "/v1/metrics"
+	httpTracesPath  = "/v1/traces"
+	grpcMetricsPath = "/opentelemetry.proto.collector.metrics.v1.MetricsService/Export"
+	grpcTracesPath  = "/opentelemetry.proto.collector.trace.v1.TraceService/Export"
+)
+
+// client posts the encoded export requests to a collector.
+type client interface {
+	exportMetrics(ctx context.Context, req []byte) error
+	exportTraces(ctx context.Context, req []byte) error
+}
+
+// baseURL returns the URL of endpoint, http:// unless it has a scheme.
+func baseURL(endpoint string) string {
+	if strings.Contains(endpoint, "://") {
+		return strings.TrimSuffix(endpoint, "/")
+	}
+
+	return "http://" + strings.TrimSuffix(endpoint, "/")
+}
+
+// httpClient is OTLP/HTTP with binary protobuf.
+type httpClient struct {
+	url     string
+	headers map[string]string
+	client  *http.Client
+}
+
+func (c *httpClient) exportMetrics(ctx context.Context, req []byte) error {
+	return c.post(ctx, httpMetricsPath, req)
+}
+
+func (c *httpClient) exportTraces(ctx context.Context, req []byte) error {
+	return c.post(ctx, httpTracesPath, req)
+}
+
+func (c *httpClient) post(ctx context.Context, path string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, c.url+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	for k, v := range c.headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s%s: %s %s", c.url, path, resp.Status, msg)
+	}
+
+	return nil
+}
+
+// grpcClient is OTLP/gRPC: unary calls over HTTP/2, in plaintext (h2c) unless the endpoint is https://
+type grpcClient struct {
+	url     string
+	headers map[string]string
+	client  *http.Client
+}
+
+func newGRPCClient(endpoint string, headers map[string]string) *grpcClient {
+	url := baseURL(endpoint)
+	transport := &http2.Transport{}
+	if strings.HasPrefix(url, "http://") {
+		transport.AllowHTTP = true
+		transport.DialTLS = func(network, addr string, _ *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		}
+	}
+
+	return &grpcClient{url: url, headers: headers, client: &http.Client{Transport: transport}}
+}
+
+func (c *grpcClient) exportMetrics(ctx context.Context, req []byte) error {
+	return c.call(ctx, grpcMetricsPath, req)
+}
+
+func (c *grpcClient) exportTraces(ctx context.Context, req []byte) error {
+	return c.call(ctx, grpcTracesPath, req)
+}
+
+func (c *grpcClient) call(ctx context.Context, path string, msg []byte) error {
+	// a length-prefixed message, uncompressed
+	body := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(body[1:], uint32(len(msg)))
+	body = append(body, msg...)
+
+	req, err := http.NewRequest(http.MethodPost, c.url+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+	for k, v := range c.headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// the trailers follow the body
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s%s: %s", c.url, path, resp.Status)
+	}
+
+	status, message := resp.Trailer.Get("grpc-status"), resp.Trailer.Get("grpc-message")
+	if status == "" {
+		// a trailers-only response
+		status, message = resp.Header.Get("grpc-status"), resp.Header.Get("grpc-message")
+	}
+	if status != "0" {
+		return fmt.Errorf("%s%s: grpc status %s %s", c.url, path, status, message)
+	}
+
+	return nil
+}
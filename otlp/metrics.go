@@ -0,0 +1,132 @@
+package otlp
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// encodeMetrics encodes the gathered prometheus metrics as an ExportMetricsServiceRequest. The counters,
+// histograms and summaries are cumulative since start.
+func encodeMetrics(resource, scope []byte, families []*dto.MetricFamily, start, now time.Time) []byte {
+	var metrics []byte
+	for _, f := range families {
+		if m := encodeMetric(f, uint64(start.UnixNano()), uint64(now.UnixNano())); m != nil {
+			metrics = appendMessage(metrics, fieldMetrics, m)
+		}
+	}
+
+	scopeMetrics := appendMessage(nil, fieldScope, scope)
+	scopeMetrics = append(scopeMetrics, metrics...)
+
+	resourceMetrics := appendMessage(nil, fieldResource, resource)
+	resourceMetrics = appendMessage(resourceMetrics, fieldScopeMetrics, scopeMetrics)
+
+	return appendMessage(nil, fieldResourceMetrics, resourceMetrics)
+}
+
+// encodeMetric encodes a Metric, nil for the types without an OTLP equivalent.
+func encodeMetric(f *dto.MetricFamily, start, now uint64) []byte {
+	var data []byte
+	var field protowire.Number = fieldMetricGauge
+
+	switch f.GetType() {
+	case dto.MetricType_COUNTER:
+		field = fieldMetricSum
+		for _, m := range f.Metric {
+			data = appendMessage(data, fieldDataPoints, numberPoint(m, m.GetCounter().GetValue(), start, now))
+		}
+		data = appendVarint(data, fieldAggregationTemporality, aggregationTemporalityCumulative)
+		data = appendBool(data, fieldIsMonotonic, true)
+	case dto.MetricType_GAUGE:
+		for _, m := range f.Metric {
+			data = appendMessage(data, fieldDataPoints, numberPoint(m, m.GetGauge().GetValue(), start, now))
+		}
+	case dto.MetricType_UNTYPED:
+		for _, m := range f.Metric {
+			data = appendMessage(data, fieldDataPoints, numberPoint(m, m.GetUntyped().GetValue(), start, now))
+		}
+	case dto.MetricType_HISTOGRAM:
+		field = fieldMetricHistogram
+		for _, m := range f.Metric {
+			data = appendMessage(data, fieldDataPoints, histogramPoint(m, start, now))
+		}
+		data = appendVarint(data, fieldAggregationTemporality, aggregationTemporalityCumulative)
+	case dto.MetricType_SUMMARY:
+		field = fieldMetricSummary
+		for _, m := range f.Metric {
+			data = appendMessage(data, fieldDataPoints, summaryPoint(m, start, now))
+		}
+	default:
+		return nil
+	}
+
+	b := appendString(nil, fieldMetricName, f.GetName())
+	b = appendString(b, fieldMetricDescription, f.GetHelp())
+
+	return appendMessage(b, field, data)
+}
+
+func numberPoint(m *dto.Metric, value float64, start, now uint64) []byte {
+	b := appendFixed64(nil, fieldPointStartTime, start)
+	b = appendFixed64(b, fieldPointTime, now)
+	b = appendDouble(b, fieldNumberAsDouble, value)
+
+	return appendAttributes(b, fieldNumberAttributes, labels(m))
+}
+
+// histogramPoint converts the cumulative prometheus buckets to the counts of every bucket.
+func histogramPoint(m *dto.Metric, start, now uint64) []byte {
+	h := m.GetHistogram()
+
+	var bounds, counts []uint64
+	var previous uint64
+	for _, bucket := range h.Bucket {
+		if math.IsInf(bucket.GetUpperBound(), +1) {
+			continue
+		}
+		bounds = append(bounds, math.Float64bits(bucket.GetUpperBound()))
+		counts = append(counts, bucket.GetCumulativeCount()-previous)
+		previous = bucket.GetCumulativeCount()
+	}
+	counts = append(counts, h.GetSampleCount()-previous)
+
+	b := appendFixed64(nil, fieldPointStartTime, start)
+	b = appendFixed64(b, fieldPointTime, now)
+	b = appendFixed64(b, fieldPointCount, h.GetSampleCount())
+	b = appendDouble(b, fieldPointSum, h.GetSampleSum())
+	b = appendPackedFixed64(b, fieldHistogramBucketCounts, counts)
+	b = appendPackedFixed64(b, fieldHistogramExplicitBounds, bounds)
+
+	return appendAttributes(b, fieldHistogramAttributes, labels(m))
+}
+
+func summaryPoint(m *dto.Metric, start, now uint64) []byte {
+	s := m.GetSummary()
+
+	b := appendFixed64(nil, fieldPointStartTime, start)
+	b = appendFixed64(b, fieldPointTime, now)
+	b = appendFixed64(b, fieldPointCount, s.GetSampleCount())
+	b = appendDouble(b, fieldPointSum, s.GetSampleSum())
+	for _, q := range s.Quantile {
+		v := appendDouble(nil, fieldQuantile, q.GetQuantile())
+		v = appendDouble(v, fieldQuantileValue, q.GetValue())
+		b = appendMessage(b, fieldSummaryQuantileValues, v)
+	}
+
+	return appendAttributes(b, fieldSummaryAttributes, labels(m))
+}
+
+// labels returns the labels of m as attributes, sorted by name.
+func labels(m *dto.Metric) []attribute {
+	attrs := make([]attribute, 0, len(m.Label))
+	for _, l := range m.Label {
+		attrs = append(attrs, attribute{Key: l.GetName(), Value: l.GetValue()})
+	}
+	sort.Slice(attrs, func(i, j int) bool { return attrs[i].Key < attrs[j].Key })
+
+	return attrs
+}
@@ -0,0 +1,199 @@
+// Package otlp exports the prometheus metrics of the sniffer and a span per answered request to an
+// OpenTelemetry collector over OTLP/gRPC or OTLP/HTTP, see https://opentelemetry.io/docs/specs/otlp/
+package otlp
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/bingoohuang/kafka-sniffer/stream"
+	"github.com/bingoohuang/kafka-sniffer/version"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	scopeName = "github.com/bingoohuang/kafka-sniffer"
+	// maxSpans bounds the spans waiting for the next export, the newer ones are dropped beyond it.
+	maxSpans = 8192
+)
+
+// Options configures an Exporter. The zero values of the fields commented with a default take that default.
+type Options struct {
+	// Endpoint of the collector, e.g. localhost:4317 for gRPC or http://localhost:4318 for HTTP.
+	// gRPC is in plaintext unless the endpoint is https://
+	Endpoint string
+	// Protocol is grpc or http, default grpc.
+	Protocol string
+	// Headers are sent with every export, e.g. for authentication.
+	Headers map[string]string
+	// Interval between exports, default 15s.
+	Interval time.Duration
+	// Timeout of an export, default 10s.
+	Timeout time.Duration
+	// Gatherer gathers the metrics to export, default prometheus.DefaultGatherer.
+	Gatherer prometheus.Gatherer
+	// Interface is the capturing interface, exported as the resource attribute network.interface.name.
+	Interface string
+	// Resource are more resource attributes, besides service.name, service.version and host.name.
+	Resource map[string]string
+}
+
+func (o *Options) setDefaults() {
+	if o.Protocol == "" {
+		o.Protocol = ProtocolGRPC
+	}
+	if o.Interval <= 0 {
+		o.Interval = 15 * time.Second
+	}
+	if o.Timeout <= 0 {
+		o.Timeout = 10 * time.Second
+	}
+	if o.Gatherer == nil {
+		o.Gatherer = prometheus.DefaultGatherer
+	}
+}
+
+// Exporter is a stream.Sink collecting a span for every response, exported with the metrics every interval.
+type Exporter struct {
+	opts     Options
+	client   client
+	resource []byte
+	scope    []byte
+	start    time.Time
+
+	lock    sync.Mutex
+	spans   []*stream.Response
+	dropped int
+}
+
+// New creates an Exporter, the exports are started by Run.
+func New(opts Options) (*Exporter, error) {
+	opts.setDefaults()
+	if opts.Endpoint == "" {
+		return nil, fmt.Errorf("missing OTLP endpoint")
+	}
+
+	e := &Exporter{
+		opts:     opts,
+		resource: resource(opts),
+		scope:    scope(scopeName, version.Version),
+		start:    time.Now(),
+	}
+
+	switch opts.Protocol {
+	case ProtocolGRPC:
+		e.client = newGRPCClient(opts.Endpoint, opts.Headers)
+	case ProtocolHTTP:
+		e.client = &httpClient{url: baseURL(opts.Endpoint), headers: opts.Headers, client: &http.Client{}}
+	default:
+		return nil, fmt.Errorf("unknown OTLP protocol %q, grpc or http", opts.Protocol)
+	}
+
+	return e, nil
+}
+
+// resource encodes the Resource of the sniffer.
+func resource(opts Options) []byte {
+	attrs := []attribute{{Key: "service.name", Value: "kafka-sniffer"}}
+	if version.Version != "" {
+		attrs = append(attrs, attribute{Key: "service.version", Value: version.Version})
+	}
+	if host, err := os.Hostname(); err == nil {
+		attrs = append(attrs, attribute{Key: "host.name", Value: host})
+	}
+	if opts.Interface != "" {
+		attrs = append(attrs, attribute{Key: "network.interface.name", Value: opts.Interface})
+	}
+
+	keys := make([]string, 0, len(opts.Resource))
+	for k := range opts.Resource {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		attrs = append(attrs, attribute{Key: k, Value: opts.Resource[k]})
+	}
+
+	return appendAttributes(nil, fieldResourceAttributes, attrs)
+}
+
+// Publish implements stream.Sink
+func (e *Exporter) Publish(ev stream.Event) {
+	if ev.Type != stream.EventResponse {
+		return
+	}
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if len(e.spans) >= maxSpans {
+		e.dropped++
+		return
+	}
+	e.spans = append(e.spans, ev.Response)
+}
+
+// Run exports every interval until ctx is done, then exports once more.
+func (e *Exporter) Run(ctx context.Context) {
+	ticker := time.NewTicker(e.opts.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			e.export(context.Background())
+			return
+		case <-ticker.C:
+			e.export(ctx)
+		}
+	}
+}
+
+// export exports the metrics and the spans collected since the last export, logging the failures.
+func (e *Exporter) export(ctx context.Context) {
+	if err := e.Export(ctx); err != nil {
+		log.Printf("failed to export to OTLP collector %s: %v", e.opts.Endpoint, err)
+	}
+}
+
+// Export exports the metrics and the spans collected since the last export. The spans are dropped
+// when the export fails.
+func (e *Exporter) Export(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, e.opts.Timeout)
+	defer cancel()
+
+	e.lock.Lock()
+	spans, dropped := e.spans, e.dropped
+	e.spans, e.dropped = nil, 0
+	e.lock.Unlock()
+
+	if dropped > 0 {
+		log.Printf("dropped %d OTLP spans, more than %d between exports", dropped, maxSpans)
+	}
+
+	families, err := e.opts.Gatherer.Gather()
+	if err != nil {
+		return fmt.Errorf("gather metrics: %w", err)
+	}
+
+	if err := e.client.exportMetrics(ctx, encodeMetrics(e.resource, e.scope, families, e.start, time.Now())); err != nil {
+		return fmt.Errorf("export metrics: %w", err)
+	}
+
+	if len(spans) == 0 {
+		return nil
+	}
+
+	if err := e.client.exportTraces(ctx, encodeTraces(e.resource, e.scope, spans)); err != nil {
+		return fmt.Errorf("export %d spans: %w", len(spans), err)
+	}
+
+	return nil
+}
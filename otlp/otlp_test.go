@@ -0,0 +1,369 @@
+package otlp
+
+import (
+	"context"
+	"encoding/binary"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bingoohuang/kafka-sniffer/stream"
+
+	"github.com/prometheus/client_golang/prometheus"
+	collectormetrics "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	collectortrace "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"google.golang.org/protobuf/proto"
+)
+
+// collector is a stand-in OTLP collector over HTTP or gRPC, decoding the exports with the official types.
+type collector struct {
+	*httptest.Server
+
+	lock    sync.Mutex
+	metrics []*collectormetrics.ExportMetricsServiceRequest
+	traces  []*collectortrace.ExportTraceServiceRequest
+	headers []http.Header
+	// grpcStatus is the status of the gRPC calls, 0 when empty.
+	grpcStatus string
+}
+
+func newHTTPCollector(t *testing.T) *collector {
+	c := &collector{}
+	c.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ct := r.Header.Get("Content-Type"); ct != "application/x-protobuf" {
+			t.Errorf("content type %q", ct)
+		}
+
+		body, _ := ioutil.ReadAll(r.Body)
+		resp, err := c.decode(r, body, httpMetricsPath, httpTracesPath)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		_, _ = w.Write(resp)
+	}))
+
+	return c
+}
+
+func newGRPCCollector(t *testing.T) *collector {
+	c := &collector{}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 {
+			t.Errorf("gRPC over HTTP/%d", r.ProtoMajor)
+		}
+		if ct := r.Header.Get("Content-Type"); ct != "application/grpc" {
+			t.Errorf("content type %q", ct)
+		}
+
+		body, _ := ioutil.ReadAll(r.Body)
+		if len(body) < 5 || body[0] != 0 || int(binary.BigEndian.Uint32(body[1:5])) != len(body)-5 {
+			t.Errorf("invalid length-prefixed message % x", body)
+			return
+		}
+
+		resp, err := c.decode(r, body[5:], grpcMetricsPath, grpcTracesPath)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		c.lock.Lock()
+		status := c.grpcStatus
+		c.lock.Unlock()
+		if status == "" {
+			status = "0"
+		}
+
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "grpc-status, grpc-message")
+		msg := make([]byte, 5, 5+len(resp))
+		binary.BigEndian.PutUint32(msg[1:], uint32(len(resp)))
+		_, _ = w.Write(append(msg, resp...))
+		w.Header().Set("grpc-status", status)
+		if status != "0" {
+			w.Header().Set("grpc-message", "rejected")
+		}
+	})
+	c.Server = httptest.NewServer(h2c.NewHandler(handler, &http2.Server{}))
+
+	return c
+}
+
+// decode decodes the export request of the path of r, returning the encoded response to it.
+func (c *collector) decode(r *http.Request, body []byte, metricsPath, tracesPath string) ([]byte, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.headers = append(c.headers, r.Header.Clone())
+
+	switch r.URL.Path {
+	case metricsPath:
+		req := &collectormetrics.ExportMetricsServiceRequest{}
+		if err := proto.Unmarshal(body, req); err != nil {
+			return nil, err
+		}
+		c.metrics = append(c.metrics, req)
+		return proto.Marshal(&collectormetrics.ExportMetricsServiceResponse{})
+	case tracesPath:
+		req := &collectortrace.ExportTraceServiceRequest{}
+		if err := proto.Unmarshal(body, req); err != nil {
+			return nil, err
+		}
+		c.traces = append(c.traces, req)
+		return proto.Marshal(&collectortrace.ExportTraceServiceResponse{})
+	default:
+		return nil, &unknownPathError{r.URL.Path}
+	}
+}
+
+type unknownPathError struct{ path string }
+
+func (e *unknownPathError) Error() string { return "unknown path " + e.path }
+
+func TestExportHTTP(t *testing.T) {
+	c := newHTTPCollector(t)
+	defer c.Close()
+
+	testExport(t, c, Options{Endpoint: c.URL, Protocol: ProtocolHTTP})
+}
+
+func TestExportGRPC(t *testing.T) {
+	c := newGRPCCollector(t)
+	defer c.Close()
+
+	// plaintext, as an endpoint without a scheme
+	testExport(t, c, Options{Endpoint: strings.TrimPrefix(c.URL, "http://"), Protocol: ProtocolGRPC})
+}
+
+func TestExportGRPCStatus(t *testing.T) {
+	c := newGRPCCollector(t)
+	defer c.Close()
+	c.grpcStatus = "3"
+
+	e, err := New(Options{Endpoint: c.URL, Gatherer: prometheus.NewRegistry()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := e.Export(context.Background()); err == nil || !strings.Contains(err.Error(), "grpc status 3 rejected") {
+		t.Errorf("export rejected by the collector returned %v", err)
+	}
+}
+
+func testExport(t *testing.T, c *collector, opts Options) {
+	registry := prometheus.NewRegistry()
+	requests := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "requests_total", Help: "Requests."},
+		[]string{"client_ip", "request_type"})
+	connections := prometheus.NewGauge(prometheus.GaugeOpts{Name: "connections", Help: "Connections."})
+	sizes := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "sizes", Help: "Sizes.", Buckets: []float64{10, 100}})
+	latencies := prometheus.NewSummary(prometheus.SummaryOpts{Name: "latencies", Help: "Latencies.",
+		Objectives: map[float64]float64{0.5: 0.05}})
+	registry.MustRegister(requests, connections, sizes, latencies)
+
+	requests.WithLabelValues("10.0.0.1", "produce").Add(3)
+	connections.Set(2)
+	for _, v := range []float64{5, 50, 500, 7} {
+		sizes.Observe(v)
+	}
+	latencies.Observe(4)
+
+	opts.Gatherer = registry
+	opts.Headers = map[string]string{"Authorization": "Bearer secret"}
+	opts.Interface = "eth0"
+	opts.Resource = map[string]string{"deployment.environment": "test"}
+	e, err := New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	end := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	e.Publish(stream.Event{Type: stream.EventResponse, Response: &stream.Response{
+		Endpoints:     stream.Endpoints{Client: "10.0.0.1:50000", Broker: "[::1]:9092"},
+		CorrelationID: 7,
+		Key:           0,
+		Version:       9,
+		ClientID:      "producer-1",
+		Topics:        []string{"orders"},
+		Size:          120,
+		Latency:       3 * time.Millisecond,
+		Time:          end,
+	}})
+
+	if err := e.Export(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if len(c.metrics) != 1 || len(c.traces) != 1 {
+		t.Fatalf("collected %d metrics and %d traces exports, want 1 and 1", len(c.metrics), len(c.traces))
+	}
+	for _, h := range c.headers {
+		if got := h.Get("Authorization"); got != "Bearer secret" {
+			t.Errorf("header Authorization %q", got)
+		}
+	}
+
+	rm := c.metrics[0].GetResourceMetrics()
+	if len(rm) != 1 || len(rm[0].GetScopeMetrics()) != 1 {
+		t.Fatalf("resource metrics %v", rm)
+	}
+	checkResource(t, rm[0].GetResource().GetAttributes())
+	sm := rm[0].GetScopeMetrics()[0]
+	if sm.GetScope().GetName() != scopeName {
+		t.Errorf("scope %q", sm.GetScope().GetName())
+	}
+
+	byName := map[string]*metricspb.Metric{}
+	for _, m := range sm.GetMetrics() {
+		byName[m.GetName()] = m
+	}
+
+	sum := byName["requests_total"].GetSum()
+	if sum == nil || !sum.GetIsMonotonic() ||
+		sum.GetAggregationTemporality() != metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE {
+		t.Fatalf("requests_total %v, want a cumulative monotonic sum", byName["requests_total"])
+	}
+	if p := sum.GetDataPoints(); len(p) != 1 || p[0].GetAsDouble() != 3 || p[0].GetStartTimeUnixNano() == 0 ||
+		p[0].GetTimeUnixNano() < p[0].GetStartTimeUnixNano() {
+		t.Errorf("requests_total points %v", p)
+	} else if got := attributes(p[0].GetAttributes()); got["client_ip"] != "10.0.0.1" || got["request_type"] != "produce" {
+		t.Errorf("requests_total attributes %v", got)
+	}
+	if byName["requests_total"].GetDescription() != "Requests." {
+		t.Errorf("requests_total description %q", byName["requests_total"].GetDescription())
+	}
+
+	if p := byName["connections"].GetGauge().GetDataPoints(); len(p) != 1 || p[0].GetAsDouble() != 2 {
+		t.Errorf("connections points %v", p)
+	}
+
+	h := byName["sizes"].GetHistogram()
+	if p := h.GetDataPoints(); len(p) != 1 {
+		t.Errorf("sizes points %v", p)
+	} else {
+		p := p[0]
+		if p.GetCount() != 4 || p.GetSum() != 562 {
+			t.Errorf("sizes count %d sum %v, want 4 and 562", p.GetCount(), p.GetSum())
+		}
+		if !equalFloats(p.GetExplicitBounds(), []float64{10, 100}) || !equalUints(p.GetBucketCounts(), []uint64{2, 1, 1}) {
+			t.Errorf("sizes bounds %v counts %v, want [10 100] and [2 1 1]", p.GetExplicitBounds(), p.GetBucketCounts())
+		}
+	}
+
+	if p := byName["latencies"].GetSummary().GetDataPoints(); len(p) != 1 || p[0].GetCount() != 1 || p[0].GetSum() != 4 ||
+		len(p[0].GetQuantileValues()) != 1 || p[0].GetQuantileValues()[0].GetQuantile() != 0.5 ||
+		p[0].GetQuantileValues()[0].GetValue() != 4 {
+		t.Errorf("latencies points %v", p)
+	}
+
+	rs := c.traces[0].GetResourceSpans()
+	if len(rs) != 1 || len(rs[0].GetScopeSpans()) != 1 || len(rs[0].GetScopeSpans()[0].GetSpans()) != 1 {
+		t.Fatalf("resource spans %v", rs)
+	}
+	checkResource(t, rs[0].GetResource().GetAttributes())
+
+	span := rs[0].GetScopeSpans()[0].GetSpans()[0]
+	if len(span.GetTraceId()) != 16 || len(span.GetSpanId()) != 8 {
+		t.Errorf("trace id % x span id % x", span.GetTraceId(), span.GetSpanId())
+	}
+	if span.GetName() != "Produce" || span.GetKind() != tracepb.Span_SPAN_KIND_SERVER {
+		t.Errorf("span %q kind %v", span.GetName(), span.GetKind())
+	}
+	if span.GetEndTimeUnixNano() != uint64(end.UnixNano()) ||
+		span.GetEndTimeUnixNano()-span.GetStartTimeUnixNano() != uint64(3*time.Millisecond) {
+		t.Errorf("span from %d to %d", span.GetStartTimeUnixNano(), span.GetEndTimeUnixNano())
+	}
+
+	want := map[string]interface{}{
+		"messaging.system":           "kafka",
+		"messaging.operation.name":   "Produce",
+		"messaging.client.id":        "producer-1",
+		"messaging.destination.name": "orders",
+		"kafka.api_key":              int64(0),
+		"kafka.api_version":          int64(9),
+		"kafka.correlation_id":       int64(7),
+		"kafka.response.size":        int64(120),
+		"client.address":             "10.0.0.1",
+		"client.port":                int64(50000),
+		"server.address":             "::1",
+		"server.port":                int64(9092),
+	}
+	got := attributes(span.GetAttributes())
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("span attribute %s %v, want %v", k, got[k], v)
+		}
+	}
+}
+
+func checkResource(t *testing.T, attrs []*commonpb.KeyValue) {
+	t.Helper()
+
+	got := attributes(attrs)
+	for k, v := range map[string]interface{}{
+		"service.name":           "kafka-sniffer",
+		"network.interface.name": "eth0",
+		"deployment.environment": "test",
+	} {
+		if got[k] != v {
+			t.Errorf("resource attribute %s %v, want %v", k, got[k], v)
+		}
+	}
+}
+
+// attributes returns the string and int values of attrs by key.
+func attributes(attrs []*commonpb.KeyValue) map[string]interface{} {
+	ret := map[string]interface{}{}
+	for _, a := range attrs {
+		switch v := a.GetValue().GetValue().(type) {
+		case *commonpb.AnyValue_StringValue:
+			ret[a.GetKey()] = v.StringValue
+		case *commonpb.AnyValue_IntValue:
+			ret[a.GetKey()] = v.IntValue
+		default:
+			ret[a.GetKey()] = a.GetValue()
+		}
+	}
+
+	return ret
+}
+
+func equalFloats(a, b []float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func equalUints(a, b []uint64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
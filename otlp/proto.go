@@ -0,0 +1,174 @@
+package otlp
+
+import (
+	"math"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// The field numbers of the OTLP messages, see https://github.com/open-telemetry/opentelemetry-proto
+const (
+	// ExportMetricsServiceRequest, ExportTraceServiceRequest
+	fieldResourceMetrics = 1
+	fieldResourceSpans   = 1
+
+	// ResourceMetrics, ResourceSpans
+	fieldResource     = 1
+	fieldScopeMetrics = 2
+	fieldScopeSpans   = 2
+
+	// ScopeMetrics, ScopeSpans
+	fieldScope   = 1
+	fieldMetrics = 2
+	fieldSpans   = 2
+
+	// Resource
+	fieldResourceAttributes = 1
+
+	// InstrumentationScope
+	fieldScopeName    = 1
+	fieldScopeVersion = 2
+
+	// KeyValue
+	fieldKey   = 1
+	fieldValue = 2
+
+	// AnyValue
+	fieldStringValue = 1
+	fieldBoolValue   = 2
+	fieldIntValue    = 3
+	fieldDoubleValue = 4
+	fieldArrayValue  = 5
+
+	// ArrayValue
+	fieldArrayValues = 1
+
+	// Metric
+	fieldMetricName        = 1
+	fieldMetricDescription = 2
+	fieldMetricGauge       = 5
+	fieldMetricSum         = 7
+	fieldMetricHistogram   = 9
+	fieldMetricSummary     = 11
+
+	// Gauge, Sum, Histogram, Summary
+	fieldDataPoints             = 1
+	fieldAggregationTemporality = 2
+	fieldIsMonotonic            = 3
+
+	// NumberDataPoint, HistogramDataPoint, SummaryDataPoint
+	fieldPointStartTime          = 2
+	fieldPointTime               = 3
+	fieldNumberAsDouble          = 4
+	fieldNumberAttributes        = 7
+	fieldPointCount              = 4
+	fieldPointSum                = 5
+	fieldHistogramBucketCounts   = 6
+	fieldHistogramExplicitBounds = 7
+	fieldHistogramAttributes     = 9
+	fieldSummaryQuantileValues   = 6
+	fieldSummaryAttributes       = 7
+
+	// ValueAtQuantile
+	fieldQuantile      = 1
+	fieldQuantileValue = 2
+
+	// Span
+	fieldTraceID       = 1
+	fieldSpanID        = 2
+	fieldSpanName      = 5
+	fieldSpanKind      = 6
+	fieldSpanStartTime = 7
+	fieldSpanEndTime   = 8
+	fieldSpanAttrs     = 9
+
+	aggregationTemporalityCumulative = 2
+	spanKindServer                   = 2
+)
+
+// attribute is a key value of a resource, a data point or a span. Value is a string, an int64, a bool
+// or a []string.
+type attribute struct {
+	Key   string
+	Value interface{}
+}
+
+func appendMessage(b []byte, num protowire.Number, msg []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, msg)
+}
+
+func appendString(b []byte, num protowire.Number, s string) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+func appendVarint(b []byte, num protowire.Number, v uint64) []byte {
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+func appendFixed64(b []byte, num protowire.Number, v uint64) []byte {
+	b = protowire.AppendTag(b, num, protowire.Fixed64Type)
+	return protowire.AppendFixed64(b, v)
+}
+
+func appendDouble(b []byte, num protowire.Number, v float64) []byte {
+	return appendFixed64(b, num, math.Float64bits(v))
+}
+
+func appendBool(b []byte, num protowire.Number, v bool) []byte {
+	if v {
+		return appendVarint(b, num, 1)
+	}
+
+	return appendVarint(b, num, 0)
+}
+
+// appendPackedFixed64 appends a packed repeated fixed64 or double field.
+func appendPackedFixed64(b []byte, num protowire.Number, vs []uint64) []byte {
+	var packed []byte
+	for _, v := range vs {
+		packed = protowire.AppendFixed64(packed, v)
+	}
+
+	return appendMessage(b, num, packed)
+}
+
+func appendAttributes(b []byte, num protowire.Number, attrs []attribute) []byte {
+	for _, a := range attrs {
+		kv := appendString(nil, fieldKey, a.Key)
+		kv = appendMessage(kv, fieldValue, anyValue(a.Value))
+		b = appendMessage(b, num, kv)
+	}
+
+	return b
+}
+
+// anyValue encodes an AnyValue.
+func anyValue(v interface{}) []byte {
+	switch v := v.(type) {
+	case string:
+		return appendString(nil, fieldStringValue, v)
+	case bool:
+		return appendBool(nil, fieldBoolValue, v)
+	case int64:
+		return appendVarint(nil, fieldIntValue, uint64(v))
+	case float64:
+		return appendDouble(nil, fieldDoubleValue, v)
+	case []string:
+		var array []byte
+		for _, s := range v {
+			array = appendMessage(array, fieldArrayValues, appendString(nil, fieldStringValue, s))
+		}
+		return appendMessage(nil, fieldArrayValue, array)
+	default:
+		return nil
+	}
+}
+
+// scope encodes the InstrumentationScope of the sniffer.
+func scope(name, version string) []byte {
+	b := appendString(nil, fieldScopeName, name)
+	return appendString(b, fieldScopeVersion, version)
+}
@@ -0,0 +1,86 @@
+package otlp
+
+import (
+	"crypto/rand"
+	"net"
+	"strconv"
+
+	"github.com/bingoohuang/kafka-sniffer/kafka"
+	"github.com/bingoohuang/kafka-sniffer/stream"
+)
+
+// encodeTraces encodes the spans of responses as an ExportTraceServiceRequest.
+func encodeTraces(resource, scope []byte, responses []*stream.Response) []byte {
+	scopeSpans := appendMessage(nil, fieldScope, scope)
+	for _, r := range responses {
+		scopeSpans = appendMessage(scopeSpans, fieldSpans, encodeSpan(r))
+	}
+
+	resourceSpans := appendMessage(nil, fieldResource, resource)
+	resourceSpans = appendMessage(resourceSpans, fieldScopeSpans, scopeSpans)
+
+	return appendMessage(nil, fieldResourceSpans, resourceSpans)
+}
+
+// encodeSpan encodes the span of a request from its capture to the capture of its response. The span
+// is a server span of the broker, with a trace of its own since the context of the client is not seen.
+func encodeSpan(r *stream.Response) []byte {
+	ids := make([]byte, 16+8)
+	_, _ = rand.Read(ids)
+
+	end := r.Time
+	start := end.Add(-r.Latency)
+
+	b := appendMessage(nil, fieldTraceID, ids[:16])
+	b = appendMessage(b, fieldSpanID, ids[16:])
+	b = appendString(b, fieldSpanName, kafka.APIName(r.Key))
+	b = appendVarint(b, fieldSpanKind, spanKindServer)
+	b = appendFixed64(b, fieldSpanStartTime, uint64(start.UnixNano()))
+	b = appendFixed64(b, fieldSpanEndTime, uint64(end.UnixNano()))
+
+	return appendAttributes(b, fieldSpanAttrs, spanAttributes(r))
+}
+
+// spanAttributes follows the semantic conventions of messaging and network attributes where they apply.
+func spanAttributes(r *stream.Response) []attribute {
+	attrs := []attribute{
+		{Key: "messaging.system", Value: "kafka"},
+		{Key: "messaging.operation.name", Value: kafka.APIName(r.Key)},
+		{Key: "messaging.client.id", Value: r.ClientID},
+		{Key: "kafka.api_key", Value: int64(r.Key)},
+		{Key: "kafka.api_version", Value: int64(r.Version)},
+		{Key: "kafka.correlation_id", Value: int64(r.CorrelationID)},
+		{Key: "kafka.response.size", Value: int64(r.Size)},
+	}
+
+	switch len(r.Topics) {
+	case 0:
+	case 1:
+		attrs = append(attrs, attribute{Key: "messaging.destination.name", Value: r.Topics[0]})
+	default:
+		attrs = append(attrs, attribute{Key: "kafka.topics", Value: r.Topics})
+	}
+
+	attrs = appendAddress(attrs, "client", r.Client)
+	attrs = appendAddress(attrs, "server", r.Broker)
+	if r.Tunnel != "" {
+		attrs = append(attrs, attribute{Key: "kafka_sniffer.tunnel", Value: r.Tunnel})
+	}
+
+	return attrs
+}
+
+// appendAddress appends the address and port attributes of addr, e.g. client.address and client.port
+func appendAddress(attrs []attribute, prefix, addr string) []attribute {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return append(attrs, attribute{Key: prefix + ".address", Value: addr})
+	}
+
+	attrs = append(attrs, attribute{Key: prefix + ".address", Value: host})
+	if p, err := strconv.ParseInt(port, 10, 64); err == nil {
+		attrs = append(attrs, attribute{Key: prefix + ".port", Value: p})
+	}
+
+	return attrs
+}
@@ -0,0 +1,265 @@
+// Package proxy relays Kafka connections between clients and brokers and decodes the relayed requests,
+// so that traffic can be observed without packet capture privileges.
+package proxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/bingoohuang/kafka-sniffer/kafka"
+	"github.com/bingoohuang/kafka-sniffer/stream"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// Proxy relays client connections to the upstream broker byte for byte, except for Metadata and
+// FindCoordinator responses whose broker addresses are rewritten to further listeners of the proxy,
+// so that clients keep talking through it. Every broker announced by the cluster gets its own listener.
+type Proxy struct {
+	listenHost string
+	advertise  string
+	factory    stream.ConnStreamFactory
+
+	lock   sync.Mutex
+	routes map[string]string // upstream broker address -> advertised proxy address
+}
+
+// New creates a Proxy whose listeners bind to the host of listenAddr and are announced to the
+// clients with the advertise host. Relayed requests are decoded by factory.
+func New(listenAddr, advertise string, factory stream.ConnStreamFactory) (*Proxy, error) {
+	host, _, err := net.SplitHostPort(listenAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	if advertise == "" {
+		if advertise = host; advertise == "" {
+			return nil, fmt.Errorf("advertised host is required when listening on all interfaces")
+		}
+	}
+
+	return &Proxy{
+		listenHost: host,
+		advertise:  advertise,
+		factory:    factory,
+		routes:     map[string]string{},
+	}, nil
+}
+
+// ListenAndServe relays the connections accepted on listenAddr to upstream and blocks until the listener fails.
+func (p *Proxy) ListenAndServe(listenAddr, upstream string) error {
+	l, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("proxy listening on %s for upstream %s", l.Addr(), upstream)
+
+	return p.serve(l, upstream)
+}
+
+func (p *Proxy) serve(l net.Listener, upstream string) error {
+	defer l.Close()
+
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+
+		go p.relay(c, upstream)
+	}
+}
+
+// route returns the proxy address for an upstream broker, starting a listener for it on first use.
+func (p *Proxy) route(host string, port int32) (string, int32) {
+	upstream := net.JoinHostPort(host, strconv.Itoa(int(port)))
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	addr, ok := p.routes[upstream]
+	if !ok {
+		l, err := net.Listen("tcp", net.JoinHostPort(p.listenHost, "0"))
+		if err != nil {
+			log.Printf("failed to listen for broker %s, err: %v", upstream, err)
+			return host, port
+		}
+
+		_, localPort, _ := net.SplitHostPort(l.Addr().String())
+		addr = net.JoinHostPort(p.advertise, localPort)
+		p.routes[upstream] = addr
+		log.Printf("proxy listening on %s for upstream %s, advertised as %s", l.Addr(), upstream, addr)
+
+		go func() {
+			if err := p.serve(l, upstream); err != nil {
+				log.Printf("proxy listener for %s stopped, err: %v", upstream, err)
+			}
+		}()
+	}
+
+	advertisedHost, advertisedPort, _ := net.SplitHostPort(addr)
+	n, _ := strconv.Atoi(advertisedPort)
+	return advertisedHost, int32(n)
+}
+
+type apiVersion struct {
+	key, version int16
+}
+
+// conn is a relayed client connection.
+type conn struct {
+	client, upstream net.Conn
+
+	lock    sync.Mutex
+	pending map[int32]apiVersion // correlation id -> type of requests whose responses announce brokers
+}
+
+func (p *Proxy) relay(client net.Conn, upstreamAddr string) {
+	defer client.Close()
+
+	upstream, err := net.Dial("tcp", upstreamAddr)
+	if err != nil {
+		log.Printf("failed to dial upstream %s, err: %v", upstreamAddr, err)
+		return
+	}
+	defer upstream.Close()
+
+	c := &conn{client: client, upstream: upstream, pending: map[int32]apiVersion{}}
+
+	// the requests and the responses are decoded from copies of their frames, as if they were captured
+	netFlow, transportFlow := flows(client.RemoteAddr(), client.LocalAddr())
+	decoder := p.factory.NewRelay(netFlow, transportFlow)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		if err := c.relayResponses(p.route, decoder); err != nil && !isClosed(err) {
+			log.Printf("relaying responses from %s failed, err: %v", upstreamAddr, err)
+		}
+		client.Close()
+	}()
+
+	if err := c.relayRequests(decoder); err != nil && !isClosed(err) {
+		log.Printf("relaying requests from %s failed, err: %v", client.RemoteAddr(), err)
+	}
+	decoder.Close()
+	upstream.Close()
+	<-done
+}
+
+// relayRequests copies the request frames of the client to the upstream and to the decoder,
+// remembering the requests whose responses need rewriting.
+func (c *conn) relayRequests(decoder *stream.Relay) error {
+	for {
+		frame, err := readFrame(c.client)
+		if err != nil {
+			return err
+		}
+
+		if len(frame) >= 12 && kafka.AnnouncesBrokers(kafka.DecodeKey(frame)) {
+			c.lock.Lock()
+			c.pending[kafka.DecodeCorrelationID(frame)] = apiVersion{key: kafka.DecodeKey(frame), version: kafka.DecodeVersion(frame)}
+			c.lock.Unlock()
+		}
+
+		if _, err := c.upstream.Write(frame); err != nil {
+			return err
+		}
+
+		// never waits for the decoder, the frame is not modified any more
+		decoder.Request(frame)
+	}
+}
+
+// relayResponses copies the response frames of the upstream to the client, rewriting broker addresses,
+// and matches them with their requests decoded.
+func (c *conn) relayResponses(rewrite kafka.BrokerRewriter, decoder *stream.Relay) error {
+	for {
+		frame, err := readFrame(c.upstream)
+		if err != nil {
+			return err
+		}
+
+		// the response as the broker sent it
+		decoder.Response(frame)
+
+		if len(frame) >= 8 {
+			correlationID := int32(binary.BigEndian.Uint32(frame[4:8]))
+
+			c.lock.Lock()
+			req, ok := c.pending[correlationID]
+			delete(c.pending, correlationID)
+			c.lock.Unlock()
+
+			if ok {
+				frame = c.rewriteResponse(req, frame, rewrite)
+			}
+		}
+
+		if _, err := c.client.Write(frame); err != nil {
+			return err
+		}
+	}
+}
+
+// rewriteResponse rewrites the broker addresses of the response frame to req. A response which cannot be
+// rewritten is logged and relayed as the broker sent it, the client may then bypass the proxy.
+func (c *conn) rewriteResponse(req apiVersion, frame []byte, rewrite kafka.BrokerRewriter) []byte {
+	payload, err := kafka.RewriteResponse(req.key, req.version, frame[4:], rewrite)
+	if err != nil {
+		log.Printf("rewrite response of api key %d version %d from %s failed, relayed unchanged, err: %v",
+			req.key, req.version, c.upstream.RemoteAddr(), err)
+		return frame
+	}
+
+	rewritten := append(frame[:4:4], payload...)
+	binary.BigEndian.PutUint32(rewritten, uint32(len(payload)))
+
+	return rewritten
+}
+
+// isClosed tells whether err only reports that one side of the relay went away.
+func isClosed(err error) bool {
+	return err == io.EOF || errors.Is(err, net.ErrClosed)
+}
+
+// readFrame reads a length prefixed frame, including its length.
+func readFrame(r io.Reader) ([]byte, error) {
+	var head [4]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return nil, err
+	}
+
+	length := kafka.DecodeLength(head[:])
+	if length < 0 || length > kafka.MaxRequestSize {
+		return nil, fmt.Errorf("invalid frame length %d", length)
+	}
+
+	frame := make([]byte, 4+int(length))
+	copy(frame, head[:])
+	if _, err := io.ReadFull(r, frame[4:]); err != nil {
+		return nil, err
+	}
+
+	return frame, nil
+}
+
+// flows creates the flows of a connection from src to dst
+func flows(src, dst net.Addr) (netFlow, transportFlow gopacket.Flow) {
+	s, d := src.(*net.TCPAddr), dst.(*net.TCPAddr)
+	netFlow, _ = gopacket.FlowFromEndpoints(layers.NewIPEndpoint(s.IP), layers.NewIPEndpoint(d.IP))
+	transportFlow, _ = gopacket.FlowFromEndpoints(
+		layers.NewTCPPortEndpoint(layers.TCPPort(s.Port)),
+		layers.NewTCPPortEndpoint(layers.TCPPort(d.Port)))
+
+	return netFlow, transportFlow
+}
@@ -0,0 +1,219 @@
+// Package proxyproto parses the PROXY protocol header which load balancers like HAProxy send
+// ahead of the relayed bytes to tell the address of the original client,
+// see https://www.haproxy.org/download/2.0/doc/proxy-protocol.txt
+package proxyproto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// SignatureSize is how many bytes tell whether a connection starts with a PROXY header
+const SignatureSize = 6
+
+const (
+	// maxV1Size is the longest version 1 header, CRLF included
+	maxV1Size = 107
+	// v2HeaderSize is the size of the fixed part of a version 2 header
+	v2HeaderSize = 16
+)
+
+var (
+	v1Signature = []byte("PROXY ")
+	v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// ErrNotProxy is returned for bytes which do not start with a PROXY header.
+var ErrNotProxy = errors.New("not a PROXY protocol header")
+
+// Header is a PROXY protocol header.
+type Header struct {
+	Version int
+	// Source and Destination are the addresses of the original connection, nil for connections
+	// of the load balancer itself, e.g. health checks, and for unknown protocols.
+	Source, Destination *net.TCPAddr
+}
+
+// HasSignature tells whether b, of at least SignatureSize bytes, starts with the signature of a PROXY header.
+func HasSignature(b []byte) bool {
+	return len(b) >= SignatureSize && (bytes.HasPrefix(b, v1Signature) || bytes.HasPrefix(b, v2Signature[:SignatureSize]))
+}
+
+// Parse parses the PROXY header at the start of b and returns it with its size. It returns
+// io.ErrUnexpectedEOF when b holds only the start of a header.
+func Parse(b []byte) (*Header, int, error) {
+	switch {
+	case startsLike(b, v1Signature):
+		if len(b) < len(v1Signature) {
+			return nil, 0, io.ErrUnexpectedEOF
+		}
+		return parseV1(b)
+	case startsLike(b, v2Signature):
+		if len(b) < len(v2Signature) {
+			return nil, 0, io.ErrUnexpectedEOF
+		}
+		return parseV2(b)
+	default:
+		return nil, 0, ErrNotProxy
+	}
+}
+
+// startsLike tells whether b starts with signature or is the start of it.
+func startsLike(b, signature []byte) bool {
+	if len(b) < len(signature) {
+		return bytes.HasPrefix(signature, b)
+	}
+
+	return bytes.HasPrefix(b, signature)
+}
+
+// ReadAfter reads the rest of the PROXY header whose first SignatureSize bytes are head.
+func ReadAfter(head []byte, r io.Reader) (*Header, error) {
+	if !HasSignature(head) {
+		return nil, ErrNotProxy
+	}
+
+	b := append([]byte(nil), head...)
+	if bytes.HasPrefix(b, v1Signature) {
+		// the header ends with CRLF, the bytes after it belong to the connection
+		one := make([]byte, 1)
+		for !bytes.HasSuffix(b, []byte("\r\n")) {
+			if len(b) >= maxV1Size {
+				return nil, errors.New("PROXY v1 header too long")
+			}
+			if _, err := io.ReadFull(r, one); err != nil {
+				return nil, err
+			}
+			b = append(b, one[0])
+		}
+	} else {
+		rest := make([]byte, v2HeaderSize-len(b))
+		if _, err := io.ReadFull(r, rest); err != nil {
+			return nil, err
+		}
+		b = append(b, rest...)
+		if !bytes.HasPrefix(b, v2Signature) {
+			return nil, ErrNotProxy
+		}
+
+		addresses := make([]byte, binary.BigEndian.Uint16(b[14:16]))
+		if _, err := io.ReadFull(r, addresses); err != nil {
+			return nil, err
+		}
+		b = append(b, addresses...)
+	}
+
+	h, _, err := Parse(b)
+	return h, err
+}
+
+// parseV1 parses the human-readable header, e.g. PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n
+func parseV1(b []byte) (*Header, int, error) {
+	end := bytes.Index(b, []byte("\r\n"))
+	if end < 0 {
+		if len(b) >= maxV1Size {
+			return nil, 0, errors.New("PROXY v1 header too long")
+		}
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	if end+2 > maxV1Size {
+		return nil, 0, errors.New("PROXY v1 header too long")
+	}
+
+	h := &Header{Version: 1}
+	fields := strings.Split(string(b[len(v1Signature):end]), " ")
+	switch fields[0] {
+	case "UNKNOWN":
+		return h, end + 2, nil
+	case "TCP4", "TCP6":
+		if len(fields) != 5 {
+			return nil, 0, fmt.Errorf("invalid PROXY v1 header %q", b[:end])
+		}
+	default:
+		return nil, 0, fmt.Errorf("unsupported PROXY v1 protocol %q", fields[0])
+	}
+
+	var err error
+	if h.Source, err = parseV1Address(fields[1], fields[3]); err != nil {
+		return nil, 0, err
+	}
+	if h.Destination, err = parseV1Address(fields[2], fields[4]); err != nil {
+		return nil, 0, err
+	}
+
+	return h, end + 2, nil
+}
+
+func parseV1Address(host, port string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid PROXY v1 address %q", host)
+	}
+
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid PROXY v1 port %q", port)
+	}
+
+	return &net.TCPAddr{IP: ip, Port: int(p)}, nil
+}
+
+// parseV2 parses the binary header: the signature, the version and command, the address family
+// and protocol, the length of the addresses and the addresses followed by optional TLVs.
+func parseV2(b []byte) (*Header, int, error) {
+	if len(b) < v2HeaderSize {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+
+	if version := b[12] >> 4; version != 2 {
+		return nil, 0, fmt.Errorf("unsupported PROXY version %d", version)
+	}
+
+	size := v2HeaderSize + int(binary.BigEndian.Uint16(b[14:16]))
+	if len(b) < size {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+
+	h := &Header{Version: 2}
+	addresses := b[v2HeaderSize:size]
+
+	switch command := b[12] & 0x0f; command {
+	case 0: // LOCAL
+		return h, size, nil
+	case 1: // PROXY
+	default:
+		return nil, 0, fmt.Errorf("unsupported PROXY v2 command %d", command)
+	}
+
+	var ipLen int
+	switch family := b[13] >> 4; family {
+	case 1: // AF_INET
+		ipLen = net.IPv4len
+	case 2: // AF_INET6
+		ipLen = net.IPv6len
+	default:
+		// AF_UNSPEC and AF_UNIX carry no TCP addresses
+		return h, size, nil
+	}
+
+	if len(addresses) < 2*ipLen+4 {
+		return nil, 0, errors.New("PROXY v2 addresses too short")
+	}
+
+	h.Source = &net.TCPAddr{
+		IP:   net.IP(append([]byte(nil), addresses[:ipLen]...)),
+		Port: int(binary.BigEndian.Uint16(addresses[2*ipLen:])),
+	}
+	h.Destination = &net.TCPAddr{
+		IP:   net.IP(append([]byte(nil), addresses[ipLen:2*ipLen]...)),
+		Port: int(binary.BigEndian.Uint16(addresses[2*ipLen+2:])),
+	}
+
+	return h, size, nil
+}
@@ -0,0 +1,96 @@
+package push
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// NewInflux pushes InfluxDB line protocol to url: over HTTP, e.g. http://localhost:8086/write?db=kafka or
+// http://localhost:8086/api/v2/write?org=o&bucket=kafka with a token, or over UDP, e.g. udp://localhost:8089.
+// Every metric is a measurement with its labels as tags and its value as the field value, the counters
+// are cumulative, e.g. kafka_sniffer_typed_requests_total,client_ip=10.0.0.1,request_type=produce value=3 1700000000000000000
+func NewInflux(url, token string, opts Options) (*Pusher, error) {
+	opts.setDefaults()
+
+	p := &Pusher{name: "influx " + url, opts: opts, encoder: influxEncoder{}}
+
+	switch {
+	case strings.HasPrefix(url, "udp://"):
+		conn, err := net.Dial("udp", strings.TrimPrefix(url, "udp://"))
+		if err != nil {
+			return nil, err
+		}
+		p.send = func(lines []string) error {
+			return sendDatagrams(conn, lines)
+		}
+	case strings.HasPrefix(url, "http://"), strings.HasPrefix(url, "https://"):
+		client := &http.Client{Timeout: 10 * time.Second}
+		p.send = func(lines []string) error {
+			return postLines(client, url, token, lines)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported influx url %q, http://, https:// or udp://", url)
+	}
+
+	return p, nil
+}
+
+func postLines(client *http.Client, url, token string, lines []string) error {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewBufferString(strings.Join(lines, "\n")+"\n"))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if token != "" {
+		req.Header.Set("Authorization", "Token "+token)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s %s", resp.Status, msg)
+	}
+
+	return nil
+}
+
+type influxEncoder struct{}
+
+func (influxEncoder) encode(samples []sample, now time.Time) []string {
+	ts := strconv.FormatInt(now.UnixNano(), 10)
+
+	lines := make([]string, 0, len(samples))
+	for _, s := range samples {
+		var b strings.Builder
+		b.WriteString(influxMeasurement(s.name))
+		for _, t := range s.tags {
+			// empty tag values are invalid
+			if t.value != "" {
+				b.WriteString("," + influxTag(t.key) + "=" + influxTag(t.value))
+			}
+		}
+		b.WriteString(" value=" + strconv.FormatFloat(s.value, 'f', -1, 64) + " " + ts)
+
+		lines = append(lines, b.String())
+	}
+
+	return lines
+}
+
+// influxMeasurement escapes the commas and spaces of a measurement.
+var influxMeasurement = strings.NewReplacer(",", `\,`, " ", `\ `, "\n", "").Replace
+
+// influxTag escapes the commas, equal signs and spaces of a tag key or value.
+var influxTag = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `, "\n", "").Replace
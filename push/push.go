@@ -0,0 +1,175 @@
+// Package push flushes the metrics of the sniffer to StatsD or InfluxDB every interval, for the environments
+// without prometheus. The request counts, bytes, batch sizes and client/topic relations are those of /metrics,
+// aggregated by metrics.Metrics and metrics.Storage.
+package push
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+const (
+	// prefix of the metrics of the sniffer, the other metrics of the registry are not pushed
+	prefix = "kafka_sniffer_"
+	// maxDatagramSize keeps the UDP datagrams within the MTU of most networks.
+	maxDatagramSize = 1432
+)
+
+// Options configures a Pusher. The zero values of the fields commented with a default take that default.
+type Options struct {
+	// Interval between flushes, default 10s.
+	Interval time.Duration
+	// Gatherer gathers the metrics to push, default prometheus.DefaultGatherer.
+	Gatherer prometheus.Gatherer
+	// Tags are added to every metric, e.g. host.
+	Tags map[string]string
+}
+
+func (o *Options) setDefaults() {
+	if o.Interval <= 0 {
+		o.Interval = 10 * time.Second
+	}
+	if o.Gatherer == nil {
+		o.Gatherer = prometheus.DefaultGatherer
+	}
+}
+
+// Pusher flushes the gathered metrics every interval.
+type Pusher struct {
+	name    string
+	opts    Options
+	encoder encoder
+	send    func(lines []string) error
+}
+
+// encoder encodes the samples as lines of the protocol.
+type encoder interface {
+	encode(samples []sample, now time.Time) []string
+}
+
+// Run flushes every interval until ctx is done, then flushes once more.
+func (p *Pusher) Run(ctx context.Context) {
+	ticker := time.NewTicker(p.opts.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			p.flush()
+			return
+		case <-ticker.C:
+			p.flush()
+		}
+	}
+}
+
+func (p *Pusher) flush() {
+	if err := p.Push(); err != nil {
+		log.Printf("failed to push metrics to %s: %v", p.name, err)
+	}
+}
+
+// Push gathers the metrics and pushes them at once.
+func (p *Pusher) Push() error {
+	families, err := p.opts.Gatherer.Gather()
+	if err != nil {
+		return fmt.Errorf("gather metrics: %w", err)
+	}
+
+	lines := p.encoder.encode(samples(families, p.opts.Tags), time.Now())
+	if len(lines) == 0 {
+		return nil
+	}
+
+	return p.send(lines)
+}
+
+// sample is a value of a counter or a gauge with its tags, sorted by key.
+type sample struct {
+	name    string
+	tags    []tag
+	value   float64
+	counter bool
+}
+
+type tag struct {
+	key, value string
+}
+
+// key identifies the series of a sample.
+func (s sample) key() string {
+	var b strings.Builder
+	b.WriteString(s.name)
+	for _, t := range s.tags {
+		b.WriteString("\x00" + t.key + "=" + t.value)
+	}
+
+	return b.String()
+}
+
+// samples returns the counters and the gauges of the sniffer, the other metric types are not pushed.
+func samples(families []*dto.MetricFamily, tags map[string]string) (out []sample) {
+	for _, f := range families {
+		name := f.GetName()
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+
+		for _, m := range f.Metric {
+			s := sample{name: name}
+			switch f.GetType() {
+			case dto.MetricType_COUNTER:
+				s.value, s.counter = m.GetCounter().GetValue(), true
+			case dto.MetricType_GAUGE:
+				s.value = m.GetGauge().GetValue()
+			default:
+				continue
+			}
+
+			for k, v := range tags {
+				s.tags = append(s.tags, tag{key: k, value: v})
+			}
+			for _, l := range m.Label {
+				s.tags = append(s.tags, tag{key: l.GetName(), value: l.GetValue()})
+			}
+			sort.Slice(s.tags, func(i, j int) bool { return s.tags[i].key < s.tags[j].key })
+
+			out = append(out, s)
+		}
+	}
+
+	return out
+}
+
+// sendDatagrams sends the lines over UDP, as many per datagram as fit.
+func sendDatagrams(conn net.Conn, lines []string) error {
+	var datagram []byte
+	for _, line := range lines {
+		if len(datagram) > 0 && len(datagram)+1+len(line) > maxDatagramSize {
+			if _, err := conn.Write(datagram); err != nil {
+				return err
+			}
+			datagram = datagram[:0]
+		}
+
+		if len(datagram) > 0 {
+			datagram = append(datagram, '\n')
+		}
+		datagram = append(datagram, line...)
+	}
+
+	if len(datagram) == 0 {
+		return nil
+	}
+
+	_, err := conn.Write(datagram)
+	return err
+}
@@ -0,0 +1,103 @@
+package push
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// NewStatsD pushes to the StatsD server at address over UDP, e.g. localhost:8125. The counters are sent as the
+// increments since the last flush, the gauges as their values. With dogStatsD, the labels are DogStatsD tags,
+// e.g. kafka_sniffer_typed_requests_total:3|c|#client_ip:10.0.0.1,request_type:produce, otherwise their values
+// are appended to the name, e.g. kafka_sniffer_typed_requests_total.10_0_0_1.produce:3|c
+func NewStatsD(address string, dogStatsD bool, opts Options) (*Pusher, error) {
+	opts.setDefaults()
+
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Pusher{
+		name:    "statsd " + address,
+		opts:    opts,
+		encoder: &statsdEncoder{dogStatsD: dogStatsD, last: map[string]float64{}},
+		send: func(lines []string) error {
+			return sendDatagrams(conn, lines)
+		},
+	}, nil
+}
+
+type statsdEncoder struct {
+	dogStatsD bool
+	// last are the values of the counters at the last flush
+	last map[string]float64
+}
+
+func (e *statsdEncoder) encode(samples []sample, _ time.Time) []string {
+	var lines []string
+	seen := make(map[string]bool, len(samples))
+
+	for _, s := range samples {
+		value, typ := s.value, "g"
+		if s.counter {
+			key := s.key()
+			seen[key] = true
+
+			last, ok := e.last[key]
+			e.last[key] = s.value
+			if ok && s.value >= last {
+				value = s.value - last
+			}
+			if value == 0 {
+				continue
+			}
+			typ = "c"
+		}
+
+		lines = append(lines, e.line(s, value, typ))
+	}
+
+	// forget the series which are gone, e.g. expired
+	for key := range e.last {
+		if !seen[key] {
+			delete(e.last, key)
+		}
+	}
+
+	return lines
+}
+
+func (e *statsdEncoder) line(s sample, value float64, typ string) string {
+	var b strings.Builder
+	b.WriteString(statsdName(s.name))
+
+	if !e.dogStatsD {
+		for _, t := range s.tags {
+			if t.value != "" {
+				b.WriteString("." + statsdName(t.value))
+			}
+		}
+	}
+
+	b.WriteString(":" + strconv.FormatFloat(value, 'f', -1, 64) + "|" + typ)
+
+	if e.dogStatsD && len(s.tags) > 0 {
+		b.WriteString("|#")
+		for i, t := range s.tags {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			b.WriteString(dogStatsDTag(t.key) + ":" + dogStatsDTag(t.value))
+		}
+	}
+
+	return b.String()
+}
+
+// statsdName replaces the characters separating the parts of a metric or a line.
+var statsdName = strings.NewReplacer(".", "_", ":", "_", "|", "_", "@", "_", "#", "_", ",", "_", " ", "_", "\n", "_").Replace
+
+// dogStatsDTag replaces the characters separating the tags.
+var dogStatsDTag = strings.NewReplacer(",", "_", "|", "_", "#", "_", " ", "_", "\n", "_").Replace
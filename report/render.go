@@ -0,0 +1,195 @@
+package report
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bingoohuang/kafka-sniffer/clock"
+	"github.com/bingoohuang/kafka-sniffer/stream"
+)
+
+// Render writes r in format, FormatMarkdown, FormatCSV or FormatJSON. The clients keep their order and the times
+// are UTC, so that the reports of two runs diff line by line.
+func Render(w io.Writer, r *Report, format string) error {
+	switch format {
+	case FormatMarkdown:
+		return renderMarkdown(w, r)
+	case FormatCSV:
+		return renderCSV(w, r)
+	case FormatJSON:
+		enc := json.NewEncoder(w)
+		enc.SetEscapeHTML(false)
+		enc.SetIndent("", "  ")
+		return enc.Encode(r)
+	default:
+		return fmt.Errorf("unknown format %q, md, csv or json", format)
+	}
+}
+
+// ContentType returns the media type of format.
+func ContentType(format string) string {
+	switch format {
+	case FormatMarkdown:
+		return "text/markdown; charset=utf-8"
+	case FormatCSV:
+		return "text/csv; charset=utf-8"
+	case FormatJSON:
+		return "application/json; charset=utf-8"
+	default:
+		return "text/plain; charset=utf-8"
+	}
+}
+
+// Handler serves the report of the clients of inv within the window of the query parameters since and until,
+// see ParseWindow, in the format of the query parameter format, default md. The durations are before the time of c,
+// and until defaults to it. A previous report in JSON posted as the body is diffed against, see Diff.
+func Handler(inv *stream.ClientInventory, c clock.Clock) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		format := r.URL.Query().Get("format")
+		if format == "" {
+			format = FormatMarkdown
+		}
+		if format != FormatMarkdown && format != FormatCSV && format != FormatJSON {
+			http.Error(w, fmt.Sprintf("unknown format %q, md, csv or json", format), http.StatusBadRequest)
+			return
+		}
+
+		now := c.Now()
+		since, until, err := ParseWindow(r.URL.Query(), now)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if until.IsZero() {
+			// the report tells the time it is diffed against later
+			until = now
+		}
+
+		report := Build(inv.Snapshot(), since, until)
+
+		if r.Method == http.MethodPost {
+			var prev Report
+			if err := json.NewDecoder(r.Body).Decode(&prev); err != nil {
+				http.Error(w, "invalid previous report: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			Diff(report, &prev)
+		}
+
+		w.Header().Set("Content-Type", ContentType(format))
+		_ = Render(w, report, format)
+	}
+}
+
+// csvHeader are the columns of a report in CSV.
+var csvHeader = []string{"status", "ip", "client_id", "principals", "software", "roles", "topics", "brokers",
+	"requests", "connections", "tls", "first_seen", "last_seen"}
+
+// renderCSV writes r as CSV, a client per row, the values of a column separated by semicolons.
+func renderCSV(w io.Writer, r *Report) error {
+	cw := csv.NewWriter(w)
+	_ = cw.Write(csvHeader)
+
+	for _, e := range r.Clients {
+		_ = cw.Write([]string{
+			e.Status, e.IP, e.ClientID,
+			strings.Join(e.Principals, ";"), strings.Join(e.Software, ";"), strings.Join(e.Roles, ";"),
+			strings.Join(e.Topics, ";"), strings.Join(e.Brokers, ";"),
+			strconv.Itoa(e.Requests), strconv.Itoa(e.Connections), strconv.FormatBool(e.TLS),
+			formatTime(e.FirstSeen), formatTime(e.LastSeen),
+		})
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+// renderMarkdown writes r as a Markdown document: the window, whether the brokers have no clients left, and their table.
+func renderMarkdown(w io.Writer, r *Report) error {
+	b := bufio.NewWriter(w)
+
+	fmt.Fprintln(b, "# Kafka migration readiness report")
+	fmt.Fprintln(b)
+	fmt.Fprintf(b, "- window: %s to %s\n", formatBound(r.Since, "the start"), formatBound(r.Until, "now"))
+	if r.Previous != nil {
+		fmt.Fprintf(b, "- diffed against the report until %s\n", formatBound(*r.Previous, "now"))
+	}
+
+	counts := map[string]int{}
+	active := 0
+	for _, e := range r.Clients {
+		counts[e.Status]++
+		if e.Status == StatusGone {
+			continue
+		}
+		active++
+		for _, role := range e.Roles {
+			counts[role]++
+		}
+	}
+	fmt.Fprintf(b, "- clients: %d, producers: %d, consumers: %d\n", active, counts[stream.RoleProducer], counts[stream.RoleConsumer])
+	if r.Previous != nil {
+		fmt.Fprintf(b, "- new: %d, seen: %d, gone: %d\n", counts[StatusNew], counts[StatusSeen], counts[StatusGone])
+	}
+	fmt.Fprintln(b)
+
+	if r.Ready() {
+		fmt.Fprintln(b, "**Ready**: no client talked to the brokers within the window.")
+	} else {
+		fmt.Fprintf(b, "**Not ready**: %d client(s) still talk to the brokers.\n", active)
+	}
+
+	if len(r.Clients) == 0 {
+		return b.Flush()
+	}
+
+	fmt.Fprintln(b)
+	fmt.Fprintln(b, "| status | ip | client id | principal | software | role | topics | brokers | requests | connections | tls | last seen |")
+	fmt.Fprintln(b, "|---|---|---|---|---|---|---|---|---:|---:|---|---|")
+	for _, e := range r.Clients {
+		tls := ""
+		if e.TLS {
+			tls = "yes"
+		}
+		fmt.Fprintf(b, "| %s | %s | %s | %s | %s | %s | %s | %s | %d | %d | %s | %s |\n",
+			markdownCell(e.Status), markdownCell(e.IP), markdownCell(e.ClientID),
+			markdownList(e.Principals), markdownList(e.Software), markdownList(e.Roles),
+			markdownList(e.Topics), markdownList(e.Brokers), e.Requests, e.Connections, markdownCell(tls),
+			formatTime(e.LastSeen))
+	}
+
+	return b.Flush()
+}
+
+func formatTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+// formatBound formats a bound of the window, unbounded when it is zero.
+func formatBound(t time.Time, unbounded string) string {
+	if t.IsZero() {
+		return unbounded
+	}
+
+	return formatTime(t)
+}
+
+func markdownList(values []string) string {
+	return markdownCell(strings.Join(values, ", "))
+}
+
+// markdownCell escapes s as the cell of a Markdown table, - when it is empty.
+func markdownCell(s string) string {
+	if s == "" {
+		return "-"
+	}
+
+	return strings.NewReplacer(`|`, `\|`, "\n", " ").Replace(s)
+}
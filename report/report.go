@@ -0,0 +1,162 @@
+// Package report tells which clients still talk to the sniffed brokers, e.g. before their cluster is
+// decommissioned: the migration readiness report of a time window from a stream.ClientInventory,
+// diffable against a previous report, in Markdown, CSV or JSON.
+package report
+
+import (
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/bingoohuang/kafka-sniffer/stream"
+)
+
+// The formats of a rendered report
+const (
+	FormatMarkdown = "md"
+	FormatCSV      = "csv"
+	FormatJSON     = "json"
+)
+
+// The statuses of the entries of a report diffed against a previous one
+const (
+	// StatusNew is a client not in the previous report.
+	StatusNew = "new"
+	// StatusSeen is a client in the previous report too.
+	StatusSeen = "seen"
+	// StatusGone is a client of the previous report not seen any more.
+	StatusGone = "gone"
+)
+
+// Report is the migration readiness report: the clients seen within a time window.
+// The cluster is ready to be decommissioned when it has no clients.
+type Report struct {
+	// Since and Until are the window, zero when it is not bounded.
+	Since time.Time `json:"since"`
+	Until time.Time `json:"until"`
+	// Previous is the Until of the report diffed against, if any.
+	Previous *time.Time `json:"previous,omitempty"`
+	Clients  []Entry    `json:"clients"`
+}
+
+// Entry is a client, the connections of a client id from an IP.
+type Entry struct {
+	IP         string   `json:"ip"`
+	ClientID   string   `json:"client_id"`
+	Principals []string `json:"principals,omitempty"`
+	Software   []string `json:"software,omitempty"`
+	// Roles are stream.RoleProducer and stream.RoleConsumer.
+	Roles   []string `json:"roles,omitempty"`
+	Topics  []string `json:"topics,omitempty"`
+	Brokers []string `json:"brokers,omitempty"`
+	// Requests is the count of the requests since the sniffer started, not only within the window.
+	Requests int `json:"requests"`
+	// Connections is the count of its connections still open when the report was built.
+	Connections int `json:"connections"`
+	// TLS tells whether any of its connections used TLS, an IP without a client id when it was not decrypted.
+	TLS       bool      `json:"tls,omitempty"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	// Status is StatusNew, StatusSeen or StatusGone once diffed against a previous report.
+	Status string `json:"status,omitempty"`
+}
+
+// Ready tells whether no client talked to the brokers within the window, the gone ones aside.
+func (r *Report) Ready() bool {
+	for _, e := range r.Clients {
+		if e.Status != StatusGone {
+			return false
+		}
+	}
+
+	return true
+}
+
+// ParseWindow parses the query parameters since and until, RFC 3339 times or durations before now, e.g. 24h.
+func ParseWindow(q url.Values, now time.Time) (since, until time.Time, err error) {
+	if since, err = parseTime(q.Get("since"), now); err != nil {
+		return since, until, fmt.Errorf("invalid since: %w", err)
+	}
+	if until, err = parseTime(q.Get("until"), now); err != nil {
+		return since, until, fmt.Errorf("invalid until: %w", err)
+	}
+	if !since.IsZero() && !until.IsZero() && until.Before(since) {
+		return since, until, fmt.Errorf("until %s before since %s", until.Format(time.RFC3339), since.Format(time.RFC3339))
+	}
+
+	return since, until, nil
+}
+
+// parseTime parses a RFC 3339 time, or a duration before now, zero when s is empty.
+func parseTime(s string, now time.Time) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return t, fmt.Errorf("%q is no RFC 3339 time or duration", s)
+	}
+
+	return t, nil
+}
+
+// Build builds the report of the clients of the snapshot of a stream.ClientInventory seen within since and until,
+// those last seen not before since or with connections still open, and first seen not after until,
+// in the order of the snapshot.
+func Build(items []stream.ClientInventoryItem, since, until time.Time) *Report {
+	r := &Report{Since: since.UTC(), Until: until.UTC(), Clients: []Entry{}}
+
+	for _, item := range items {
+		if item.LastSeen.Before(since) && item.Connections == 0 || !until.IsZero() && item.FirstSeen.After(until) {
+			continue
+		}
+
+		r.Clients = append(r.Clients, Entry{
+			IP:          item.IP,
+			ClientID:    item.ClientID,
+			Principals:  item.Principals,
+			Software:    item.Software,
+			Roles:       item.Roles,
+			Topics:      item.Topics,
+			Brokers:     item.Brokers,
+			Requests:    item.Requests,
+			Connections: item.Connections,
+			TLS:         item.TLS,
+			FirstSeen:   item.FirstSeen.UTC(),
+			LastSeen:    item.LastSeen.UTC(),
+		})
+	}
+
+	return r
+}
+
+// Diff marks the clients of r StatusNew or StatusSeen against prev, and appends the clients of prev
+// not in r as StatusGone, in their order.
+func Diff(r, prev *Report) {
+	until := prev.Until
+	r.Previous = &until
+
+	index := make(map[[2]string]int, len(r.Clients))
+	for i, e := range r.Clients {
+		index[[2]string{e.IP, e.ClientID}] = i
+		r.Clients[i].Status = StatusNew
+	}
+
+	for _, e := range prev.Clients {
+		if e.Status == StatusGone {
+			continue
+		}
+
+		if i, ok := index[[2]string{e.IP, e.ClientID}]; ok {
+			r.Clients[i].Status = StatusSeen
+			continue
+		}
+
+		e.Status = StatusGone
+		r.Clients = append(r.Clients, e)
+	}
+}
@@ -0,0 +1,84 @@
+package report
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bingoohuang/kafka-sniffer/kafka"
+	"github.com/bingoohuang/kafka-sniffer/stream"
+)
+
+var start = time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+
+func TestTLSOnlyClientNotReady(t *testing.T) {
+	inv := stream.NewClientInventory()
+	conn := &stream.Connection{
+		Endpoints: stream.Endpoints{Client: "10.0.0.7:51000", Broker: "10.0.1.1:9093"},
+		TLS:       &stream.TLSInfo{ServerName: "kafka-1", Version: "TLS 1.3"},
+		Time:      start,
+	}
+	inv.Publish(stream.Event{Type: stream.EventConnection, Connection: conn})
+
+	// the connection is still open, though seen only before the window
+	r := Build(inv.Snapshot(), start.Add(time.Hour), time.Time{})
+	if r.Ready() || len(r.Clients) != 1 {
+		t.Fatalf("report of an open TLS connection %+v, want not ready", r)
+	}
+	if e := r.Clients[0]; e.IP != "10.0.0.7" || e.ClientID != "" || !e.TLS || e.Connections != 1 ||
+		len(e.Brokers) != 1 || e.Brokers[0] != "10.0.1.1:9093" {
+		t.Errorf("entry %+v", e)
+	}
+
+	var md bytes.Buffer
+	if err := Render(&md, r, FormatMarkdown); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(md.String(), "**Not ready**: 1 client(s)") || !strings.Contains(md.String(), "| 10.0.0.7 | - |") {
+		t.Errorf("markdown report:\n%s", md.String())
+	}
+
+	closed := *conn
+	closed.Closed, closed.Time = true, start.Add(2*time.Hour)
+	inv.Publish(stream.Event{Type: stream.EventConnection, Connection: &closed})
+
+	if r := Build(inv.Snapshot(), start.Add(time.Hour), time.Time{}); r.Ready() || r.Clients[0].Connections != 0 {
+		t.Errorf("report of a TLS connection closed within the window %+v, want not ready", r)
+	}
+	if r := Build(inv.Snapshot(), start.Add(3*time.Hour), time.Time{}); !r.Ready() {
+		t.Errorf("report of a TLS connection closed before the window %+v, want ready", r)
+	}
+}
+
+func TestUndecodedRequestsNotReady(t *testing.T) {
+	// a Metadata v1 request of all topics, whose type is not decoded
+	frame := []byte{0, 0, 0, 0, 0, 3, 0, 1, 0, 0, 0, 5, 0, 7}
+	frame = append(frame, "admin-1"...)
+	frame = append(frame, 0xff, 0xff, 0xff, 0xff)
+	binary.BigEndian.PutUint32(frame, uint32(len(frame)-4))
+
+	header, _, err := kafka.NewRequestReader(bytes.NewReader(frame)).Next()
+	if err == nil || header == nil || header.ClientID != "admin-1" || header.Key != 3 || header.CorrelationID != 5 {
+		t.Fatalf("undecoded frame read as %+v, %v", header, err)
+	}
+
+	inv := stream.NewClientInventory()
+	endpoints := stream.Endpoints{Client: "10.0.0.8:52000", Broker: "10.0.1.1:9092"}
+	inv.Publish(stream.Event{Type: stream.EventConnection, Connection: &stream.Connection{Endpoints: endpoints, Time: start}})
+	inv.Publish(stream.Event{Type: stream.EventDecodeError, DecodeError: &stream.DecodeError{
+		Endpoints: endpoints,
+		Header:    header,
+		Error:     err.Error(),
+		Time:      start.Add(time.Second),
+	}})
+
+	r := Build(inv.Snapshot(), start, time.Time{})
+	if r.Ready() || len(r.Clients) != 1 {
+		t.Fatalf("report of a Metadata client %+v, want not ready", r)
+	}
+	if e := r.Clients[0]; e.IP != "10.0.0.8" || e.ClientID != "admin-1" || e.Requests != 1 || e.Connections != 1 || e.TLS {
+		t.Errorf("entry %+v", e)
+	}
+}
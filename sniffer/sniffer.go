@@ -0,0 +1,507 @@
+// Package sniffer captures Kafka traffic and decodes the requests of the clients. It is what the
+// kafka-sniffer command runs, for programs which observe Kafka traffic without running the binary:
+//
+//	s, err := sniffer.New(sniffer.Options{
+//		Interface: "eth0",
+//		Ports:     "9092",
+//		OnRequest: func(r stream.Request) { log.Printf("%s %s %v", r.Client, r.Type, r.Topics) },
+//	})
+//	if err != nil {
+//		return err
+//	}
+//	if err := s.Start(ctx); err != nil {
+//		return err
+//	}
+//	defer s.Stop()
+package sniffer
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bingoohuang/kafka-sniffer/clock"
+	"github.com/bingoohuang/kafka-sniffer/dashboard"
+	"github.com/bingoohuang/kafka-sniffer/metrics"
+	"github.com/bingoohuang/kafka-sniffer/mirror"
+	"github.com/bingoohuang/kafka-sniffer/report"
+	"github.com/bingoohuang/kafka-sniffer/stream"
+	"github.com/bingoohuang/kafka-sniffer/tlssniff"
+	"github.com/bingoohuang/kafka-sniffer/topology"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/pcap"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// pcapTimeout is how long a capture read waits for packets, and so how long Stop waits for the capture to end.
+const pcapTimeout = 500 * time.Millisecond
+
+// Options configures a Sniffer. The zero values of the fields commented with a default take that default.
+type Options struct {
+	// Interface to capture on, default eth0. It is not used with Mirrors or ReadFile.
+	Interface string
+	// ReadFile is a pcap file to replay instead of capturing, e.g. recorded by tcpdump -w.
+	ReadFile string
+	// Snaplen of the capture, default 16KiB.
+	Snaplen int
+	// BPF expression of the capture, default to both directions of the broker ports.
+	BPF string
+	// Mirrors are URLs receiving mirrored packets instead of capturing, see mirror.Listen.
+	Mirrors []string
+	// Tunnels also captures the broker ports behind VLAN tags and in VXLAN, Geneve and GRE tunnels.
+	Tunnels bool
+
+	// Ports are the Kafka broker ports, default 9092, e.g. 9092,9093
+	Ports string
+	// TLSPorts are the TLS broker ports, see stream.BrokerPorts.ParseTLSPorts.
+	TLSPorts string
+	// Discover captures all TCP for this long and probes the streams for Kafka requests,
+	// then narrows the BPF to the broker ports found.
+	Discover time.Duration
+	// KeyLogFile is the NSS key log file of the clients to decrypt their TLS connections.
+	KeyLogFile string
+
+	// Shards is the count of TCP reassembly shards, default the count of CPUs.
+	Shards int
+	// QueueSize is the packet queue size of each shard, default 1000. The packets beyond a full queue are dropped,
+	// except those of ReadFile, which is read as fast as the shards assemble it.
+	QueueSize int
+
+	// PrintClients logs the clients and their requests and collects them in a stream.ClientStat.
+	PrintClients bool
+	// PrintType logs the requests whose type contains it, e.g. FetchRequest, with PrintClients.
+	PrintType string
+	// PrintJSONInterval logs a request as JSON once per interval, with PrintClients.
+	PrintJSONInterval time.Duration
+	// RelationMetrics exports the relations of the clients and topics as prometheus metrics.
+	RelationMetrics bool
+	// MetricsExpireTime is the expiration time of the relation metrics, default 5m.
+	MetricsExpireTime time.Duration
+	// MetricsMaxLabels is the maximum count of label sets of each relation metric, the least recently seen
+	// are evicted beyond it. 0 keeps them until they expire.
+	MetricsMaxLabels int
+	// Clock tells the time of the statistics, the events and the expiry, default a clock.Packet
+	// following the timestamps of the packets. A clock.Observer observes every packet.
+	Clock clock.Clock
+	// Registerer registers the prometheus metrics of the sniffer, default prometheus.DefaultRegisterer.
+	// Every sniffer of a process needs its own, e.g. a prometheus.NewRegistry().
+	Registerer prometheus.Registerer
+
+	// EventsMaxClients is the maximum count of the clients of /events at once, default 16.
+	EventsMaxClients int
+	// EventsMaxRate is the maximum events per second streamed to a client of /events, default 100.
+	EventsMaxRate float64
+
+	// Verbose logs every packet in great detail.
+	Verbose bool
+
+	// OnConnection is called when decoding a client connection starts and when it ended.
+	OnConnection func(stream.Connection)
+	// OnRequest is called with every decoded request.
+	OnRequest func(stream.Request)
+	// Sinks receive all the events of the decoders, see stream.Sink.
+	Sinks []stream.Sink
+}
+
+func (o *Options) setDefaults() {
+	if o.Interface == "" {
+		o.Interface = "eth0"
+	}
+	if o.Snaplen <= 0 {
+		o.Snaplen = 16 << 10
+	}
+	if o.Ports == "" {
+		o.Ports = "9092"
+	}
+	if o.Shards <= 0 {
+		o.Shards = runtime.NumCPU()
+	}
+	if o.QueueSize <= 0 {
+		o.QueueSize = 1000
+	}
+	if o.MetricsExpireTime <= 0 {
+		o.MetricsExpireTime = 5 * time.Minute
+	}
+	if o.EventsMaxClients <= 0 {
+		o.EventsMaxClients = 16
+	}
+	if o.EventsMaxRate <= 0 {
+		o.EventsMaxRate = 100
+	}
+	if o.Registerer == nil {
+		o.Registerer = prometheus.DefaultRegisterer
+	}
+	if o.Clock == nil {
+		o.Clock = clock.NewPacket()
+	}
+}
+
+// Sniffer captures Kafka traffic and decodes it.
+type Sniffer struct {
+	opts       Options
+	ports      *stream.BrokerPorts
+	bus        *stream.Bus
+	factory    stream.ConnStreamFactory
+	clientStat *stream.ClientStat
+	recycle    *clock.Schedule
+	topicStat  *stream.TopicStat
+	inventory  *stream.ClientInventory
+	events     *stream.LiveEvents
+	metrics    *metrics.Metrics
+	storage    *metrics.Storage
+
+	lock      sync.Mutex
+	bpf       string
+	handle    *pcap.Handle
+	mirrors   []*mirror.Source
+	assembler *stream.ShardedAssembler
+	readers   sync.WaitGroup
+	cancel    context.CancelFunc
+	stopped   bool
+}
+
+// New creates a Sniffer with the decoders of opts, the capture is opened by Start.
+func New(opts Options) (*Sniffer, error) {
+	opts.setDefaults()
+
+	ports, err := stream.ParseBrokerPorts(opts.Ports)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse broker ports: %w", err)
+	}
+	if err := ports.ParseTLSPorts(opts.TLSPorts); err != nil {
+		return nil, fmt.Errorf("failed to parse broker TLS ports: %w", err)
+	}
+
+	var keyLog *tlssniff.KeyLog
+	if opts.KeyLogFile != "" {
+		if keyLog, err = tlssniff.LoadKeyLog(opts.KeyLogFile); err != nil {
+			return nil, fmt.Errorf("failed to load key log: %w", err)
+		}
+	}
+
+	ports.SetClock(opts.Clock)
+
+	s := &Sniffer{opts: opts, ports: ports, bus: stream.NewBus(), metrics: metrics.New(opts.Registerer)}
+
+	if opts.PrintClients {
+		s.clientStat = stream.NewClientStat(opts.Clock)
+		s.recycle = clock.NewSchedule(opts.Clock, recycleInterval)
+		s.bus.Subscribe(stream.NewLogSink(opts.PrintJSONInterval, opts.PrintType, opts.Verbose))
+		s.bus.Subscribe(s.clientStat)
+	}
+
+	if opts.RelationMetrics {
+		s.storage = metrics.NewStorage(opts.Registerer, opts.MetricsExpireTime, opts.MetricsMaxLabels, opts.Clock)
+	}
+	s.bus.Subscribe(stream.NewMetricsSink(s.metrics, s.storage))
+
+	s.topicStat = stream.NewTopicStat(opts.Clock)
+	s.bus.Subscribe(s.topicStat)
+	s.inventory = stream.NewClientInventory()
+	s.bus.Subscribe(s.inventory)
+
+	s.events = stream.NewLiveEvents(opts.EventsMaxClients, opts.EventsMaxRate)
+	s.bus.Subscribe(s.events)
+
+	if opts.OnConnection != nil || opts.OnRequest != nil {
+		s.bus.Subscribe(stream.SinkFunc(func(e stream.Event) {
+			switch {
+			case e.Type == stream.EventConnection && opts.OnConnection != nil:
+				opts.OnConnection(*e.Connection)
+			case e.Type == stream.EventRequest && opts.OnRequest != nil:
+				opts.OnRequest(*e.Request)
+			}
+		}))
+	}
+
+	for _, sink := range opts.Sinks {
+		s.bus.Subscribe(sink)
+	}
+
+	s.factory = stream.NewKafkaStreamFactory(s.bus, ports, keyLog, s.metrics, opts.Clock)
+
+	return s, nil
+}
+
+// Subscribe adds a sink receiving the events of the decoders.
+func (s *Sniffer) Subscribe(sink stream.Sink) {
+	s.bus.Subscribe(sink)
+}
+
+// BrokerPorts returns the broker ports, configured and discovered.
+func (s *Sniffer) BrokerPorts() *stream.BrokerPorts {
+	return s.ports
+}
+
+// ClientStat returns the clients collected with Options.PrintClients, nil otherwise.
+func (s *Sniffer) ClientStat() *stream.ClientStat {
+	return s.clientStat
+}
+
+// TopicStat returns the inventory of the topics named by the requests.
+func (s *Sniffer) TopicStat() *stream.TopicStat {
+	return s.topicStat
+}
+
+// ClientInventory returns the registry of the clients talking to the brokers.
+func (s *Sniffer) ClientInventory() *stream.ClientInventory {
+	return s.inventory
+}
+
+// Metrics returns the prometheus metrics of the sniffer, registered with Options.Registerer.
+func (s *Sniffer) Metrics() *metrics.Metrics {
+	return s.metrics
+}
+
+// StreamFactory returns the decoders, e.g. for relayed connections, see proxy.New.
+func (s *Sniffer) StreamFactory() stream.ConnStreamFactory {
+	return s.factory
+}
+
+// BPF returns the BPF expression of the capture.
+func (s *Sniffer) BPF() string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.bpf
+}
+
+// RegisterHandlers serves the broker ports at /listeners, the topics at /topics, the migration readiness report
+// at /report/migration, the clients at /client, their graph at /client/graph and /topology, the live events
+// at /events and the dashboard at /ui/ on mux.
+func (s *Sniffer) RegisterHandlers(mux *http.ServeMux) {
+	mux.Handle("/listeners", stream.ServeListenersHandler(s.ports))
+	mux.Handle("/topics", stream.ServeTopicStatHandler(s.topicStat))
+	mux.Handle("/report/migration", report.Handler(s.inventory, s.opts.Clock))
+	mux.Handle("/events", s.events)
+	if s.clientStat != nil {
+		mux.Handle("/client", stream.ServeClientStatHandler(s.clientStat))
+		mux.Handle("/client/graph", stream.ServeClientGraphHandler(s.clientStat))
+		mux.Handle("/topology", topology.Handler(s.clientStat))
+		mux.Handle("/ui/", dashboard.Handler("/ui/"))
+	}
+}
+
+// Start opens the capture or the mirror inputs and decodes their packets in the background,
+// until Stop is called or ctx is done.
+func (s *Sniffer) Start(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.opts.Discover > 0 {
+		s.ports.StartDiscovery()
+	}
+
+	customBPF := s.opts.BPF != ""
+	if s.bpf = s.opts.BPF; !customBPF {
+		s.bpf = s.defaultBPF()
+	}
+
+	sources, err := s.openPacketSources()
+	if err != nil {
+		cancel()
+		s.closeSources()
+		return err
+	}
+
+	s.cancel = cancel
+	s.assembler = stream.NewShardedAssembler(s.factory, s.ports, s.metrics, s.opts.Clock, s.opts.Shards, s.opts.QueueSize, s.opts.Verbose)
+	// a capture file is read as fast as the shards assemble it, dropping none of its packets
+	s.assembler.SetBlocking(s.opts.ReadFile != "" && len(s.opts.Mirrors) == 0)
+	s.assembler.Start()
+
+	if s.opts.Discover > 0 {
+		go s.narrowAfterDiscovery(ctx, customBPF)
+	}
+
+	if s.clientStat != nil {
+		go s.recycleClientStat(ctx)
+	}
+
+	observer, _ := s.opts.Clock.(clock.Observer)
+	for _, packets := range sources {
+		s.readers.Add(1)
+		go func(packets chan gopacket.Packet) {
+			defer s.readers.Done()
+
+			// Read in packets, pass to assembler.
+			for p := range packets {
+				if s.opts.Verbose {
+					log.Println(p)
+				}
+
+				if observer != nil {
+					observer.Observe(p.Metadata().Timestamp)
+				}
+				s.recycleIfDue()
+				s.assembler.Assemble(p)
+			}
+		}(packets)
+	}
+
+	if s.opts.Verbose {
+		log.Println("reading in packets")
+	}
+
+	go func() {
+		<-ctx.Done()
+		s.Stop()
+	}()
+
+	return nil
+}
+
+// Stop closes the capture and the connections being decoded, the callbacks see them closed.
+func (s *Sniffer) Stop() {
+	s.lock.Lock()
+	if s.stopped || s.assembler == nil {
+		s.lock.Unlock()
+		return
+	}
+	s.stopped = true
+	s.cancel()
+	s.closeSources()
+	s.lock.Unlock()
+
+	s.readers.Wait()
+	s.assembler.Stop()
+
+	if s.storage != nil {
+		s.storage.Close()
+	}
+}
+
+// defaultBPF captures both directions of the broker ports, see Options.Tunnels.
+func (s *Sniffer) defaultBPF() string {
+	expr := s.ports.BPF()
+	if s.opts.Tunnels {
+		return stream.TunnelBPF(expr)
+	}
+
+	return expr
+}
+
+// openPacketSources opens the mirror inputs, the file to replay, or the capture on the interface without them.
+func (s *Sniffer) openPacketSources() (sources []chan gopacket.Packet, err error) {
+	if len(s.opts.Mirrors) > 0 {
+		for _, u := range s.opts.Mirrors {
+			m, err := mirror.Listen(strings.TrimSpace(u))
+			if err != nil {
+				return nil, fmt.Errorf("failed to listen for mirrored packets: %w", err)
+			}
+
+			log.Printf("receiving mirrored packets on %s", u)
+			s.mirrors = append(s.mirrors, m)
+			sources = append(sources, m.Packets())
+		}
+
+		return sources, nil
+	}
+
+	if s.opts.ReadFile != "" {
+		log.Printf("replaying capture file %q using bpf %q", s.opts.ReadFile, s.bpf)
+		if s.handle, err = pcap.OpenOffline(s.opts.ReadFile); err != nil {
+			return nil, err
+		}
+	} else {
+		log.Printf("starting capture on interface %q using bpf %q", s.opts.Interface, s.bpf)
+
+		// Set up pcap packet capture
+		if s.handle, err = pcap.OpenLive(s.opts.Interface, int32(s.opts.Snaplen), true, pcapTimeout); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := s.handle.SetBPFFilter(s.bpf); err != nil {
+		return nil, err
+	}
+
+	return append(sources, gopacket.NewPacketSource(s.handle, s.handle.LinkType()).Packets()), nil
+}
+
+func (s *Sniffer) closeSources() {
+	if s.handle != nil {
+		s.handle.Close()
+	}
+
+	for _, m := range s.mirrors {
+		_ = m.Close()
+	}
+}
+
+// recycleInterval is how often the clients whose connections ended longer ago are forgotten.
+const recycleInterval = time.Minute
+
+// recycleClientStat checks the recycling of the clients while no packets arrive.
+func (s *Sniffer) recycleClientStat(ctx context.Context) {
+	t := time.NewTicker(recycleInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			s.recycleIfDue()
+		}
+	}
+}
+
+// recycleIfDue forgets the clients whose connections ended a while ago, every recycleInterval of the time
+// of the clock, checked on every packet.
+func (s *Sniffer) recycleIfDue() {
+	if s.clientStat == nil {
+		return
+	}
+
+	if now, ok := s.recycle.Due(); ok {
+		s.clientStat.Recycle(now, recycleInterval)
+	}
+}
+
+// narrowAfterDiscovery stops discovering once the discovery time passed and broker ports were found by probing,
+// the configured ones aside, and narrows the BPF of the capture to all the broker ports.
+func (s *Sniffer) narrowAfterDiscovery(ctx context.Context, customBPF bool) {
+	ticker := time.NewTicker(s.opts.Discover)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if len(s.ports.Discovered()) > 0 {
+			break
+		}
+
+		log.Printf("no Kafka listener discovered yet, keep on probing all TCP")
+	}
+
+	s.ports.StopDiscovery()
+	log.Printf("discovered Kafka listeners on ports %v", s.ports.Discovered())
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.handle == nil || customBPF || s.stopped {
+		return
+	}
+
+	s.bpf = s.defaultBPF()
+	if err := s.handle.SetBPFFilter(s.bpf); err != nil {
+		log.Printf("failed to narrow the BPF to %q, err: %v", s.bpf, err)
+		return
+	}
+
+	log.Printf("narrowed the BPF to %q", s.bpf)
+}
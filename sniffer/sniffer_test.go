@@ -0,0 +1,114 @@
+package sniffer
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/bingoohuang/kafka-sniffer/clock"
+	"github.com/bingoohuang/kafka-sniffer/stream"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+)
+
+func TestRecycleByPacketTime(t *testing.T) {
+	start := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	c := clock.NewPacket()
+	c.Observe(start)
+
+	s := &Sniffer{clientStat: stream.NewClientStat(c), recycle: clock.NewSchedule(c, recycleInterval)}
+	s.recycleIfDue()
+
+	s.clientStat.Stat("10.0.0.1:50000", "10.0.1.1:9092", "", "c1", "", "*kafka.FetchRequest", []string{"orders"}, 100, start)
+	s.clientStat.Stat("10.0.0.2:50000", "10.0.1.1:9092", "", "c2", "", "*kafka.FetchRequest", []string{"orders"}, 100, start)
+	c.Observe(start.Add(30 * time.Second))
+	s.clientStat.Clear("10.0.0.1:50000", "10.0.1.1:9092", "", start.Add(30*time.Second))
+
+	// due a minute of packets later, the connection ended only half a minute ago
+	c.Observe(start.Add(recycleInterval + time.Second))
+	s.recycleIfDue()
+	if got := len(s.clientStat.Snapshot()); got != 2 {
+		t.Fatalf("%d clients after a minute, want 2", got)
+	}
+
+	// the replay goes on faster than the wall clock, no ticker fired
+	c.Observe(start.Add(2*recycleInterval + 2*time.Second))
+	s.recycleIfDue()
+	items := s.clientStat.Snapshot()
+	if len(items) != 1 || items[0].ClientID != "c2" {
+		t.Fatalf("clients %+v after two minutes, want only the open one", items)
+	}
+}
+
+// frame is an Ethernet frame of a TCP segment from src to dst, over IPv4 or IPv6 as the addresses are,
+// tagged with vlan unless it is 0.
+func frame(t *testing.T, vlan uint16, src, dst string, srcPort, dstPort layers.TCPPort) []byte {
+	t.Helper()
+
+	eth := &layers.Ethernet{SrcMAC: net.HardwareAddr{0, 0, 0, 0, 0, 1}, DstMAC: net.HardwareAddr{0, 0, 0, 0, 0, 2}}
+	tcp := &layers.TCP{SrcPort: srcPort, DstPort: dstPort, Seq: 1000, Ack: 1, PSH: true, ACK: true, Window: 65535}
+
+	var ip gopacket.SerializableLayer
+	etherType := layers.EthernetTypeIPv4
+	if srcIP, dstIP := net.ParseIP(src), net.ParseIP(dst); srcIP.To4() != nil {
+		ip4 := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: srcIP.To4(), DstIP: dstIP.To4()}
+		_ = tcp.SetNetworkLayerForChecksum(ip4)
+		ip = ip4
+	} else {
+		ip6 := &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolTCP, SrcIP: srcIP, DstIP: dstIP}
+		_ = tcp.SetNetworkLayerForChecksum(ip6)
+		ip, etherType = ip6, layers.EthernetTypeIPv6
+	}
+
+	stack := []gopacket.SerializableLayer{eth}
+	if vlan != 0 {
+		eth.EthernetType = layers.EthernetTypeDot1Q
+		stack = append(stack, &layers.Dot1Q{VLANIdentifier: vlan, Type: etherType})
+	} else {
+		eth.EthernetType = etherType
+	}
+	stack = append(stack, ip, tcp, gopacket.Payload("request"))
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, stack...); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestDefaultBPFMatchesIPv6(t *testing.T) {
+	ports, err := stream.ParseBrokerPorts("9092")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tunnels := range []bool{false, true} {
+		s := &Sniffer{ports: ports, opts: Options{Tunnels: tunnels}}
+		expr := s.defaultBPF()
+		bpf, err := pcap.NewBPF(layers.LinkTypeEthernet, 65535, expr)
+		if err != nil {
+			t.Skipf("libpcap cannot compile %q: %v", expr, err)
+		}
+
+		for _, tc := range []struct {
+			name  string
+			frame []byte
+			want  bool
+		}{
+			{"IPv4 request", frame(t, 0, "10.0.0.1", "10.0.1.1", 50000, 9092), true},
+			{"IPv6 request", frame(t, 0, "fd00::1", "fd00::2", 50000, 9092), true},
+			{"IPv6 response", frame(t, 0, "fd00::2", "fd00::1", 9092, 50000), true},
+			{"IPv6 of another port", frame(t, 0, "fd00::1", "fd00::2", 50000, 22), false},
+			{"IPv6 behind a VLAN tag", frame(t, 100, "fd00::1", "fd00::2", 50000, 9092), tunnels},
+		} {
+			ci := gopacket.CaptureInfo{Timestamp: time.Now(), CaptureLength: len(tc.frame), Length: len(tc.frame)}
+			if got := bpf.Matches(ci, tc.frame); got != tc.want {
+				t.Errorf("%q matches the %s: %t, want %t", expr, tc.name, got, tc.want)
+			}
+		}
+	}
+}
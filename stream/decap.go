@@ -0,0 +1,92 @@
+package stream
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// Segment is the innermost TCP segment of a packet, unwrapped from VLAN tags, from
+// VXLAN, Geneve and GRE tunnels and from the TZSP and ERSPAN mirroring protocols.
+type Segment struct {
+	Network gopacket.NetworkLayer
+	TCP     *layers.TCP
+
+	// Tunnel describes the encapsulations from the outermost on, e.g. "vlan=100,vni=5001".
+	// It is empty for plain packets.
+	Tunnel string
+}
+
+// Decapsulate finds the innermost TCP segment of p. gopacket decodes the supported encapsulations on
+// its own, VXLAN and Geneve on their well known UDP ports, so that the inner layers follow the outer ones.
+func Decapsulate(p gopacket.Packet) (Segment, bool) {
+	var (
+		network gopacket.NetworkLayer
+		tunnel  []string
+	)
+
+	for _, l := range p.Layers() {
+		switch l := l.(type) {
+		case *layers.Dot1Q:
+			tunnel = append(tunnel, fmt.Sprintf("vlan=%d", l.VLANIdentifier))
+		case *layers.VXLAN:
+			tunnel = append(tunnel, fmt.Sprintf("vni=%d", l.VNI))
+		case *layers.Geneve:
+			tunnel = append(tunnel, fmt.Sprintf("vni=%d", l.VNI))
+		case *TZSP:
+			tunnel = append(tunnel, "tzsp")
+		case *ERSPAN:
+			tunnel = append(tunnel, fmt.Sprintf("erspan=%d", l.SessionID))
+		case *layers.GRE:
+			if l.Protocol == ethernetTypeERSPAN || l.Protocol == ethernetTypeERSPANIII {
+				// labeled by the ERSPAN session
+				continue
+			}
+
+			if l.KeyPresent {
+				tunnel = append(tunnel, fmt.Sprintf("gre=%d", l.Key))
+			} else {
+				tunnel = append(tunnel, "gre")
+			}
+		case *layers.IPv4, *layers.IPv6:
+			network = l.(gopacket.NetworkLayer)
+		case *layers.TCP:
+			if network == nil {
+				return Segment{}, false
+			}
+
+			return Segment{Network: network, TCP: l, Tunnel: strings.Join(tunnel, ",")}, true
+		}
+	}
+
+	return Segment{}, false
+}
+
+// TunnelBPF extends the BPF expression for plain packets to the same packets behind VLAN tags, and to all
+// VXLAN, Geneve and GRE packets, whose inner headers a BPF expression cannot reach.
+func TunnelBPF(plain string) string {
+	expr := fmt.Sprintf("(%s) or (udp and (port 4789 or port 6081)) or proto gre", plain)
+
+	// vlan shifts the offsets of everything following it, so it comes last
+	return fmt.Sprintf("%s or (vlan and (%s))", expr, expr)
+}
+
+// tunnelOf returns the encapsulations of the packets of an assembler context, see Segment.Tunnel.
+func tunnelOf(ac interface{}) string {
+	if t, ok := ac.(interface{ Tunnel() string }); ok {
+		return t.Tunnel()
+	}
+
+	return ""
+}
+
+// via formats the tunnel for logs.
+func via(tunnel string) string {
+	if tunnel == "" {
+		return ""
+	}
+
+	return " via " + tunnel
+}
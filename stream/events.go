@@ -0,0 +1,190 @@
+package stream
+
+import (
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/bingoohuang/kafka-sniffer/kafka"
+)
+
+// EventType tells which of the fields of an Event is set.
+type EventType string
+
+// The types of the events published by the decoders
+const (
+	EventConnection  EventType = "connection"
+	EventRequest     EventType = "request"
+	EventResponse    EventType = "response"
+	EventDecodeError EventType = "decode_error"
+)
+
+// Event is published by the decoders for every connection, request, response and decode error.
+// Exactly one of the fields after Type is set, according to Type.
+type Event struct {
+	Type EventType
+
+	Connection  *Connection  `json:",omitempty"`
+	Request     *Request     `json:",omitempty"`
+	Response    *Response    `json:",omitempty"`
+	DecodeError *DecodeError `json:",omitempty"`
+}
+
+// Endpoints identify the connection an event happened on.
+type Endpoints struct {
+	// Client is the address of the client, the original one behind a load balancer sending a PROXY header.
+	Client string
+	Broker string
+	Tunnel string `json:",omitempty"`
+}
+
+// Connection describes a client connection to a broker, once when decoding starts and once when it ended.
+type Connection struct {
+	Endpoints
+
+	// Proxy is the address of the load balancer which sent a PROXY header, if any.
+	Proxy string `json:",omitempty"`
+	// TLS is set for TLS connections, decrypted or not.
+	TLS    *TLSInfo `json:",omitempty"`
+	Closed bool
+	Time   time.Time
+}
+
+// Request is a request decoded from a client connection.
+type Request struct {
+	Endpoints
+	*kafka.Request
+
+	// Type is the Go type of the body, e.g. *kafka.ProduceRequest
+	Type   string
+	Topics []string `json:",omitempty"`
+	// Principal is the user the connection authenticated as with SASL, if seen.
+	Principal string `json:",omitempty"`
+	// Software is the name/version of the client software the connection told with ApiVersions, if seen.
+	Software string `json:",omitempty"`
+	// Size is the count of bytes the request was decoded from.
+	Size int
+	Time time.Time
+}
+
+// Response is the response of a broker to a request, told by its correlation id.
+// Only the frame of the response is read, not its body.
+type Response struct {
+	Endpoints
+
+	CorrelationID int32
+	// Key, Version, ClientID and Topics are those of the request answered.
+	Key      int16
+	Version  int16
+	ClientID string
+	Topics   []string `json:",omitempty"`
+	Size     int
+	// Latency is the time from the request to the response.
+	Latency time.Duration
+	Time    time.Time
+}
+
+// DecodeError is a request which could not be decoded.
+type DecodeError struct {
+	Endpoints
+
+	// Header is the header of a frame whose request type is not decoded, e.g. Metadata, its Body nil.
+	Header *kafka.Request `json:",omitempty"`
+	Error  string
+	Time   time.Time
+}
+
+// Sink receives the events of the decoders. Publish is called concurrently from the goroutines
+// decoding the connections, and from the assembler for responses, so it must not block.
+type Sink interface {
+	Publish(Event)
+}
+
+// SinkFunc is a function receiving events.
+type SinkFunc func(Event)
+
+// Publish implements Sink
+func (f SinkFunc) Publish(e Event) {
+	f(e)
+}
+
+// Bus publishes the events of the decoders to its sinks, in the order they subscribed.
+type Bus struct {
+	lock  sync.RWMutex
+	sinks []Sink
+}
+
+// NewBus creates a Bus publishing to sinks.
+func NewBus(sinks ...Sink) *Bus {
+	return &Bus{sinks: sinks}
+}
+
+// Subscribe adds a sink.
+func (b *Bus) Subscribe(s Sink) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.sinks = append(b.sinks, s)
+}
+
+// Publish implements Sink
+func (b *Bus) Publish(e Event) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	for _, s := range b.sinks {
+		s.Publish(e)
+	}
+}
+
+// requestType returns the Go type of a request body, e.g. *kafka.FetchRequest
+func requestType(body kafka.ProtocolBody) string {
+	return reflect.TypeOf(body).String()
+}
+
+// requestTopics returns the topics of produce and fetch requests.
+func requestTopics(body kafka.ProtocolBody) []string {
+	if t, ok := body.(topicsExtractor); ok {
+		return t.ExtractTopics()
+	}
+
+	return nil
+}
+
+// topicsExtractor is implemented by the requests naming topics.
+type topicsExtractor interface {
+	ExtractTopics() []string
+}
+
+// requestPrincipal returns the user authenticating with a SASL request, empty for the other requests.
+func requestPrincipal(body kafka.ProtocolBody) string {
+	if p, ok := body.(principalExtractor); ok {
+		return p.Principal()
+	}
+
+	return ""
+}
+
+// principalExtractor is implemented by the requests authenticating a user.
+type principalExtractor interface {
+	Principal() string
+}
+
+// requestSoftware returns the software of the client told by an api versions request, empty for the other requests.
+func requestSoftware(body kafka.ProtocolBody) string {
+	if s, ok := body.(softwareExtractor); ok {
+		return s.ClientSoftware()
+	}
+
+	return ""
+}
+
+// softwareExtractor is implemented by the requests naming the software of the client.
+type softwareExtractor interface {
+	ClientSoftware() string
+}
+
+// partitionsExtractor is implemented by the requests naming the partitions of their topics.
+type partitionsExtractor interface {
+	ExtractPartitions() map[string][]int32
+}
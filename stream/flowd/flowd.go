@@ -2,11 +2,14 @@ package flowd
 
 import (
 	"encoding/json"
-	"fmt"
+	"github.com/bingoohuang/kafka-sniffer/clock"
+	"github.com/bingoohuang/kafka-sniffer/proxyproto"
+	"github.com/bingoohuang/kafka-sniffer/stream"
 	"github.com/google/gopacket"
-	"github.com/google/gopacket/layers"
 	"github.com/google/gopacket/pcap"
+	"net"
 	"net/http"
+	"strconv"
 	"sync"
 	"time"
 )
@@ -14,14 +17,22 @@ import (
 type Flow struct {
 	Src        string
 	Dst        string
+	Tunnel     string `json:",omitempty"`
+	Client     string `json:",omitempty"` // the original client told by a PROXY protocol header
 	PayloadSum int
 	Closed     bool
 	Update     time.Time
 }
 
 type FlowTable struct {
-	lock sync.Mutex
-	Map  map[string]*Flow
+	lock  sync.Mutex
+	Map   map[string]*Flow
+	clock clock.Clock
+}
+
+// NewFlowTable creates a FlowTable whose update times are told by c, e.g. the time of the captured packets.
+func NewFlowTable(c clock.Clock) *FlowTable {
+	return &FlowTable{Map: map[string]*Flow{}, clock: c}
 }
 
 func (t *FlowTable) Snapshot() (flows []Flow) {
@@ -34,28 +45,50 @@ func (t *FlowTable) Snapshot() (flows []Flow) {
 	return
 }
 
-func (t *FlowTable) Update(src, dst string, payloadSize int, closed bool) {
+func (t *FlowTable) Update(src, dst, tunnel, client string, payloadSize int, closed bool) {
 	t.lock.Lock()
 	defer t.lock.Unlock()
 
-	k := src + "->" + dst
+	k := src + "->" + dst + "@" + tunnel
 	flow, ok := t.Map[k]
 	if !ok {
-		flow = &Flow{Src: src, Dst: dst}
+		flow = &Flow{Src: src, Dst: dst, Tunnel: tunnel}
 		t.Map[k] = flow
 	}
 
+	if client != "" {
+		flow.Client = client
+	}
 	flow.PayloadSum += payloadSize
 	flow.Closed = closed
-	flow.Update = time.Now()
+	flow.Update = t.clock.Now()
+}
+
+// Record updates the flow of a TCP segment, its addresses formatted with IPv6 hosts in brackets, e.g. [fd00::1]:9092.
+func (t *FlowTable) Record(seg stream.Segment) {
+	ip, tcp := seg.Network.NetworkFlow(), seg.TCP
+
+	src := net.JoinHostPort(ip.Src().String(), strconv.Itoa(int(tcp.SrcPort)))
+	dst := net.JoinHostPort(ip.Dst().String(), strconv.Itoa(int(tcp.DstPort)))
+
+	// the first segment behind a load balancer starts with a PROXY header
+	client := ""
+	if h, _, err := proxyproto.Parse(tcp.Payload); err == nil && h.Source != nil {
+		client = h.Source.String()
+	}
+
+	// terminate c
+	closed := tcp.FIN || tcp.RST
+	t.Update(src, dst, seg.Tunnel, client, len(tcp.Payload), closed)
 }
 
 func (t *FlowTable) Clear(expire time.Duration) {
 	t.lock.Lock()
 	defer t.lock.Unlock()
 
+	now := t.clock.Now()
 	for k, v := range t.Map {
-		if v.Closed && time.Since(v.Update) >= expire {
+		if v.Closed && now.Sub(v.Update) >= expire {
 			delete(t.Map, k)
 		}
 	}
@@ -73,7 +106,8 @@ func RunNetworkAnalyzer(device, bpf string, snaplen int32) (http.HandlerFunc, er
 		}
 	}
 
-	flowTable := &FlowTable{Map: map[string]*Flow{}}
+	packetClock := clock.NewPacket()
+	flowTable := NewFlowTable(packetClock)
 
 	go func() {
 		ticker := time.Tick(time.Minute)
@@ -81,19 +115,9 @@ func RunNetworkAnalyzer(device, bpf string, snaplen int32) (http.HandlerFunc, er
 		for {
 			select {
 			case p := <-packets:
-				ipLayer := p.Layer(layers.LayerTypeIPv4)
-				tcpLayer := p.Layer(layers.LayerTypeTCP)
-
-				if ipLayer != nil && tcpLayer != nil {
-					ip, _ := ipLayer.(*layers.IPv4)
-					tcp, _ := tcpLayer.(*layers.TCP)
-
-					src := fmt.Sprintf("%s:%d", ip.SrcIP, tcp.SrcPort)
-					dst := fmt.Sprintf("%s:%d", ip.DstIP, tcp.DstPort)
-
-					// terminate c
-					closed := tcp.FIN || tcp.RST
-					flowTable.Update(src, dst, len(tcp.Payload), closed)
+				packetClock.Observe(p.Metadata().Timestamp)
+				if seg, ok := stream.Decapsulate(p); ok {
+					flowTable.Record(seg)
 				}
 			case <-ticker:
 				flowTable.Clear(time.Minute)
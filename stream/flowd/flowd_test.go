@@ -0,0 +1,88 @@
+package flowd
+
+import (
+	"net"
+	"testing"
+
+	"github.com/bingoohuang/kafka-sniffer/clock"
+	"github.com/bingoohuang/kafka-sniffer/stream"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// segment is the TCP segment of payload from src to dst, over IPv4 or IPv6 as the addresses are.
+func segment(t *testing.T, src, dst string, srcPort, dstPort layers.TCPPort, payload string) stream.Segment {
+	t.Helper()
+
+	tcp := &layers.TCP{SrcPort: srcPort, DstPort: dstPort, Seq: 1000, Ack: 1, PSH: true, ACK: true, Window: 65535}
+	var ip gopacket.SerializableLayer
+	first := layers.LayerTypeIPv4
+	if srcIP, dstIP := net.ParseIP(src), net.ParseIP(dst); srcIP.To4() != nil {
+		ip4 := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: srcIP.To4(), DstIP: dstIP.To4()}
+		_ = tcp.SetNetworkLayerForChecksum(ip4)
+		ip = ip4
+	} else {
+		ip6 := &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolTCP, SrcIP: srcIP, DstIP: dstIP}
+		_ = tcp.SetNetworkLayerForChecksum(ip6)
+		ip, first = ip6, layers.LayerTypeIPv6
+	}
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, ip, tcp, gopacket.Payload(payload)); err != nil {
+		t.Fatal(err)
+	}
+
+	seg, ok := stream.Decapsulate(gopacket.NewPacket(buf.Bytes(), first, gopacket.Default))
+	if !ok {
+		t.Fatalf("no TCP segment from %s to %s", src, dst)
+	}
+
+	return seg
+}
+
+func TestFlowTableRecord(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		seg      stream.Segment
+		src, dst string
+		client   string
+	}{
+		{
+			name: "IPv4",
+			seg:  segment(t, "10.0.0.1", "10.0.1.1", 50000, 9092, "request"),
+			src:  "10.0.0.1:50000",
+			dst:  "10.0.1.1:9092",
+		},
+		{
+			name: "IPv6",
+			seg:  segment(t, "fd00::1", "fd00::2", 50000, 9092, "request"),
+			src:  "[fd00::1]:50000",
+			dst:  "[fd00::2]:9092",
+		},
+		{
+			name:   "IPv6 behind a load balancer",
+			seg:    segment(t, "fd00::3", "fd00::2", 50001, 9092, "PROXY TCP6 2001:db8::7 fd00::2 51000 9092\r\n"),
+			src:    "[fd00::3]:50001",
+			dst:    "[fd00::2]:9092",
+			client: "[2001:db8::7]:51000",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			table := NewFlowTable(clock.Wall)
+			table.Record(tc.seg)
+			// the next segment of the flow updates it
+			table.Record(tc.seg)
+
+			key := tc.src + "->" + tc.dst + "@"
+			flow, ok := table.Map[key]
+			if !ok || len(table.Map) != 1 {
+				t.Fatalf("flows %v, want %s", table.Map, key)
+			}
+			if flow.Src != tc.src || flow.Dst != tc.dst || flow.Client != tc.client || flow.PayloadSum != 2*len(tc.seg.TCP.Payload) {
+				t.Errorf("flow %+v, want %s -> %s of client %q", flow, tc.src, tc.dst, tc.client)
+			}
+		})
+	}
+}
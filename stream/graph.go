@@ -0,0 +1,219 @@
+package stream
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// The roles of a client for a topic
+const (
+	RoleProducer = "producer"
+	RoleConsumer = "consumer"
+)
+
+// ClientGraph is the bipartite graph of the clients and the topics they produce to or fetch from,
+// built from the snapshot of a ClientStat.
+type ClientGraph struct {
+	Time    time.Time
+	Clients []GraphClient
+	Topics  []GraphTopic
+	Edges   []GraphEdge
+	// ClientIDs are the clients by client id. They are no consumer groups, whose requests are not decoded.
+	ClientIDs []GraphClientID
+}
+
+// GraphClient is an application instance: the connections of a client id from an IP.
+type GraphClient struct {
+	// ID is IP/client id, e.g. 10.0.0.1/consumer-1
+	ID       string
+	IP       string
+	ClientID string
+	Produces []string `json:",omitempty"`
+	Fetches  []string `json:",omitempty"`
+	Brokers  []string
+	TLS      bool `json:",omitempty"`
+	Requests int
+	// BytesRead is the count of bytes of the requests.
+	BytesRead   int
+	Start       time.Time
+	Connections []ReqTypeStatItemSnapshot
+}
+
+// GraphTopic is a topic with the counts of its producers and consumers.
+type GraphTopic struct {
+	Topic     string
+	Producers int
+	Consumers int
+}
+
+// GraphEdge is a client producing to or fetching from a topic.
+type GraphEdge struct {
+	Client string
+	Topic  string
+	// Role is RoleProducer or RoleConsumer.
+	Role        string
+	Connections int
+}
+
+// GraphClientID is the clients of a client id.
+type GraphClientID struct {
+	ClientID string
+	Clients  []string
+	Produces []string `json:",omitempty"`
+	Fetches  []string `json:",omitempty"`
+	Requests int
+}
+
+// NewClientGraph builds the graph of the snapshot of a ClientStat at t, its nodes and edges sorted.
+func NewClientGraph(items []ReqTypeStatItemSnapshot, t time.Time) *ClientGraph {
+	clients := map[string]*GraphClient{}
+	edges := map[GraphEdge]int{}
+	clientIDs := map[string]*GraphClientID{}
+
+	for _, item := range items {
+		ip := hostOf(item.Src)
+		id := ip + "/" + item.ClientID
+
+		c, ok := clients[id]
+		if !ok {
+			c = &GraphClient{ID: id, IP: ip, ClientID: item.ClientID, Start: item.Start}
+			clients[id] = c
+		}
+		c.Requests += item.Requests
+		c.BytesRead += item.BytesRead
+		c.Brokers = appendUnique(c.Brokers, item.Dst)
+		c.TLS = c.TLS || item.TLS != nil
+		if item.Start.Before(c.Start) {
+			c.Start = item.Start
+		}
+		c.Connections = append(c.Connections, item)
+
+		g, ok := clientIDs[item.ClientID]
+		if !ok {
+			g = &GraphClientID{ClientID: item.ClientID}
+			clientIDs[item.ClientID] = g
+		}
+		g.Clients = appendUnique(g.Clients, id)
+		g.Requests += item.Requests
+
+		role := RequestRole(item.ReqType)
+		for _, topic := range item.Topics {
+			switch role {
+			case RoleProducer:
+				c.Produces = appendUnique(c.Produces, topic)
+				g.Produces = appendUnique(g.Produces, topic)
+			case RoleConsumer:
+				c.Fetches = appendUnique(c.Fetches, topic)
+				g.Fetches = appendUnique(g.Fetches, topic)
+			default:
+				continue
+			}
+			edges[GraphEdge{Client: id, Topic: topic, Role: role}]++
+		}
+	}
+
+	graph := &ClientGraph{Time: t}
+	topics := map[string]*GraphTopic{}
+	for e, n := range edges {
+		e.Connections = n
+		graph.Edges = append(graph.Edges, e)
+
+		topic, ok := topics[e.Topic]
+		if !ok {
+			topic = &GraphTopic{Topic: e.Topic}
+			topics[e.Topic] = topic
+		}
+		if e.Role == RoleProducer {
+			topic.Producers++
+		} else {
+			topic.Consumers++
+		}
+	}
+	sort.Slice(graph.Edges, func(i, j int) bool {
+		a, b := graph.Edges[i], graph.Edges[j]
+		if a.Client != b.Client {
+			return a.Client < b.Client
+		}
+		if a.Topic != b.Topic {
+			return a.Topic < b.Topic
+		}
+		return a.Role < b.Role
+	})
+
+	for _, c := range clients {
+		sort.Strings(c.Produces)
+		sort.Strings(c.Fetches)
+		sort.Strings(c.Brokers)
+		sort.Slice(c.Connections, func(i, j int) bool {
+			a, b := c.Connections[i], c.Connections[j]
+			if a.Src != b.Src {
+				return a.Src < b.Src
+			}
+			if a.Dst != b.Dst {
+				return a.Dst < b.Dst
+			}
+			return a.ReqType < b.ReqType
+		})
+		graph.Clients = append(graph.Clients, *c)
+	}
+	sort.Slice(graph.Clients, func(i, j int) bool { return graph.Clients[i].ID < graph.Clients[j].ID })
+
+	for _, t := range topics {
+		graph.Topics = append(graph.Topics, *t)
+	}
+	sort.Slice(graph.Topics, func(i, j int) bool { return graph.Topics[i].Topic < graph.Topics[j].Topic })
+
+	for _, g := range clientIDs {
+		sort.Strings(g.Clients)
+		sort.Strings(g.Produces)
+		sort.Strings(g.Fetches)
+		graph.ClientIDs = append(graph.ClientIDs, *g)
+	}
+	sort.Slice(graph.ClientIDs, func(i, j int) bool { return graph.ClientIDs[i].ClientID < graph.ClientIDs[j].ClientID })
+
+	return graph
+}
+
+// RequestRole returns the role of a client sending requests of typ, empty for the others.
+func RequestRole(typ string) string {
+	switch typ {
+	case "*kafka.ProduceRequest":
+		return RoleProducer
+	case "*kafka.FetchRequest":
+		return RoleConsumer
+	default:
+		return ""
+	}
+}
+
+// hostOf returns the IP of an address, the address itself when it has no port.
+func hostOf(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+
+	return addr
+}
+
+func appendUnique(values []string, v string) []string {
+	for _, s := range values {
+		if s == v {
+			return values
+		}
+	}
+
+	return append(values, v)
+}
+
+// ServeClientGraphHandler serves the ClientGraph of stat as JSON.
+func ServeClientGraphHandler(stat *ClientStat) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		graph := NewClientGraph(stat.Snapshot(), stat.clock.Now())
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		_ = json.NewEncoder(w).Encode(graph)
+	}
+}
@@ -0,0 +1,23 @@
+package stream
+
+import "testing"
+
+func TestHostOf(t *testing.T) {
+	for _, tc := range []struct {
+		addr string
+		want string
+	}{
+		{"10.0.0.1:50000", "10.0.0.1"},
+		{"10.0.0.1", "10.0.0.1"},
+		{"[::1]:9092", "::1"},
+		{"[fd00::1]:50000", "fd00::1"},
+		{"[fe80::1%eth0]:50000", "fe80::1%eth0"},
+		// an IPv6 address without port is not mistaken for a host and port
+		{"fd00::1", "fd00::1"},
+		{"::1", "::1"},
+	} {
+		if got := hostOf(tc.addr); got != tc.want {
+			t.Errorf("hostOf(%q) = %q, want %q", tc.addr, got, tc.want)
+		}
+	}
+}
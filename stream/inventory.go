@@ -0,0 +1,207 @@
+package stream
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// ClientInventoryItem is what was seen of a client, the connections of a client id from an IP,
+// by all its requests, decoded or not. The connections without any request seen, e.g. those with TLS
+// which is not decrypted, are of the client of their IP without a client id.
+type ClientInventoryItem struct {
+	IP       string
+	ClientID string
+	// Principals are the users its connections authenticated as with SASL.
+	Principals []string `json:",omitempty"`
+	// Software is the name/version of the client software its connections told with ApiVersions.
+	Software []string `json:",omitempty"`
+	// Roles are RoleProducer and RoleConsumer, none when it only sent requests which name no topics, e.g. Metadata.
+	Roles   []string `json:",omitempty"`
+	Topics  []string `json:",omitempty"`
+	Brokers []string
+	// Requests is the count of its requests, those whose type is not decoded included.
+	Requests int
+	// Connections is the count of its connections still open.
+	Connections int
+	// TLS tells whether any of its connections used TLS, decrypted or not.
+	TLS       bool `json:",omitempty"`
+	FirstSeen time.Time
+	LastSeen  time.Time
+}
+
+// inventoryKey identifies a client.
+type inventoryKey struct {
+	ip       string
+	clientID string
+}
+
+// inventoryConn is an open connection, of the client of its first request once it is identified.
+type inventoryConn struct {
+	Connection
+
+	identified bool
+	key        inventoryKey
+}
+
+// ClientInventory is the registry of every client talking to the brokers, unlike ClientStat it keeps them
+// after their connections closed, to tell which clients still use a cluster.
+type ClientInventory struct {
+	lock    sync.Mutex
+	clients map[inventoryKey]*ClientInventoryItem
+	conns   map[Endpoints]*inventoryConn
+}
+
+// NewClientInventory creates an empty ClientInventory.
+func NewClientInventory() *ClientInventory {
+	return &ClientInventory{
+		clients: map[inventoryKey]*ClientInventoryItem{},
+		conns:   map[Endpoints]*inventoryConn{},
+	}
+}
+
+// Publish implements Sink, it records the connections, every decoded request, and the header of the requests
+// whose type is not decoded.
+func (s *ClientInventory) Publish(e Event) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	switch e.Type {
+	case EventConnection:
+		s.recordConnection(e.Connection)
+	case EventRequest:
+		r := e.Request
+		c := s.identify(r.Endpoints, r.ClientID, r.Time)
+		if r.Principal != "" {
+			c.Principals = appendUnique(c.Principals, r.Principal)
+		}
+		if r.Software != "" {
+			c.Software = appendUnique(c.Software, r.Software)
+		}
+		if role := RequestRole(r.Type); role != "" {
+			c.Roles = appendUnique(c.Roles, role)
+			for _, topic := range r.Topics {
+				c.Topics = appendUnique(c.Topics, topic)
+			}
+		}
+	case EventDecodeError:
+		if d := e.DecodeError; d.Header != nil {
+			s.identify(d.Endpoints, d.Header.ClientID, d.Time)
+		}
+	}
+}
+
+// recordConnection tracks an open connection until it is closed. A closed connection without any request seen
+// is recorded for the client of its IP without a client id.
+func (s *ClientInventory) recordConnection(conn *Connection) {
+	if !conn.Closed {
+		s.conns[conn.Endpoints] = &inventoryConn{Connection: *conn}
+		return
+	}
+
+	open, ok := s.conns[conn.Endpoints]
+	if !ok {
+		return
+	}
+	delete(s.conns, conn.Endpoints)
+
+	if open.identified {
+		c := s.clients[open.key]
+		c.Connections--
+		c.seen(conn.Time)
+		return
+	}
+
+	c := s.item(inventoryKey{ip: hostOf(conn.Client)}, open.Time)
+	c.seen(conn.Time)
+	c.Brokers = appendUnique(c.Brokers, conn.Broker)
+	c.TLS = c.TLS || conn.TLS != nil
+}
+
+// identify records a request of clientID on the connection of endpoints at t, the connection becomes
+// one of that client on its first request.
+func (s *ClientInventory) identify(endpoints Endpoints, clientID string, t time.Time) *ClientInventoryItem {
+	k := inventoryKey{ip: hostOf(endpoints.Client), clientID: clientID}
+	c := s.item(k, t)
+	c.Requests++
+	c.seen(t)
+	c.Brokers = appendUnique(c.Brokers, endpoints.Broker)
+
+	if conn, ok := s.conns[endpoints]; ok && !conn.identified {
+		conn.identified, conn.key = true, k
+		c.Connections++
+		c.TLS = c.TLS || conn.TLS != nil
+	}
+
+	return c
+}
+
+// item returns the item of k, created first seen at t when it was not seen before.
+func (s *ClientInventory) item(k inventoryKey, t time.Time) *ClientInventoryItem {
+	c, ok := s.clients[k]
+	if !ok {
+		c = &ClientInventoryItem{IP: k.ip, ClientID: k.clientID, FirstSeen: t, LastSeen: t}
+		s.clients[k] = c
+	}
+
+	return c
+}
+
+// seen extends the time c was seen within to t.
+func (c *ClientInventoryItem) seen(t time.Time) {
+	if t.After(c.LastSeen) {
+		c.LastSeen = t
+	}
+	if t.Before(c.FirstSeen) {
+		c.FirstSeen = t
+	}
+}
+
+// Snapshot returns the clients sorted by IP and client id, their sets sorted. The open connections without
+// any request seen yet count for the client of their IP without a client id.
+func (s *ClientInventory) Snapshot() []ClientInventoryItem {
+	s.lock.Lock()
+	clients := make(map[inventoryKey]*ClientInventoryItem, len(s.clients))
+	for k, c := range s.clients {
+		item := *c
+		for _, values := range []*[]string{&item.Principals, &item.Software, &item.Roles, &item.Topics, &item.Brokers} {
+			*values = append([]string(nil), *values...)
+		}
+		clients[k] = &item
+	}
+	for _, conn := range s.conns {
+		if conn.identified {
+			continue
+		}
+
+		k := inventoryKey{ip: hostOf(conn.Client)}
+		c, ok := clients[k]
+		if !ok {
+			c = &ClientInventoryItem{IP: k.ip, FirstSeen: conn.Time, LastSeen: conn.Time}
+			clients[k] = c
+		}
+		c.Connections++
+		c.seen(conn.Time)
+		c.Brokers = appendUnique(c.Brokers, conn.Broker)
+		c.TLS = c.TLS || conn.TLS != nil
+	}
+	s.lock.Unlock()
+
+	ret := make([]ClientInventoryItem, 0, len(clients))
+	for _, c := range clients {
+		sort.Strings(c.Principals)
+		sort.Strings(c.Software)
+		sort.Strings(c.Roles)
+		sort.Strings(c.Topics)
+		sort.Strings(c.Brokers)
+		ret = append(ret, *c)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if c := compareAddrs(ret[i].IP, ret[j].IP); c != 0 {
+			return c < 0
+		}
+		return ret[i].ClientID < ret[j].ClientID
+	})
+
+	return ret
+}
@@ -0,0 +1,136 @@
+package stream
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/bingoohuang/kafka-sniffer/kafka"
+)
+
+// JSONSchemaVersion is the version of the fields of JSONRequest, written as "v" with every object.
+// New fields may be added within a version, it changes when fields are removed, renamed or change their meaning.
+const JSONSchemaVersion = 1
+
+// JSONRequest is the JSON object written by JSONSink for every request.
+type JSONRequest struct {
+	Version       int         `json:"v"`
+	Time          time.Time   `json:"ts"`
+	Src           string      `json:"src"`
+	Dst           string      `json:"dst"`
+	Tunnel        string      `json:"tunnel,omitempty"`
+	APIKey        int16       `json:"api_key"`
+	APIName       string      `json:"api_name"`
+	APIVersion    int16       `json:"api_version"`
+	CorrelationID int32       `json:"correlation_id"`
+	ClientID      string      `json:"client_id"`
+	Principal     string      `json:"principal,omitempty"`
+	Software      string      `json:"software,omitempty"`
+	Topics        []JSONTopic `json:"topics,omitempty"`
+	// Size is the count of bytes of the request frame.
+	Size int `json:"size"`
+	// RecordsSize and RecordsCount are the bytes and the count of the records of produce requests.
+	RecordsSize  int `json:"records_size,omitempty"`
+	RecordsCount int `json:"records_count,omitempty"`
+}
+
+// JSONTopic is a topic of a request with its partitions.
+type JSONTopic struct {
+	Topic      string  `json:"topic"`
+	Partitions []int32 `json:"partitions,omitempty"`
+}
+
+// JSONConnection is the JSON object of a client connection, once when decoding starts and once when it ended.
+type JSONConnection struct {
+	Version int       `json:"v"`
+	Time    time.Time `json:"ts"`
+	Src     string    `json:"src"`
+	Dst     string    `json:"dst"`
+	Tunnel  string    `json:"tunnel,omitempty"`
+	// Proxy is the load balancer which sent a PROXY header, if any.
+	Proxy  string   `json:"proxy,omitempty"`
+	TLS    *TLSInfo `json:"tls,omitempty"`
+	Closed bool     `json:"closed"`
+}
+
+// NewJSONConnection creates the JSON object of c.
+func NewJSONConnection(c *Connection) JSONConnection {
+	return JSONConnection{
+		Version: JSONSchemaVersion,
+		Time:    c.Time,
+		Src:     c.Client,
+		Dst:     c.Broker,
+		Tunnel:  c.Tunnel,
+		Proxy:   c.Proxy,
+		TLS:     c.TLS,
+		Closed:  c.Closed,
+	}
+}
+
+// JSONSink writes one JSON object per line (NDJSON) for every request, see JSONRequest.
+type JSONSink struct {
+	lock sync.Mutex
+	enc  *json.Encoder
+}
+
+// NewJSONSink writes to w, e.g. os.Stdout.
+func NewJSONSink(w io.Writer) *JSONSink {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+
+	return &JSONSink{enc: enc}
+}
+
+// Publish implements Sink
+func (s *JSONSink) Publish(e Event) {
+	if e.Type != EventRequest {
+		return
+	}
+
+	o := NewJSONRequest(e.Request)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err := s.enc.Encode(o); err != nil {
+		log.Printf("failed to write the JSON of a request: %v", err)
+	}
+}
+
+// NewJSONRequest creates the JSON object of r, its topics sorted by name.
+func NewJSONRequest(r *Request) JSONRequest {
+	o := JSONRequest{
+		Version:       JSONSchemaVersion,
+		Time:          r.Time,
+		Src:           r.Client,
+		Dst:           r.Broker,
+		Tunnel:        r.Tunnel,
+		APIKey:        r.Key,
+		APIName:       kafka.APIName(r.Key),
+		APIVersion:    r.Version,
+		CorrelationID: r.CorrelationID,
+		ClientID:      r.ClientID,
+		Principal:     r.Principal,
+		Software:      r.Software,
+		Size:          r.Size,
+	}
+
+	var partitions map[string][]int32
+	if p, ok := r.Body.(partitionsExtractor); ok {
+		partitions = p.ExtractPartitions()
+	}
+	for _, topic := range r.Topics {
+		o.Topics = append(o.Topics, JSONTopic{Topic: topic, Partitions: partitions[topic]})
+	}
+	sort.Slice(o.Topics, func(i, j int) bool { return o.Topics[i].Topic < o.Topics[j].Topic })
+
+	if p, ok := r.Body.(*kafka.ProduceRequest); ok {
+		o.RecordsSize = p.RecordsSize()
+		o.RecordsCount = p.RecordsLen()
+	}
+
+	return o
+}
@@ -1,111 +1,164 @@
 package stream
 
 import (
-	"bufio"
-	"fmt"
 	"io"
-	"log"
 
-	"github.com/bingoohuang/kafka-sniffer/kafka"
+	"github.com/bingoohuang/kafka-sniffer/clock"
 	"github.com/bingoohuang/kafka-sniffer/metrics"
+	"github.com/bingoohuang/kafka-sniffer/tlssniff"
 
 	"github.com/google/gopacket"
-	"github.com/google/gopacket/tcpassembly"
-	"github.com/google/gopacket/tcpassembly/tcpreader"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/reassembly"
 )
 
-// KafkaStreamFactory implements tcpassembly.StreamFactory
+// KafkaStreamFactory implements reassembly.StreamFactory. Its decoders publish the connections,
+// requests, responses and decode errors to a Sink, e.g. a Bus.
 type KafkaStreamFactory struct {
-	metricsStorage *metrics.Storage
-	verbose        bool
+	sink    Sink
+	ports   *BrokerPorts
+	keyLog  *tlssniff.KeyLog
+	metrics *metrics.Metrics
+	clock   clock.Clock
 }
 
-// NewKafkaStreamFactory assembles streams
-func NewKafkaStreamFactory(metricsStorage *metrics.Storage, verbose bool) *KafkaStreamFactory {
-	return &KafkaStreamFactory{metricsStorage: metricsStorage, verbose: verbose}
+// NewKafkaStreamFactory assembles streams. TLS connections are decrypted with the secrets of keyLog, if any.
+// The assembly and the decoding are measured with m, the events are timed by c.
+func NewKafkaStreamFactory(sink Sink, ports *BrokerPorts, keyLog *tlssniff.KeyLog, m *metrics.Metrics, c clock.Clock) *KafkaStreamFactory {
+	return &KafkaStreamFactory{sink: sink, ports: ports, keyLog: keyLog, metrics: m, clock: c}
 }
 
 // New assembles new stream
-func (h *KafkaStreamFactory) New(net, transport gopacket.Flow) tcpassembly.Stream {
+func (h *KafkaStreamFactory) New(net, transport gopacket.Flow, tcp *layers.TCP, ac reassembly.AssemblerContext) reassembly.Stream {
+	tunnel := tunnelOf(ac)
+
+	return newTCPStream(net, transport, tcp, h.ports, h.metrics, func(net, transport gopacket.Flow, r io.Reader) {
+		h.NewReader(net, transport, tunnel, r)
+	})
+}
+
+// NewReader decodes the requests read from r
+func (h *KafkaStreamFactory) NewReader(net, transport gopacket.Flow, tunnel string, r io.Reader) {
 	s := &kafkaStream{
-		net:            net,
-		transport:      transport,
-		r:              tcpreader.NewReaderStream(),
-		metricsStorage: h.metricsStorage,
-		verbose:        h.verbose,
+		net:       net,
+		transport: transport,
+		tunnel:    tunnel,
+		r:         r,
+		sink:      h.sink,
+		ports:     h.ports,
+		keyLog:    h.keyLog,
+		metrics:   h.metrics,
+		clock:     h.clock,
 	}
 
 	go s.run() // Important... we must guarantee that data from the reader stream is read.
-
-	return &s.r
 }
 
 // kafkaStream will handle the actual decoding of http requests.
 type kafkaStream struct {
 	net, transport gopacket.Flow
-	r              tcpreader.ReaderStream
-	metricsStorage *metrics.Storage
-	verbose        bool
+	tunnel         string
+	r              io.Reader
+	sink           Sink
+	ports          *BrokerPorts
+	keyLog         *tlssniff.KeyLog
+	metrics        *metrics.Metrics
+	clock          clock.Clock
 }
 
 func (h *kafkaStream) run() {
-	srcHost := fmt.Sprint(h.net.Src())
-	srcPort := fmt.Sprint(h.transport.Src())
-	dstHost := fmt.Sprint(h.net.Dst())
-	dstPort := fmt.Sprint(h.transport.Dst())
+	defer discardToEOF(h.r)
+
+	r, proxyHeader := sniffProxyHeader(h.r, h.metrics)
+	src := clientAddr(h.net, h.transport, proxyHeader)
+	endpoints := Endpoints{Client: src, Broker: hostPort(h.net.Dst(), h.transport.Dst()), Tunnel: h.tunnel}
 
-	log.Printf("%s:%s -> %s:%s", srcHost, srcPort, dstHost, dstPort)
-	log.Printf("%s:%s -> %s:%s", dstHost, dstPort, srcHost, srcPort)
+	// the responses are read from the other half by the assembler
+	pending := newPendingRequests()
+	if m, ok := h.r.(matchingReader); ok {
+		pending = m.responses()
+	}
+	pending.start(h.sink, endpoints)
 
-	buf := bufio.NewReaderSize(&h.r, 2<<15) // 65k
+	r, tlsInfo, decrypted := sniffTLS(r, h.keyLog, h.metrics)
+
+	conn := Connection{Endpoints: endpoints, Proxy: proxyAddr(h.net, h.transport, proxyHeader), TLS: tlsInfo}
+	h.publishConnection(conn)
+	defer func() {
+		conn.Closed = true
+		h.publishConnection(conn)
+	}()
+
+	if tlsInfo != nil {
+		checkSecurity(h.ports, h.metrics, src, h.transport, SecurityTLS)
+		if !decrypted {
+			discardToEOF(h.r)
+			return
+		}
+	}
 
-	// add new client ip to metric
-	h.metricsStorage.AddActiveConnectionsTotal(h.net.Src().String())
+	rr := newRequestReader(r, h.metrics)
+	// decrypted requests are no plaintext on the wire
+	decoded := decrypted
+	// the requests after a SASL authentication are of its principal
+	principal := ""
+	// and all of them are of the software told by ApiVersions
+	software := ""
 
 	for {
-		req, readBytes, err := kafka.DecodeRequest(buf)
+		req, n, err := rr.Next()
 		if err == io.EOF || err == io.ErrUnexpectedEOF {
 			return
 		}
 
-		if err != nil {
-			log.Printf("unable to read request to Broker - skipping packet: %s\n", err)
-
-			if _, ok := err.(kafka.PacketDecodingError); ok {
-				_, err := buf.Discard(readBytes)
-				if err != nil {
-					log.Printf("could not discard: %s\n", err)
-				}
-			}
+		if err == ErrLostData {
+			// bytes buffered before the gap do not continue after it
+			rr.Reset()
+			continue
+		}
 
+		if err != nil {
+			h.sink.Publish(Event{Type: EventDecodeError, DecodeError: &DecodeError{
+				Endpoints: endpoints,
+				Header:    req,
+				Error:     err.Error(),
+				Time:      h.clock.Now(),
+			}})
 			continue
 		}
 
-		if h.verbose {
-			log.Printf("got request, key: %d, version: %d, correlationID: %d, clientID: %s\n", req.Key, req.Version, req.CorrelationID, req.ClientID)
+		if !decoded {
+			decoded = true
+			checkSecurity(h.ports, h.metrics, src, h.transport, SecurityPlaintext)
 		}
 
-		req.Body.CollectClientMetrics(srcHost)
-
-		switch body := req.Body.(type) {
-		case *kafka.ProduceRequest:
-			for _, topic := range body.ExtractTopics() {
-				if h.verbose {
-					log.Printf("client %s:%s wrote to topic %s", h.net.Src(), h.transport.Src(), topic)
-				}
-
-				// add producer and topic relation info into metric
-				h.metricsStorage.AddProducerTopicRelationInfo(h.net.Src().String(), topic)
-			}
-		case *kafka.FetchRequest:
-			for _, topic := range body.ExtractTopics() {
-				if h.verbose {
-					log.Printf("client %s:%s read from topic %s", h.net.Src(), h.transport.Src(), topic)
-				}
-
-				// add consumer and topic relation info into metric
-				h.metricsStorage.AddConsumerTopicRelationInfo(h.net.Src().String(), topic)
-			}
+		t := h.clock.Now()
+		if m, ok := h.r.(matchingReader); ok && !m.seenTime().IsZero() {
+			t = m.seenTime()
+		}
+		if p := requestPrincipal(req.Body); p != "" {
+			principal = p
 		}
+		if s := requestSoftware(req.Body); s != "" {
+			software = s
+		}
+		request := &Request{
+			Endpoints: endpoints,
+			Request:   req,
+			Type:      requestType(req.Body),
+			Topics:    requestTopics(req.Body),
+			Principal: principal,
+			Software:  software,
+			Size:      n,
+			Time:      t,
+		}
+		pending.request(request)
+
+		h.sink.Publish(Event{Type: EventRequest, Request: request})
 	}
 }
+
+func (h *kafkaStream) publishConnection(conn Connection) {
+	conn.Time = h.clock.Now()
+	h.sink.Publish(Event{Type: EventConnection, Connection: &conn})
+}
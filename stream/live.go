@@ -0,0 +1,519 @@
+package stream
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bingoohuang/kafka-sniffer/kafka"
+
+	"golang.org/x/net/websocket"
+)
+
+// LiveDropped is the type of the live events telling how many events were dropped for a subscriber,
+// beyond its rate or while it was too slow to read them.
+const LiveDropped EventType = "dropped"
+
+const (
+	// liveQueueSize is the count of events waiting for a slow subscriber, the newer ones are dropped beyond it.
+	liveQueueSize = 256
+	// liveHeartbeat is the interval of the SSE comments keeping idle streams open through proxies,
+	// and of the dropped notices when no event follows the drops.
+	liveHeartbeat = 15 * time.Second
+)
+
+// LiveEvent is the JSON object streamed for every request and connection event, and for the drops.
+type LiveEvent struct {
+	Type       EventType       `json:"type"`
+	Request    *JSONRequest    `json:"request,omitempty"`
+	Connection *JSONConnection `json:"connection,omitempty"`
+	// Dropped is the count of events dropped since the last notice, with LiveDropped.
+	Dropped int `json:"dropped,omitempty"`
+}
+
+// LiveEvents is a Sink streaming the requests and the connection events to the clients of /events
+// as they are decoded, over Server-Sent Events or WebSocket, see ServeHTTP.
+type LiveEvents struct {
+	maxSubscribers int
+	maxRate        float64
+
+	lock        sync.RWMutex
+	subscribers map[*liveSubscriber]bool
+}
+
+// NewLiveEvents streams to at most maxSubscribers clients at once, each at most maxRate events per second.
+func NewLiveEvents(maxSubscribers int, maxRate float64) *LiveEvents {
+	return &LiveEvents{
+		maxSubscribers: maxSubscribers,
+		maxRate:        maxRate,
+		subscribers:    map[*liveSubscriber]bool{},
+	}
+}
+
+// Publish implements Sink, an event is encoded once for all the subscribers it matches.
+func (l *LiveEvents) Publish(e Event) {
+	if e.Type != EventRequest && e.Type != EventConnection {
+		return
+	}
+
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+
+	var msg *liveMessage
+	for s := range l.subscribers {
+		if !s.filter.match(e) {
+			continue
+		}
+
+		if msg == nil {
+			if msg = newLiveMessage(e); msg == nil {
+				return
+			}
+		}
+		s.offer(msg)
+	}
+}
+
+// ServeHTTP streams the events as Server-Sent Events, or as WebSocket text messages when upgraded.
+// The query parameters filter them, repeated or comma separated:
+//
+//	client     the client address: an IP, IP:port or CIDR
+//	topic      a topic of the requests, with * wildcards, e.g. orders.*
+//	api_key    an api key of the requests, its number or name, e.g. 0 or Produce
+//	client_id  a client id of the requests
+//	type       request or connection, default both
+//	rate       the maximum events per second, capped by the server
+//
+// The connection events are only filtered by client.
+func (l *LiveEvents) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseLiveFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	rate, err := l.rate(r.URL.Query().Get("rate"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s := l.subscribe(filter, rate)
+	if s == nil {
+		http.Error(w, fmt.Sprintf("more than %d clients of the live events", l.maxSubscribers), http.StatusServiceUnavailable)
+		return
+	}
+	defer l.unsubscribe(s)
+
+	if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		websocket.Server{
+			Handshake: checkSameOrigin,
+			Handler:   func(ws *websocket.Conn) { s.serveWebSocket(ws) },
+		}.ServeHTTP(w, r)
+		return
+	}
+
+	s.serveSSE(w, r)
+}
+
+// rate returns the rate asked by a subscriber, the maximum rate without it.
+func (l *LiveEvents) rate(s string) (float64, error) {
+	if s == "" {
+		return l.maxRate, nil
+	}
+
+	rate, err := strconv.ParseFloat(s, 64)
+	if err != nil || rate <= 0 {
+		return 0, fmt.Errorf("invalid rate %q", s)
+	}
+	if l.maxRate > 0 && rate > l.maxRate {
+		rate = l.maxRate
+	}
+
+	return rate, nil
+}
+
+func (l *LiveEvents) subscribe(filter liveFilter, rate float64) *liveSubscriber {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.maxSubscribers > 0 && len(l.subscribers) >= l.maxSubscribers {
+		return nil
+	}
+
+	s := &liveSubscriber{
+		filter: filter,
+		events: make(chan *liveMessage, liveQueueSize),
+		bucket: newTokenBucket(rate, time.Now()),
+	}
+	l.subscribers[s] = true
+
+	return s
+}
+
+func (l *LiveEvents) unsubscribe(s *liveSubscriber) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	delete(l.subscribers, s)
+}
+
+// checkSameOrigin rejects the WebSocket connections of the pages of other origins, which the browsers
+// allow unlike the cross origin Server-Sent Events. The clients which are not browsers send no origin.
+func checkSameOrigin(config *websocket.Config, r *http.Request) error {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return nil
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil || !strings.EqualFold(u.Host, r.Host) {
+		return fmt.Errorf("cross origin %q", origin)
+	}
+
+	return nil
+}
+
+// liveMessage is an event encoded for the subscribers.
+type liveMessage struct {
+	typ  EventType
+	data []byte
+}
+
+func newLiveMessage(e Event) *liveMessage {
+	o := LiveEvent{Type: e.Type}
+	switch e.Type {
+	case EventRequest:
+		r := NewJSONRequest(e.Request)
+		o.Request = &r
+	case EventConnection:
+		c := NewJSONConnection(e.Connection)
+		o.Connection = &c
+	}
+
+	return encodeLiveEvent(o)
+}
+
+func encodeLiveEvent(o LiveEvent) *liveMessage {
+	data, err := json.Marshal(o)
+	if err != nil {
+		log.Printf("failed to encode a live event: %v", err)
+		return nil
+	}
+
+	return &liveMessage{typ: o.Type, data: data}
+}
+
+// liveSubscriber is a client of /events.
+type liveSubscriber struct {
+	filter liveFilter
+	events chan *liveMessage
+
+	lock    sync.Mutex
+	bucket  tokenBucket
+	dropped int
+}
+
+// offer queues msg unless it is beyond the rate of the subscriber or its queue is full,
+// after the notice of the events dropped before it.
+func (s *liveSubscriber) offer(msg *liveMessage) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if !s.bucket.allow(time.Now()) {
+		s.dropped++
+		return
+	}
+
+	if s.dropped > 0 {
+		select {
+		case s.events <- droppedMessage(s.dropped):
+			s.dropped = 0
+		default:
+			s.dropped++
+			return
+		}
+	}
+
+	select {
+	case s.events <- msg:
+	default:
+		s.dropped++
+	}
+}
+
+// takeDropped returns the notice of the events dropped since the last queued event, once the queue is
+// empty, nil otherwise.
+func (s *liveSubscriber) takeDropped() *liveMessage {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.dropped == 0 || len(s.events) > 0 {
+		return nil
+	}
+
+	msg := droppedMessage(s.dropped)
+	s.dropped = 0
+
+	return msg
+}
+
+func droppedMessage(dropped int) *liveMessage {
+	return encodeLiveEvent(LiveEvent{Type: LiveDropped, Dropped: dropped})
+}
+
+// serveSSE writes the events as Server-Sent Events until the client goes away.
+func (s *liveSubscriber) serveSSE(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// nginx buffers the responses otherwise
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	write := func(msg *liveMessage) error {
+		_, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", msg.typ, msg.data)
+		return err
+	}
+
+	s.run(r.Context().Done(), write, func() error {
+		_, err := io.WriteString(w, ": ping\n\n")
+		return err
+	}, flusher.Flush)
+}
+
+// serveWebSocket writes the events as text messages until the client goes away.
+func (s *liveSubscriber) serveWebSocket(ws *websocket.Conn) {
+	ws.PayloadType = websocket.TextFrame
+
+	// the messages of the client are ignored, reading tells when it closed the connection
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		_, _ = io.Copy(ioutil.Discard, ws)
+	}()
+
+	write := func(msg *liveMessage) error {
+		_, err := ws.Write(msg.data)
+		return err
+	}
+
+	s.run(closed, write, nil, func() {})
+	_ = ws.Close()
+}
+
+// run writes the queued events until done or a write fails. Every heartbeat, the drops since
+// the last queued event are noticed, or ping is written, if any.
+func (s *liveSubscriber) run(done <-chan struct{}, write func(*liveMessage) error, ping func() error, flush func()) {
+	ticker := time.NewTicker(liveHeartbeat)
+	defer ticker.Stop()
+
+	for {
+		var err error
+		select {
+		case <-done:
+			return
+		case msg := <-s.events:
+			err = write(msg)
+		case <-ticker.C:
+			if dropped := s.takeDropped(); dropped != nil {
+				err = write(dropped)
+			} else if ping != nil {
+				err = ping()
+			}
+		}
+
+		if err != nil {
+			if !isClosedConnError(err) {
+				log.Printf("failed to write live events: %v", err)
+			}
+			return
+		}
+		flush()
+	}
+}
+
+// isClosedConnError tells the errors of writing to a client which went away.
+func isClosedConnError(err error) bool {
+	if err == io.EOF {
+		return true
+	}
+	if _, ok := err.(*net.OpError); ok {
+		return true
+	}
+
+	s := err.Error()
+	return strings.Contains(s, "broken pipe") || strings.Contains(s, "connection reset") ||
+		strings.Contains(s, "use of closed network connection")
+}
+
+// tokenBucket limits the events of a subscriber to rate per second, in bursts of up to a second of them.
+// A zero rate is not limited.
+type tokenBucket struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, now time.Time) tokenBucket {
+	return tokenBucket{rate: rate, tokens: burst(rate), last: now}
+}
+
+// burst is a second of events, at least one.
+func burst(rate float64) float64 {
+	if rate < 1 {
+		return 1
+	}
+
+	return rate
+}
+
+func (b *tokenBucket) allow(now time.Time) bool {
+	if b.rate <= 0 {
+		return true
+	}
+
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens += elapsed.Seconds() * b.rate
+		if max := burst(b.rate); b.tokens > max {
+			b.tokens = max
+		}
+		b.last = now
+	}
+
+	if b.tokens < 1 {
+		return false
+	}
+
+	b.tokens--
+	return true
+}
+
+// liveFilter selects the events of a subscriber, an empty criterion selects all.
+type liveFilter struct {
+	clients   []clientMatcher
+	topics    []string
+	apiKeys   map[int16]bool
+	clientIDs map[string]bool
+	types     map[EventType]bool
+}
+
+// clientMatcher matches a client address by its IP, its IP:port or the network of its IP.
+type clientMatcher struct {
+	addr    string
+	network *net.IPNet
+}
+
+func (m clientMatcher) match(addr string) bool {
+	if addr == m.addr {
+		return true
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	if m.network != nil {
+		ip := net.ParseIP(host)
+		return ip != nil && m.network.Contains(ip)
+	}
+
+	return host == m.addr
+}
+
+// parseLiveFilter parses the query parameters of /events, see LiveEvents.ServeHTTP.
+func parseLiveFilter(q url.Values) (f liveFilter, err error) {
+	if f.clients, err = parseClientMatchers(queryValues(q, "client")); err != nil {
+		return f, err
+	}
+
+	for _, t := range queryValues(q, "topic") {
+		if _, err := path.Match(t, ""); err != nil {
+			return f, fmt.Errorf("invalid topic %q: %w", t, err)
+		}
+		f.topics = append(f.topics, t)
+	}
+
+	for _, k := range queryValues(q, "api_key") {
+		key, ok := kafka.APIKey(k)
+		if !ok {
+			n, err := strconv.ParseInt(k, 10, 16)
+			if err != nil {
+				return f, fmt.Errorf("unknown api key %q", k)
+			}
+			key = int16(n)
+		}
+		if f.apiKeys == nil {
+			f.apiKeys = map[int16]bool{}
+		}
+		f.apiKeys[key] = true
+	}
+
+	for _, id := range queryValues(q, "client_id") {
+		if f.clientIDs == nil {
+			f.clientIDs = map[string]bool{}
+		}
+		f.clientIDs[id] = true
+	}
+
+	for _, t := range queryValues(q, "type") {
+		typ := EventType(strings.ToLower(t))
+		if typ != EventRequest && typ != EventConnection {
+			return f, fmt.Errorf("unknown event type %q, request or connection", t)
+		}
+		if f.types == nil {
+			f.types = map[EventType]bool{}
+		}
+		f.types[typ] = true
+	}
+
+	return f, nil
+}
+
+// queryValues returns the values of a query parameter, repeated or comma separated.
+func queryValues(q url.Values, key string) (values []string) {
+	for _, v := range q[key] {
+		for _, s := range strings.Split(v, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				values = append(values, s)
+			}
+		}
+	}
+
+	return values
+}
+
+func (f liveFilter) match(e Event) bool {
+	if len(f.types) > 0 && !f.types[e.Type] {
+		return false
+	}
+
+	switch e.Type {
+	case EventConnection:
+		return matchAny(f.clients, e.Connection.Client)
+	case EventRequest:
+		r := e.Request
+		return matchAny(f.clients, r.Client) &&
+			(len(f.apiKeys) == 0 || f.apiKeys[r.Key]) &&
+			(len(f.clientIDs) == 0 || f.clientIDs[r.ClientID]) &&
+			(len(f.topics) == 0 || matchTopicPatterns(f.topics, r.Topics))
+	default:
+		return false
+	}
+}
@@ -0,0 +1,91 @@
+package stream
+
+import (
+	"net"
+
+	"github.com/bingoohuang/kafka-sniffer/kafka"
+	"github.com/bingoohuang/kafka-sniffer/metrics"
+)
+
+// MetricsSink exports the requests of the clients, their connections and their relations with the topics
+// as prometheus metrics.
+type MetricsSink struct {
+	metrics *metrics.Metrics
+	storage *metrics.Storage
+}
+
+// NewMetricsSink counts the requests with m and exports the connections and the relations to storage, if any.
+func NewMetricsSink(m *metrics.Metrics, storage *metrics.Storage) *MetricsSink {
+	return &MetricsSink{metrics: m, storage: storage}
+}
+
+// Publish implements Sink
+func (s *MetricsSink) Publish(e Event) {
+	switch e.Type {
+	case EventConnection:
+		if c := e.Connection; !c.Closed && s.storage != nil {
+			// add new client ip to metric
+			s.storage.AddActiveConnectionsTotal(clientHost(c.Client), c.Tunnel)
+		}
+	case EventRequest:
+		r := e.Request
+		host := clientHost(r.Client)
+
+		switch body := r.Body.(type) {
+		case *kafka.ProduceRequest:
+			s.metrics.RequestsCount.WithLabelValues(host, "produce").Inc()
+			s.metrics.RequestBytes.WithLabelValues(host, "produce").Add(float64(r.Size))
+			s.metrics.ProducerBatchSize.WithLabelValues(host).Add(float64(body.RecordsSize()))
+			s.metrics.ProducerBatchLen.WithLabelValues(host).Add(float64(body.RecordsLen()))
+
+			s.topicMetrics(r, "produce")
+			records, recordBytes := body.TopicRecordsLen(), body.TopicRecordsSize()
+			for _, topic := range r.Topics {
+				s.metrics.TopicRecords.WithLabelValues(topic).Add(float64(records[topic]))
+				s.metrics.TopicRecordBytes.WithLabelValues(topic).Add(float64(recordBytes[topic]))
+			}
+
+			if s.storage == nil {
+				return
+			}
+			for _, topic := range r.Topics {
+				// add producer and topic relation info into metric
+				s.storage.AddProducerTopicRelationInfo(host, topic, r.Tunnel)
+			}
+		case *kafka.FetchRequest:
+			s.metrics.RequestsCount.WithLabelValues(host, "fetch").Inc()
+			s.metrics.RequestBytes.WithLabelValues(host, "fetch").Add(float64(r.Size))
+			s.metrics.BlocksRequested.WithLabelValues(host).Add(float64(body.GetRequestedBlocksCount()))
+
+			s.topicMetrics(r, "fetch")
+
+			if s.storage == nil {
+				return
+			}
+			for _, topic := range r.Topics {
+				// add consumer and topic relation info into metric
+				s.storage.AddConsumerTopicRelationInfo(host, topic, r.Tunnel)
+			}
+		}
+	}
+}
+
+// topicMetrics counts a request of typ for each of its topics, a request naming several topics counts for each
+// and its bytes are split among them, see topicRequestBytes.
+func (s *MetricsSink) topicMetrics(r *Request, typ string) {
+	requestBytes := topicRequestBytes(r)
+	for i, topic := range r.Topics {
+		s.metrics.TopicRequestsCount.WithLabelValues(topic, typ).Inc()
+		s.metrics.TopicRequestBytes.WithLabelValues(topic, typ).Add(float64(requestBytes[i]))
+		s.metrics.TopicLastSeen.WithLabelValues(topic).Set(float64(r.Time.UnixNano()) / 1e9)
+	}
+}
+
+// clientHost returns the host of a client address, e.g. fd00::1 of [fd00::1]:45678
+func clientHost(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+
+	return addr
+}
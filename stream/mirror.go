@@ -0,0 +1,141 @@
+package stream
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// Encapsulations of mirrored traffic which gopacket does not decode on its own.
+var (
+	// LayerTypeTZSP is the TaZmen Sniffer Protocol, used by MikroTik and others to stream copies of packets over UDP.
+	LayerTypeTZSP = gopacket.RegisterLayerType(1700, gopacket.LayerTypeMetadata{Name: "TZSP", Decoder: gopacket.DecodeFunc(decodeTZSP)})
+	// LayerTypeERSPAN is the header of Cisco's Encapsulated Remote SPAN, types II and III, carried in GRE.
+	LayerTypeERSPAN = gopacket.RegisterLayerType(1701, gopacket.LayerTypeMetadata{Name: "ERSPAN", Decoder: gopacket.DecodeFunc(decodeERSPAN)})
+)
+
+const (
+	ethernetTypeERSPAN    layers.EthernetType = 0x88be // type II
+	ethernetTypeERSPANIII layers.EthernetType = 0x22eb
+)
+
+func init() {
+	// GRE looks up the layer following it by its protocol field
+	for _, t := range []layers.EthernetType{ethernetTypeERSPAN, ethernetTypeERSPANIII} {
+		layers.EthernetTypeMetadata[t] = layers.EnumMetadata{
+			DecodeWith: gopacket.DecodeFunc(decodeERSPAN),
+			Name:       "ERSPAN",
+			LayerType:  LayerTypeERSPAN,
+		}
+	}
+}
+
+// TZSP is the header of a TZSP packet, see https://en.wikipedia.org/wiki/TZSP
+type TZSP struct {
+	layers.BaseLayer
+	Version       uint8
+	Type          uint8
+	Encapsulation uint16
+}
+
+// LayerType returns LayerTypeTZSP
+func (t *TZSP) LayerType() gopacket.LayerType { return LayerTypeTZSP }
+
+const (
+	tzspTagPadding = 0
+	tzspTagEnd     = 1
+
+	tzspTypeReceived    = 0
+	tzspTypeTransmitted = 1
+
+	tzspEncapEthernet = 1
+)
+
+func decodeTZSP(data []byte, p gopacket.PacketBuilder) error {
+	if len(data) < 4 {
+		return fmt.Errorf("TZSP length %d too short", len(data))
+	}
+
+	t := &TZSP{Version: data[0], Type: data[1], Encapsulation: binary.BigEndian.Uint16(data[2:4])}
+
+	// the header is followed by tagged fields up to the end tag
+	off := 4
+	for off < len(data) && data[off] != tzspTagEnd {
+		if data[off] == tzspTagPadding {
+			off++
+			continue
+		}
+
+		if off+1 >= len(data) {
+			return fmt.Errorf("TZSP tag truncated")
+		}
+		off += 2 + int(data[off+1])
+	}
+	if off >= len(data) {
+		return fmt.Errorf("TZSP end tag missing")
+	}
+	off++
+
+	t.Contents, t.Payload = data[:off], data[off:]
+	p.AddLayer(t)
+
+	// keepalives and the like carry no packet
+	if (t.Type != tzspTypeReceived && t.Type != tzspTypeTransmitted) || t.Encapsulation != tzspEncapEthernet {
+		return nil
+	}
+
+	return p.NextDecoder(layers.LayerTypeEthernet)
+}
+
+// ERSPAN is the header of an ERSPAN type II or III packet.
+type ERSPAN struct {
+	layers.BaseLayer
+	Version   uint8
+	VLAN      uint16
+	SessionID uint16
+}
+
+// LayerType returns LayerTypeERSPAN
+func (e *ERSPAN) LayerType() gopacket.LayerType { return LayerTypeERSPAN }
+
+func decodeERSPAN(data []byte, p gopacket.PacketBuilder) error {
+	if len(data) < 8 {
+		return fmt.Errorf("ERSPAN length %d too short", len(data))
+	}
+
+	e := &ERSPAN{
+		Version:   data[0] >> 4,
+		VLAN:      binary.BigEndian.Uint16(data[0:2]) & 0x0fff,
+		SessionID: binary.BigEndian.Uint16(data[2:4]) & 0x03ff,
+	}
+
+	length, frameType := 8, uint8(0)
+	switch e.Version {
+	case 1: // type II
+	case 2: // type III, an optional platform specific sub-header follows
+		if len(data) < 12 {
+			return fmt.Errorf("ERSPAN length %d too short", len(data))
+		}
+		length, frameType = 12, (data[10]>>2)&0x1f
+		if data[11]&0x01 != 0 {
+			length += 8
+		}
+	default:
+		return fmt.Errorf("unsupported ERSPAN version %d", e.Version)
+	}
+
+	if len(data) < length {
+		return fmt.Errorf("ERSPAN length %d too short", len(data))
+	}
+
+	e.Contents, e.Payload = data[:length], data[length:]
+	p.AddLayer(e)
+
+	if frameType != 0 { // only mirrored ethernet frames are decoded, not bare IP packets
+		return p.NextDecoder(gopacket.LayerTypePayload)
+	}
+
+	return p.NextDecoder(layers.LayerTypeEthernet)
+}
@@ -0,0 +1,252 @@
+package stream
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bingoohuang/kafka-sniffer/clock"
+)
+
+// BrokerPorts is the set of TCP ports the Kafka brokers listen on.
+// It tells which half of a captured connection is the client.
+// While discovering, connections on other ports are probed for Kafka requests and
+// the ports of the recognized ones are added.
+type BrokerPorts struct {
+	lock        sync.RWMutex
+	ports       map[uint16]*Listener
+	discovering bool
+	clock       clock.Clock
+}
+
+// Listener is a broker port with the brokers seen accepting connections on it.
+type Listener struct {
+	Port uint16
+	// Discovered tells whether the port was found by probing rather than configured.
+	Discovered bool
+	// Security is tls or plaintext, configured or learned from the first connection.
+	Security    string `json:",omitempty"`
+	Since       time.Time
+	Brokers     []string
+	Connections int
+
+	brokers map[string]bool
+}
+
+// ParseBrokerPorts parses a comma separated port list, e.g. 9092,9093
+func ParseBrokerPorts(s string) (*BrokerPorts, error) {
+	p := &BrokerPorts{ports: map[uint16]*Listener{}, clock: clock.Wall}
+	for _, f := range strings.Split(s, ",") {
+		if f = strings.TrimSpace(f); f == "" {
+			continue
+		}
+
+		port, err := strconv.ParseUint(f, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid broker port %q: %w", f, err)
+		}
+		p.ports[uint16(port)] = newListener(uint16(port), false, p.clock.Now())
+	}
+
+	return p, nil
+}
+
+// Security of listeners
+const (
+	SecurityTLS       = "tls"
+	SecurityPlaintext = "plaintext"
+)
+
+// ParseTLSPorts adds the comma separated TLS ports, e.g. 9093. The other ports are plaintext then,
+// otherwise the security of every port is learned from its first connection.
+func (p *BrokerPorts) ParseTLSPorts(s string) error {
+	tlsPorts, err := ParseBrokerPorts(s)
+	if err != nil {
+		return err
+	}
+	if len(tlsPorts.ports) == 0 {
+		return nil
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for port, l := range tlsPorts.ports {
+		p.ports[port] = l
+	}
+	for _, l := range p.ports {
+		if tlsPorts.ports[l.Port] != nil {
+			l.Security = SecurityTLS
+		} else {
+			l.Security = SecurityPlaintext
+		}
+	}
+
+	return nil
+}
+
+// CheckSecurity checks the security of a connection to a broker port against the one of the port,
+// which is learned from the first connection unless configured. It returns the security expected.
+func (p *BrokerPorts) CheckSecurity(port uint16, security string) (expected string, ok bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	l := p.ports[port]
+	if l == nil {
+		return security, true
+	}
+
+	if l.Security == "" {
+		l.Security = security
+	}
+
+	return l.Security, l.Security == security
+}
+
+func newListener(port uint16, discovered bool, since time.Time) *Listener {
+	return &Listener{Port: port, Discovered: discovered, Since: since, brokers: map[string]bool{}}
+}
+
+// Contains tells whether the port is a broker port.
+func (p *BrokerPorts) Contains(port uint16) bool {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	return p.ports[port] != nil
+}
+
+// Accepts tells whether a connection between the ports is worth assembling:
+// one of them is a broker port, or the ports are being discovered.
+func (p *BrokerPorts) Accepts(port1, port2 uint16) bool {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	return p.discovering || p.ports[port1] != nil || p.ports[port2] != nil
+}
+
+// Record records a connection to a broker, adding the port when it was discovered.
+func (p *BrokerPorts) Record(port uint16, broker string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	l := p.ports[port]
+	if l == nil {
+		l = newListener(port, true, p.clock.Now())
+		p.ports[port] = l
+		log.Printf("discovered Kafka listener on port %d of %s", port, broker)
+	}
+
+	l.Connections++
+	if !l.brokers[broker] {
+		l.brokers[broker] = true
+		l.Brokers = append(l.Brokers, broker)
+	}
+}
+
+// SetClock tells the time the ports are discovered by c, e.g. the time of the captured packets.
+func (p *BrokerPorts) SetClock(c clock.Clock) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.clock = c
+}
+
+// StartDiscovery starts probing the connections on all ports.
+func (p *BrokerPorts) StartDiscovery() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.discovering = true
+}
+
+// StopDiscovery stops probing new connections, only the known broker ports are assembled further.
+func (p *BrokerPorts) StopDiscovery() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.discovering = false
+}
+
+// Discovering tells whether the connections on all ports are probed.
+func (p *BrokerPorts) Discovering() bool {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	return p.discovering
+}
+
+// List returns the sorted broker ports.
+func (p *BrokerPorts) List() []uint16 {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	ports := make([]uint16, 0, len(p.ports))
+	for port := range p.ports {
+		ports = append(ports, port)
+	}
+	sort.Slice(ports, func(i, j int) bool { return ports[i] < ports[j] })
+
+	return ports
+}
+
+// Discovered returns the sorted broker ports found by probing, not the configured ones.
+func (p *BrokerPorts) Discovered() []uint16 {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	var ports []uint16
+	for port, l := range p.ports {
+		if l.Discovered {
+			ports = append(ports, port)
+		}
+	}
+	sort.Slice(ports, func(i, j int) bool { return ports[i] < ports[j] })
+
+	return ports
+}
+
+// Listeners returns a snapshot of the broker ports, sorted by port.
+func (p *BrokerPorts) Listeners() []Listener {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	listeners := make([]Listener, 0, len(p.ports))
+	for _, l := range p.ports {
+		c := *l
+		c.Brokers, c.brokers = append([]string(nil), l.Brokers...), nil
+		sort.Strings(c.Brokers)
+		listeners = append(listeners, c)
+	}
+	sort.Slice(listeners, func(i, j int) bool { return listeners[i].Port < listeners[j].Port })
+
+	return listeners
+}
+
+// BPF returns a BPF expression capturing both directions of the broker ports, or all TCP while discovering.
+func (p *BrokerPorts) BPF() string {
+	ports := p.List()
+	if len(ports) == 0 || p.Discovering() {
+		return "tcp"
+	}
+
+	exprs := make([]string, 0, len(ports))
+	for _, port := range ports {
+		exprs = append(exprs, fmt.Sprintf("port %d", port))
+	}
+
+	return "tcp and (" + strings.Join(exprs, " or ") + ")"
+}
+
+// ServeListenersHandler serves the broker ports, configured and discovered.
+func ServeListenersHandler(ports *BrokerPorts) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		_ = json.NewEncoder(w).Encode(ports.Listeners())
+	}
+}
@@ -0,0 +1,31 @@
+package stream
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestBrokerPortsDiscovered(t *testing.T) {
+	p, err := ParseBrokerPorts("9092")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := p.Discovered(); len(got) != 0 {
+		t.Fatalf("configured ports reported as discovered: %v", got)
+	}
+
+	p.Record(9092, "10.0.0.1")
+	if got := p.Discovered(); len(got) != 0 {
+		t.Fatalf("connection to a configured port reported as discovered: %v", got)
+	}
+
+	p.Record(19092, "10.0.0.2")
+	p.Record(9093, "10.0.0.1")
+	if got, want := p.Discovered(), []uint16{9093, 19092}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("discovered %v, want %v", got, want)
+	}
+	if got, want := p.List(), []uint16{9092, 9093, 19092}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("listed %v, want %v", got, want)
+	}
+}
@@ -1,132 +1,138 @@
 package stream
 
 import (
-	"bufio"
 	"encoding/json"
-	"fmt"
-	"github.com/bingoohuang/kafka-sniffer/kafka"
-	"io"
 	"log"
 	"net/http"
-	"reflect"
-	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
-	"github.com/google/gopacket"
-	"github.com/google/gopacket/tcpassembly"
-	"github.com/google/gopacket/tcpassembly/tcpreader"
+	"github.com/bingoohuang/kafka-sniffer/clock"
 )
 
-// KafkaPrintStreamFactory implements tcpassembly.StreamFactory
-type KafkaPrintStreamFactory struct {
-	ClientStat        *ClientStat
+// LogSink logs the connections and the first request of every type of a connection, like
+// the kafka-sniffer command does by default.
+type LogSink struct {
 	printJsonDuration time.Duration
 	printType         string
+	verbose           bool
+
+	lock  sync.Mutex
+	conns map[Endpoints]*loggedConn
+}
+
+// loggedConn is what was logged of a connection.
+type loggedConn struct {
+	types map[string]bool
+	start time.Time
 }
 
-// NewKafkaClientPrintStreamFactory assembles streams
-func NewKafkaClientPrintStreamFactory(printJsonDuration time.Duration, printType string) *KafkaPrintStreamFactory {
-	f := &KafkaPrintStreamFactory{
-		ClientStat:        NewClientStat(),
+// NewLogSink logs the requests whose type contains printType, and one of them as JSON every printJsonDuration.
+// Every request is logged when verbose.
+func NewLogSink(printJsonDuration time.Duration, printType string, verbose bool) *LogSink {
+	return &LogSink{
 		printJsonDuration: printJsonDuration,
 		printType:         strings.ToLower(printType),
+		verbose:           verbose,
+		conns:             map[Endpoints]*loggedConn{},
 	}
+}
 
-	go func() {
-		d := 1 * time.Minute
-		t := time.NewTicker(d)
-		defer t.Stop()
-
-		for range t.C {
-			f.ClientStat.Recycle(d)
+// Publish implements Sink
+func (s *LogSink) Publish(e Event) {
+	switch e.Type {
+	case EventConnection:
+		s.logConnection(e.Connection)
+	case EventRequest:
+		s.logRequest(e.Request)
+	case EventDecodeError:
+		if s.verbose {
+			log.Printf("unable to read request to Broker - skipping packet: %s\n", e.DecodeError.Error)
 		}
-	}()
-
-	return f
+	case EventResponse:
+		if s.verbose {
+			r := e.Response
+			log.Printf("got response, key: %d, version: %d, correlationID: %d, size: %d, latency: %s",
+				r.Key, r.Version, r.CorrelationID, r.Size, r.Latency)
+		}
+	}
 }
 
-// New assembles new stream
-func (h *KafkaPrintStreamFactory) New(net, transport gopacket.Flow) tcpassembly.Stream {
-	s := &kafkaStreamPrinter{
-		net:       net,
-		transport: transport,
-		r:         tcpreader.NewReaderStream(),
-		factory:   h,
+func (s *LogSink) logConnection(c *Connection) {
+	src, dst, tunnel := c.Client, c.Broker, c.Tunnel
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if c.Closed {
+		delete(s.conns, c.Endpoints)
+		log.Printf("conn: %s -> %s%s EOF", src, dst, via(tunnel))
+		return
 	}
 
-	go s.run() // Important... we must guarantee that data from the reader stream is read.
+	s.conns[c.Endpoints] = &loggedConn{types: map[string]bool{}, start: c.Time}
+
+	if c.Proxy != "" {
+		log.Printf("conn: %s -> %s%s via PROXY %s", src, dst, via(tunnel), c.Proxy)
+	}
 
-	return &s.r
+	if c.TLS != nil {
+		log.Printf("conn: %s -> %s%s, type: %s, server name: %s, version: %s, ja4: %s",
+			src, dst, via(tunnel), ReqTypeTLS, c.TLS.ServerName, c.TLS.Version, c.TLS.JA4)
+	}
 }
 
-func (h *kafkaStreamPrinter) run() {
-	buf := bufio.NewReaderSize(&h.r, 2<<15) // 65k
-	src := fmt.Sprintf("%s:%s", h.net.Src(), h.transport.Src())
-	dst := fmt.Sprintf("%s:%s", h.net.Dst(), h.transport.Dst())
+func (s *LogSink) logRequest(r *Request) {
+	src, dst, typ := r.Client, r.Broker, r.Type
 
-	start := time.Now()
-	for {
-		r, n, err := kafka.DecodeRequest(buf)
-		if err == io.EOF || err == io.ErrUnexpectedEOF {
-			log.Printf("conn: %s -> %s EOF", src, dst)
-			h.factory.ClientStat.Clear(src, dst)
-			return
-		}
+	if s.verbose {
+		log.Printf("got request, key: %d, version: %d, correlationID: %d, clientID: %s\n", r.Key, r.Version, r.CorrelationID, r.ClientID)
+	}
 
-		if err != nil {
-			if _, ok := err.(kafka.PacketDecodingError); ok {
-				if _, err := buf.Discard(n); err != nil {
-					log.Printf("could not discard: %s\n", err)
-				}
-			}
+	if !strings.Contains(strings.ToLower(typ), s.printType) {
+		return
+	}
 
-			continue
-		}
+	s.lock.Lock()
+	c, ok := s.conns[r.Endpoints]
+	if !ok {
+		c = &loggedConn{types: map[string]bool{}, start: r.Time}
+		s.conns[r.Endpoints] = c
+	}
 
-		typ := reflect.TypeOf(r.Body).String()
-		isPrintType := strings.Contains(strings.ToLower(typ), h.factory.printType)
-
-		if t, ok := r.Body.(interface {
-			ExtractTopics() []string
-		}); ok {
-			topics := t.ExtractTopics()
-			if h.factory.ClientStat.Stat(src, dst, r.ClientID, typ, topics, n) {
-				if isPrintType {
-					// CorrelationId，int32类型，由客户端指定的一个数字唯一标示这次请求的id，
-					// 服务器端在处理完请求后也会把同样的CorrelationId写到Response中，这样客户端就能把某个请求和响应对应起来了
-					log.Printf("conn: %s -> %s, type: %s topics: %s, correlationID: %d, clientID: %s",
-						src, dst, typ, topics, r.CorrelationID, r.ClientID)
-				}
-			}
-		}
+	_, hasTopics := r.Body.(topicsExtractor)
+	firstOfType := hasTopics && !c.types[typ]
+	c.types[typ] = true
 
-		if isPrintType {
-			if h.factory.printJsonDuration > 0 && time.Since(start) > h.factory.printJsonDuration {
-				start = time.Now()
-
-				log.Printf("conn: %s -> %s, correlationID: %d, clientID: %s", src, dst, r.CorrelationID, r.ClientID)
-				if b, err := json.Marshal(r.Body); err != nil {
-					log.Printf("json marshal failed: %s", err)
-				} else {
-					log.Printf("%s: %s", typ, b)
-				}
-			}
-		}
+	printJSON := s.printJsonDuration > 0 && r.Time.Sub(c.start) > s.printJsonDuration
+	if printJSON {
+		c.start = r.Time
 	}
-}
+	s.lock.Unlock()
 
-// kafkaStreamPrinter will handle the actual decoding of http requests.
-type kafkaStreamPrinter struct {
-	net, transport gopacket.Flow
-	r              tcpreader.ReaderStream
-	factory        *KafkaPrintStreamFactory
+	if firstOfType {
+		// CorrelationId，int32类型，由客户端指定的一个数字唯一标示这次请求的id，
+		// 服务器端在处理完请求后也会把同样的CorrelationId写到Response中，这样客户端就能把某个请求和响应对应起来了
+		log.Printf("conn: %s -> %s%s, type: %s topics: %s, correlationID: %d, clientID: %s",
+			src, dst, via(r.Tunnel), typ, r.Topics, r.CorrelationID, r.ClientID)
+	}
+
+	if printJSON {
+		log.Printf("conn: %s -> %s, correlationID: %d, clientID: %s", src, dst, r.CorrelationID, r.ClientID)
+		if b, err := json.Marshal(r.Body); err != nil {
+			log.Printf("json marshal failed: %s", err)
+		} else {
+			log.Printf("%s: %s", typ, b)
+		}
+	}
 }
 
 type Key struct {
 	Src     string
 	Dst     string
+	Tunnel  string `json:",omitempty"`
 	ReqType string
 }
 
@@ -134,29 +140,36 @@ type ReqTypeStatItemSnapshot struct {
 	Key
 
 	Start     time.Time
+	Update    time.Time
 	ClientID  string
+	Principal string `json:",omitempty"`
 	Requests  int
 	BytesRead int
 	Topics    []string
+	TLS       *TLSInfo `json:",omitempty"`
+	// Eof is set once the connection closed, at EofTime.
+	Eof     bool       `json:",omitempty"`
+	EofTime *time.Time `json:",omitempty"`
 }
 
 type ReqTypeStatItem struct {
 	ReqTypeStatItemSnapshot
 
 	topicsMap map[string]bool
-	Eof       bool
-	EofTime   *time.Time
-	Update    time.Time
 }
 
 type ClientStat struct {
-	lock sync.Mutex
-	Map  map[Key]*ReqTypeStatItem
+	lock  sync.Mutex
+	Map   map[Key]*ReqTypeStatItem
+	clock clock.Clock
 }
 
-func NewClientStat() *ClientStat {
+// NewClientStat creates a ClientStat whose queries are timed by c, e.g. the time of the captured packets.
+// The start, update and EOF times are those of the requests and connections recorded.
+func NewClientStat(c clock.Clock) *ClientStat {
 	return &ClientStat{
-		Map: map[Key]*ReqTypeStatItem{},
+		Map:   map[Key]*ReqTypeStatItem{},
+		clock: c,
 	}
 }
 
@@ -171,13 +184,15 @@ func (s *ClientStat) Snapshot() (ret []ReqTypeStatItemSnapshot) {
 	return
 }
 
-func (s *ClientStat) Stat(src, dst, clientID, typ string, topics []string, n int) (newTyp bool) {
+// Stat records a request of typ sent at t.
+func (s *ClientStat) Stat(src, dst, tunnel, clientID, principal, typ string, topics []string, n int, t time.Time) (newTyp bool) {
 	s.lock.Lock()
 	defer s.lock.Unlock()
 
 	k := Key{
 		Src:     src,
 		Dst:     dst,
+		Tunnel:  tunnel,
 		ReqType: typ,
 	}
 	r, ok := s.Map[k]
@@ -185,7 +200,7 @@ func (s *ClientStat) Stat(src, dst, clientID, typ string, topics []string, n int
 		r = &ReqTypeStatItem{
 			ReqTypeStatItemSnapshot: ReqTypeStatItemSnapshot{
 				Key:      k,
-				Start:    time.Now(),
+				Start:    t,
 				ClientID: clientID,
 			},
 			topicsMap: map[string]bool{}}
@@ -195,7 +210,16 @@ func (s *ClientStat) Stat(src, dst, clientID, typ string, topics []string, n int
 	r.Requests++
 	r.BytesRead += n
 	r.ClientID = clientID
-	r.Update = time.Now()
+	if principal != "" {
+		r.Principal = principal
+	}
+	// the requests of several shards are not recorded in order
+	if t.After(r.Update) {
+		r.Update = t
+	}
+	if t.Before(r.Start) {
+		r.Start = t
+	}
 
 	for _, topic := range topics {
 		if !r.topicsMap[topic] {
@@ -207,41 +231,85 @@ func (s *ClientStat) Stat(src, dst, clientID, typ string, topics []string, n int
 	return !ok
 }
 
-func (s *ClientStat) Clear(src, dst string) {
+// ReqTypeTLS is the request type of the clients connecting with TLS, whose requests are not seen.
+const ReqTypeTLS = "tls"
+
+// StatTLS records a client connecting with TLS at t.
+func (s *ClientStat) StatTLS(src, dst, tunnel string, info *TLSInfo, t time.Time) {
+	s.Stat(src, dst, tunnel, "", "", ReqTypeTLS, nil, 0, t)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if r, ok := s.Map[Key{Src: src, Dst: dst, Tunnel: tunnel, ReqType: ReqTypeTLS}]; ok {
+		r.TLS = info
+	}
+}
+
+// Publish implements Sink, it records the requests naming topics and the TLS connections.
+func (s *ClientStat) Publish(e Event) {
+	switch {
+	case e.Type == EventConnection && e.Connection.Closed:
+		c := e.Connection
+		s.Clear(c.Client, c.Broker, c.Tunnel, c.Time)
+	case e.Type == EventConnection && e.Connection.TLS != nil:
+		c := e.Connection
+		s.StatTLS(c.Client, c.Broker, c.Tunnel, c.TLS, c.Time)
+	case e.Type == EventRequest:
+		r := e.Request
+		if _, ok := r.Body.(topicsExtractor); ok {
+			s.Stat(r.Client, r.Broker, r.Tunnel, r.ClientID, r.Principal, r.Type, r.Topics, r.Size, r.Time)
+		}
+	}
+}
+
+// Clear records the connection closed at t.
+func (s *ClientStat) Clear(src, dst, tunnel string, t time.Time) {
 	s.lock.Lock()
 	defer s.lock.Unlock()
 
-	now := time.Now()
 	for k, v := range s.Map {
-		if k.Src == src && k.Dst == dst {
+		if k.Src == src && k.Dst == dst && k.Tunnel == tunnel {
 			v.Eof = true
-			v.EofTime = &now
+			v.EofTime = &t
 		}
 	}
 }
 
-func (s *ClientStat) Recycle(expire time.Duration) {
+// Recycle forgets the connections closed longer than expire before now.
+func (s *ClientStat) Recycle(now time.Time, expire time.Duration) {
 	s.lock.Lock()
 	defer s.lock.Unlock()
 
 	for k, v := range s.Map {
-		if v.Eof && time.Since(*v.EofTime) > expire {
+		if v.Eof && now.Sub(*v.EofTime) > expire {
 			delete(s.Map, k)
 		}
 	}
 }
 
+// ServeClientStatHandler serves the snapshot of stat as JSON, filtered, sorted, aggregated and paginated
+// by the query parameters, see ParseClientQuery. The count of the results of all the pages is X-Total-Count.
 func ServeClientStatHandler(stat *ClientStat) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		s := stat.Snapshot()
-		sort.SliceStable(s, func(i, j int) bool {
-			return s[i].Src < s[j].Src ||
-				s[i].Dst < s[j].Dst ||
-				s[i].ReqType < s[j].ReqType ||
-				s[i].ClientID < s[j].ClientID
-		})
+		q, err := ParseClientQuery(r.URL.Query(), stat.clock.Now())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var (
+			result interface{}
+			total  int
+		)
+		if q.Grouped() {
+			result, total = q.Aggregates(stat.Snapshot())
+		} else {
+			result, total = q.Items(stat.Snapshot())
+		}
 
 		w.Header().Set("Content-Type", "application/json; charset=utf-8")
-		_ = json.NewEncoder(w).Encode(s)
+		w.Header().Set("X-Total-Count", strconv.Itoa(total))
+		_ = json.NewEncoder(w).Encode(result)
 	}
 }
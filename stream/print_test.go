@@ -0,0 +1,52 @@
+package stream
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bingoohuang/kafka-sniffer/clock"
+	"github.com/bingoohuang/kafka-sniffer/kafka"
+)
+
+func TestClientStatTimedByEvents(t *testing.T) {
+	// the clock is ahead of the events, as the time of the packets read is ahead of those still queued
+	c := clock.NewPacket()
+	start := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	c.Observe(start.Add(time.Hour))
+	stat := NewClientStat(c)
+
+	endpoints := Endpoints{Client: "10.0.0.1:50000", Broker: "10.0.1.1:9092"}
+	request := func(t time.Time) Event {
+		return Event{Type: EventRequest, Request: &Request{
+			Endpoints: endpoints,
+			Request:   &kafka.Request{ClientID: "c1", Body: &kafka.FetchRequest{}},
+			Type:      "*kafka.FetchRequest",
+			Topics:    []string{"orders"},
+			Size:      100,
+			Time:      t,
+		}}
+	}
+
+	stat.Publish(request(start.Add(time.Second)))
+	// a request of another shard published late
+	stat.Publish(request(start))
+	stat.Publish(Event{Type: EventConnection, Connection: &Connection{Endpoints: endpoints, Closed: true, Time: start.Add(time.Minute)}})
+
+	items := stat.Snapshot()
+	if len(items) != 1 {
+		t.Fatalf("items %+v, want one", items)
+	}
+	if item := items[0]; !item.Start.Equal(start) || !item.Update.Equal(start.Add(time.Second)) || item.Requests != 2 ||
+		!item.Eof || item.EofTime == nil || !item.EofTime.Equal(start.Add(time.Minute)) {
+		t.Errorf("item %+v, want started at %s, updated a second later and ended a minute later", item, start)
+	}
+
+	stat.Recycle(start.Add(time.Minute+30*time.Second), time.Minute)
+	if got := len(stat.Snapshot()); got != 1 {
+		t.Fatalf("%d items half a minute after the end, want 1", got)
+	}
+	stat.Recycle(start.Add(2*time.Minute+time.Second), time.Minute)
+	if got := len(stat.Snapshot()); got != 0 {
+		t.Fatalf("%d items a minute after the end, want 0", got)
+	}
+}
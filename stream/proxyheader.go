@@ -0,0 +1,52 @@
+package stream
+
+import (
+	"io"
+	"log"
+	"strconv"
+
+	"github.com/bingoohuang/kafka-sniffer/metrics"
+	"github.com/bingoohuang/kafka-sniffer/proxyproto"
+
+	"github.com/google/gopacket"
+)
+
+// sniffProxyHeader reads the PROXY protocol header which load balancers send ahead of the client
+// bytes and returns the reader of the client bytes following it. Without a header, the returned
+// reader replays the bytes read, followed by the rest of r.
+func sniffProxyHeader(r io.Reader, m *metrics.Metrics) (io.Reader, *proxyproto.Header) {
+	head := make([]byte, proxyproto.SignatureSize)
+	n, err := io.ReadFull(r, head)
+	if err != nil || !proxyproto.HasSignature(head) {
+		return &replayReader{head: head[:n], err: err, r: r}, nil
+	}
+
+	h, err := proxyproto.ReadAfter(head, r)
+	if err != nil {
+		log.Printf("unable to parse PROXY protocol header: %v", err)
+		m.ProxyHeaders.WithLabelValues("invalid").Inc()
+		return r, nil
+	}
+
+	m.ProxyHeaders.WithLabelValues("v" + strconv.Itoa(h.Version)).Inc()
+	return r, h
+}
+
+// clientAddr returns the address of the client of a connection oriented from the client to the broker,
+// the original client told by the PROXY header h if any, e.g. 10.0.0.1:45678
+func clientAddr(net, transport gopacket.Flow, h *proxyproto.Header) string {
+	if h != nil && h.Source != nil {
+		return h.Source.String()
+	}
+
+	return hostPort(net.Src(), transport.Src())
+}
+
+// proxyAddr returns the address of the load balancer which sent the PROXY header h, if any.
+func proxyAddr(net, transport gopacket.Flow, h *proxyproto.Header) string {
+	if h == nil || h.Source == nil {
+		return ""
+	}
+
+	return hostPort(net.Src(), transport.Src())
+}
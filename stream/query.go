@@ -0,0 +1,527 @@
+package stream
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The aggregations of ClientQuery.GroupBy
+const (
+	GroupByIP       = "ip"
+	GroupByClientID = "client_id"
+	GroupByTopic    = "topic"
+)
+
+// The states of ClientQuery.State
+const (
+	StateActive = "active"
+	StateClosed = "closed"
+)
+
+// ClientQuery filters, sorts, aggregates and paginates the snapshot of a ClientStat, see ParseClientQuery.
+type ClientQuery struct {
+	src      []clientMatcher
+	dst      []clientMatcher
+	types    []string
+	clientID *regexp.Regexp
+	topics   []string
+	state    string
+	since    time.Time
+
+	sort    []sortKey
+	groupBy string
+	offset  int
+	limit   int
+}
+
+// sortKey is a field to sort by, descending or not.
+type sortKey struct {
+	field string
+	desc  bool
+}
+
+// ClientAggregate is the sum of the connections of an IP, a client id or a topic.
+type ClientAggregate struct {
+	// Key is the IP, the client id or the topic.
+	Key         string
+	Connections int
+	// Active is the count of the connections not closed.
+	Active    int
+	Requests  int
+	BytesRead int
+	Start     time.Time
+	Update    time.Time
+	IPs       []string `json:",omitempty"`
+	ClientIDs []string `json:",omitempty"`
+	Topics    []string `json:",omitempty"`
+	Types     []string `json:",omitempty"`
+}
+
+// the fields the snapshot items and the aggregates sort by
+var (
+	itemSortFields      = []string{"src", "dst", "type", "client_id", "principal", "requests", "bytes", "start", "update"}
+	aggregateSortFields = []string{"key", "connections", "active", "requests", "bytes", "start", "update"}
+)
+
+// ParseClientQuery parses the query parameters of /client, repeated or comma separated:
+//
+//	src        the client address: an IP, IP:port or CIDR
+//	dst        the broker address: an IP, IP:port or CIDR
+//	type       a request type, case insensitive substring, e.g. fetch or tls
+//	client_id  a regular expression the client id matches, e.g. ^consumer-
+//	topic      a topic, with * wildcards, e.g. orders.*
+//	state      active or closed
+//	since      seen since a time, RFC 3339, or a duration before now, e.g. 5m
+//	group_by   aggregates by ip, client_id or topic
+//	sort       the fields to sort by, - descending, e.g. -requests,src
+//	offset     skips the first results
+//	limit      the maximum count of results
+//
+// The items sort by src, dst, type, client_id, principal, requests, bytes, start or update, default src,dst,type,client_id.
+// The aggregates sort by key, connections, active, requests, bytes, start or update, default key.
+func ParseClientQuery(q url.Values, now time.Time) (*ClientQuery, error) {
+	cq := &ClientQuery{groupBy: q.Get("group_by"), state: q.Get("state")}
+
+	var err error
+	if cq.src, err = parseClientMatchers(queryValues(q, "src")); err != nil {
+		return nil, err
+	}
+	if cq.dst, err = parseClientMatchers(queryValues(q, "dst")); err != nil {
+		return nil, err
+	}
+
+	for _, t := range queryValues(q, "type") {
+		cq.types = append(cq.types, strings.ToLower(t))
+	}
+
+	if expr := q.Get("client_id"); expr != "" {
+		if cq.clientID, err = regexp.Compile(expr); err != nil {
+			return nil, fmt.Errorf("invalid client_id: %w", err)
+		}
+	}
+
+	for _, t := range queryValues(q, "topic") {
+		if _, err := path.Match(t, ""); err != nil {
+			return nil, fmt.Errorf("invalid topic %q: %w", t, err)
+		}
+		cq.topics = append(cq.topics, t)
+	}
+
+	switch cq.state {
+	case "", StateActive, StateClosed:
+	default:
+		return nil, fmt.Errorf("unknown state %q, active or closed", cq.state)
+	}
+
+	if since := q.Get("since"); since != "" {
+		if cq.since, err = parseSince(since, now); err != nil {
+			return nil, err
+		}
+	}
+
+	fields, defaultSort := itemSortFields, "src,dst,type,client_id"
+	switch cq.groupBy {
+	case "":
+	case GroupByIP, GroupByClientID, GroupByTopic:
+		fields, defaultSort = aggregateSortFields, "key"
+	default:
+		return nil, fmt.Errorf("unknown group_by %q, ip, client_id or topic", cq.groupBy)
+	}
+
+	sortBy := queryValues(q, "sort")
+	if len(sortBy) == 0 {
+		sortBy = strings.Split(defaultSort, ",")
+	}
+	for _, s := range sortBy {
+		key := sortKey{field: strings.TrimPrefix(s, "-"), desc: strings.HasPrefix(s, "-")}
+		if !containsString(fields, key.field) {
+			return nil, fmt.Errorf("unknown sort field %q, %s", key.field, strings.Join(fields, ", "))
+		}
+		cq.sort = append(cq.sort, key)
+	}
+
+	if cq.offset, err = parseCount(q.Get("offset")); err != nil {
+		return nil, fmt.Errorf("invalid offset: %w", err)
+	}
+	if cq.limit, err = parseCount(q.Get("limit")); err != nil {
+		return nil, fmt.Errorf("invalid limit: %w", err)
+	}
+
+	return cq, nil
+}
+
+func parseClientMatchers(values []string) (matchers []clientMatcher, err error) {
+	for _, v := range values {
+		m := clientMatcher{addr: v}
+		if strings.Contains(v, "/") {
+			if _, m.network, err = net.ParseCIDR(v); err != nil {
+				return nil, fmt.Errorf("invalid address %q: %w", v, err)
+			}
+		}
+		matchers = append(matchers, m)
+	}
+
+	return matchers, nil
+}
+
+// parseSince parses a time, RFC 3339, or a duration before now.
+func parseSince(s string, now time.Time) (time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return t, fmt.Errorf("invalid since %q, a RFC 3339 time or a duration", s)
+	}
+
+	return t, nil
+}
+
+func parseCount(s string) (int, error) {
+	if s == "" {
+		return 0, nil
+	}
+
+	n, err := strconv.Atoi(s)
+	if err == nil && n < 0 {
+		err = fmt.Errorf("negative %d", n)
+	}
+
+	return n, err
+}
+
+// Grouped tells whether the results are aggregates.
+func (q *ClientQuery) Grouped() bool {
+	return q.groupBy != ""
+}
+
+// Items returns the page of the items matching q, sorted, with the count of them all.
+func (q *ClientQuery) Items(items []ReqTypeStatItemSnapshot) ([]ReqTypeStatItemSnapshot, int) {
+	matched := make([]ReqTypeStatItemSnapshot, 0, len(items))
+	for _, item := range items {
+		if q.match(item) {
+			matched = append(matched, item)
+		}
+	}
+
+	// the snapshot is in the order of a map, the ties are broken by the keys of the items
+	sort.Slice(matched, func(i, j int) bool {
+		return q.less(func(field string) int { return compareItems(matched[i], matched[j], field) })
+	})
+
+	from, to := q.page(len(matched))
+	return matched[from:to], len(matched)
+}
+
+// Aggregates returns the page of the aggregates of the items matching q, sorted, with the count of them all.
+func (q *ClientQuery) Aggregates(items []ReqTypeStatItemSnapshot) ([]ClientAggregate, int) {
+	groups := map[string]*ClientAggregate{}
+	for _, item := range items {
+		if !q.match(item) {
+			continue
+		}
+
+		for _, key := range q.groupKeys(item) {
+			a, ok := groups[key]
+			if !ok {
+				a = &ClientAggregate{Key: key, Start: item.Start, Update: item.Update}
+				groups[key] = a
+			}
+			a.add(item, q.groupBy)
+		}
+	}
+
+	aggregates := make([]ClientAggregate, 0, len(groups))
+	for _, a := range groups {
+		sort.Strings(a.IPs)
+		sort.Strings(a.ClientIDs)
+		sort.Strings(a.Topics)
+		sort.Strings(a.Types)
+		aggregates = append(aggregates, *a)
+	}
+
+	// the groups are in the order of a map, the ties are broken by the keys
+	sort.Slice(aggregates, func(i, j int) bool {
+		return q.less(func(field string) int { return compareAggregates(aggregates[i], aggregates[j], field) })
+	})
+
+	from, to := q.page(len(aggregates))
+	return aggregates[from:to], len(aggregates)
+}
+
+// groupKeys returns the keys of the aggregates item adds to, one per topic by topic.
+func (q *ClientQuery) groupKeys(item ReqTypeStatItemSnapshot) []string {
+	switch q.groupBy {
+	case GroupByIP:
+		return []string{hostOf(item.Src)}
+	case GroupByClientID:
+		return []string{item.ClientID}
+	default:
+		return item.Topics
+	}
+}
+
+func (a *ClientAggregate) add(item ReqTypeStatItemSnapshot, groupBy string) {
+	a.Connections++
+	if !item.Eof {
+		a.Active++
+	}
+	a.Requests += item.Requests
+	a.BytesRead += item.BytesRead
+	if item.Start.Before(a.Start) {
+		a.Start = item.Start
+	}
+	if item.Update.After(a.Update) {
+		a.Update = item.Update
+	}
+
+	if groupBy != GroupByIP {
+		a.IPs = appendUnique(a.IPs, hostOf(item.Src))
+	}
+	if groupBy != GroupByClientID {
+		a.ClientIDs = appendUnique(a.ClientIDs, item.ClientID)
+	}
+	if groupBy != GroupByTopic {
+		for _, t := range item.Topics {
+			a.Topics = appendUnique(a.Topics, t)
+		}
+	}
+	a.Types = appendUnique(a.Types, item.ReqType)
+}
+
+// less orders by the sort keys in turn, compare returns the order of two results by a field.
+// The ties are broken by the unique keys of the results, compare of the empty field, so that the order
+// is total and the pages of the same results neither overlap nor skip any.
+func (q *ClientQuery) less(compare func(field string) int) bool {
+	for _, k := range q.sort {
+		c := compare(k.field)
+		if k.desc {
+			c = -c
+		}
+		if c != 0 {
+			return c < 0
+		}
+	}
+
+	return compare("") < 0
+}
+
+// page returns the bounds of the page of n results.
+func (q *ClientQuery) page(n int) (from, to int) {
+	from = q.offset
+	if from > n {
+		from = n
+	}
+
+	to = n
+	if q.limit > 0 && from+q.limit < n {
+		to = from + q.limit
+	}
+
+	return from, to
+}
+
+func (q *ClientQuery) match(item ReqTypeStatItemSnapshot) bool {
+	if !matchAny(q.src, item.Src) || !matchAny(q.dst, item.Dst) {
+		return false
+	}
+
+	if len(q.types) > 0 {
+		typ := strings.ToLower(item.ReqType)
+		found := false
+		for _, t := range q.types {
+			if strings.Contains(typ, t) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if q.clientID != nil && !q.clientID.MatchString(item.ClientID) {
+		return false
+	}
+
+	if len(q.topics) > 0 && !matchTopicPatterns(q.topics, item.Topics) {
+		return false
+	}
+
+	switch {
+	case q.state == StateActive && item.Eof,
+		q.state == StateClosed && !item.Eof:
+		return false
+	}
+
+	return q.since.IsZero() || !item.Update.Before(q.since)
+}
+
+func matchAny(matchers []clientMatcher, addr string) bool {
+	if len(matchers) == 0 {
+		return true
+	}
+
+	for _, m := range matchers {
+		if m.match(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matchTopicPatterns tells whether one of the topics matches one of the patterns.
+func matchTopicPatterns(patterns, topics []string) bool {
+	for _, t := range topics {
+		for _, p := range patterns {
+			if ok, _ := path.Match(p, t); ok {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func compareItems(a, b ReqTypeStatItemSnapshot, field string) int {
+	switch field {
+	case "src":
+		return compareAddrs(a.Src, b.Src)
+	case "dst":
+		return compareAddrs(a.Dst, b.Dst)
+	case "type":
+		return strings.Compare(a.ReqType, b.ReqType)
+	case "client_id":
+		return strings.Compare(a.ClientID, b.ClientID)
+	case "principal":
+		return strings.Compare(a.Principal, b.Principal)
+	case "requests":
+		return compareInts(a.Requests, b.Requests)
+	case "bytes":
+		return compareInts(a.BytesRead, b.BytesRead)
+	case "start":
+		return compareTimes(a.Start, b.Start)
+	case "update":
+		return compareTimes(a.Update, b.Update)
+	}
+
+	// the key of the item last, it is unique
+	if c := compareAddrStrings(a.Src, b.Src); c != 0 {
+		return c
+	}
+	if c := compareAddrStrings(a.Dst, b.Dst); c != 0 {
+		return c
+	}
+	if c := strings.Compare(a.Tunnel, b.Tunnel); c != 0 {
+		return c
+	}
+	return strings.Compare(a.ReqType, b.ReqType)
+}
+
+func compareAggregates(a, b ClientAggregate, field string) int {
+	switch field {
+	case "connections":
+		return compareInts(a.Connections, b.Connections)
+	case "active":
+		return compareInts(a.Active, b.Active)
+	case "requests":
+		return compareInts(a.Requests, b.Requests)
+	case "bytes":
+		return compareInts(a.BytesRead, b.BytesRead)
+	case "start":
+		return compareTimes(a.Start, b.Start)
+	case "update":
+		return compareTimes(a.Update, b.Update)
+	}
+
+	// the key last, it is unique
+	return compareAddrStrings(a.Key, b.Key)
+}
+
+// compareAddrStrings orders by compareAddrs, and the addresses equal by it, e.g. an IPv4 and its IPv4-mapped IPv6,
+// as strings.
+func compareAddrStrings(a, b string) int {
+	if c := compareAddrs(a, b); c != 0 {
+		return c
+	}
+
+	return strings.Compare(a, b)
+}
+
+// compareAddrs orders the addresses by IP and port, numerically, the others as strings after them.
+func compareAddrs(a, b string) int {
+	ipA, portA := splitAddr(a)
+	ipB, portB := splitAddr(b)
+
+	switch {
+	case ipA != nil && ipB != nil:
+		if c := bytes.Compare(ipA, ipB); c != 0 {
+			return c
+		}
+		return compareInts(portA, portB)
+	case ipA != nil:
+		return -1
+	case ipB != nil:
+		return 1
+	default:
+		return strings.Compare(a, b)
+	}
+}
+
+// splitAddr returns the IP, in 16 bytes, and the port of an address, or of an IP without port.
+func splitAddr(addr string) (net.IP, int) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, 0
+	}
+
+	p, _ := strconv.Atoi(port)
+	return ip.To16(), p
+}
+
+func compareInts(a, b int) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
+
+func compareTimes(a, b time.Time) int {
+	switch {
+	case a.Before(b):
+		return -1
+	case a.After(b):
+		return 1
+	default:
+		return 0
+	}
+}
+
+func containsString(values []string, v string) bool {
+	for _, s := range values {
+		if s == v {
+			return true
+		}
+	}
+
+	return false
+}
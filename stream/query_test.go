@@ -0,0 +1,55 @@
+package stream
+
+import (
+	"math/rand"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestClientQueryPagesWithTies(t *testing.T) {
+	now := time.Now()
+	items := []ReqTypeStatItemSnapshot{
+		{Key: Key{Src: "10.0.0.2:1000", Dst: "10.0.1.1:9092", ReqType: "*kafka.FetchRequest"}, ClientID: "a", Requests: 5, Topics: []string{"t1"}},
+		{Key: Key{Src: "10.0.0.10:1000", Dst: "10.0.1.1:9092", ReqType: "*kafka.FetchRequest"}, ClientID: "b", Requests: 5, Topics: []string{"t2"}},
+		{Key: Key{Src: "10.0.0.2:1000", Dst: "10.0.1.1:9092", ReqType: "*kafka.ProduceRequest"}, ClientID: "a", Requests: 5, Topics: []string{"t3"}},
+		{Key: Key{Src: "10.0.0.2:1000", Dst: "10.0.1.1:9092", Tunnel: "vlan=100", ReqType: "*kafka.FetchRequest"}, ClientID: "c", Requests: 5, Topics: []string{"t4"}},
+		{Key: Key{Src: "10.0.0.3:1000", Dst: "10.0.1.1:9092", ReqType: "*kafka.FetchRequest"}, ClientID: "d", Requests: 9, Topics: []string{"t5"}},
+	}
+
+	want := []Key{items[4].Key, items[0].Key, items[2].Key, items[3].Key, items[1].Key}
+
+	for round := 0; round < 20; round++ {
+		rand.Shuffle(len(items), func(i, j int) { items[i], items[j] = items[j], items[i] })
+
+		for offset := range want {
+			q, err := ParseClientQuery(url.Values{"sort": {"-requests"}, "limit": {"1"}, "offset": {strconv.Itoa(offset)}}, now)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			page, total := q.Items(items)
+			if total != len(want) || len(page) != 1 {
+				t.Fatalf("page %d: got %d items of %d", offset, len(page), total)
+			}
+			if page[0].Key != want[offset] {
+				t.Fatalf("page %d: got %+v, want %+v", offset, page[0].Key, want[offset])
+			}
+		}
+
+		q, err := ParseClientQuery(url.Values{"group_by": {"topic"}, "sort": {"-requests"}}, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		aggregates, _ := q.Aggregates(items)
+		keys := make([]string, 0, len(aggregates))
+		for _, a := range aggregates {
+			keys = append(keys, a.Key)
+		}
+		if got := strings.Join(keys, ","); got != "t5,t1,t2,t3,t4" {
+			t.Fatalf("aggregates sorted %s", got)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package stream
+
+import (
+	"encoding/binary"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/bingoohuang/kafka-sniffer/clock"
+	"github.com/bingoohuang/kafka-sniffer/metrics"
+
+	"github.com/google/gopacket"
+)
+
+// relayQueue bounds the frames of a relayed connection waiting for its decoder.
+const relayQueue = 256
+
+// Relay feeds the decoder of a connection which is relayed instead of captured, e.g. by the proxy,
+// with the request frames of the client and the response frames of the broker. The relay never waits
+// for the decoder: the requests beyond a full queue are dropped and counted, the responses beyond it
+// are not matched with their requests.
+type Relay struct {
+	chunks  chan relayedChunk
+	reader  *relayReader
+	metrics *metrics.Metrics
+	clock   clock.Clock
+
+	lock   sync.Mutex
+	lost   bool
+	closed bool
+}
+
+// NewRelay starts decoding the connection of the client at the source of net and transport, fed by the Relay.
+func (h *KafkaStreamFactory) NewRelay(net, transport gopacket.Flow) *Relay {
+	chunks := make(chan relayedChunk, relayQueue)
+	r := &Relay{
+		chunks:  chunks,
+		reader:  &relayReader{chunks: chunks, pending: newPendingRequests()},
+		metrics: h.metrics,
+		clock:   h.clock,
+	}
+	h.NewReader(net, transport, "", r.reader)
+
+	return r
+}
+
+// Request queues a request frame relayed to the broker, length included, for decoding.
+// The frame must not be modified afterwards.
+func (r *Relay) Request(frame []byte) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.closed {
+		return
+	}
+
+	select {
+	case r.chunks <- relayedChunk{chunk: chunk{data: frame, lost: r.lost, seen: r.clock.Now()}}:
+		r.lost = false
+	default:
+		// the decoder resynchronizes after the frames it missed
+		r.lost = true
+		r.metrics.RelayDroppedRequests.Inc()
+	}
+}
+
+// Response queues a response frame relayed to the client, length included, to be matched with its request
+// by the decoder. Only its correlation id and size are kept.
+func (r *Relay) Response(frame []byte) {
+	if len(frame) < responseHeaderSize {
+		return
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.closed {
+		return
+	}
+
+	response := &relayedResponse{correlationID: int32(binary.BigEndian.Uint32(frame[4:])), size: len(frame)}
+	select {
+	case r.chunks <- relayedChunk{chunk: chunk{seen: r.clock.Now()}, response: response}:
+	default:
+		// the request stays pending until it is evicted
+	}
+}
+
+// Close ends the requests, the decoder ends once it decoded the queued ones.
+func (r *Relay) Close() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if !r.closed {
+		r.closed = true
+		close(r.chunks)
+	}
+}
+
+// relayedChunk is a request frame queued by a Relay, or a response when response is set.
+type relayedChunk struct {
+	chunk
+	response *relayedResponse
+}
+
+// relayedResponse is the correlation id and size of a response frame
+type relayedResponse struct {
+	correlationID int32
+	size          int
+}
+
+// relayReader is an io.Reader over the request frames of a Relay, which matches the responses queued
+// in between with their requests. Like halfReader, it returns ErrLostData once before the frames
+// following dropped ones.
+type relayReader struct {
+	chunks  <-chan relayedChunk
+	current relayedChunk
+	// lastSeen is the time the frame read last was relayed
+	lastSeen time.Time
+	pending  *pendingRequests
+}
+
+// Read implements io.Reader
+func (r *relayReader) Read(p []byte) (int, error) {
+	for !r.current.lost && len(r.current.data) == 0 {
+		var ok bool
+		if r.current, ok = <-r.chunks; !ok {
+			return 0, io.EOF
+		}
+		if resp := r.current.response; resp != nil {
+			r.pending.response(resp.correlationID, resp.size, r.current.seen)
+		}
+	}
+
+	if r.current.lost {
+		r.current.lost = false
+		return 0, ErrLostData
+	}
+
+	r.lastSeen = r.current.seen
+	n := copy(p, r.current.data)
+	r.current.data = r.current.data[n:]
+
+	return n, nil
+}
+
+func (r *relayReader) seenTime() time.Time {
+	return r.lastSeen
+}
+
+func (r *relayReader) responses() *pendingRequests {
+	return r.pending
+}
@@ -0,0 +1,138 @@
+package stream
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/bingoohuang/kafka-sniffer/clock"
+	"github.com/bingoohuang/kafka-sniffer/metrics"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// chanSink publishes the events to a channel, blocking until they are received.
+type chanSink chan Event
+
+func (s chanSink) Publish(e Event) { s <- e }
+
+func newTestRelay(t *testing.T, sink Sink, m *metrics.Metrics) *Relay {
+	t.Helper()
+
+	ports, err := ParseBrokerPorts("9092")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	netFlow, _ := gopacket.FlowFromEndpoints(layers.NewIPEndpoint(net.ParseIP("10.0.0.1")), layers.NewIPEndpoint(net.ParseIP("10.0.1.1")))
+	transportFlow, _ := gopacket.FlowFromEndpoints(layers.NewTCPPortEndpoint(50000), layers.NewTCPPortEndpoint(9092))
+
+	return NewKafkaStreamFactory(sink, ports, nil, m, clock.Wall).NewRelay(netFlow, transportFlow)
+}
+
+// apiVersionsFrame is an ApiVersions v0 request of correlationID.
+func apiVersionsFrame(correlationID int32) []byte {
+	frame := make([]byte, 12, 16)
+	binary.BigEndian.PutUint16(frame[4:], 18)
+	binary.BigEndian.PutUint32(frame[8:], uint32(correlationID))
+	frame = append(frame, 0, 2, 'c', '1')
+	binary.BigEndian.PutUint32(frame, uint32(len(frame)-4))
+
+	return frame
+}
+
+// untilClosed receives the events until the connection is closed, the closing event included.
+func untilClosed(t *testing.T, events chanSink) []Event {
+	t.Helper()
+
+	var received []Event
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case e := <-events:
+			received = append(received, e)
+			if e.Type == EventConnection && e.Connection.Closed {
+				return received
+			}
+		case <-timeout:
+			t.Fatalf("the connection was not closed, received %d events", len(received))
+		}
+	}
+}
+
+func responseFrame(correlationID int32, size int) []byte {
+	frame := make([]byte, 4+size)
+	binary.BigEndian.PutUint32(frame, uint32(size))
+	binary.BigEndian.PutUint32(frame[4:], uint32(correlationID))
+
+	return frame
+}
+
+func TestRelayMatchesResponses(t *testing.T) {
+	events := make(chanSink, 16)
+	relay := newTestRelay(t, events, metrics.New(nil))
+
+	relay.Request(apiVersionsFrame(1))
+	relay.Response(responseFrame(1, 100))
+	relay.Close()
+
+	var request *Request
+	var response *Response
+	for _, e := range untilClosed(t, events) {
+		switch e.Type {
+		case EventRequest:
+			request = e.Request
+		case EventResponse:
+			response = e.Response
+		}
+	}
+
+	if request == nil || request.ClientID != "c1" || request.Client != "10.0.0.1:50000" {
+		t.Fatalf("request %+v", request)
+	}
+	if response == nil || response.CorrelationID != 1 || response.Key != 18 || response.ClientID != "c1" ||
+		response.Size != 104 || response.Latency < 0 || response.Broker != "10.0.1.1:9092" {
+		t.Fatalf("response %+v", response)
+	}
+}
+
+func TestRelayDropsWhenFull(t *testing.T) {
+	// the decoder is stuck publishing the connection until the events are received
+	events := make(chanSink)
+	m := metrics.New(nil)
+	relay := newTestRelay(t, events, m)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := int32(1); i <= 2*relayQueue; i++ {
+			relay.Request(apiVersionsFrame(i))
+			relay.Response(responseFrame(i, 100))
+		}
+		relay.Close()
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("relaying waited for the decoder")
+	}
+
+	dropped := int(testutil.ToFloat64(m.RelayDroppedRequests))
+	if dropped < relayQueue-1 {
+		t.Errorf("dropped %d requests, want at least %d", dropped, relayQueue-1)
+	}
+
+	requests := 0
+	for _, e := range untilClosed(t, events) {
+		if e.Type == EventRequest {
+			requests++
+		}
+	}
+	if requests == 0 || requests+dropped > 2*relayQueue {
+		t.Errorf("decoded %d requests, dropped %d of %d", requests, dropped, 2*relayQueue)
+	}
+}
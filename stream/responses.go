@@ -0,0 +1,160 @@
+package stream
+
+import (
+	"encoding/binary"
+	"sync"
+	"time"
+)
+
+const (
+	// responseHeaderSize is the size and the correlation id starting every response
+	responseHeaderSize = 8
+	// maxResponseSize is larger than the default socket.request.max.bytes and fetch.max.bytes of brokers.
+	// TLS records and other protocols have larger sizes.
+	maxResponseSize = 100 << 20
+	// maxPending bounds the requests waiting for a response per connection, e.g. produce requests
+	// with acks=0 are never answered.
+	maxPending = 1024
+)
+
+// responseFrames splits the broker half of a connection into response frames. It gives up at the
+// first gap or implausible frame size, e.g. of TLS records, since the next frame boundary is unknown.
+type responseFrames struct {
+	head      []byte
+	remaining int
+	failed    bool
+}
+
+// feed reads the frames of data, calling onFrame with the correlation id and the size of every frame which starts.
+func (f *responseFrames) feed(data []byte, lost bool, onFrame func(correlationID int32, size int)) {
+	if lost {
+		f.failed = true
+	}
+
+	for len(data) > 0 && !f.failed {
+		if f.remaining > 0 {
+			n := f.remaining
+			if n > len(data) {
+				n = len(data)
+			}
+			f.remaining -= n
+			data = data[n:]
+			continue
+		}
+
+		n := responseHeaderSize - len(f.head)
+		if n > len(data) {
+			n = len(data)
+		}
+		f.head, data = append(f.head, data[:n]...), data[n:]
+		if len(f.head) < responseHeaderSize {
+			return
+		}
+
+		size := int(int32(binary.BigEndian.Uint32(f.head)))
+		if size < 4 || size > maxResponseSize {
+			f.failed = true
+			return
+		}
+
+		onFrame(int32(binary.BigEndian.Uint32(f.head[4:])), 4+size)
+		f.remaining, f.head = size-4, f.head[:0]
+	}
+}
+
+// pendingRequests matches the responses of a connection with its requests by their correlation id.
+// The responses may be seen before the decoder decoded their requests, so both sides wait for the other.
+type pendingRequests struct {
+	lock      sync.Mutex
+	sink      Sink
+	endpoints Endpoints
+	requests  map[int32]pendingRequest
+	responses map[int32]pendingResponse
+}
+
+type pendingRequest struct {
+	key, version int16
+	clientID     string
+	topics       []string
+	time         time.Time
+}
+
+type pendingResponse struct {
+	size int
+	time time.Time
+}
+
+func newPendingRequests() *pendingRequests {
+	return &pendingRequests{
+		requests:  map[int32]pendingRequest{},
+		responses: map[int32]pendingResponse{},
+	}
+}
+
+// start publishes the responses to sink once the decoder knows the endpoints of the connection.
+func (p *pendingRequests) start(sink Sink, endpoints Endpoints) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.sink, p.endpoints = sink, endpoints
+}
+
+// request records a decoded request.
+func (p *pendingRequests) request(req *Request) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	pending := pendingRequest{key: req.Key, version: req.Version, clientID: req.ClientID, topics: req.Topics, time: req.Time}
+	if resp, ok := p.responses[req.CorrelationID]; ok {
+		delete(p.responses, req.CorrelationID)
+		p.publish(req.CorrelationID, pending, resp)
+		return
+	}
+
+	if len(p.requests) >= maxPending {
+		p.requests = map[int32]pendingRequest{}
+	}
+	p.requests[req.CorrelationID] = pending
+}
+
+// response records the frame of a response seen at t.
+func (p *pendingRequests) response(correlationID int32, size int, t time.Time) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	resp := pendingResponse{size: size, time: t}
+	if req, ok := p.requests[correlationID]; ok {
+		delete(p.requests, correlationID)
+		p.publish(correlationID, req, resp)
+		return
+	}
+
+	if len(p.responses) >= maxPending {
+		p.responses = map[int32]pendingResponse{}
+	}
+	p.responses[correlationID] = resp
+}
+
+func (p *pendingRequests) publish(correlationID int32, req pendingRequest, resp pendingResponse) {
+	if p.sink == nil {
+		return
+	}
+
+	latency := resp.time.Sub(req.time)
+	if latency < 0 {
+		// the request was decoded after the response was captured
+		latency = 0
+	}
+
+	p.sink.Publish(Event{Type: EventResponse, Response: &Response{
+		Endpoints:     p.endpoints,
+		CorrelationID: correlationID,
+		Key:           req.key,
+		Version:       req.version,
+		ClientID:      req.clientID,
+		Topics:        req.topics,
+		Size:          resp.size,
+		Latency:       latency,
+		Time:          resp.time,
+	}})
+}
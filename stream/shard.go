@@ -0,0 +1,229 @@
+package stream
+
+import (
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bingoohuang/kafka-sniffer/clock"
+	"github.com/bingoohuang/kafka-sniffer/metrics"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/reassembly"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	maxBufferedPagesTotal         = 100000
+	maxBufferedPagesPerConnection = 64
+
+	// flushInterval is how often buffered segments older than flushAge are pushed to the streams,
+	// giving up on the missing segments before them.
+	flushInterval = 5 * time.Second
+	flushAge      = 10 * time.Second
+	// closeAge is the inactivity after which connections are closed.
+	closeAge = 2 * time.Minute
+)
+
+// ShardedAssembler spreads TCP flows across several reassembly.Assembler shards.
+// Both directions of a connection hash to the same shard, so every shard owns its
+// connections exclusively and uses a private stream pool without lock contention.
+type ShardedAssembler struct {
+	shards   []*shard
+	ports    *BrokerPorts
+	verbose  bool
+	blocking bool
+
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
+
+type shard struct {
+	packets   chan captured
+	assembler *reassembly.Assembler
+	// clock tells the time of the packets the shard assembled, not of those still queued.
+	clock   clock.Clock
+	depth   prometheus.Gauge
+	drops   prometheus.Counter
+	verbose bool
+}
+
+// captured is a decapsulated TCP segment queued for its shard.
+type captured struct {
+	net gopacket.Flow
+	tcp *layers.TCP
+	ctx captureContext
+}
+
+// NewShardedAssembler creates n shards, each with its own stream pool and a queue of queueSize packets.
+// Encapsulated packets are only assembled when their inner TCP segment belongs to one of ports.
+// The idle connections are flushed and closed by the time of c. When c is a clock.Observer, the time of the
+// captured packets, every shard tells it by the packets it assembled instead, so that the packets waiting
+// in its queue are not flushed as if they were late.
+func NewShardedAssembler(factory reassembly.StreamFactory, ports *BrokerPorts, m *metrics.Metrics, c clock.Clock,
+	n, queueSize int, verbose bool) *ShardedAssembler {
+	if n <= 0 {
+		n = 1
+	}
+
+	a := &ShardedAssembler{ports: ports, verbose: verbose, quit: make(chan struct{})}
+	for i := 0; i < n; i++ {
+		assembler := reassembly.NewAssembler(reassembly.NewStreamPool(factory))
+
+		// Buffer some out of order segments per connection instead of flushing at once,
+		// the request decoder resynchronizes after the gaps which remain.
+		assembler.MaxBufferedPagesTotal = maxBufferedPagesTotal
+		assembler.MaxBufferedPagesPerConnection = maxBufferedPagesPerConnection
+
+		shardClock := c
+		if _, ok := c.(clock.Observer); ok {
+			shardClock = clock.NewPacket()
+		}
+
+		label := strconv.Itoa(i)
+		a.shards = append(a.shards, &shard{
+			packets:   make(chan captured, queueSize),
+			assembler: assembler,
+			clock:     shardClock,
+			depth:     m.AssemblyQueueDepth.WithLabelValues(label),
+			drops:     m.AssemblyDroppedPackets.WithLabelValues(label),
+			verbose:   verbose,
+		})
+	}
+
+	return a
+}
+
+// SetBlocking makes Assemble wait for room in the queue of a shard instead of dropping the packet,
+// for the sources which can wait, e.g. a capture file being replayed. It must be called before Start.
+func (a *ShardedAssembler) SetBlocking(blocking bool) {
+	a.blocking = blocking
+}
+
+// Start starts a goroutine per shard.
+func (a *ShardedAssembler) Start() {
+	for _, s := range a.shards {
+		a.wg.Add(1)
+		go func(s *shard) {
+			defer a.wg.Done()
+			s.run(a.quit)
+		}(s)
+	}
+}
+
+// Stop stops the shards once they assembled the packets queued, and closes their connections, so that the
+// decoders see io.EOF.
+// Packets assembled afterwards are dropped.
+func (a *ShardedAssembler) Stop() {
+	close(a.quit)
+	a.wg.Wait()
+}
+
+// Assemble dispatches the innermost TCP segment of the packet to the shard owning its flow.
+// The packet is dropped when that shard's queue is full, unless the assembler is blocking.
+func (a *ShardedAssembler) Assemble(p gopacket.Packet) {
+	seg, ok := Decapsulate(p)
+	if !ok {
+		if a.verbose {
+			log.Println("Unusable packet")
+		}
+		return
+	}
+
+	// the BPF expression can only select the ports of plain packets
+	if seg.Tunnel != "" && !a.ports.Accepts(uint16(seg.TCP.SrcPort), uint16(seg.TCP.DstPort)) {
+		return
+	}
+
+	// Connections are told apart by their inner addresses, overlapping tunnels are not kept apart.
+	// FastHash is symmetric, so both directions of a connection land on the same shard.
+	netFlow := seg.Network.NetworkFlow()
+	h := netFlow.FastHash() ^ seg.TCP.TransportFlow().FastHash()
+	s := a.shards[h%uint64(len(a.shards))]
+
+	c := captured{
+		net: netFlow,
+		tcp: seg.TCP,
+		ctx: captureContext{ci: p.Metadata().CaptureInfo, tunnel: seg.Tunnel},
+	}
+
+	if a.blocking {
+		select {
+		case s.packets <- c:
+			s.depth.Set(float64(len(s.packets)))
+		case <-a.quit:
+		}
+		return
+	}
+
+	select {
+	case s.packets <- c:
+		s.depth.Set(float64(len(s.packets)))
+	default:
+		s.drops.Inc()
+	}
+}
+
+// run assembles the packets of the shard, flushing every flushInterval of the time of its clock, checked on every
+// packet, and by a ticker while no packets arrive.
+func (s *shard) run(quit chan struct{}) {
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	flush := clock.NewSchedule(s.clock, flushInterval)
+	observer, _ := s.clock.(clock.Observer)
+
+	for {
+		select {
+		case <-quit:
+			// the packets queued before Stop are assembled
+			for {
+				select {
+				case p := <-s.packets:
+					s.assemble(p, observer)
+				default:
+					s.assembler.FlushAll()
+					return
+				}
+			}
+
+		case p := <-s.packets:
+			s.assemble(p, observer)
+
+		case <-ticker.C:
+		}
+
+		if now, ok := flush.Due(); ok {
+			s.assembler.FlushWithOptions(reassembly.FlushOptions{T: now.Add(-flushAge), TC: now.Add(-closeAge)})
+			if s.verbose {
+				log.Println("---- FLUSHING ----")
+			}
+		}
+	}
+}
+
+// assemble assembles a packet dequeued, advancing the clock of the shard to its time.
+func (s *shard) assemble(p captured, observer clock.Observer) {
+	s.depth.Set(float64(len(s.packets)))
+	if observer != nil {
+		observer.Observe(p.ctx.ci.Timestamp)
+	}
+	s.assembler.AssembleWithContext(p.net, p.tcp, &p.ctx)
+}
+
+// captureContext implements reassembly.AssemblerContext
+type captureContext struct {
+	ci     gopacket.CaptureInfo
+	tunnel string
+}
+
+func (c *captureContext) GetCaptureInfo() gopacket.CaptureInfo {
+	return c.ci
+}
+
+// Tunnel returns the encapsulations the packet was carried in, see Segment.Tunnel.
+func (c *captureContext) Tunnel() string {
+	return c.tunnel
+}
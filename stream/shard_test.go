@@ -0,0 +1,196 @@
+package stream
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bingoohuang/kafka-sniffer/clock"
+	"github.com/bingoohuang/kafka-sniffer/metrics"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// tcpPacket is a packet of payload from the client at port to the broker, captured at t.
+func tcpPacket(t *testing.T, port layers.TCPPort, payload []byte, ts time.Time) gopacket.Packet {
+	t.Helper()
+
+	return ipPacket(t, net.ParseIP("10.0.0.1"), net.ParseIP("10.0.1.1"), port, 9092, payload, ts)
+}
+
+// ipPacket is a packet of payload from src at srcPort to dst at dstPort, over IPv4 or IPv6 as the addresses are,
+// captured at t.
+func ipPacket(t *testing.T, src, dst net.IP, srcPort, dstPort layers.TCPPort, payload []byte, ts time.Time) gopacket.Packet {
+	t.Helper()
+
+	eth := &layers.Ethernet{SrcMAC: net.HardwareAddr{0, 0, 0, 0, 0, 1}, DstMAC: net.HardwareAddr{0, 0, 0, 0, 0, 2}}
+	tcp := &layers.TCP{SrcPort: srcPort, DstPort: dstPort, Seq: 1000, Ack: 1, PSH: true, ACK: true, Window: 65535}
+
+	var ip gopacket.SerializableLayer
+	if src.To4() != nil {
+		eth.EthernetType = layers.EthernetTypeIPv4
+		ip4 := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: src.To4(), DstIP: dst.To4()}
+		_ = tcp.SetNetworkLayerForChecksum(ip4)
+		ip = ip4
+	} else {
+		eth.EthernetType = layers.EthernetTypeIPv6
+		ip6 := &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolTCP, SrcIP: src, DstIP: dst}
+		_ = tcp.SetNetworkLayerForChecksum(ip6)
+		ip = ip6
+	}
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, eth, ip, tcp, gopacket.Payload(payload)); err != nil {
+		t.Fatal(err)
+	}
+
+	p := gopacket.NewPacket(buf.Bytes(), layers.LayerTypeEthernet, gopacket.Default)
+	md := p.Metadata()
+	md.Timestamp, md.CaptureLength, md.Length = ts, len(buf.Bytes()), len(buf.Bytes())
+
+	return p
+}
+
+// fakeClock is set by the test, it tells every time it is read.
+type fakeClock struct {
+	lock  sync.Mutex
+	now   time.Time
+	reads chan time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.lock.Lock()
+	now := c.now
+	c.lock.Unlock()
+
+	c.reads <- now
+	return now
+}
+
+func (c *fakeClock) set(t time.Time) {
+	c.lock.Lock()
+	c.now = t
+	c.lock.Unlock()
+}
+
+func TestShardFlushesByPacketTime(t *testing.T) {
+	ports, err := ParseBrokerPorts("9092")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	c := &fakeClock{now: start, reads: make(chan time.Time, 1)}
+	m := metrics.New(nil)
+	events := make(chanSink, 16)
+	a := NewShardedAssembler(NewKafkaStreamFactory(events, ports, nil, m, clock.Wall), ports, m, c, 1, 16, false)
+	a.Start()
+	defer a.Stop()
+
+	// the shard reads its clock once per packet to schedule the flushes
+	a.Assemble(tcpPacket(t, 50000, apiVersionsFrame(1), start))
+	<-c.reads
+
+	// the replay goes on faster than the wall clock: the idle connection is closed by the time of the packets
+	later := start.Add(closeAge + flushInterval + time.Second)
+	c.set(later)
+	a.Assemble(tcpPacket(t, 50001, apiVersionsFrame(1), later))
+	<-c.reads
+
+	timeout := time.After(flushInterval / 2)
+	for {
+		select {
+		case e := <-events:
+			if e.Type == EventConnection && e.Connection.Closed {
+				if e.Connection.Client != "10.0.0.1:50000" {
+					t.Fatalf("closed %s, want the idle connection", e.Connection.Client)
+				}
+				return
+			}
+		case <-timeout:
+			t.Fatal("the idle connection was not closed before the flush ticker")
+		}
+	}
+}
+
+func TestShardIPv6(t *testing.T) {
+	ports, err := ParseBrokerPorts("9092")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	c := &fakeClock{now: start, reads: make(chan time.Time, 1)}
+	m := metrics.New(nil)
+	events := make(chanSink, 16)
+	a := NewShardedAssembler(NewKafkaStreamFactory(events, ports, nil, m, clock.Wall), ports, m, c, 4, 16, false)
+	a.Start()
+
+	// both directions of the connection are assembled by the same shard, so that the response matches its request
+	client, broker := net.ParseIP("fd00::1"), net.ParseIP("fd00::2")
+	a.Assemble(ipPacket(t, client, broker, 50000, 9092, apiVersionsFrame(1), start))
+	<-c.reads
+	a.Assemble(ipPacket(t, broker, client, 9092, 50000, responseFrame(1, 100), start.Add(time.Millisecond)))
+	<-c.reads
+	a.Stop()
+
+	var request *Request
+	var response *Response
+	for _, e := range untilClosed(t, events) {
+		switch e.Type {
+		case EventRequest:
+			request = e.Request
+		case EventResponse:
+			response = e.Response
+		}
+	}
+
+	if request == nil || request.Client != "[fd00::1]:50000" || request.Broker != "[fd00::2]:9092" {
+		t.Fatalf("request %+v", request)
+	}
+	if response == nil || response.CorrelationID != 1 || response.Broker != "[fd00::2]:9092" {
+		t.Fatalf("response %+v", response)
+	}
+}
+
+func TestShardBlockingReplay(t *testing.T) {
+	ports, err := ParseBrokerPorts("9092")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const queueSize, connections = 4, 50
+	start := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	m := metrics.New(nil)
+	events := make(chanSink, 4*connections)
+	a := NewShardedAssembler(NewKafkaStreamFactory(events, ports, nil, m, clock.Wall), ports, m, clock.NewPacket(), 1, queueSize, false)
+	a.SetBlocking(true)
+	a.Start()
+
+	// the replay reads the packets much faster than the shard assembles them
+	for i := 0; i < connections; i++ {
+		a.Assemble(tcpPacket(t, layers.TCPPort(50000+i), apiVersionsFrame(int32(i)), start.Add(time.Duration(i)*time.Millisecond)))
+	}
+	a.Stop()
+
+	if dropped := testutil.ToFloat64(m.AssemblyDroppedPackets.WithLabelValues("0")); dropped != 0 {
+		t.Fatalf("dropped %v packets", dropped)
+	}
+
+	requests := 0
+	timeout := time.After(5 * time.Second)
+	for requests < connections {
+		select {
+		case e := <-events:
+			if e.Type == EventRequest {
+				requests++
+			}
+		case <-timeout:
+			t.Fatalf("decoded %d requests, want %d", requests, connections)
+		}
+	}
+}
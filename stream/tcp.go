@@ -0,0 +1,434 @@
+package stream
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/bingoohuang/kafka-sniffer/kafka"
+	"github.com/bingoohuang/kafka-sniffer/metrics"
+	"github.com/bingoohuang/kafka-sniffer/proxyproto"
+	"github.com/bingoohuang/kafka-sniffer/tlssniff"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/reassembly"
+)
+
+// ErrLostData is returned by the request reader when TCP segments were lost
+// and the bytes following it do not continue the previous ones.
+var ErrLostData = errors.New("lost data")
+
+// tcpStream implements reassembly.Stream. It sees both halves of a connection:
+// the bytes sent by the client are handed to the requests reader, the bytes sent
+// by the broker are only counted.
+type tcpStream struct {
+	// net and transport are oriented from the client to the broker.
+	net, transport gopacket.Flow
+	clientDir      reassembly.TCPFlowDirection
+
+	fsm        *reassembly.TCPSimpleFSM
+	optChecker reassembly.TCPOptionCheck
+
+	ports   *BrokerPorts
+	metrics *metrics.Metrics
+	start   startFunc
+	// probe holds the first bytes of connections on unknown ports until they are recognized as Kafka.
+	probe   *probe
+	ignored bool
+
+	requests      *halfReader
+	responses     responseFrames
+	responseBytes int
+}
+
+// startFunc starts decoding the requests of a connection oriented from the client to the broker.
+type startFunc func(net, transport gopacket.Flow, r io.Reader)
+
+// newTCPStream creates a stream for the connection whose first seen packet is tcp.
+// Decoding starts at once on broker ports and, while discovering, on other ports once probing recognized the connection as Kafka.
+func newTCPStream(net, transport gopacket.Flow, tcp *layers.TCP, ports *BrokerPorts, m *metrics.Metrics, start startFunc) *tcpStream {
+	s := &tcpStream{
+		net:        net,
+		transport:  transport,
+		clientDir:  reassembly.TCPDirClientToServer,
+		fsm:        reassembly.NewTCPSimpleFSM(reassembly.TCPSimpleFSMOptions{SupportMissingEstablishment: true}),
+		optChecker: reassembly.NewTCPOptionCheck(),
+		ports:      ports,
+		metrics:    m,
+		start:      start,
+		requests:   newHalfReader(),
+	}
+
+	if isServerFirst(tcp, ports) {
+		s.net, s.transport = net.Reverse(), transport.Reverse()
+		s.clientDir = reassembly.TCPDirServerToClient
+	}
+
+	switch {
+	case ports.Contains(uint16(tcp.SrcPort)) || ports.Contains(uint16(tcp.DstPort)):
+		s.startRequests()
+	case ports.Discovering():
+		// the client is only known for sure when the handshake was seen
+		s.probe = &probe{
+			oriented: tcp.SYN,
+			first:    map[reassembly.TCPFlowDirection][]byte{},
+			failed:   map[reassembly.TCPFlowDirection]bool{},
+		}
+	default:
+		// selected by a custom BPF expression
+		s.start(s.net, s.transport, s.requests)
+	}
+
+	return s
+}
+
+// startRequests starts decoding a connection to a broker port.
+func (s *tcpStream) startRequests() {
+	s.ports.Record(endpointPort(s.transport.Dst()), s.net.Dst().String())
+	s.start(s.net, s.transport, s.requests)
+}
+
+// probe recognizes Kafka connections by the header of the first request.
+type probe struct {
+	oriented bool
+	first    map[reassembly.TCPFlowDirection][]byte // the first bytes of each direction
+	failed   map[reassembly.TCPFlowDirection]bool
+}
+
+// probeBytes buffers the bytes of a connection which is not known to be Kafka yet.
+// Once the first bytes of a direction carry a plausible request header, that direction is
+// the client, decoding starts and the buffered bytes are fed. Connections of which no
+// direction looks like Kafka are ignored.
+func (s *tcpStream) probeBytes(dir reassembly.TCPFlowDirection, data []byte, lost bool) {
+	p := s.probe
+	if p.failed[dir] || p.oriented && dir != s.clientDir {
+		return
+	}
+
+	// bytes after a gap do not start a request
+	if !lost {
+		p.first[dir] = append(p.first[dir], data...)
+	}
+
+	// load balancers send a PROXY header ahead of the first request
+	first := p.first[dir]
+	if _, n, err := proxyproto.Parse(first); err == nil {
+		first = first[n:]
+	} else if err == io.ErrUnexpectedEOF && !lost {
+		return
+	}
+
+	switch {
+	case !lost && kafka.ProbeRequestHeader(first):
+		if dir != s.clientDir {
+			s.net, s.transport = s.net.Reverse(), s.transport.Reverse()
+			s.clientDir = dir
+		}
+
+		s.probe = nil
+		s.startRequests()
+		s.requests.feed(p.first[dir], false, time.Time{})
+		return
+	case lost || len(first) >= kafka.RequestHeaderProbeSize:
+		p.failed[dir] = true
+		delete(p.first, dir)
+	}
+
+	if p.failed[reassembly.TCPDirClientToServer] && p.failed[reassembly.TCPDirServerToClient] || p.oriented && p.failed[s.clientDir] {
+		s.probe = nil
+		s.ignored = true
+	}
+}
+
+// isServerFirst tells whether the first seen packet of a connection was sent by the broker.
+func isServerFirst(tcp *layers.TCP, ports *BrokerPorts) bool {
+	switch {
+	case tcp.SYN && !tcp.ACK:
+		return false
+	case tcp.SYN && tcp.ACK:
+		return true
+	default:
+		return ports.Contains(uint16(tcp.SrcPort)) && !ports.Contains(uint16(tcp.DstPort))
+	}
+}
+
+// Accept implements reassembly.Stream
+func (s *tcpStream) Accept(tcp *layers.TCP, ci gopacket.CaptureInfo, dir reassembly.TCPFlowDirection,
+	nextSeq reassembly.Sequence, start *bool, ac reassembly.AssemblerContext) bool {
+	if !s.fsm.CheckState(tcp, dir) {
+		s.metrics.TCPRejectedPackets.WithLabelValues("state").Inc()
+		return false
+	}
+
+	if err := s.optChecker.Accept(tcp, ci, dir, nextSeq, start); err != nil {
+		s.metrics.TCPRejectedPackets.WithLabelValues("options").Inc()
+		return false
+	}
+
+	// Connections opened before the capture started never show their SYN.
+	*start = true
+
+	return true
+}
+
+// ReassembledSG implements reassembly.Stream
+func (s *tcpStream) ReassembledSG(sg reassembly.ScatterGather, ac reassembly.AssemblerContext) {
+	dir, _, _, skip := sg.Info()
+	length, _ := sg.Lengths()
+
+	if stats := sg.Stats(); stats.OverlapPackets > 0 {
+		s.metrics.TCPOverlapPackets.Add(float64(stats.OverlapPackets))
+		s.metrics.TCPOverlapBytes.Add(float64(stats.OverlapBytes))
+	}
+
+	lost := skip > 0
+	if lost {
+		s.metrics.TCPGaps.Inc()
+		s.metrics.TCPMissingBytes.Add(float64(skip))
+	}
+
+	if s.ignored {
+		return
+	}
+
+	if s.probe != nil {
+		s.probeBytes(dir, sg.Fetch(length), lost)
+		return
+	}
+
+	seen := ac.GetCaptureInfo().Timestamp
+
+	if dir != s.clientDir {
+		data := sg.Fetch(length)
+		if s.requests.keepsResponse() {
+			s.requests.keepResponse(data, lost)
+		}
+		s.responses.feed(data, lost, func(correlationID int32, size int) {
+			s.requests.pending.response(correlationID, size, seen)
+		})
+		s.responseBytes += length
+		return
+	}
+
+	if length > 0 || lost {
+		s.requests.feed(sg.Fetch(length), lost, seen)
+	}
+}
+
+// ReassemblyComplete implements reassembly.Stream
+func (s *tcpStream) ReassemblyComplete(ac reassembly.AssemblerContext) bool {
+	s.requests.close()
+
+	// remove the connection, both halves are closed
+	return true
+}
+
+// ConnStreamFactory is a reassembly.StreamFactory which also decodes connections that are not captured
+// but relayed, e.g. by the proxy.
+type ConnStreamFactory interface {
+	reassembly.StreamFactory
+
+	// NewRelay starts decoding the requests which the client at the source of net and transport sends,
+	// and matching the responses of the broker with them, both fed by the returned Relay.
+	NewRelay(net, transport gopacket.Flow) *Relay
+}
+
+// endpointPort returns the port of a TCP endpoint.
+func endpointPort(e gopacket.Endpoint) uint16 {
+	return binary.BigEndian.Uint16(e.Raw())
+}
+
+// hostPort formats the address of an endpoint of a connection, with IPv6 hosts in brackets, e.g. [::1]:9092
+func hostPort(host, port gopacket.Endpoint) string {
+	return net.JoinHostPort(host.String(), port.String())
+}
+
+// newRequestReader creates a request decoder over the client half of a connection.
+func newRequestReader(r io.Reader, m *metrics.Metrics) *kafka.RequestReader {
+	rr := kafka.NewRequestReader(r)
+	rr.OnResync = func(skipped int) {
+		m.ResyncSkippedBytes.Add(float64(skipped))
+	}
+
+	return rr
+}
+
+type chunk struct {
+	data []byte
+	lost bool
+	seen time.Time
+}
+
+// maxResponsePrefix is how many bytes of the other half are kept, enough for a TLS ServerHello,
+// even one of a post-quantum hybrid key share such as X25519MLKEM768 of over a kilobyte
+const maxResponsePrefix = 4096
+
+// halfReader is an io.Reader over the reassembled bytes of one half of a connection.
+// Like tcpreader.ReaderStream, feed blocks until the bytes were consumed, so the
+// assembler can reuse its buffers, and the reader must be read until io.EOF.
+// It also keeps the first bytes of the other half when they start a TLS handshake,
+// for decrypting the connection, see responsePrefix.
+type halfReader struct {
+	chunks  chan chunk
+	done    chan struct{}
+	current chunk
+	fed     bool
+	closed  bool
+	// lastSeen is the capture time of the bytes read last
+	lastSeen time.Time
+	// pending matches the responses of the other half with the requests read
+	pending *pendingRequests
+
+	responseLock sync.Mutex
+	response     []byte
+	responseDone bool
+}
+
+func newHalfReader() *halfReader {
+	return &halfReader{
+		chunks:  make(chan chunk),
+		done:    make(chan struct{}),
+		pending: newPendingRequests(),
+	}
+}
+
+func (r *halfReader) feed(data []byte, lost bool, seen time.Time) {
+	r.chunks <- chunk{data: data, lost: lost, seen: seen}
+	<-r.done
+}
+
+func (r *halfReader) close() {
+	close(r.chunks)
+}
+
+// keepsResponse tells whether the first bytes of the other half are still wanted.
+func (r *halfReader) keepsResponse() bool {
+	r.responseLock.Lock()
+	defer r.responseLock.Unlock()
+
+	return !r.responseDone
+}
+
+// keepResponse keeps the first bytes of the other half, from its start and without gaps.
+func (r *halfReader) keepResponse(data []byte, lost bool) {
+	r.responseLock.Lock()
+	defer r.responseLock.Unlock()
+
+	switch {
+	case r.responseDone:
+	case lost || len(r.response) == 0 && len(data) > 0 && data[0] != tlssniff.RecordTypeHandshake:
+		r.response, r.responseDone = nil, true
+	default:
+		r.response = append(r.response, data...)
+		if len(r.response) >= maxResponsePrefix {
+			r.response, r.responseDone = r.response[:maxResponsePrefix], true
+		}
+	}
+}
+
+// responsePrefix returns the first bytes kept of the other half.
+func (r *halfReader) responsePrefix() []byte {
+	r.responseLock.Lock()
+	defer r.responseLock.Unlock()
+
+	return append([]byte(nil), r.response...)
+}
+
+// Read implements io.Reader. It returns ErrLostData once before the bytes following a gap.
+func (r *halfReader) Read(p []byte) (int, error) {
+	for !r.closed && !r.current.lost && len(r.current.data) == 0 {
+		if r.fed {
+			r.done <- struct{}{}
+		}
+
+		var ok bool
+		if r.current, ok = <-r.chunks; !ok {
+			r.closed = true
+		}
+		r.fed = ok
+	}
+
+	if r.current.lost {
+		r.current.lost = false
+		return 0, ErrLostData
+	}
+
+	if len(r.current.data) > 0 {
+		if !r.current.seen.IsZero() {
+			r.lastSeen = r.current.seen
+		}
+		n := copy(p, r.current.data)
+		r.current.data = r.current.data[n:]
+		return n, nil
+	}
+
+	return 0, io.EOF
+}
+
+func (r *halfReader) seenTime() time.Time {
+	return r.lastSeen
+}
+
+func (r *halfReader) responses() *pendingRequests {
+	return r.pending
+}
+
+// matchingReader is implemented by the readers of the client half which tell when the bytes read last were seen,
+// and match the responses of the broker half with the requests read, see halfReader and relayReader.
+type matchingReader interface {
+	seenTime() time.Time
+	responses() *pendingRequests
+}
+
+// responsePrefixer is implemented by the readers of the client half which keep the first bytes of the broker half.
+type responsePrefixer interface {
+	responsePrefix() []byte
+}
+
+// replayReader replays the bytes read ahead from r, then reads on from r. The error of the read ahead,
+// e.g. ErrLostData, is returned once before.
+type replayReader struct {
+	head []byte
+	err  error
+	r    io.Reader
+}
+
+// Read implements io.Reader
+func (r *replayReader) Read(p []byte) (int, error) {
+	if len(r.head) > 0 {
+		n := copy(p, r.head)
+		r.head = r.head[n:]
+		return n, nil
+	}
+
+	if err := r.err; err != nil {
+		r.err = nil
+		if err != io.EOF && err != io.ErrUnexpectedEOF {
+			return 0, err
+		}
+	}
+
+	return r.r.Read(p)
+}
+
+func (r *replayReader) responsePrefix() []byte {
+	if h, ok := r.r.(responsePrefixer); ok {
+		return h.responsePrefix()
+	}
+
+	return nil
+}
+
+// discardToEOF drains the reader so that the assembler or the relay never blocks on it.
+func discardToEOF(r io.Reader) {
+	for {
+		if _, err := io.Copy(ioutil.Discard, r); err != ErrLostData {
+			return
+		}
+	}
+}
@@ -0,0 +1,28 @@
+package stream
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func TestHostPort(t *testing.T) {
+	for _, tc := range []struct {
+		host gopacket.Endpoint
+		port gopacket.Endpoint
+		want string
+	}{
+		{layers.NewIPEndpoint(net.ParseIP("10.0.0.1")), layers.NewTCPPortEndpoint(9092), "10.0.0.1:9092"},
+		{layers.NewIPEndpoint(net.ParseIP("::1")), layers.NewTCPPortEndpoint(9092), "[::1]:9092"},
+		{layers.NewIPEndpoint(net.ParseIP("fd00::1")), layers.NewTCPPortEndpoint(50000), "[fd00::1]:50000"},
+		{layers.NewIPEndpoint(net.ParseIP("fe80::1:2:3:4")), layers.NewTCPPortEndpoint(9093), "[fe80::1:2:3:4]:9093"},
+		// a client of a dual-stack socket, as the IPv6 layer tells it
+		{gopacket.NewEndpoint(layers.EndpointIPv6, net.ParseIP("::ffff:10.0.0.1")), layers.NewTCPPortEndpoint(50000), "10.0.0.1:50000"},
+	} {
+		if got := hostPort(tc.host, tc.port); got != tc.want {
+			t.Errorf("hostPort(%s, %s) = %q, want %q", tc.host, tc.port, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package stream
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log"
+	"strconv"
+
+	"github.com/bingoohuang/kafka-sniffer/metrics"
+	"github.com/bingoohuang/kafka-sniffer/tlssniff"
+
+	"github.com/google/gopacket"
+)
+
+// TLSInfo describes the TLS connection of a client. It is empty for connections captured after the handshake.
+type TLSInfo struct {
+	ServerName   string   `json:",omitempty"`
+	Version      string   `json:",omitempty"`
+	CipherSuites []string `json:",omitempty"`
+	ALPN         []string `json:",omitempty"`
+	JA3          string   `json:",omitempty"`
+	JA4          string   `json:",omitempty"`
+}
+
+func newTLSInfo(h *tlssniff.ClientHello) *TLSInfo {
+	if h == nil {
+		return &TLSInfo{}
+	}
+
+	return &TLSInfo{
+		ServerName:   h.ServerName,
+		Version:      tlssniff.VersionName(h.MaxVersion()),
+		CipherSuites: h.CipherSuiteNames(),
+		ALPN:         h.ALPN,
+		JA3:          h.JA3(),
+		JA4:          h.JA4(),
+	}
+}
+
+// sniffTLS reads the first bytes of the client half of a connection. When they start a TLS record,
+// it parses the ClientHello, if any, and returns the TLS details. With the secrets of the session in
+// keyLog, the returned reader decrypts the requests, and decrypted is true. Otherwise the returned
+// reader replays the bytes read, followed by the rest of r.
+func sniffTLS(r io.Reader, keyLog *tlssniff.KeyLog, m *metrics.Metrics) (rest io.Reader, info *TLSInfo, decrypted bool) {
+	head := make([]byte, tlssniff.RecordHeaderSize)
+	n, err := io.ReadFull(r, head)
+	if err != nil || !tlssniff.ProbeRecordHeader(head) {
+		return &replayReader{head: head[:n], err: err, r: r}, nil, false
+	}
+
+	var hello *tlssniff.ClientHello
+
+	// records other than handshakes were captured after the handshake
+	if rec, err := tlssniff.ReadRecordAfter(head, r); err == nil && rec.Type == tlssniff.RecordTypeHandshake {
+		if hello, err = tlssniff.ReadClientHello(rec, r); err != nil {
+			log.Printf("unable to parse TLS ClientHello: %v", err)
+		}
+	}
+
+	info = newTLSInfo(hello)
+	if info.Version != "" {
+		m.TLSConnections.WithLabelValues(info.Version).Inc()
+	} else {
+		m.TLSConnections.WithLabelValues("unknown").Inc()
+	}
+
+	if keyLog == nil || hello == nil {
+		return r, info, false
+	}
+
+	return &decryptingReader{r: r, keyLog: keyLog, hello: hello, metrics: m}, info, true
+}
+
+// decryptingReader decrypts the records of a client following its ClientHello. The decryption
+// starts with the next record of the client, the ServerHello was captured by then. When the
+// connection cannot be decrypted, it returns io.EOF and the rest of r is discarded by the caller.
+type decryptingReader struct {
+	r         io.Reader
+	keyLog    *tlssniff.KeyLog
+	hello     *tlssniff.ClientHello
+	decrypter *tlssniff.Decrypter
+	metrics   *metrics.Metrics
+}
+
+// Read implements io.Reader
+func (d *decryptingReader) Read(p []byte) (int, error) {
+	if d.decrypter == nil {
+		head := make([]byte, tlssniff.RecordHeaderSize)
+		if _, err := io.ReadFull(d.r, head); err != nil {
+			return 0, io.EOF
+		}
+
+		decrypter, err := d.newDecrypter(io.MultiReader(bytes.NewReader(head), d.r))
+		if err != nil {
+			log.Printf("unable to decrypt TLS connection: %v", err)
+			d.metrics.TLSDecryptions.WithLabelValues("failed").Inc()
+			d.r = eofReader{}
+			return 0, io.EOF
+		}
+
+		d.metrics.TLSDecryptions.WithLabelValues("decrypted").Inc()
+		d.decrypter = decrypter
+	}
+
+	return d.decrypter.Read(p)
+}
+
+func (d *decryptingReader) newDecrypter(r io.Reader) (*tlssniff.Decrypter, error) {
+	var response []byte
+	if h, ok := d.r.(responsePrefixer); ok {
+		response = h.responsePrefix()
+	}
+	if len(response) == 0 {
+		return nil, errors.New("the ServerHello was not captured")
+	}
+
+	server, err := tlssniff.ReadServerHello(response)
+	if err != nil {
+		return nil, err
+	}
+
+	return tlssniff.NewDecrypter(r, d.keyLog, d.hello, server)
+}
+
+type eofReader struct{}
+
+func (eofReader) Read([]byte) (int, error) { return 0, io.EOF }
+
+// checkSecurity alerts when a client speaks plaintext to a TLS port of a broker or the other way round.
+func checkSecurity(ports *BrokerPorts, m *metrics.Metrics, src string, transport gopacket.Flow, security string) {
+	port := endpointPort(transport.Dst())
+	if expected, ok := ports.CheckSecurity(port, security); !ok {
+		log.Printf("ALERT: client %s speaks %s to the %s port %d", src, security, expected, port)
+		m.SecurityMismatches.WithLabelValues(strconv.Itoa(int(port)), expected, security).Inc()
+	}
+}
@@ -0,0 +1,278 @@
+package stream
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/bingoohuang/kafka-sniffer/clock"
+	"github.com/bingoohuang/kafka-sniffer/kafka"
+)
+
+// TopicStatItem is what was seen of a topic by the produce and fetch requests naming it,
+// and by the responses to them. A request naming several topics counts for each, its bytes are split among them.
+type TopicStatItem struct {
+	Topic     string
+	FirstSeen time.Time
+	LastSeen  time.Time
+	// Producers and Consumers are the clients as IP/client id, e.g. 10.0.0.1/consumer-1
+	Producers []string `json:",omitempty"`
+	Consumers []string `json:",omitempty"`
+	Produces  int
+	Fetches   int
+	// RequestBytes is the count of bytes of the requests. Those of a produce request naming several topics are split
+	// by the size of their record batches, the rest evenly.
+	RequestBytes int
+	// Records and RecordBytes are the count and the bytes of the records produced.
+	Records     int
+	RecordBytes int
+	// FetchedBytes is the count of bytes of the responses to the fetch requests. The bodies of the responses
+	// are not decoded, the size of a response naming several topics is split evenly among them.
+	FetchedBytes int
+	// Partitions are the partitions named by the requests, in ascending order.
+	Partitions []int32 `json:",omitempty"`
+}
+
+// topicStatItem is a TopicStatItem with the sets of its slices.
+type topicStatItem struct {
+	TopicStatItem
+
+	producers  map[string]bool
+	consumers  map[string]bool
+	partitions map[int32]bool
+}
+
+// TopicStat is the inventory of the topics in use: the registry of the topics of every decoded request,
+// unlike ClientStat it keeps them after the connections of their clients closed.
+type TopicStat struct {
+	lock   sync.Mutex
+	topics map[string]*topicStatItem
+	clock  clock.Clock
+}
+
+// NewTopicStat creates a TopicStat, the time of its queries is told by c, e.g. the time of the captured packets.
+func NewTopicStat(c clock.Clock) *TopicStat {
+	return &TopicStat{topics: map[string]*topicStatItem{}, clock: c}
+}
+
+// Publish implements Sink, it records the produce and fetch requests and the responses to the fetch requests.
+func (s *TopicStat) Publish(e Event) {
+	switch e.Type {
+	case EventRequest:
+		s.statRequest(e.Request)
+	case EventResponse:
+		if r := e.Response; r.Key == fetchKey {
+			s.statFetchResponse(r)
+		}
+	}
+}
+
+// fetchKey is the API key of the fetch requests.
+const fetchKey = 1
+
+func (s *TopicStat) statRequest(r *Request) {
+	role := RequestRole(r.Type)
+	if role == "" || len(r.Topics) == 0 {
+		return
+	}
+
+	client := hostOf(r.Client) + "/" + r.ClientID
+
+	var partitions map[string][]int32
+	if p, ok := r.Body.(partitionsExtractor); ok {
+		partitions = p.ExtractPartitions()
+	}
+	var records, recordBytes map[string]int
+	if p, ok := r.Body.(*kafka.ProduceRequest); ok {
+		records, recordBytes = p.TopicRecordsLen(), p.TopicRecordsSize()
+	}
+
+	requestBytes := topicRequestBytes(r)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for i, topic := range r.Topics {
+		t := s.item(topic, r.Time)
+		t.RequestBytes += requestBytes[i]
+
+		if role == RoleProducer {
+			t.Produces++
+			t.Records += records[topic]
+			t.RecordBytes += recordBytes[topic]
+			if !t.producers[client] {
+				t.producers[client] = true
+				t.Producers = append(t.Producers, client)
+			}
+		} else {
+			t.Fetches++
+			if !t.consumers[client] {
+				t.consumers[client] = true
+				t.Consumers = append(t.Consumers, client)
+			}
+		}
+
+		for _, p := range partitions[topic] {
+			if !t.partitions[p] {
+				t.partitions[p] = true
+				t.Partitions = append(t.Partitions, p)
+			}
+		}
+	}
+}
+
+func (s *TopicStat) statFetchResponse(r *Response) {
+	if len(r.Topics) == 0 {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	fetchedBytes := splitBytes(r.Size, len(r.Topics))
+	for i, topic := range r.Topics {
+		s.item(topic, r.Time).FetchedBytes += fetchedBytes[i]
+	}
+}
+
+// topicRequestBytes splits the size of r among its topics, in the order of r.Topics. A produce request
+// gives each topic the size of its record batches, and the rest, the headers, is split evenly among them
+// as the size of the other requests is.
+func topicRequestBytes(r *Request) []int {
+	var batchSize map[string]int
+	if p, ok := r.Body.(*kafka.ProduceRequest); ok {
+		batchSize = p.TopicBatchSize()
+	}
+
+	rest := r.Size
+	for _, topic := range r.Topics {
+		rest -= batchSize[topic]
+	}
+	if rest < 0 {
+		// a size which does not cover the batches is split evenly
+		batchSize, rest = nil, r.Size
+	}
+
+	shares := splitBytes(rest, len(r.Topics))
+	for i, topic := range r.Topics {
+		shares[i] += batchSize[topic]
+	}
+
+	return shares
+}
+
+// splitBytes splits size evenly in n shares. The first shares take the remainder, so that they sum up to size.
+func splitBytes(size, n int) []int {
+	shares := make([]int, n)
+	if n == 0 {
+		return shares
+	}
+
+	share, rest := size/n, size%n
+	for i := range shares {
+		shares[i] = share
+		if i < rest {
+			shares[i]++
+		}
+	}
+
+	return shares
+}
+
+// item returns the item of topic seen at t, created when it was not seen before.
+func (s *TopicStat) item(topic string, t time.Time) *topicStatItem {
+	item, ok := s.topics[topic]
+	if !ok {
+		item = &topicStatItem{
+			TopicStatItem: TopicStatItem{Topic: topic, FirstSeen: t},
+			producers:     map[string]bool{},
+			consumers:     map[string]bool{},
+			partitions:    map[int32]bool{},
+		}
+		s.topics[topic] = item
+	}
+
+	if t.After(item.LastSeen) {
+		item.LastSeen = t
+	}
+
+	return item
+}
+
+// Snapshot returns the topics sorted by name, their clients and partitions sorted.
+func (s *TopicStat) Snapshot() []TopicStatItem {
+	s.lock.Lock()
+	ret := make([]TopicStatItem, 0, len(s.topics))
+	for _, t := range s.topics {
+		item := t.TopicStatItem
+		item.Producers = append([]string(nil), item.Producers...)
+		item.Consumers = append([]string(nil), item.Consumers...)
+		item.Partitions = append([]int32(nil), item.Partitions...)
+		ret = append(ret, item)
+	}
+	s.lock.Unlock()
+
+	for _, t := range ret {
+		sort.Strings(t.Producers)
+		sort.Strings(t.Consumers)
+		sort.Slice(t.Partitions, func(i, j int) bool { return t.Partitions[i] < t.Partitions[j] })
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Topic < ret[j].Topic })
+
+	return ret
+}
+
+// ServeTopicStatHandler serves the snapshot of stat as JSON, filtered by the query parameters:
+//
+//	topic  a topic, with * wildcards, e.g. orders.*, repeated or comma separated
+//	since  last seen since a time, RFC 3339, or a duration before now, e.g. 24h
+//	role   producer or consumer, the topics with producers or with consumers
+func ServeTopicStatHandler(stat *TopicStat) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+
+		patterns := queryValues(q, "topic")
+		for _, p := range patterns {
+			if _, err := path.Match(p, ""); err != nil {
+				http.Error(w, fmt.Sprintf("invalid topic %q: %v", p, err), http.StatusBadRequest)
+				return
+			}
+		}
+
+		var since time.Time
+		if s := q.Get("since"); s != "" {
+			var err error
+			if since, err = parseSince(s, stat.clock.Now()); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		role := q.Get("role")
+		switch role {
+		case "", RoleProducer, RoleConsumer:
+		default:
+			http.Error(w, fmt.Sprintf("unknown role %q, producer or consumer", role), http.StatusBadRequest)
+			return
+		}
+
+		topics := []TopicStatItem{}
+		for _, t := range stat.Snapshot() {
+			switch {
+			case len(patterns) > 0 && !matchTopicPatterns(patterns, []string{t.Topic}):
+			case t.LastSeen.Before(since):
+			case role == RoleProducer && len(t.Producers) == 0:
+			case role == RoleConsumer && len(t.Consumers) == 0:
+			default:
+				topics = append(topics, t)
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		_ = json.NewEncoder(w).Encode(topics)
+	}
+}
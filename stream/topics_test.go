@@ -0,0 +1,122 @@
+package stream
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"testing"
+	"time"
+
+	"github.com/bingoohuang/kafka-sniffer/kafka"
+	"github.com/bingoohuang/kafka-sniffer/metrics"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/twmb/franz-go/pkg/kmsg"
+)
+
+// recordBatch is the record batch of a single record of value, shorter than 64 bytes.
+func recordBatch(value string) []byte {
+	record := kmsg.NewRecord()
+	record.Value = []byte(value)
+	// the length of the record is a varint of a single byte
+	record.Length = int32(len(record.AppendTo(nil)) - 1)
+
+	batch := kmsg.NewRecordBatch()
+	batch.Magic, batch.NumRecords, batch.ProducerID, batch.ProducerEpoch, batch.FirstSequence = 2, 1, -1, -1, -1
+	batch.Records = record.AppendTo(nil)
+	// the length follows the first offset and itself, the crc covers the attributes and what follows
+	batch.Length = int32(len(batch.AppendTo(nil)) - 12)
+	batch.CRC = int32(crc32.Checksum(batch.AppendTo(nil)[21:], crc32.MakeTable(crc32.Castagnoli)))
+
+	return batch.AppendTo(nil)
+}
+
+// produceRequest is a produce request v3 of the values to partition 0 of the topics, in the order of the topics.
+func produceRequest(t *testing.T, topics []string, values []string) *Request {
+	t.Helper()
+
+	body := kmsg.NewPtrProduceRequest()
+	body.Version, body.Acks, body.TimeoutMillis = 3, 1, 1000
+	for i, topic := range topics {
+		p := kmsg.NewProduceRequestTopicPartition()
+		p.Records = recordBatch(values[i])
+		rt := kmsg.NewProduceRequestTopic()
+		rt.Topic, rt.Partitions = topic, []kmsg.ProduceRequestTopicPartition{p}
+		body.Topics = append(body.Topics, rt)
+	}
+
+	frame := []byte{0, 0, 0, 0, 0, 0, 0, 3, 0, 0, 0, 1, 0, 2, 'p', '1'}
+	frame = body.AppendTo(frame)
+	binary.BigEndian.PutUint32(frame, uint32(len(frame)-4))
+
+	req, n, err := kafka.DecodeRequest(bytes.NewReader(frame))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &Request{
+		Endpoints: Endpoints{Client: "10.0.0.1:50000", Broker: "10.0.1.1:9092"},
+		Request:   req,
+		Type:      "*kafka.ProduceRequest",
+		Topics:    topics,
+		Size:      n,
+		Time:      time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+}
+
+func TestTopicRequestBytesSplit(t *testing.T) {
+	topics := []string{"orders", "payments", "audit"}
+	produce := produceRequest(t, topics, []string{"a", "a much longer value than the others", "bc"})
+	fetch := &Request{
+		Endpoints: produce.Endpoints,
+		Request:   &kafka.Request{ClientID: "c1", Body: &kafka.FetchRequest{}},
+		Type:      "*kafka.FetchRequest",
+		Topics:    topics,
+		Size:      100,
+		Time:      produce.Time,
+	}
+
+	// the batches go to their topics, the header is split evenly and the first topics take the remainder
+	batchSize := produce.Body.(*kafka.ProduceRequest).TopicBatchSize()
+	header := produce.Size
+	for _, topic := range topics {
+		header -= batchSize[topic]
+	}
+	want := map[string]int{}
+	for i, topic := range topics {
+		want[topic] = batchSize[topic] + header/len(topics)
+		if i < header%len(topics) {
+			want[topic]++
+		}
+	}
+	if batchSize["payments"] <= batchSize["orders"] {
+		t.Fatalf("batch sizes %v, want the longer value in the larger batch", batchSize)
+	}
+	wantFetch := map[string]int{"orders": 34, "payments": 33, "audit": 33}
+
+	stat := NewTopicStat(nil)
+	m := metrics.New(nil)
+	sink := NewMetricsSink(m, nil)
+	for _, r := range []*Request{produce, fetch} {
+		stat.Publish(Event{Type: EventRequest, Request: r})
+		sink.Publish(Event{Type: EventRequest, Request: r})
+	}
+
+	total := 0
+	for _, item := range stat.Snapshot() {
+		total += item.RequestBytes
+		if item.RequestBytes != want[item.Topic]+wantFetch[item.Topic] {
+			t.Errorf("%s: request bytes %d, want %d", item.Topic, item.RequestBytes, want[item.Topic]+wantFetch[item.Topic])
+		}
+
+		produced := int(testutil.ToFloat64(m.TopicRequestBytes.WithLabelValues(item.Topic, "produce")))
+		fetched := int(testutil.ToFloat64(m.TopicRequestBytes.WithLabelValues(item.Topic, "fetch")))
+		if produced != want[item.Topic] || fetched != wantFetch[item.Topic] {
+			t.Errorf("%s: metric of %d bytes produced and %d fetched, want %d and %d",
+				item.Topic, produced, fetched, want[item.Topic], wantFetch[item.Topic])
+		}
+	}
+	if total != produce.Size+fetch.Size {
+		t.Errorf("the topics account for %d bytes, the requests for %d", total, produce.Size+fetch.Size)
+	}
+}
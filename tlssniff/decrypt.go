@@ -0,0 +1,432 @@
+package tlssniff
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// ErrNoSecret is returned when the key log lacks the secrets of a session.
+var ErrNoSecret = errors.New("no secret logged for the session")
+
+// Handshake message types seen in the encrypted flight of a TLS 1.3 client
+const (
+	handshakeTypeFinished  = 20
+	handshakeTypeKeyUpdate = 24
+)
+
+type cipherMode int
+
+const (
+	modeGCM cipherMode = iota
+	modeChaCha20Poly1305
+	modeCBC
+)
+
+// cipherSuite lists what decrypting a cipher suite takes.
+type cipherSuite struct {
+	mode   cipherMode
+	keyLen int
+	// ivLen is the implicit part of the nonce for AEADs in TLS 1.2, the IV is explicit for CBC
+	ivLen int
+	// mac is the hash of the record MAC of CBC suites
+	mac func() hash.Hash
+	// hash is the hash of the PRF in TLS 1.2 and of HKDF in TLS 1.3
+	hash func() hash.Hash
+}
+
+var cipherSuites = map[uint16]cipherSuite{
+	// TLS 1.3
+	0x1301: {mode: modeGCM, keyLen: 16, ivLen: 12, hash: sha256.New},
+	0x1302: {mode: modeGCM, keyLen: 32, ivLen: 12, hash: sha512.New384},
+	0x1303: {mode: modeChaCha20Poly1305, keyLen: 32, ivLen: 12, hash: sha256.New},
+
+	// TLS 1.2 AEADs
+	0xc02f: {mode: modeGCM, keyLen: 16, ivLen: 4, hash: sha256.New},
+	0xc02b: {mode: modeGCM, keyLen: 16, ivLen: 4, hash: sha256.New},
+	0xc030: {mode: modeGCM, keyLen: 32, ivLen: 4, hash: sha512.New384},
+	0xc02c: {mode: modeGCM, keyLen: 32, ivLen: 4, hash: sha512.New384},
+	0x009c: {mode: modeGCM, keyLen: 16, ivLen: 4, hash: sha256.New},
+	0x009d: {mode: modeGCM, keyLen: 32, ivLen: 4, hash: sha512.New384},
+	0x009e: {mode: modeGCM, keyLen: 16, ivLen: 4, hash: sha256.New},
+	0x009f: {mode: modeGCM, keyLen: 32, ivLen: 4, hash: sha512.New384},
+	0xcca8: {mode: modeChaCha20Poly1305, keyLen: 32, ivLen: 12, hash: sha256.New},
+	0xcca9: {mode: modeChaCha20Poly1305, keyLen: 32, ivLen: 12, hash: sha256.New},
+	0xccaa: {mode: modeChaCha20Poly1305, keyLen: 32, ivLen: 12, hash: sha256.New},
+
+	// TLS 1.2 CBC
+	0xc013: {mode: modeCBC, keyLen: 16, ivLen: 16, mac: sha1.New, hash: sha256.New},
+	0xc014: {mode: modeCBC, keyLen: 32, ivLen: 16, mac: sha1.New, hash: sha256.New},
+	0xc009: {mode: modeCBC, keyLen: 16, ivLen: 16, mac: sha1.New, hash: sha256.New},
+	0xc00a: {mode: modeCBC, keyLen: 32, ivLen: 16, mac: sha1.New, hash: sha256.New},
+	0x002f: {mode: modeCBC, keyLen: 16, ivLen: 16, mac: sha1.New, hash: sha256.New},
+	0x0035: {mode: modeCBC, keyLen: 32, ivLen: 16, mac: sha1.New, hash: sha256.New},
+	0x003c: {mode: modeCBC, keyLen: 16, ivLen: 16, mac: sha256.New, hash: sha256.New},
+	0xc027: {mode: modeCBC, keyLen: 16, ivLen: 16, mac: sha256.New, hash: sha256.New},
+	0xc023: {mode: modeCBC, keyLen: 16, ivLen: 16, mac: sha256.New, hash: sha256.New},
+}
+
+// secretWait is how long a missing secret is waited for, clients log it while finishing the handshake
+const secretWait = 300 * time.Millisecond
+
+// Decrypter reads the application data sent by a TLS 1.2 or 1.3 client, decrypted with the secrets of a key log.
+type Decrypter struct {
+	r       io.Reader
+	keyLog  *KeyLog
+	client  *ClientHello
+	server  *ServerHello
+	suite   cipherSuite
+	version uint16
+
+	// the cipher state of the client
+	aead  cipher.AEAD
+	cbc   cipher.Block
+	iv    []byte
+	seq   uint64
+	ready bool
+
+	// TLS 1.3 traffic secrets
+	secret      []byte
+	application bool
+
+	plaintext []byte
+	err       error
+}
+
+// NewDecrypter decrypts the records read from r, which follow the ClientHello of client.
+func NewDecrypter(r io.Reader, keyLog *KeyLog, client *ClientHello, server *ServerHello) (*Decrypter, error) {
+	suite, ok := cipherSuites[server.CipherSuite]
+	if !ok {
+		return nil, fmt.Errorf("cipher suite %04x is not supported", server.CipherSuite)
+	}
+
+	if server.Version != 0x0303 && server.Version != 0x0304 {
+		return nil, fmt.Errorf("%s is not supported", VersionName(server.Version))
+	}
+
+	return &Decrypter{r: r, keyLog: keyLog, client: client, server: server, suite: suite, version: server.Version}, nil
+}
+
+// Read implements io.Reader. An error is returned once, io.EOF afterwards, since the keys
+// of the records following a lost one are unknown.
+func (d *Decrypter) Read(p []byte) (int, error) {
+	for len(d.plaintext) == 0 {
+		if err := d.err; err != nil {
+			d.err = io.EOF
+			return 0, err
+		}
+
+		d.err = d.next()
+	}
+
+	n := copy(p, d.plaintext)
+	d.plaintext = d.plaintext[n:]
+	return n, nil
+}
+
+// next reads the next record, keeping the application data it carries.
+func (d *Decrypter) next() error {
+	rec, err := ReadRecord(d.r)
+	if err != nil {
+		return err
+	}
+
+	if d.version == 0x0304 {
+		return d.next13(rec)
+	}
+
+	return d.next12(rec)
+}
+
+func (d *Decrypter) next12(rec *Record) error {
+	switch {
+	case rec.Type == RecordTypeChangeCipherSpec:
+		return d.keys12()
+	case !d.ready:
+		// the plaintext handshake messages following the ClientHello
+		return nil
+	}
+
+	plaintext, err := d.open12(rec)
+	if err != nil {
+		return err
+	}
+
+	switch rec.Type {
+	case RecordTypeApplicationData:
+		d.plaintext = plaintext
+	case RecordTypeAlert:
+		return io.EOF
+	}
+
+	return nil
+}
+
+// keys12 derives the keys of the client from the master secret, see RFC 5246 section 6.3
+func (d *Decrypter) keys12() error {
+	master, err := d.lookup(LabelClientRandom)
+	if err != nil {
+		return err
+	}
+
+	macLen := 0
+	if d.suite.mac != nil {
+		macLen = d.suite.mac().Size()
+	}
+
+	seed := append(append([]byte(nil), d.server.Random...), d.client.Random...)
+	block := prf12(d.suite.hash, master, "key expansion", seed, 2*macLen+2*d.suite.keyLen+2*d.suite.ivLen)
+
+	key := block[2*macLen : 2*macLen+d.suite.keyLen]
+	d.iv = block[2*macLen+2*d.suite.keyLen : 2*macLen+2*d.suite.keyLen+d.suite.ivLen]
+	d.seq, d.ready = 0, true
+
+	return d.initCipher(key)
+}
+
+func (d *Decrypter) open12(rec *Record) ([]byte, error) {
+	defer func() { d.seq++ }()
+
+	switch d.suite.mode {
+	case modeCBC:
+		bs := d.cbc.BlockSize()
+		if len(rec.Fragment) < 2*bs || len(rec.Fragment)%bs != 0 {
+			return nil, errors.New("invalid CBC record")
+		}
+
+		plaintext := make([]byte, len(rec.Fragment)-bs)
+		cipher.NewCBCDecrypter(d.cbc, rec.Fragment[:bs]).CryptBlocks(plaintext, rec.Fragment[bs:])
+
+		// the MAC is not checked, the padding has to be sane
+		padding := int(plaintext[len(plaintext)-1]) + 1
+		macLen := d.suite.mac().Size()
+		if padding+macLen > len(plaintext) {
+			return nil, errors.New("invalid CBC padding")
+		}
+
+		return plaintext[:len(plaintext)-padding-macLen], nil
+	default:
+		var nonce, ciphertext []byte
+		if d.suite.mode == modeGCM {
+			explicit := d.aead.NonceSize() - len(d.iv)
+			if len(rec.Fragment) < explicit {
+				return nil, errors.New("invalid GCM record")
+			}
+			nonce = append(append([]byte(nil), d.iv...), rec.Fragment[:explicit]...)
+			ciphertext = rec.Fragment[explicit:]
+		} else {
+			nonce, ciphertext = d.xorNonce(), rec.Fragment
+		}
+
+		if len(ciphertext) < d.aead.Overhead() {
+			return nil, errors.New("record too short")
+		}
+
+		var ad [13]byte
+		binary.BigEndian.PutUint64(ad[:8], d.seq)
+		ad[8] = rec.Type
+		binary.BigEndian.PutUint16(ad[9:11], rec.Version)
+		binary.BigEndian.PutUint16(ad[11:13], uint16(len(ciphertext)-d.aead.Overhead()))
+
+		return d.aead.Open(nil, nonce, ciphertext, ad[:])
+	}
+}
+
+func (d *Decrypter) next13(rec *Record) error {
+	// the compatibility change_cipher_spec and the plaintext ClientHello after a HelloRetryRequest
+	if rec.Type != RecordTypeApplicationData {
+		return nil
+	}
+
+	if !d.ready {
+		if err := d.keys13(LabelClientHandshakeTrafficSecret); err != nil {
+			// without the handshake secret, the application data is still readable
+			if err = d.keys13(LabelClientTrafficSecret); err != nil {
+				return err
+			}
+			d.application = true
+		}
+	}
+
+	plaintext, typ, err := d.open13(rec)
+	if err != nil && !d.application {
+		// the handshake was resumed without encrypted handshake messages from the client
+		if err = d.keys13(LabelClientTrafficSecret); err == nil {
+			d.application = true
+			plaintext, typ, err = d.open13(rec)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	switch typ {
+	case RecordTypeApplicationData:
+		d.plaintext = plaintext
+	case RecordTypeAlert:
+		return io.EOF
+	case RecordTypeHandshake:
+		return d.handshake13(plaintext)
+	}
+
+	return nil
+}
+
+// handshake13 switches the keys after the Finished message of the client and on key updates.
+func (d *Decrypter) handshake13(msgs []byte) error {
+	for len(msgs) >= 4 {
+		typ, length := msgs[0], int(uint32(msgs[1])<<16|uint32(msgs[2])<<8|uint32(msgs[3]))
+
+		switch {
+		case typ == handshakeTypeFinished && !d.application:
+			if err := d.keys13(LabelClientTrafficSecret); err != nil {
+				return err
+			}
+			d.application = true
+		case typ == handshakeTypeKeyUpdate && d.application:
+			d.secret = hkdfExpandLabel(d.suite.hash, d.secret, "traffic upd", d.suite.hash().Size())
+			if err := d.trafficKeys13(); err != nil {
+				return err
+			}
+		}
+
+		if 4+length > len(msgs) {
+			break
+		}
+		msgs = msgs[4+length:]
+	}
+
+	return nil
+}
+
+// keys13 derives the keys of the client from the traffic secret logged with label, see RFC 8446 section 7.3
+func (d *Decrypter) keys13(label string) error {
+	secret, err := d.lookup(label)
+	if err != nil {
+		return err
+	}
+
+	d.secret = secret
+	return d.trafficKeys13()
+}
+
+func (d *Decrypter) trafficKeys13() error {
+	key := hkdfExpandLabel(d.suite.hash, d.secret, "key", d.suite.keyLen)
+	d.iv = hkdfExpandLabel(d.suite.hash, d.secret, "iv", d.suite.ivLen)
+	d.seq, d.ready = 0, true
+
+	return d.initCipher(key)
+}
+
+func (d *Decrypter) open13(rec *Record) ([]byte, uint8, error) {
+	var ad [RecordHeaderSize]byte
+	ad[0] = rec.Type
+	binary.BigEndian.PutUint16(ad[1:3], rec.Version)
+	binary.BigEndian.PutUint16(ad[3:5], uint16(len(rec.Fragment)))
+
+	plaintext, err := d.aead.Open(nil, d.xorNonce(), rec.Fragment, ad[:])
+	if err != nil {
+		return nil, 0, err
+	}
+	d.seq++
+
+	// the content type follows the content, then zero padding
+	for i := len(plaintext) - 1; i >= 0; i-- {
+		if plaintext[i] != 0 {
+			return plaintext[:i], plaintext[i], nil
+		}
+	}
+
+	return nil, 0, errors.New("record without content type")
+}
+
+func (d *Decrypter) initCipher(key []byte) (err error) {
+	switch d.suite.mode {
+	case modeGCM:
+		var block cipher.Block
+		if block, err = aes.NewCipher(key); err == nil {
+			d.aead, err = cipher.NewGCM(block)
+		}
+	case modeChaCha20Poly1305:
+		d.aead, err = chacha20poly1305.New(key)
+	case modeCBC:
+		d.cbc, err = aes.NewCipher(key)
+	}
+
+	return err
+}
+
+// xorNonce returns the nonce of the current record, the IV xored with the sequence number.
+func (d *Decrypter) xorNonce() []byte {
+	nonce := append([]byte(nil), d.iv...)
+	for i := 0; i < 8; i++ {
+		nonce[len(nonce)-1-i] ^= byte(d.seq >> (8 * i))
+	}
+
+	return nonce
+}
+
+// lookup returns a secret of the session, waiting a little for clients still writing it.
+func (d *Decrypter) lookup(label string) ([]byte, error) {
+	deadline := time.Now().Add(secretWait)
+	for {
+		if secret, ok := d.keyLog.Secret(label, d.client.Random); ok {
+			return secret, nil
+		}
+
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("%w: %s", ErrNoSecret, label)
+		}
+		time.Sleep(secretWait / 10)
+	}
+}
+
+// prf12 is the pseudorandom function of TLS 1.2, see RFC 5246 section 5
+func prf12(h func() hash.Hash, secret []byte, label string, seed []byte, length int) []byte {
+	seed = append([]byte(label), seed...)
+	mac := hmac.New(h, secret)
+
+	out := make([]byte, 0, length)
+	a := seed
+	for len(out) < length {
+		mac.Reset()
+		mac.Write(a)
+		a = mac.Sum(nil)
+
+		mac.Reset()
+		mac.Write(a)
+		mac.Write(seed)
+		out = mac.Sum(out)
+	}
+
+	return out[:length]
+}
+
+// hkdfExpandLabel is HKDF-Expand-Label of TLS 1.3 with an empty context, see RFC 8446 section 7.1
+func hkdfExpandLabel(h func() hash.Hash, secret []byte, label string, length int) []byte {
+	label = "tls13 " + label
+
+	info := make([]byte, 0, 4+len(label))
+	info = append(info, byte(length>>8), byte(length), byte(len(label)))
+	info = append(info, label...)
+	info = append(info, 0) // context
+
+	out := make([]byte, length)
+	if _, err := io.ReadFull(hkdf.Expand(h, secret, info), out); err != nil {
+		panic(err) // only for lengths hkdf cannot produce
+	}
+
+	return out
+}
@@ -0,0 +1,315 @@
+package tlssniff
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// tap records the bytes a client sends and receives, as a capture of its connection would.
+type tap struct {
+	net.Conn
+
+	lock     sync.Mutex
+	sent     bytes.Buffer
+	received bytes.Buffer
+}
+
+func (c *tap) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.lock.Lock()
+	c.sent.Write(p[:n])
+	c.lock.Unlock()
+	return n, err
+}
+
+func (c *tap) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.lock.Lock()
+	c.received.Write(p[:n])
+	c.lock.Unlock()
+	return n, err
+}
+
+// captured is a TLS session of a crypto/tls client whose secrets were logged.
+type captured struct {
+	sent, received []byte
+	keyLog         *KeyLog
+	plaintext      []byte
+}
+
+// capture runs a session of config, the client writing messages, with the key log of a crypto/tls client.
+func capture(t *testing.T, config *tls.Config, messages ...[]byte) *captured {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "keylog")
+	keyLogFile, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer keyLogFile.Close()
+
+	var plaintext []byte
+	for _, m := range messages {
+		plaintext = append(plaintext, m...)
+	}
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	server := tls.Server(serverConn, &tls.Config{
+		Certificates: []tls.Certificate{certificate(t)},
+		CipherSuites: config.CipherSuites,
+		MaxVersion:   config.MaxVersion,
+	})
+	received := make(chan []byte, 1)
+	go func() {
+		b := make([]byte, len(plaintext))
+		n, _ := io.ReadFull(server, b)
+		received <- b[:n]
+	}()
+
+	config.InsecureSkipVerify = true
+	config.KeyLogWriter = keyLogFile
+	c := &tap{Conn: clientConn}
+	client := tls.Client(c, config)
+	for _, m := range messages {
+		if _, err := client.Write(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got := <-received; !bytes.Equal(got, plaintext) {
+		t.Fatalf("server received %d bytes, want %d", len(got), len(plaintext))
+	}
+
+	keyLog, err := LoadKeyLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return &captured{
+		sent:      append([]byte(nil), c.sent.Bytes()...),
+		received:  append([]byte(nil), c.received.Bytes()...),
+		keyLog:    keyLog,
+		plaintext: plaintext,
+	}
+}
+
+// certificate is a self-signed ECDSA certificate, for the ECDHE_ECDSA suites.
+func certificate(t *testing.T) tls.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "kafka"},
+		DNSNames:     []string{"kafka"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// decrypter decrypts the records the client sent after its ClientHello, as the sniffer does.
+func (c *captured) decrypter(t *testing.T, sent []byte) (*Decrypter, *ClientHello, *ServerHello) {
+	t.Helper()
+
+	r := bytes.NewReader(sent)
+	first, err := ReadRecord(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hello, err := ReadClientHello(first, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := ReadServerHello(c.received)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := NewDecrypter(r, c.keyLog, hello, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return d, hello, server
+}
+
+// messages are a request, a request spanning several records and another request.
+var messages = [][]byte{
+	[]byte("first request"),
+	bytes.Repeat([]byte("0123456789abcdef"), 2000),
+	[]byte("last request"),
+}
+
+func TestDecryptTLS12(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		suite uint16
+	}{
+		{"AES-128-GCM", tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+		{"AES-256-GCM-SHA384", tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384},
+		{"ChaCha20-Poly1305", tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256},
+		{"AES-128-CBC-SHA", tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA},
+		{"AES-256-CBC-SHA", tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA},
+		{"AES-128-CBC-SHA256", tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := capture(t, &tls.Config{MaxVersion: tls.VersionTLS12, CipherSuites: []uint16{tc.suite}}, messages...)
+
+			d, _, server := c.decrypter(t, c.sent)
+			if server.Version != tls.VersionTLS12 || server.CipherSuite != tc.suite {
+				t.Fatalf("negotiated %04x with %04x, want %04x", server.Version, server.CipherSuite, tc.suite)
+			}
+
+			got, err := ioutil.ReadAll(d)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, c.plaintext) {
+				t.Fatalf("decrypted %d bytes %.40q, want %d bytes", len(got), got, len(c.plaintext))
+			}
+		})
+	}
+}
+
+func TestDecryptTLS13(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		curves []tls.CurveID
+	}{
+		{name: "X25519", curves: []tls.CurveID{tls.X25519}},
+		// the ServerHello of a hybrid key share is over a kilobyte
+		{name: "X25519MLKEM768", curves: []tls.CurveID{tls.X25519MLKEM768}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv("GODEBUG", "tlsmlkem=1")
+			c := capture(t, &tls.Config{MinVersion: tls.VersionTLS13, CurvePreferences: tc.curves}, messages...)
+
+			d, _, server := c.decrypter(t, c.sent)
+			if server.Version != tls.VersionTLS13 {
+				t.Fatalf("negotiated %04x, want TLS 1.3", server.Version)
+			}
+
+			got, err := ioutil.ReadAll(d)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, c.plaintext) {
+				t.Fatalf("decrypted %d bytes %.40q, want %d bytes", len(got), got, len(c.plaintext))
+			}
+		})
+	}
+}
+
+func TestDecryptTLS13KeyUpdate(t *testing.T) {
+	c := capture(t, &tls.Config{MinVersion: tls.VersionTLS13}, messages...)
+
+	_, hello, server := c.decrypter(t, c.sent)
+	suite := cipherSuites[server.CipherSuite]
+	secret, ok := c.keyLog.Secret(LabelClientTrafficSecret, hello.Random)
+	if !ok {
+		t.Fatal("no client traffic secret logged")
+	}
+
+	// crypto/tls has no API to update the keys, the client goes on with a KeyUpdate sealed with the keys
+	// of its application data, following the records it sent: the Finished and the application data.
+	seq := uint64(countRecords(t, c.sent, RecordTypeApplicationData) - 1)
+	sent := append([]byte(nil), c.sent...)
+	sent = append(sent, seal13(t, suite, secret, seq, RecordTypeHandshake, []byte{handshakeTypeKeyUpdate, 0, 0, 1, 0})...)
+
+	secret = hkdfExpandLabel(suite.hash, secret, "traffic upd", suite.hash().Size())
+	sent = append(sent, seal13(t, suite, secret, 0, RecordTypeApplicationData, []byte("after the update"))...)
+	sent = append(sent, seal13(t, suite, secret, 1, RecordTypeApplicationData, []byte(", again"))...)
+
+	d, _, _ := c.decrypter(t, sent)
+	got, err := ioutil.ReadAll(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := append(append([]byte(nil), c.plaintext...), "after the update, again"...); !bytes.Equal(got, want) {
+		t.Fatalf("decrypted %d bytes ending with %q, want %d bytes", len(got), got[len(got)-20:], len(want))
+	}
+}
+
+// countRecords counts the records of type typ in b.
+func countRecords(t *testing.T, b []byte, typ uint8) int {
+	t.Helper()
+
+	n := 0
+	for r := bytes.NewReader(b); r.Len() > 0; {
+		rec, err := ReadRecord(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rec.Type == typ {
+			n++
+		}
+	}
+
+	return n
+}
+
+// seal13 seals a TLS 1.3 record of content of type typ, with the seq-th nonce of the traffic secret.
+func seal13(t *testing.T, suite cipherSuite, secret []byte, seq uint64, typ uint8, content []byte) []byte {
+	t.Helper()
+
+	key := hkdfExpandLabel(suite.hash, secret, "key", suite.keyLen)
+	nonce := hkdfExpandLabel(suite.hash, secret, "iv", suite.ivLen)
+	for i := 0; i < 8; i++ {
+		nonce[len(nonce)-8+i] ^= byte(seq >> (56 - 8*i))
+	}
+
+	var aead cipher.AEAD
+	var err error
+	if suite.mode == modeGCM {
+		var block cipher.Block
+		if block, err = aes.NewCipher(key); err == nil {
+			aead, err = cipher.NewGCM(block)
+		}
+	} else {
+		aead, err = chacha20poly1305.New(key)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inner := append(append([]byte(nil), content...), typ)
+	header := []byte{RecordTypeApplicationData, 3, 3, 0, 0}
+	binary.BigEndian.PutUint16(header[3:], uint16(len(inner)+aead.Overhead()))
+
+	return aead.Seal(header, nonce, inner, header)
+}
@@ -0,0 +1,192 @@
+package tlssniff
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// isGREASE tells whether v is one of the values reserved by RFC 8701 to keep servers tolerant, 0x0a0a, 0x1a1a...
+// Fingerprints skip them since clients pick them at random.
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+// VersionName returns the name of a TLS version, e.g. TLS 1.3 for 0x0304
+func VersionName(v uint16) string {
+	switch v {
+	case 0x0300:
+		return "SSL 3.0"
+	case 0x0301:
+		return "TLS 1.0"
+	case 0x0302:
+		return "TLS 1.1"
+	case 0x0303:
+		return "TLS 1.2"
+	case 0x0304:
+		return "TLS 1.3"
+	default:
+		return fmt.Sprintf("0x%04X", v)
+	}
+}
+
+// CipherSuiteNames returns the names of the offered cipher suites, GREASE values aside.
+func (h *ClientHello) CipherSuiteNames() []string {
+	names := make([]string, 0, len(h.CipherSuites))
+	for _, s := range h.CipherSuites {
+		if !isGREASE(s) {
+			names = append(names, tls.CipherSuiteName(s))
+		}
+	}
+
+	return names
+}
+
+// JA3String returns the fields fingerprinted by JA3: version, cipher suites, extensions,
+// supported groups and EC point formats, see https://github.com/salesforce/ja3
+func (h *ClientHello) JA3String() string {
+	formats := make([]uint16, 0, len(h.ECPointFormats))
+	for _, f := range h.ECPointFormats {
+		formats = append(formats, uint16(f))
+	}
+
+	return strings.Join([]string{
+		strconv.Itoa(int(h.Version)),
+		joinDecimal(h.CipherSuites),
+		joinDecimal(h.Extensions),
+		joinDecimal(h.SupportedGroups),
+		joinDecimal(formats),
+	}, ",")
+}
+
+// JA3 returns the JA3 fingerprint, the MD5 of JA3String.
+func (h *ClientHello) JA3() string {
+	sum := md5.Sum([]byte(h.JA3String()))
+	return hex.EncodeToString(sum[:])
+}
+
+// JA4 returns the JA4 fingerprint of a TLS client over TCP, e.g. t13d1516h2_8daaf6152771_e5627efa2ab1,
+// see https://github.com/FoxIO-LLC/ja4
+func (h *ClientHello) JA4() string {
+	ciphers := withoutGREASE(h.CipherSuites)
+	extensions := withoutGREASE(h.Extensions)
+
+	sni := "i"
+	if h.ServerName != "" {
+		sni = "d"
+	}
+
+	a := fmt.Sprintf("t%s%s%02d%02d%s",
+		ja4Version(h.MaxVersion()), sni, min99(len(ciphers)), min99(len(extensions)), ja4ALPN(h.ALPN))
+
+	sort.Slice(ciphers, func(i, j int) bool { return ciphers[i] < ciphers[j] })
+	b := ja4Hash(joinHex(ciphers))
+
+	// the server name and ALPN are part of the first section already
+	hashed := make([]uint16, 0, len(extensions))
+	for _, e := range extensions {
+		if e != extensionServerName && e != extensionALPN {
+			hashed = append(hashed, e)
+		}
+	}
+	sort.Slice(hashed, func(i, j int) bool { return hashed[i] < hashed[j] })
+
+	c := ""
+	if len(hashed) > 0 {
+		c = joinHex(hashed)
+		if len(h.SignatureAlgorithms) > 0 {
+			c += "_" + joinHex(h.SignatureAlgorithms)
+		}
+	}
+
+	return a + "_" + b + "_" + ja4Hash(c)
+}
+
+func ja4Version(v uint16) string {
+	switch v {
+	case 0x0300:
+		return "s3"
+	case 0x0301:
+		return "10"
+	case 0x0302:
+		return "11"
+	case 0x0303:
+		return "12"
+	case 0x0304:
+		return "13"
+	default:
+		return "00"
+	}
+}
+
+// ja4ALPN returns the first and the last character of the first ALPN protocol,
+// or of its hex representation when they are not alphanumeric.
+func ja4ALPN(protocols []string) string {
+	if len(protocols) == 0 || protocols[0] == "" {
+		return "00"
+	}
+
+	p := protocols[0]
+	first, last := p[0], p[len(p)-1]
+	if !isAlphanumeric(first) || !isAlphanumeric(last) {
+		x := hex.EncodeToString([]byte(p))
+		return x[:1] + x[len(x)-1:]
+	}
+
+	return string([]byte{first, last})
+}
+
+func isAlphanumeric(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+// ja4Hash returns the first 12 hex digits of the SHA256 of s, zeros for an empty s
+func ja4Hash(s string) string {
+	if s == "" {
+		return "000000000000"
+	}
+
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+func min99(n int) int {
+	if n > 99 {
+		return 99
+	}
+	return n
+}
+
+func withoutGREASE(values []uint16) []uint16 {
+	ret := make([]uint16, 0, len(values))
+	for _, v := range values {
+		if !isGREASE(v) {
+			ret = append(ret, v)
+		}
+	}
+
+	return ret
+}
+
+func joinDecimal(values []uint16) string {
+	s := make([]string, 0, len(values))
+	for _, v := range withoutGREASE(values) {
+		s = append(s, strconv.Itoa(int(v)))
+	}
+
+	return strings.Join(s, "-")
+}
+
+func joinHex(values []uint16) string {
+	s := make([]string, 0, len(values))
+	for _, v := range values {
+		s = append(s, fmt.Sprintf("%04x", v))
+	}
+
+	return strings.Join(s, ",")
+}
@@ -0,0 +1,189 @@
+package tlssniff
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// handshakeTypeClientHello is the type of the handshake message a client starts with
+const handshakeTypeClientHello = 1
+
+// Extension types used in fingerprints
+const (
+	extensionServerName          uint16 = 0
+	extensionSupportedGroups     uint16 = 10
+	extensionECPointFormats      uint16 = 11
+	extensionSignatureAlgorithms uint16 = 13
+	extensionALPN                uint16 = 16
+	extensionSupportedVersions   uint16 = 43
+)
+
+// errShortHello is returned for ClientHellos cut short
+var errShortHello = errors.New("truncated ClientHello")
+
+// ClientHello is the first handshake message of a client, with the fields needed to describe and fingerprint it.
+type ClientHello struct {
+	// Version is the legacy version field, TLS 1.3 clients announce TLS 1.2 there.
+	Version             uint16
+	Random              []byte
+	SessionID           []byte
+	CipherSuites        []uint16
+	CompressionMethods  []uint8
+	Extensions          []uint16
+	ServerName          string
+	ALPN                []string
+	SupportedGroups     []uint16
+	ECPointFormats      []uint8
+	SignatureAlgorithms []uint16
+	SupportedVersions   []uint16
+}
+
+// ReadClientHello reads the ClientHello starting in the handshake record first, reading more records from r
+// while the message spans them.
+func ReadClientHello(first *Record, r io.Reader) (*ClientHello, error) {
+	if first.Type != RecordTypeHandshake {
+		return nil, fmt.Errorf("TLS record of type %d is not a handshake", first.Type)
+	}
+
+	msg := first.Fragment
+	for len(msg) < 4 || len(msg) < 4+int(uint32(msg[1])<<16|uint32(msg[2])<<8|uint32(msg[3])) {
+		rec, err := ReadRecord(r)
+		if err != nil {
+			return nil, err
+		}
+		if rec.Type != RecordTypeHandshake {
+			return nil, errShortHello
+		}
+		msg = append(msg, rec.Fragment...)
+	}
+
+	return ParseClientHello(msg)
+}
+
+// ParseClientHello parses a ClientHello handshake message, starting with its type and length.
+func ParseClientHello(msg []byte) (*ClientHello, error) {
+	if len(msg) < 4 || msg[0] != handshakeTypeClientHello {
+		return nil, errors.New("not a ClientHello")
+	}
+
+	p := parser(msg[4:])
+	h := &ClientHello{
+		Version:   p.uint16(),
+		Random:    p.bytes(32),
+		SessionID: p.vector8(),
+	}
+
+	suites := parser(p.vector16())
+	for !suites.empty() {
+		h.CipherSuites = append(h.CipherSuites, suites.uint16())
+	}
+	h.CompressionMethods = p.vector8()
+
+	// extensions are optional
+	if p.empty() {
+		return h, p.err()
+	}
+
+	extensions := parser(p.vector16())
+	for !extensions.empty() {
+		typ, data := extensions.uint16(), parser(extensions.vector16())
+		h.Extensions = append(h.Extensions, typ)
+
+		switch typ {
+		case extensionServerName:
+			names := parser(data.vector16())
+			for !names.empty() {
+				if nameType, name := names.uint8(), names.vector16(); nameType == 0 {
+					h.ServerName = string(name)
+				}
+			}
+		case extensionALPN:
+			protocols := parser(data.vector16())
+			for !protocols.empty() {
+				h.ALPN = append(h.ALPN, string(protocols.vector8()))
+			}
+		case extensionSupportedGroups:
+			groups := parser(data.vector16())
+			for !groups.empty() {
+				h.SupportedGroups = append(h.SupportedGroups, groups.uint16())
+			}
+		case extensionECPointFormats:
+			h.ECPointFormats = data.vector8()
+		case extensionSignatureAlgorithms:
+			algorithms := parser(data.vector16())
+			for !algorithms.empty() {
+				h.SignatureAlgorithms = append(h.SignatureAlgorithms, algorithms.uint16())
+			}
+		case extensionSupportedVersions:
+			versions := parser(data.vector8())
+			for !versions.empty() {
+				h.SupportedVersions = append(h.SupportedVersions, versions.uint16())
+			}
+		}
+	}
+
+	return h, extensions.err()
+}
+
+// MaxVersion returns the highest TLS version offered, GREASE values aside.
+func (h *ClientHello) MaxVersion() uint16 {
+	max := h.Version
+	for _, v := range h.SupportedVersions {
+		if !isGREASE(v) && v > max {
+			max = v
+		}
+	}
+
+	return max
+}
+
+// parser reads the fields of a handshake message. A field cut short empties the parser
+// and yields zero values, err tells afterwards.
+type parser []byte
+
+func (p *parser) empty() bool {
+	return len(*p) == 0
+}
+
+func (p *parser) bytes(n int) []byte {
+	if n > len(*p) {
+		*p = nil
+		return nil
+	}
+
+	b := (*p)[:n:n]
+	*p = (*p)[n:]
+	return b
+}
+
+func (p *parser) uint8() uint8 {
+	if b := p.bytes(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (p *parser) uint16() uint16 {
+	if b := p.bytes(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (p *parser) vector8() []byte {
+	return p.bytes(int(p.uint8()))
+}
+
+func (p *parser) vector16() []byte {
+	return p.bytes(int(p.uint16()))
+}
+
+// err reports whether the parser was emptied by a field cut short
+func (p *parser) err() error {
+	if *p == nil {
+		return errShortHello
+	}
+	return nil
+}
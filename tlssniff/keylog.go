@@ -0,0 +1,100 @@
+package tlssniff
+
+import (
+	"bufio"
+	"encoding/hex"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Labels of the NSS key log format, see https://firefox-source-docs.mozilla.org/security/nss/legacy/key_log_format/
+const (
+	// LabelClientRandom logs the master secret of a TLS 1.2 session
+	LabelClientRandom = "CLIENT_RANDOM"
+	// LabelClientHandshakeTrafficSecret logs the secret of the encrypted TLS 1.3 handshake messages of the client
+	LabelClientHandshakeTrafficSecret = "CLIENT_HANDSHAKE_TRAFFIC_SECRET"
+	// LabelClientTrafficSecret logs the first secret of the TLS 1.3 application data of the client
+	LabelClientTrafficSecret = "CLIENT_TRAFFIC_SECRET_0"
+)
+
+// KeyLog holds the secrets of an NSS key log file, as written by clients with SSLKEYLOGFILE set
+// or by Go clients with tls.Config.KeyLogWriter. The file is read again when a secret is missing,
+// since clients append to it while connecting.
+type KeyLog struct {
+	path string
+
+	lock    sync.Mutex
+	offset  int64
+	secrets map[string][]byte // label and client random in hex -> secret
+}
+
+// LoadKeyLog reads the key log file at path.
+func LoadKeyLog(path string) (*KeyLog, error) {
+	k := &KeyLog{path: path, secrets: map[string][]byte{}}
+	if err := k.load(); err != nil {
+		return nil, err
+	}
+
+	return k, nil
+}
+
+// Secret returns the secret logged with label for the session of clientRandom.
+func (k *KeyLog) Secret(label string, clientRandom []byte) ([]byte, bool) {
+	key := label + " " + hex.EncodeToString(clientRandom)
+
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	if secret, ok := k.secrets[key]; ok {
+		return secret, true
+	}
+
+	if err := k.load(); err != nil {
+		return nil, false
+	}
+
+	secret, ok := k.secrets[key]
+	return secret, ok
+}
+
+// load reads the lines appended since the last load.
+func (k *KeyLog) load() error {
+	f, err := os.Open(k.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if info, err := f.Stat(); err == nil && info.Size() < k.offset {
+		// truncated, start over
+		k.offset = 0
+	}
+
+	if _, err := f.Seek(k.offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			// an incomplete last line is read again next time
+			return nil
+		}
+		k.offset += int64(len(line))
+
+		fields := strings.Fields(line)
+		if len(fields) != 3 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		secret, err := hex.DecodeString(fields[2])
+		if err != nil {
+			continue
+		}
+
+		k.secrets[fields[0]+" "+strings.ToLower(fields[1])] = secret
+	}
+}
@@ -0,0 +1,78 @@
+// Package tlssniff inspects the TLS connections of Kafka clients: it parses the ClientHello
+// and fingerprints the client with JA3 and JA4.
+package tlssniff
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Content types of TLS records
+const (
+	RecordTypeChangeCipherSpec uint8 = 20
+	RecordTypeAlert            uint8 = 21
+	RecordTypeHandshake        uint8 = 22
+	RecordTypeApplicationData  uint8 = 23
+)
+
+// RecordHeaderSize is the size of the content type, the version and the length of a record
+const RecordHeaderSize = 5
+
+// maxRecordSize is the largest record fragment, an encrypted record of 2^14 bytes with its expansion
+const maxRecordSize = 1<<14 + 2048
+
+// Record is a TLS record.
+type Record struct {
+	Type     uint8
+	Version  uint16
+	Fragment []byte
+}
+
+// ProbeRecordHeader tells whether b starts with a plausible TLS record header:
+// a known content type, a version from SSL 3.0 up to TLS 1.2 and a sane length.
+func ProbeRecordHeader(b []byte) bool {
+	if len(b) < RecordHeaderSize {
+		return false
+	}
+
+	if b[0] < RecordTypeChangeCipherSpec || b[0] > RecordTypeApplicationData {
+		return false
+	}
+
+	// TLS 1.3 records carry the version of TLS 1.2, ClientHellos may carry 1.0
+	if b[1] != 3 || b[2] > 3 {
+		return false
+	}
+
+	length := binary.BigEndian.Uint16(b[3:5])
+	return length > 0 && length <= maxRecordSize
+}
+
+// ReadRecord reads the next record from r.
+func ReadRecord(r io.Reader) (*Record, error) {
+	var head [RecordHeaderSize]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return nil, err
+	}
+
+	return ReadRecordAfter(head[:], r)
+}
+
+// ReadRecordAfter reads the fragment of the record whose header was read already.
+func ReadRecordAfter(head []byte, r io.Reader) (*Record, error) {
+	if !ProbeRecordHeader(head) {
+		return nil, fmt.Errorf("invalid TLS record header %x", head[:RecordHeaderSize])
+	}
+
+	rec := &Record{
+		Type:     head[0],
+		Version:  binary.BigEndian.Uint16(head[1:3]),
+		Fragment: make([]byte, binary.BigEndian.Uint16(head[3:5])),
+	}
+	if _, err := io.ReadFull(r, rec.Fragment); err != nil {
+		return nil, err
+	}
+
+	return rec, nil
+}
@@ -0,0 +1,72 @@
+package tlssniff
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+// handshakeTypeServerHello is the type of the handshake message a server replies with
+const handshakeTypeServerHello = 2
+
+// helloRetryRequestRandom marks a ServerHello which is a TLS 1.3 HelloRetryRequest
+var helloRetryRequestRandom = []byte{
+	0xcf, 0x21, 0xad, 0x74, 0xe5, 0x9a, 0x61, 0x11, 0xbe, 0x1d, 0x8c, 0x02, 0x1e, 0x65, 0xb8, 0x91,
+	0xc2, 0xa2, 0x11, 0x16, 0x7a, 0xbb, 0x8c, 0x5e, 0x07, 0x9e, 0x09, 0xe2, 0xc8, 0xa8, 0x33, 0x9c,
+}
+
+// ServerHello is the reply of the server to the ClientHello, with the version and the cipher suite chosen.
+type ServerHello struct {
+	Version     uint16
+	Random      []byte
+	CipherSuite uint16
+}
+
+// ReadServerHello parses the ServerHello at the start of the bytes sent by a server. It only needs
+// the record header and the ServerHello message, not the complete record.
+func ReadServerHello(b []byte) (*ServerHello, error) {
+	if !ProbeRecordHeader(b) || b[0] != RecordTypeHandshake {
+		return nil, errors.New("server did not start with a handshake")
+	}
+
+	msg := b[RecordHeaderSize:]
+	if len(msg) < 4 || len(msg) < 4+int(uint32(msg[1])<<16|uint32(msg[2])<<8|uint32(msg[3])) {
+		return nil, errors.New("truncated ServerHello")
+	}
+
+	return ParseServerHello(msg)
+}
+
+// ParseServerHello parses a ServerHello handshake message, starting with its type and length.
+func ParseServerHello(msg []byte) (*ServerHello, error) {
+	if len(msg) < 4 || msg[0] != handshakeTypeServerHello {
+		return nil, errors.New("not a ServerHello")
+	}
+
+	p := parser(msg[4:])
+	h := &ServerHello{
+		Version: p.uint16(),
+		Random:  p.bytes(32),
+	}
+	p.vector8() // session id
+	h.CipherSuite = p.uint16()
+	p.uint8() // compression method
+
+	if bytes.Equal(h.Random, helloRetryRequestRandom) {
+		return nil, errors.New("HelloRetryRequest is not supported")
+	}
+
+	if p.empty() {
+		return h, p.err()
+	}
+
+	extensions := parser(p.vector16())
+	for !extensions.empty() {
+		typ, data := extensions.uint16(), extensions.vector16()
+		if typ == extensionSupportedVersions && len(data) == 2 {
+			h.Version = binary.BigEndian.Uint16(data)
+		}
+	}
+
+	return h, extensions.err()
+}
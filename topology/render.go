@@ -0,0 +1,196 @@
+package topology
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/bingoohuang/kafka-sniffer/stream"
+)
+
+// Render writes g in format, FormatDOT, FormatMermaid or FormatJSON.
+func Render(w io.Writer, g *Graph, format string) error {
+	switch format {
+	case FormatDOT:
+		return renderDOT(w, g)
+	case FormatMermaid:
+		return renderMermaid(w, g)
+	case FormatJSON:
+		enc := json.NewEncoder(w)
+		enc.SetEscapeHTML(false)
+		enc.SetIndent("", "  ")
+		return enc.Encode(g)
+	default:
+		return fmt.Errorf("unknown format %q, dot, mermaid or json", format)
+	}
+}
+
+// ContentType returns the media type of format.
+func ContentType(format string) string {
+	switch format {
+	case FormatDOT:
+		return "text/vnd.graphviz; charset=utf-8"
+	case FormatJSON:
+		return "application/json; charset=utf-8"
+	default:
+		return "text/plain; charset=utf-8"
+	}
+}
+
+// Handler serves the graph of stat in the format of the query parameter format, default dot,
+// with the Options of the query parameters, see ParseOptions.
+func Handler(stat *stream.ClientStat) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		format := r.URL.Query().Get("format")
+		if format == "" {
+			format = FormatDOT
+		}
+		if format != FormatDOT && format != FormatMermaid && format != FormatJSON {
+			http.Error(w, fmt.Sprintf("unknown format %q, dot, mermaid or json", format), http.StatusBadRequest)
+			return
+		}
+
+		opts, err := ParseOptions(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		g, err := Build(stat.Snapshot(), opts)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", ContentType(format))
+		_ = Render(w, g, format)
+	}
+}
+
+// maxWeight is the weight of the heaviest edge, at least 1.
+func maxWeight(g *Graph) float64 {
+	max := 1.0
+	for _, e := range g.Edges {
+		if e.Weight > max {
+			max = e.Weight
+		}
+	}
+
+	return max
+}
+
+// weightLabel formats the weight of an edge, e.g. 12.5 req/s or 3.2 MiB
+func weightLabel(g *Graph, e Edge) string {
+	if g.Weight == WeightBytes {
+		return formatBytes(e.Bytes)
+	}
+
+	return strconv.FormatFloat(e.Rate, 'f', rateDecimals(e.Rate), 64) + " req/s"
+}
+
+func rateDecimals(rate float64) int {
+	switch {
+	case rate >= 100:
+		return 0
+	case rate >= 1:
+		return 1
+	default:
+		return 3
+	}
+}
+
+func formatBytes(n int) string {
+	const unit = 1024
+	if n < unit {
+		return strconv.Itoa(n) + " B"
+	}
+
+	div, exp := unit, 0
+	for m := n / unit; m >= unit && exp < 4; m /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTP"[exp])
+}
+
+// renderDOT writes g as a Graphviz digraph, the producers left of the topics and the consumers right of them,
+// e.g. kafka-sniffer topology | dot -Tsvg > topology.svg
+func renderDOT(w io.Writer, g *Graph) error {
+	b := bufio.NewWriter(w)
+	max := maxWeight(g)
+
+	fmt.Fprintf(b, "// kafka-sniffer topology, clients grouped by %s, edges weighted by %s\n", g.GroupBy, g.Weight)
+	fmt.Fprintln(b, "digraph kafka {")
+	fmt.Fprintln(b, "  rankdir=LR;")
+	fmt.Fprintln(b, `  node [fontname="Helvetica", fontsize=11];`)
+	fmt.Fprintln(b, `  edge [fontname="Helvetica", fontsize=9];`)
+
+	for _, n := range g.Nodes {
+		shape := `shape=ellipse`
+		if n.Kind == KindTopic {
+			shape = `shape=box, style="rounded,filled", fillcolor="#ddf4ff"`
+		}
+		fmt.Fprintf(b, "  %s [label=%s, %s];\n", dotQuote(n.ID), dotQuote(n.Label), shape)
+	}
+
+	for _, e := range g.Edges {
+		color := "#0969da"
+		if e.Role == stream.RoleConsumer {
+			color = "#1a7f37"
+		}
+		fmt.Fprintf(b, "  %s -> %s [label=%s, penwidth=%.1f, color=%s];\n",
+			dotQuote(e.Source), dotQuote(e.Target), dotQuote(weightLabel(g, e)), 1+4*e.Weight/max, dotQuote(color))
+	}
+
+	fmt.Fprintln(b, "}")
+	return b.Flush()
+}
+
+// dotQuote quotes s as a DOT string.
+func dotQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s) + `"`
+}
+
+// renderMermaid writes g as a Mermaid flowchart, the topics as cylinders and the edges of more than
+// half the heaviest weight thick.
+func renderMermaid(w io.Writer, g *Graph) error {
+	b := bufio.NewWriter(w)
+	max := maxWeight(g)
+
+	// the ids of the nodes are arbitrary strings, mermaid needs plain ones
+	ids := make(map[string]string, len(g.Nodes))
+	for i, n := range g.Nodes {
+		ids[n.ID] = "n" + strconv.Itoa(i)
+	}
+
+	fmt.Fprintf(b, "%%%% kafka-sniffer topology, clients grouped by %s, edges weighted by %s\n", g.GroupBy, g.Weight)
+	fmt.Fprintln(b, "flowchart LR")
+
+	for _, n := range g.Nodes {
+		if n.Kind == KindTopic {
+			fmt.Fprintf(b, "  %s[(%s)]\n", ids[n.ID], mermaidQuote(n.Label))
+		} else {
+			fmt.Fprintf(b, "  %s[%s]\n", ids[n.ID], mermaidQuote(n.Label))
+		}
+	}
+
+	for _, e := range g.Edges {
+		arrow := "-->"
+		if e.Weight > max/2 {
+			arrow = "==>"
+		}
+		fmt.Fprintf(b, "  %s %s|%s| %s\n", ids[e.Source], arrow, mermaidQuote(weightLabel(g, e)), ids[e.Target])
+	}
+
+	return b.Flush()
+}
+
+// mermaidQuote quotes s as a Mermaid label, its quotes as entity codes.
+func mermaidQuote(s string) string {
+	return `"` + strings.NewReplacer(`"`, "#quot;", "\n", " ").Replace(s) + `"`
+}
@@ -0,0 +1,289 @@
+// Package topology renders the producers, the topics and the consumers seen by a stream.ClientStat
+// as a graph in Graphviz DOT, Mermaid or JSON, the clients grouped by IP, subnet, client id or principal,
+// and the edges weighted by request rate or bytes.
+package topology
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/bingoohuang/kafka-sniffer/stream"
+)
+
+// The groupings of the clients
+const (
+	GroupIP        = "ip"
+	GroupSubnet    = "subnet"
+	GroupClientID  = "client_id"
+	GroupPrincipal = "principal"
+)
+
+// The weights of the edges
+const (
+	// WeightRate is the requests per second of the connections since they were first seen.
+	WeightRate = "rate"
+	// WeightBytes is the count of bytes of the requests.
+	WeightBytes = "bytes"
+)
+
+// The formats of a rendered graph
+const (
+	FormatDOT     = "dot"
+	FormatMermaid = "mermaid"
+	FormatJSON    = "json"
+)
+
+// Options configures the graph. The zero values of the fields commented with a default take that default.
+type Options struct {
+	// GroupBy groups the clients by GroupIP, GroupSubnet, GroupClientID or GroupPrincipal, default GroupIP.
+	GroupBy string
+	// Weight weights the edges by WeightRate or WeightBytes, default WeightRate.
+	Weight string
+	// Mask is the prefix length of the IPv4 subnets, default 24.
+	Mask int
+	// Mask6 is the prefix length of the IPv6 subnets, default 64.
+	Mask6 int
+}
+
+func (o *Options) setDefaults() {
+	if o.GroupBy == "" {
+		o.GroupBy = GroupIP
+	}
+	if o.Weight == "" {
+		o.Weight = WeightRate
+	}
+	if o.Mask <= 0 {
+		o.Mask = 24
+	}
+	if o.Mask6 <= 0 {
+		o.Mask6 = 64
+	}
+}
+
+func (o Options) validate() error {
+	switch o.GroupBy {
+	case GroupIP, GroupSubnet, GroupClientID, GroupPrincipal:
+	default:
+		return fmt.Errorf("unknown grouping %q, ip, subnet, client_id or principal", o.GroupBy)
+	}
+
+	switch o.Weight {
+	case WeightRate, WeightBytes:
+	default:
+		return fmt.Errorf("unknown weight %q, rate or bytes", o.Weight)
+	}
+
+	if o.Mask > 32 || o.Mask6 > 128 {
+		return fmt.Errorf("invalid subnet mask /%d or /%d", o.Mask, o.Mask6)
+	}
+
+	return nil
+}
+
+// ParseOptions parses the query parameters group, weight, mask and mask6, see Options.
+func ParseOptions(q url.Values) (opts Options, err error) {
+	opts.GroupBy = q.Get("group")
+	opts.Weight = q.Get("weight")
+	if opts.Mask, err = atoi(q.Get("mask")); err != nil {
+		return opts, fmt.Errorf("invalid mask: %w", err)
+	}
+	if opts.Mask6, err = atoi(q.Get("mask6")); err != nil {
+		return opts, fmt.Errorf("invalid mask6: %w", err)
+	}
+
+	opts.setDefaults()
+	return opts, opts.validate()
+}
+
+func atoi(s string) (int, error) {
+	if s == "" {
+		return 0, nil
+	}
+
+	return strconv.Atoi(s)
+}
+
+// The kinds of the nodes
+const (
+	KindClient = "client"
+	KindTopic  = "topic"
+)
+
+// Graph is the directed graph of the data: from the producers to the topics, and from the topics to the consumers.
+type Graph struct {
+	GroupBy string `json:"group_by"`
+	Weight  string `json:"weight"`
+	Nodes   []Node `json:"nodes"`
+	Edges   []Edge `json:"edges"`
+}
+
+// Node is a group of clients, or a topic.
+type Node struct {
+	// ID is unique among the nodes, e.g. client:10.0.0.0/24 or topic:orders
+	ID    string `json:"id"`
+	Kind  string `json:"kind"`
+	Label string `json:"label"`
+	// Clients are the IPs of a group of clients.
+	Clients []string `json:"clients,omitempty"`
+}
+
+// Edge is a group of clients producing to a topic, or a topic fetched by a group of clients.
+type Edge struct {
+	Source string `json:"source"`
+	Target string `json:"target"`
+	// Role is stream.RoleProducer or stream.RoleConsumer.
+	Role        string `json:"role"`
+	Connections int    `json:"connections"`
+	Requests    int    `json:"requests"`
+	Bytes       int    `json:"bytes"`
+	// Rate is the requests per second.
+	Rate float64 `json:"rate"`
+	// Weight is the Rate or the Bytes, according to Graph.Weight.
+	Weight float64 `json:"weight"`
+}
+
+// Build builds the graph of the snapshot of a stream.ClientStat, its nodes and edges sorted by id.
+// A request naming several topics counts for each of them.
+func Build(items []stream.ReqTypeStatItemSnapshot, opts Options) (*Graph, error) {
+	opts.setDefaults()
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+
+	nodes := map[string]*Node{}
+	edges := map[[2]string]*Edge{}
+
+	for _, item := range items {
+		role := stream.RequestRole(item.ReqType)
+		if role == "" {
+			continue
+		}
+
+		client := opts.group(item)
+		cn, ok := nodes[client.ID]
+		if !ok {
+			cn = &client
+			nodes[client.ID] = cn
+		}
+		ip := hostOf(item.Src)
+		if !contains(cn.Clients, ip) {
+			cn.Clients = append(cn.Clients, ip)
+		}
+
+		for _, topic := range item.Topics {
+			tn := Node{ID: "topic:" + topic, Kind: KindTopic, Label: topic}
+			if _, ok := nodes[tn.ID]; !ok {
+				nodes[tn.ID] = &tn
+			}
+
+			source, target := cn.ID, tn.ID
+			if role == stream.RoleConsumer {
+				source, target = target, source
+			}
+
+			e, ok := edges[[2]string{source, target}]
+			if !ok {
+				e = &Edge{Source: source, Target: target, Role: role}
+				edges[[2]string{source, target}] = e
+			}
+			e.Connections++
+			e.Requests += item.Requests
+			e.Bytes += item.BytesRead
+			e.Rate += rate(item)
+		}
+	}
+
+	g := &Graph{GroupBy: opts.GroupBy, Weight: opts.Weight}
+	for _, n := range nodes {
+		sort.Strings(n.Clients)
+		g.Nodes = append(g.Nodes, *n)
+	}
+	sort.Slice(g.Nodes, func(i, j int) bool { return g.Nodes[i].ID < g.Nodes[j].ID })
+
+	for _, e := range edges {
+		e.Weight = e.Rate
+		if opts.Weight == WeightBytes {
+			e.Weight = float64(e.Bytes)
+		}
+		g.Edges = append(g.Edges, *e)
+	}
+	sort.Slice(g.Edges, func(i, j int) bool {
+		a, b := g.Edges[i], g.Edges[j]
+		if a.Source != b.Source {
+			return a.Source < b.Source
+		}
+		return a.Target < b.Target
+	})
+
+	return g, nil
+}
+
+// group returns the node of the group of the client of item.
+func (o Options) group(item stream.ReqTypeStatItemSnapshot) Node {
+	var label string
+	switch o.GroupBy {
+	case GroupSubnet:
+		label = subnet(hostOf(item.Src), o.Mask, o.Mask6)
+	case GroupClientID:
+		label = item.ClientID
+		if label == "" {
+			label = "(no client id)"
+		}
+	case GroupPrincipal:
+		label = item.Principal
+		if label == "" {
+			label = "(unauthenticated)"
+		}
+	default:
+		label = hostOf(item.Src)
+	}
+
+	return Node{ID: "client:" + label, Kind: KindClient, Label: label}
+}
+
+// rate returns the requests per second of a connection, over at least a second.
+func rate(item stream.ReqTypeStatItemSnapshot) float64 {
+	d := item.Update.Sub(item.Start)
+	if d < time.Second {
+		d = time.Second
+	}
+
+	return float64(item.Requests) / d.Seconds()
+}
+
+// subnet returns the network of ip, e.g. 10.0.1.0/24, ip itself when it is no IP, e.g. a hostname.
+func subnet(ip string, mask, mask6 int) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ip
+	}
+
+	if v4 := parsed.To4(); v4 != nil {
+		return (&net.IPNet{IP: v4.Mask(net.CIDRMask(mask, 32)), Mask: net.CIDRMask(mask, 32)}).String()
+	}
+
+	return (&net.IPNet{IP: parsed.Mask(net.CIDRMask(mask6, 128)), Mask: net.CIDRMask(mask6, 128)}).String()
+}
+
+// hostOf returns the IP of an address, the address itself when it has no port.
+func hostOf(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+
+	return addr
+}
+
+func contains(values []string, v string) bool {
+	for _, s := range values {
+		if s == v {
+			return true
+		}
+	}
+
+	return false
+}